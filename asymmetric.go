@@ -20,12 +20,16 @@ import (
 	"crypto"
 	"crypto/aes"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
 	"errors"
 	"fmt"
+	"hash"
 	"math/big"
 
 	"github.com/square/go-jose/cipher"
@@ -46,6 +50,16 @@ type ecEncrypterVerifier struct {
 	publicKey *ecdsa.PublicKey
 }
 
+// A generic EdDSA-based verifier
+type edEncrypterVerifier struct {
+	publicKey ed25519.PublicKey
+}
+
+// A generic EdDSA-based signer
+type edDecrypterSigner struct {
+	privateKey ed25519.PrivateKey
+}
+
 // A key generator for ECDH-ES
 type ecKeyGenerator struct {
 	size      int
@@ -56,13 +70,55 @@ type ecKeyGenerator struct {
 // A generic EC-based decrypter/signer
 type ecDecrypterSigner struct {
 	privateKey *ecdsa.PrivateKey
+
+	// Use deterministic nonces (RFC 6979) when signing.
+	deterministic bool
+}
+
+// ECDH1PUDecryptionKey holds the keys needed to decrypt a message encrypted
+// with ECDH-1PU: the recipient's private key, and the static public key of the
+// sender (typically looked up by the "skid" or "apu" header). Note that
+// ECDH-1PU is not (yet) a final RFC, see draft-madden-jose-ecdh-1pu-04.
+type ECDH1PUDecryptionKey struct {
+	RecipientKey *ecdsa.PrivateKey
+	SenderKey    *ecdsa.PublicKey
+}
+
+// ECDH1PUEncryptionKey holds the keys needed to encrypt a message with
+// ECDH-1PU: the sender's static private key, and the recipient's public key.
+// If SenderKeyID is set, it is sent to the recipient in the "skid" header.
+type ECDH1PUEncryptionKey struct {
+	SenderKey    *ecdsa.PrivateKey
+	SenderKeyID  string
+	RecipientKey *ecdsa.PublicKey
+}
+
+// An encrypter for ECDH-1PU
+type ecdh1PUEncrypter struct {
+	senderKey    *ecdsa.PrivateKey
+	senderKeyID  string
+	recipientKey *ecdsa.PublicKey
+}
+
+// A key generator for ECDH-1PU (direct key agreement mode)
+type ecdh1PUKeyGenerator struct {
+	size      int
+	algID     string
+	encrypter ecdh1PUEncrypter
+}
+
+// A decrypter for ECDH-1PU
+type ecdh1PUDecrypter struct {
+	recipientKey *ecdsa.PrivateKey
+	senderKey    *ecdsa.PublicKey
+	tag          []byte // Content authentication tag, for key wrapping modes
 }
 
 // newRSARecipient creates recipientKeyInfo based on the given key.
 func newRSARecipient(keyAlg KeyAlgorithm, publicKey *rsa.PublicKey) (recipientKeyInfo, error) {
 	// Verify that key management algorithm is supported by this encrypter
 	switch keyAlg {
-	case RSA1_5, RSA_OAEP, RSA_OAEP_256:
+	case RSA1_5, RSA_OAEP, RSA_OAEP_256, RSA_OAEP_384, RSA_OAEP_512:
 	default:
 		return recipientKeyInfo{}, ErrUnsupportedAlgorithm
 	}
@@ -115,6 +171,9 @@ func newECDHRecipient(keyAlg KeyAlgorithm, publicKey *ecdsa.PublicKey) (recipien
 	if publicKey == nil || !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
 		return recipientKeyInfo{}, errors.New("invalid public key")
 	}
+	if isSecp256k1(publicKey.Curve) {
+		return recipientKeyInfo{}, ErrUnsupportedKeyType
+	}
 
 	return recipientKeyInfo{
 		keyAlg: keyAlg,
@@ -124,19 +183,65 @@ func newECDHRecipient(keyAlg KeyAlgorithm, publicKey *ecdsa.PublicKey) (recipien
 	}, nil
 }
 
+// newECDH1PURecipient creates recipientKeyInfo based on the given keys.
+func newECDH1PURecipient(keyAlg KeyAlgorithm, key *ECDH1PUEncryptionKey) (recipientKeyInfo, error) {
+	// Verify that key management algorithm is supported by this encrypter
+	switch keyAlg {
+	case ECDH_1PU, ECDH_1PU_A128KW, ECDH_1PU_A192KW, ECDH_1PU_A256KW:
+	default:
+		return recipientKeyInfo{}, ErrUnsupportedAlgorithm
+	}
+
+	if key == nil || key.SenderKey == nil || key.RecipientKey == nil {
+		return recipientKeyInfo{}, errors.New("square/go-jose: ECDH-1PU requires sender and recipient keys")
+	}
+
+	curve := key.RecipientKey.Curve
+	if curve == nil || !curve.IsOnCurve(key.RecipientKey.X, key.RecipientKey.Y) {
+		return recipientKeyInfo{}, errors.New("invalid public key")
+	}
+	if key.SenderKey.Curve != curve {
+		return recipientKeyInfo{}, errors.New("square/go-jose: sender key not on same curve as recipient key")
+	}
+	if isSecp256k1(curve) {
+		return recipientKeyInfo{}, ErrUnsupportedKeyType
+	}
+
+	return recipientKeyInfo{
+		keyAlg: keyAlg,
+		keyEncrypter: &ecdh1PUEncrypter{
+			senderKey:    key.SenderKey,
+			senderKeyID:  key.SenderKeyID,
+			recipientKey: key.RecipientKey,
+		},
+	}, nil
+}
+
 // newECDSASigner creates a recipientSigInfo based on the given key.
 func newECDSASigner(sigAlg SignatureAlgorithm, privateKey *ecdsa.PrivateKey) (recipientSigInfo, error) {
 	// Verify that key management algorithm is supported by this encrypter
 	switch sigAlg {
-	case ES256, ES384, ES512:
+	case ES256, ES384, ES512, ES256K:
 	default:
 		return recipientSigInfo{}, ErrUnsupportedAlgorithm
 	}
 
-	if privateKey == nil {
+	if privateKey == nil || privateKey.Curve == nil {
 		return recipientSigInfo{}, errors.New("invalid private key")
 	}
 
+	if err := checkECDSACurve(sigAlg, privateKey.Curve); err != nil {
+		return recipientSigInfo{}, err
+	}
+
+	if sigAlg == ES256K {
+		// The secp256k1 arithmetic of josecipher is not constant time, and
+		// would leak the nonce (and so the private key) through timing. Keys
+		// held elsewhere, e.g. in a hardware module, can be used through an
+		// OpaqueSigner.
+		return recipientSigInfo{}, errors.New("square/go-jose: ES256K signing is only supported with an OpaqueSigner")
+	}
+
 	return recipientSigInfo{
 		sigAlg: sigAlg,
 		publicKey: &JsonWebKey{
@@ -148,6 +253,66 @@ func newECDSASigner(sigAlg SignatureAlgorithm, privateKey *ecdsa.PrivateKey) (re
 	}, nil
 }
 
+// newEd25519Signer creates a recipientSigInfo based on the given key.
+func newEd25519Signer(sigAlg SignatureAlgorithm, privateKey ed25519.PrivateKey) (recipientSigInfo, error) {
+	if sigAlg != EdDSA {
+		return recipientSigInfo{}, ErrUnsupportedAlgorithm
+	}
+
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return recipientSigInfo{}, errors.New("square/go-jose: invalid Ed25519 private key")
+	}
+
+	return recipientSigInfo{
+		sigAlg: sigAlg,
+		publicKey: &JsonWebKey{
+			Key: privateKey.Public(),
+		},
+		signer: &edDecrypterSigner{
+			privateKey: privateKey,
+		},
+	}, nil
+}
+
+// checkECDSACurve verifies that the curve of an ECDSA key matches the curve
+// required by the given signature algorithm (ES256 with P-256, ES384 with
+// P-384, ES512 with P-521 and ES256K with secp256k1).
+func checkECDSACurve(alg SignatureAlgorithm, curve elliptic.Curve) error {
+	var expected elliptic.Curve
+
+	switch alg {
+	case ES256:
+		expected = elliptic.P256()
+	case ES384:
+		expected = elliptic.P384()
+	case ES512:
+		expected = elliptic.P521()
+	case ES256K:
+		expected = josecipher.Secp256k1()
+	default:
+		return ErrUnsupportedAlgorithm
+	}
+
+	// Compare by name, as P-256 and secp256k1 have the same size.
+	if curve == nil || curve.Params().Name != expected.Params().Name {
+		name := "unknown"
+		if curve != nil {
+			name = curve.Params().Name
+		}
+		return fmt.Errorf("square/go-jose: %s requires a key on curve %s, got %s instead", alg, expected.Params().Name, name)
+	}
+
+	return nil
+}
+
+// isSecp256k1 reports whether the given curve is secp256k1. The arithmetic of
+// josecipher on that curve is not constant time, so it must not be used for
+// ECDH either: the peer chooses the point multiplied with the private key,
+// which would turn decryption into a timing oracle for the key.
+func isSecp256k1(curve elliptic.Curve) bool {
+	return curve != nil && curve.Params().Name == josecipher.Secp256k1().Params().Name
+}
+
 // Encrypt the given payload and update the object.
 func (ctx rsaEncrypterVerifier) encryptKey(cek []byte, alg KeyAlgorithm) (recipientInfo, error) {
 	encryptedKey, err := ctx.encrypt(cek, alg)
@@ -162,7 +327,7 @@ func (ctx rsaEncrypterVerifier) encryptKey(cek []byte, alg KeyAlgorithm) (recipi
 }
 
 // Encrypt the given payload. Based on the key encryption algorithm,
-// this will either use RSA-PKCS1v1.5 or RSA-OAEP (with SHA-1 or SHA-256).
+// this will either use RSA-PKCS1v1.5 or RSA-OAEP (with SHA-1 or SHA-2).
 func (ctx rsaEncrypterVerifier) encrypt(cek []byte, alg KeyAlgorithm) ([]byte, error) {
 	switch alg {
 	case RSA1_5:
@@ -171,6 +336,10 @@ func (ctx rsaEncrypterVerifier) encrypt(cek []byte, alg KeyAlgorithm) ([]byte, e
 		return rsa.EncryptOAEP(sha1.New(), randReader, ctx.publicKey, cek, []byte{})
 	case RSA_OAEP_256:
 		return rsa.EncryptOAEP(sha256.New(), randReader, ctx.publicKey, cek, []byte{})
+	case RSA_OAEP_384:
+		return rsa.EncryptOAEP(sha512.New384(), randReader, ctx.publicKey, cek, []byte{})
+	case RSA_OAEP_512:
+		return rsa.EncryptOAEP(sha512.New(), randReader, ctx.publicKey, cek, []byte{})
 	}
 
 	return nil, ErrUnsupportedAlgorithm
@@ -182,7 +351,7 @@ func (ctx rsaDecrypterSigner) decryptKey(headers rawHeader, recipient *recipient
 }
 
 // Decrypt the given payload. Based on the key encryption algorithm,
-// this will either use RSA-PKCS1v1.5 or RSA-OAEP (with SHA-1 or SHA-256).
+// this will either use RSA-PKCS1v1.5 or RSA-OAEP (with SHA-1 or SHA-2).
 func (ctx rsaDecrypterSigner) decrypt(jek []byte, alg KeyAlgorithm, generator keyGenerator) ([]byte, error) {
 	// Note: The random reader on decrypt operations is only used for blinding,
 	// so stubbing is meanlingless (hence the direct use of rand.Reader).
@@ -199,7 +368,7 @@ func (ctx rsaDecrypterSigner) decrypt(jek []byte, alg KeyAlgorithm, generator ke
 		}()
 
 		// Perform some input validation.
-		keyBytes := ctx.privateKey.PublicKey.N.BitLen() / 8
+		keyBytes := ctx.privateKey.PublicKey.Size()
 		if keyBytes != len(jek) {
 			// Input size is incorrect, the encrypted payload should always match
 			// the size of the public modulus (e.g. using a 2048 bit key will
@@ -225,24 +394,40 @@ func (ctx rsaDecrypterSigner) decrypt(jek []byte, alg KeyAlgorithm, generator ke
 	case RSA_OAEP_256:
 		// Use rand.Reader for RSA blinding
 		return rsa.DecryptOAEP(sha256.New(), rand.Reader, ctx.privateKey, jek, []byte{})
+	case RSA_OAEP_384:
+		// Use rand.Reader for RSA blinding
+		return rsa.DecryptOAEP(sha512.New384(), rand.Reader, ctx.privateKey, jek, []byte{})
+	case RSA_OAEP_512:
+		// Use rand.Reader for RSA blinding
+		return rsa.DecryptOAEP(sha512.New(), rand.Reader, ctx.privateKey, jek, []byte{})
 	}
 
 	return nil, ErrUnsupportedAlgorithm
 }
 
+// Substitute a random key for the result of an RSA1_5 key decryption that
+// failed, or produced a key of the wrong size, for decrypters which (unlike
+// rsa.DecryptPKCS1v15SessionKey) may report padding errors. A padding error
+// then surfaces in the same way as a bad authentication tag, rather than as an
+// early error which would enable the million message attack (RFC 3218).
+func rsaPKCS1v15SessionKey(cek []byte, err error, generator keyGenerator) ([]byte, error) {
+	// Always generate the random key, so that both cases take the same path.
+	random, _, genErr := generator.genKey()
+	if genErr != nil {
+		return nil, ErrCryptoFailure
+	}
+
+	if err != nil || len(cek) != len(random) {
+		return random, nil
+	}
+	return cek, nil
+}
+
 // Sign the given payload
 func (ctx rsaDecrypterSigner) signPayload(payload []byte, alg SignatureAlgorithm) (Signature, error) {
-	var hash crypto.Hash
-
-	switch alg {
-	case RS256, PS256:
-		hash = crypto.SHA256
-	case RS384, PS384:
-		hash = crypto.SHA384
-	case RS512, PS512:
-		hash = crypto.SHA512
-	default:
-		return Signature{}, ErrUnsupportedAlgorithm
+	hash, err := rsaSignatureHash(alg)
+	if err != nil {
+		return Signature{}, err
 	}
 
 	hasher := hash.New()
@@ -251,18 +436,7 @@ func (ctx rsaDecrypterSigner) signPayload(payload []byte, alg SignatureAlgorithm
 	_, _ = hasher.Write(payload)
 	hashed := hasher.Sum(nil)
 
-	var out []byte
-	var err error
-
-	switch alg {
-	case RS256, RS384, RS512:
-		out, err = rsa.SignPKCS1v15(randReader, ctx.privateKey, hash, hashed)
-	case PS256, PS384, PS512:
-		out, err = rsa.SignPSS(randReader, ctx.privateKey, hash, hashed, &rsa.PSSOptions{
-			SaltLength: rsa.PSSSaltLengthAuto,
-		})
-	}
-
+	out, err := ctx.signDigest(hashed, alg)
 	if err != nil {
 		return Signature{}, err
 	}
@@ -273,19 +447,48 @@ func (ctx rsaDecrypterSigner) signPayload(payload []byte, alg SignatureAlgorithm
 	}, nil
 }
 
-// Verify the given payload
-func (ctx rsaEncrypterVerifier) verifyPayload(payload []byte, signature []byte, alg SignatureAlgorithm) error {
-	var hash crypto.Hash
+// Sign the given digest, which must have been computed with the hash function
+// of the signature algorithm.
+func (ctx rsaDecrypterSigner) signDigest(digest []byte, alg SignatureAlgorithm) ([]byte, error) {
+	hash, err := rsaSignatureHash(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(digest) != hash.Size() {
+		return nil, ErrInvalidDigestSize
+	}
+
+	switch alg {
+	case PS256, PS384, PS512:
+		// RFC 7518 requires the salt to be the same size as the hash output.
+		return rsa.SignPSS(randReader, ctx.privateKey, hash, digest, &rsa.PSSOptions{
+			SaltLength: rsa.PSSSaltLengthEqualsHash,
+		})
+	default:
+		return rsa.SignPKCS1v15(randReader, ctx.privateKey, hash, digest)
+	}
+}
 
+// Get the hash function used by an RSA signature algorithm.
+func rsaSignatureHash(alg SignatureAlgorithm) (crypto.Hash, error) {
 	switch alg {
 	case RS256, PS256:
-		hash = crypto.SHA256
+		return crypto.SHA256, nil
 	case RS384, PS384:
-		hash = crypto.SHA384
+		return crypto.SHA384, nil
 	case RS512, PS512:
-		hash = crypto.SHA512
+		return crypto.SHA512, nil
 	default:
-		return ErrUnsupportedAlgorithm
+		return 0, ErrUnsupportedAlgorithm
+	}
+}
+
+// Verify the given payload
+func (ctx rsaEncrypterVerifier) verifyPayload(payload []byte, signature []byte, alg SignatureAlgorithm) error {
+	hash, err := rsaSignatureHash(alg)
+	if err != nil {
+		return err
 	}
 
 	hasher := hash.New()
@@ -294,16 +497,53 @@ func (ctx rsaEncrypterVerifier) verifyPayload(payload []byte, signature []byte,
 	_, _ = hasher.Write(payload)
 	hashed := hasher.Sum(nil)
 
+	return ctx.verifyDigest(hashed, signature, alg)
+}
+
+// Verify the signature over the given digest, which must have been computed
+// with the hash function of the signature algorithm.
+func (ctx rsaEncrypterVerifier) verifyDigest(digest []byte, signature []byte, alg SignatureAlgorithm) error {
+	hash, err := rsaSignatureHash(alg)
+	if err != nil {
+		return err
+	}
+
 	switch alg {
 	case RS256, RS384, RS512:
-		return rsa.VerifyPKCS1v15(ctx.publicKey, hash, hashed, signature)
+		return rsa.VerifyPKCS1v15(ctx.publicKey, hash, digest, signature)
 	case PS256, PS384, PS512:
-		return rsa.VerifyPSS(ctx.publicKey, hash, hashed, signature, nil)
+		// Detect the salt length, so that signatures produced by older versions
+		// of this library (which used the maximum salt length) still verify.
+		return rsa.VerifyPSS(ctx.publicKey, hash, digest, signature, nil)
 	}
 
 	return ErrUnsupportedAlgorithm
 }
 
+// Create a hash for a payload which is hashed incrementally.
+func (ctx rsaDecrypterSigner) newHash(alg SignatureAlgorithm) (hash.Hash, error) {
+	hash, err := rsaSignatureHash(alg)
+	if err != nil {
+		return nil, err
+	}
+	return hash.New(), nil
+}
+
+// Sign a payload which has been hashed incrementally.
+func (ctx rsaDecrypterSigner) signHash(h hash.Hash, alg SignatureAlgorithm) ([]byte, error) {
+	return ctx.signDigest(h.Sum(nil), alg)
+}
+
+// Create a hash for a payload which is hashed incrementally.
+func (ctx rsaEncrypterVerifier) newHash(alg SignatureAlgorithm) (hash.Hash, error) {
+	return rsaDecrypterSigner{}.newHash(alg)
+}
+
+// Verify a payload which has been hashed incrementally.
+func (ctx rsaEncrypterVerifier) verifyHash(h hash.Hash, signature []byte, alg SignatureAlgorithm) error {
+	return ctx.verifyDigest(h.Sum(nil), signature, alg)
+}
+
 // Encrypt the given payload and update the object.
 func (ctx ecEncrypterVerifier) encryptKey(cek []byte, alg KeyAlgorithm) (recipientInfo, error) {
 	switch alg {
@@ -359,6 +599,10 @@ func (ctx ecKeyGenerator) keySize() int {
 
 // Get a content encryption key for ECDH-ES
 func (ctx ecKeyGenerator) genKey() ([]byte, rawHeader, error) {
+	if isSecp256k1(ctx.publicKey.Curve) {
+		return nil, rawHeader{}, ErrUnsupportedKeyType
+	}
+
 	priv, err := ecdsa.GenerateKey(ctx.publicKey.Curve, randReader)
 	if err != nil {
 		return nil, rawHeader{}, err
@@ -386,6 +630,9 @@ func (ctx ecDecrypterSigner) decryptKey(headers rawHeader, recipient *recipientI
 		return nil, errors.New("square/go-jose: invalid epk header")
 	}
 
+	if isSecp256k1(ctx.privateKey.Curve) {
+		return nil, ErrUnsupportedKeyType
+	}
 	if !ctx.privateKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
 		return nil, errors.New("square/go-jose: invalid public key in epk header")
 	}
@@ -402,6 +649,10 @@ func (ctx ecDecrypterSigner) decryptKey(headers rawHeader, recipient *recipientI
 	switch KeyAlgorithm(headers.Alg) {
 	case ECDH_ES:
 		// ECDH-ES uses direct key agreement, no key unwrapping necessary.
+		// The encrypted key must be empty (RFC 7518 section 4.6).
+		if len(recipient.encryptedKey) > 0 {
+			return nil, errors.New("square/go-jose: unexpected encrypted key for ECDH-ES")
+		}
 		return deriveKey(string(headers.Enc), generator.keySize()), nil
 	case ECDH_ES_A128KW:
 		keySize = 16
@@ -422,26 +673,176 @@ func (ctx ecDecrypterSigner) decryptKey(headers rawHeader, recipient *recipientI
 	return josecipher.KeyUnwrap(block, recipient.encryptedKey)
 }
 
-// Sign the given payload
-func (ctx ecDecrypterSigner) signPayload(payload []byte, alg SignatureAlgorithm) (Signature, error) {
-	var expectedBitSize int
-	var hash crypto.Hash
+// Compute the ECDH shared secret Z of the given keys, which is defined to be
+// the x coordinate, padded to the size of the curve.
+func ecdhSharedSecret(priv *ecdsa.PrivateKey, pub *ecdsa.PublicKey) []byte {
+	x, _ := priv.Curve.ScalarMult(pub.X, pub.Y, priv.D.Bytes())
+
+	size := curveSize(priv.Curve)
+	xBytes := x.Bytes()
+	z := make([]byte, size)
+	copy(z[size-len(xBytes):], xBytes)
+	return z
+}
+
+// Generate an ephemeral key and compute the ECDH-1PU shared secrets Ze and Zs.
+func (ctx ecdh1PUEncrypter) agree() (ze, zs []byte, header rawHeader, err error) {
+	priv, err := ecdsa.GenerateKey(ctx.recipientKey.Curve, randReader)
+	if err != nil {
+		return nil, nil, rawHeader{}, err
+	}
+
+	ze = ecdhSharedSecret(priv, ctx.recipientKey)
+	zs = ecdhSharedSecret(ctx.senderKey, ctx.recipientKey)
+
+	header = rawHeader{
+		Epk: &JsonWebKey{
+			Key: &priv.PublicKey,
+		},
+		Skid: ctx.senderKeyID,
+	}
+
+	return ze, zs, header, nil
+}
+
+// Encrypt the given payload and update the object. Only direct key agreement
+// mode is supported here, key wrapping modes depend on the content tag (see
+// encryptKeyDeferred).
+func (ctx ecdh1PUEncrypter) encryptKey(cek []byte, alg KeyAlgorithm) (recipientInfo, error) {
+	if alg != ECDH_1PU {
+		return recipientInfo{}, ErrUnsupportedAlgorithm
+	}
+
+	// The key generator has already done the key agreement.
+	return recipientInfo{
+		header: &rawHeader{},
+	}, nil
+}
+
+// Generate the headers for the given recipient, and return a function which
+// wraps the key once the content authentication tag is known.
+func (ctx ecdh1PUEncrypter) encryptKeyDeferred(cek []byte, alg KeyAlgorithm) (recipientInfo, func(tag []byte) ([]byte, error), error) {
+	var keySize int
 
 	switch alg {
-	case ES256:
-		expectedBitSize = 256
-		hash = crypto.SHA256
-	case ES384:
-		expectedBitSize = 384
-		hash = crypto.SHA384
-	case ES512:
-		expectedBitSize = 521
-		hash = crypto.SHA512
+	case ECDH_1PU:
+		// Nothing to wrap in direct key agreement mode.
+		recipient, err := ctx.encryptKey(cek, alg)
+		return recipient, nil, err
+	case ECDH_1PU_A128KW:
+		keySize = 16
+	case ECDH_1PU_A192KW:
+		keySize = 24
+	case ECDH_1PU_A256KW:
+		keySize = 32
+	default:
+		return recipientInfo{}, nil, ErrUnsupportedAlgorithm
+	}
+
+	ze, zs, header, err := ctx.agree()
+	if err != nil {
+		return recipientInfo{}, nil, err
+	}
+
+	wrap := func(tag []byte) ([]byte, error) {
+		kek := josecipher.DeriveECDH1PU(string(alg), []byte{}, []byte{}, tag, ze, zs, keySize)
+		block, err := aes.NewCipher(kek)
+		if err != nil {
+			return nil, err
+		}
+		return josecipher.KeyWrap(block, cek)
+	}
+
+	return recipientInfo{
+		header: &header,
+	}, wrap, nil
+}
+
+// Get key size for ECDH-1PU key generator
+func (ctx ecdh1PUKeyGenerator) keySize() int {
+	return ctx.size
+}
+
+// Get a content encryption key for ECDH-1PU
+func (ctx ecdh1PUKeyGenerator) genKey() ([]byte, rawHeader, error) {
+	ze, zs, header, err := ctx.encrypter.agree()
+	if err != nil {
+		return nil, rawHeader{}, err
+	}
+
+	out := josecipher.DeriveECDH1PU(ctx.algID, []byte{}, []byte{}, nil, ze, zs, ctx.size)
+	return out, header, nil
+}
+
+// Decrypt the given payload and return the content encryption key.
+func (ctx ecdh1PUDecrypter) decryptKey(headers rawHeader, recipient *recipientInfo, generator keyGenerator) ([]byte, error) {
+	if ctx.recipientKey == nil || ctx.senderKey == nil {
+		return nil, errors.New("square/go-jose: ECDH-1PU requires recipient and sender keys")
+	}
+
+	if headers.Epk == nil {
+		return nil, errors.New("square/go-jose: missing epk header")
 	}
 
-	curveBits := ctx.privateKey.Curve.Params().BitSize
-	if expectedBitSize != curveBits {
-		return Signature{}, fmt.Errorf("square/go-jose: expected %d bit key, got %d bits instead", expectedBitSize, curveBits)
+	publicKey, ok := headers.Epk.Key.(*ecdsa.PublicKey)
+	if publicKey == nil || !ok {
+		return nil, errors.New("square/go-jose: invalid epk header")
+	}
+
+	curve := ctx.recipientKey.Curve
+	if isSecp256k1(curve) {
+		return nil, ErrUnsupportedKeyType
+	}
+	if publicKey.Curve != curve || !curve.IsOnCurve(publicKey.X, publicKey.Y) {
+		return nil, errors.New("square/go-jose: invalid public key in epk header")
+	}
+	if ctx.senderKey.Curve != curve || !curve.IsOnCurve(ctx.senderKey.X, ctx.senderKey.Y) {
+		return nil, errors.New("square/go-jose: sender key not on same curve as recipient key")
+	}
+
+	ze := ecdhSharedSecret(ctx.recipientKey, publicKey)
+	zs := ecdhSharedSecret(ctx.recipientKey, ctx.senderKey)
+	apuData := headers.Apu.bytes()
+	apvData := headers.Apv.bytes()
+
+	var keySize int
+
+	switch KeyAlgorithm(headers.Alg) {
+	case ECDH_1PU:
+		// Direct key agreement, no key unwrapping necessary.
+		return josecipher.DeriveECDH1PU(string(headers.Enc), apuData, apvData, nil, ze, zs, generator.keySize()), nil
+	case ECDH_1PU_A128KW:
+		keySize = 16
+	case ECDH_1PU_A192KW:
+		keySize = 24
+	case ECDH_1PU_A256KW:
+		keySize = 32
+	default:
+		return nil, ErrUnsupportedAlgorithm
+	}
+
+	// Key wrapping modes bind the content tag into the key derivation, which
+	// requires the tag to be computed before the key, i.e. AES-CBC-HMAC.
+	switch headers.Enc {
+	case A128CBC_HS256, A192CBC_HS384, A256CBC_HS512:
+	default:
+		return nil, fmt.Errorf("square/go-jose: %s requires an AES-CBC-HMAC content encryption algorithm", headers.Alg)
+	}
+
+	key := josecipher.DeriveECDH1PU(headers.Alg, apuData, apvData, ctx.tag, ze, zs, keySize)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return josecipher.KeyUnwrap(block, recipient.encryptedKey)
+}
+
+// Sign the given payload
+func (ctx ecDecrypterSigner) signPayload(payload []byte, alg SignatureAlgorithm) (Signature, error) {
+	hash, err := ecdsaSignatureHash(alg)
+	if err != nil {
+		return Signature{}, err
 	}
 
 	hasher := hash.New()
@@ -450,16 +851,51 @@ func (ctx ecDecrypterSigner) signPayload(payload []byte, alg SignatureAlgorithm)
 	_, _ = hasher.Write(payload)
 	hashed := hasher.Sum(nil)
 
-	r, s, err := ecdsa.Sign(randReader, ctx.privateKey, hashed)
+	out, err := ctx.signDigest(hashed, alg)
 	if err != nil {
 		return Signature{}, err
 	}
 
-	keyBytes := curveBits / 8
-	if curveBits%8 > 0 {
-		keyBytes += 1
+	return Signature{
+		Signature: out,
+		protected: &rawHeader{},
+	}, nil
+}
+
+// Sign the given digest, which must have been computed with the hash function
+// of the signature algorithm.
+func (ctx ecDecrypterSigner) signDigest(digest []byte, alg SignatureAlgorithm) ([]byte, error) {
+	if err := checkECDSACurve(alg, ctx.privateKey.Curve); err != nil {
+		return nil, err
+	}
+
+	hash, err := ecdsaSignatureHash(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(digest) != hash.Size() {
+		return nil, ErrInvalidDigestSize
+	}
+
+	if ctx.deterministic {
+		// A nil random source selects deterministic nonces.
+		der, err := ctx.privateKey.Sign(nil, digest, hash)
+		if err != nil {
+			return nil, err
+		}
+		return rawECDSASignature(der, ctx.privateKey.Curve)
+	}
+
+	r, s, err := ecdsa.Sign(randReader, ctx.privateKey, digest)
+	if err != nil {
+		return nil, err
 	}
 
+	// Note that for P-521 this is 66 bytes, since 521 bits is not a multiple
+	// of eight, so a signature is 132 bytes long.
+	keyBytes := curveSize(ctx.privateKey.Curve)
+
 	// We serialize the outpus (r and s) into big-endian byte arrays and pad
 	// them with zeros on the left to make sure the sizes work out. Both arrays
 	// must be keyBytes long, and the output must be 2*keyBytes long.
@@ -471,50 +907,129 @@ func (ctx ecDecrypterSigner) signPayload(payload []byte, alg SignatureAlgorithm)
 	sBytesPadded := make([]byte, keyBytes)
 	copy(sBytesPadded[keyBytes-len(sBytes):], sBytes)
 
-	out := append(rBytesPadded, sBytesPadded...)
+	return append(rBytesPadded, sBytesPadded...), nil
+}
 
-	return Signature{
-		Signature: out,
-		protected: &rawHeader{},
-	}, nil
+// Enable or disable deterministic nonces (RFC 6979).
+func (ctx *ecDecrypterSigner) setDeterministic(deterministic bool) {
+	ctx.deterministic = deterministic
+}
+
+// Get the hash function used by an ECDSA signature algorithm.
+func ecdsaSignatureHash(alg SignatureAlgorithm) (crypto.Hash, error) {
+	switch alg {
+	case ES256, ES256K:
+		return crypto.SHA256, nil
+	case ES384:
+		return crypto.SHA384, nil
+	case ES512:
+		return crypto.SHA512, nil
+	default:
+		return 0, ErrUnsupportedAlgorithm
+	}
 }
 
 // Verify the given payload
 func (ctx ecEncrypterVerifier) verifyPayload(payload []byte, signature []byte, alg SignatureAlgorithm) error {
+	hash, err := ecdsaSignatureHash(alg)
+	if err != nil {
+		return err
+	}
+
+	hasher := hash.New()
+
+	// According to documentation, Write() on hash never fails
+	_, _ = hasher.Write(payload)
+	hashed := hasher.Sum(nil)
+
+	return ctx.verifyDigest(hashed, signature, alg)
+}
+
+// Verify the signature over the given digest, which must have been computed
+// with the hash function of the signature algorithm.
+func (ctx ecEncrypterVerifier) verifyDigest(digest []byte, signature []byte, alg SignatureAlgorithm) error {
 	var keySize int
-	var hash crypto.Hash
 
 	switch alg {
-	case ES256:
+	case ES256, ES256K:
 		keySize = 32
-		hash = crypto.SHA256
 	case ES384:
 		keySize = 48
-		hash = crypto.SHA384
 	case ES512:
 		keySize = 66
-		hash = crypto.SHA512
 	default:
 		return ErrUnsupportedAlgorithm
 	}
 
+	if err := checkECDSACurve(alg, ctx.publicKey.Curve); err != nil {
+		return err
+	}
+
 	if len(signature) != 2*keySize {
 		return fmt.Errorf("square/go-jose: invalid signature size, have %d bytes, wanted %d", len(signature), 2*keySize)
 	}
 
-	hasher := hash.New()
-
-	// According to documentation, Write() on hash never fails
-	_, _ = hasher.Write(payload)
-	hashed := hasher.Sum(nil)
-
 	r := big.NewInt(0).SetBytes(signature[:keySize])
 	s := big.NewInt(0).SetBytes(signature[keySize:])
 
-	match := ecdsa.Verify(ctx.publicKey, hashed, r, s)
+	match := ecdsa.Verify(ctx.publicKey, digest, r, s)
 	if !match {
 		return errors.New("square/go-jose: ecdsa signature failed to verify")
 	}
 
 	return nil
 }
+
+// Create a hash for a payload which is hashed incrementally.
+func (ctx ecDecrypterSigner) newHash(alg SignatureAlgorithm) (hash.Hash, error) {
+	hash, err := ecdsaSignatureHash(alg)
+	if err != nil {
+		return nil, err
+	}
+	return hash.New(), nil
+}
+
+// Sign a payload which has been hashed incrementally.
+func (ctx ecDecrypterSigner) signHash(h hash.Hash, alg SignatureAlgorithm) ([]byte, error) {
+	return ctx.signDigest(h.Sum(nil), alg)
+}
+
+// Create a hash for a payload which is hashed incrementally.
+func (ctx ecEncrypterVerifier) newHash(alg SignatureAlgorithm) (hash.Hash, error) {
+	return ecDecrypterSigner{}.newHash(alg)
+}
+
+// Verify a payload which has been hashed incrementally.
+func (ctx ecEncrypterVerifier) verifyHash(h hash.Hash, signature []byte, alg SignatureAlgorithm) error {
+	return ctx.verifyDigest(h.Sum(nil), signature, alg)
+}
+
+// Sign the given payload. Note that EdDSA signs the message itself, there is
+// no separate hash function.
+func (ctx edDecrypterSigner) signPayload(payload []byte, alg SignatureAlgorithm) (Signature, error) {
+	if alg != EdDSA {
+		return Signature{}, ErrUnsupportedAlgorithm
+	}
+
+	return Signature{
+		Signature: ed25519.Sign(ctx.privateKey, payload),
+		protected: &rawHeader{},
+	}, nil
+}
+
+// Verify the given payload
+func (ctx edEncrypterVerifier) verifyPayload(payload []byte, signature []byte, alg SignatureAlgorithm) error {
+	if alg != EdDSA {
+		return ErrUnsupportedAlgorithm
+	}
+
+	if len(ctx.publicKey) != ed25519.PublicKeySize {
+		return errors.New("square/go-jose: invalid Ed25519 public key")
+	}
+
+	if !ed25519.Verify(ctx.publicKey, payload, signature) {
+		return errors.New("square/go-jose: ed25519 signature failed to verify")
+	}
+
+	return nil
+}
@@ -18,14 +18,22 @@ package jose
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/aes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
 	"errors"
+	"fmt"
 	"io"
 	"math/big"
+	"strings"
 	"testing"
+
+	"github.com/square/go-jose/cipher"
 )
 
 func TestVectorsRSA(t *testing.T) {
@@ -258,6 +266,51 @@ func TestInvalidECDecrypt(t *testing.T) {
 	if err == nil {
 		t.Error("ec decrypter accepted object with invalid epk header")
 	}
+
+	// Encrypted key present in direct key agreement mode
+	headers.Epk = &JsonWebKey{Key: &ecTestKey256.PublicKey}
+
+	_, err = dec.decryptKey(headers, &recipientInfo{encryptedKey: []byte{1}}, generator)
+	if err == nil {
+		t.Error("ec decrypter accepted ECDH-ES object with encrypted key")
+	}
+}
+
+func TestECDHESProtectedEpk(t *testing.T) {
+	enc, err := NewEncrypter(ECDH_ES, A128GCM, &ecTestKey256.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := enc.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := obj.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(msg, ".")
+	if parts[1] != "" {
+		t.Error("ECDH-ES should not produce an encrypted key")
+	}
+
+	parsed, err := ParseEncrypted(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.protected.Epk == nil {
+		t.Fatal("epk should be in the protected header")
+	}
+	if _, ok := parsed.protected.Epk.Key.(*ecdsa.PublicKey); !ok {
+		t.Error("epk should hold an EC public key")
+	}
+
+	plaintext, err := parsed.Decrypt(ecTestKey256)
+	if err != nil || string(plaintext) != "Lorem ipsum dolor sit amet" {
+		t.Error("failed to decrypt ECDH-ES message", err)
+	}
 }
 
 func TestDecryptWithIncorrectSize(t *testing.T) {
@@ -432,6 +485,257 @@ func TestInvalidEllipticCurve(t *testing.T) {
 	}
 }
 
+func TestECDSASignerCurveMismatch(t *testing.T) {
+	keys := map[SignatureAlgorithm]*ecdsa.PrivateKey{
+		ES256: ecTestKey256,
+		ES384: ecTestKey384,
+		ES512: ecTestKey521,
+	}
+
+	for alg := range keys {
+		for keyAlg, key := range keys {
+			_, err := NewSigner(alg, key)
+			if alg == keyAlg && err != nil {
+				t.Errorf("should accept %s signer with matching key: %s", alg, err)
+			}
+			if alg != keyAlg && err == nil {
+				t.Errorf("should not accept %s signer with %s key", alg, key.Curve.Params().Name)
+			}
+		}
+	}
+
+	_, err := NewSigner(ES256, ecTestKey384)
+	if err == nil || err.Error() != "square/go-jose: ES256 requires a key on curve P-256, got P-384 instead" {
+		t.Error("unexpected error for P-384 key with ES256:", err)
+	}
+}
+
+func TestES256KCurveMismatch(t *testing.T) {
+	k1Key, err := ecdsa.GenerateKey(josecipher.Secp256k1(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// P-256 and secp256k1 are both 256-bit curves, but must not be mixed up
+	if _, err := NewSigner(ES256, k1Key); err == nil {
+		t.Error("should not accept ES256 signer with secp256k1 key")
+	}
+	if _, err := NewSigner(ES256K, ecTestKey256); err == nil {
+		t.Error("should not accept ES256K signer with P-256 key")
+	}
+
+	// Signing with in-process keys is not supported, as the arithmetic is
+	// not constant time. Sign with crypto/ecdsa directly to test verification.
+	if _, err := NewSigner(ES256K, k1Key); err == nil {
+		t.Error("should not accept ES256K signer with in-process key")
+	}
+
+	input := []byte(base64URLEncode([]byte(`{"alg":"ES256K"}`)) + "." + base64URLEncode([]byte("Lorem ipsum dolor sit amet")))
+	digest := sha256.Sum256(input)
+	r, s, err := ecdsa.Sign(rand.Reader, k1Key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	obj, err := ParseSigned(string(input) + "." + base64URLEncode(signature))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := obj.Verify(&k1Key.PublicKey); err != nil {
+		t.Error("unable to verify ES256K signature:", err)
+	}
+
+	verifier := ecEncrypterVerifier{publicKey: &k1Key.PublicKey}
+	if err := verifier.verifyPayload(input, signature, ES256); err == nil {
+		t.Error("should not verify ES256 signature with secp256k1 key")
+	}
+}
+
+func TestECDHSecp256k1(t *testing.T) {
+	k1Key, err := ecdsa.GenerateKey(josecipher.Secp256k1(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k1Key2, err := ecdsa.GenerateKey(josecipher.Secp256k1(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The secp256k1 arithmetic is not constant time, so it must not be used
+	// for key agreement either.
+	for _, alg := range []KeyAlgorithm{ECDH_ES, ECDH_ES_A128KW} {
+		if _, err := NewEncrypter(alg, A128GCM, &k1Key.PublicKey); err != ErrUnsupportedKeyType {
+			t.Errorf("%s should not accept secp256k1 key, got %v", alg, err)
+		}
+	}
+	k1PU := &ECDH1PUEncryptionKey{SenderKey: k1Key2, RecipientKey: &k1Key.PublicKey}
+	for _, alg := range []KeyAlgorithm{ECDH_1PU, ECDH_1PU_A128KW} {
+		if _, err := NewEncrypter(alg, A128CBC_HS256, k1PU); err != ErrUnsupportedKeyType {
+			t.Errorf("%s should not accept secp256k1 keys, got %v", alg, err)
+		}
+	}
+
+	generator := ecKeyGenerator{size: 16, algID: string(A128GCM), publicKey: &k1Key.PublicKey}
+	if _, _, err := generator.genKey(); err != ErrUnsupportedKeyType {
+		t.Error("key generator should not accept secp256k1 key, got", err)
+	}
+
+	// Decryption must not multiply an attacker-chosen epk with the key.
+	headers := rawHeader{
+		Alg: string(ECDH_ES),
+		Enc: A128GCM,
+		Epk: &JsonWebKey{Key: &k1Key2.PublicKey},
+	}
+	decrypter := ecDecrypterSigner{privateKey: k1Key}
+	if _, err := decrypter.decryptKey(headers, &recipientInfo{}, randomKeyGenerator{size: 16}); err != ErrUnsupportedKeyType {
+		t.Error("ECDH-ES decrypter should not accept secp256k1 key, got", err)
+	}
+	headers.Alg = string(ECDH_1PU)
+	decrypter1PU := ecdh1PUDecrypter{recipientKey: k1Key, senderKey: &k1Key2.PublicKey}
+	if _, err := decrypter1PU.decryptKey(headers, &recipientInfo{}, randomKeyGenerator{size: 16}); err != ErrUnsupportedKeyType {
+		t.Error("ECDH-1PU decrypter should not accept secp256k1 keys, got", err)
+	}
+
+	// The same holds for a full message.
+	headers.Alg = string(ECDH_ES)
+	msg := base64URLEncode(mustSerializeJSON(headers)) + "..AAAAAAAAAAAAAAAA.AA.AAAAAAAAAAAAAAAAAAAAAA"
+	obj, err := ParseEncrypted(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := obj.Decrypt(k1Key); err == nil {
+		t.Error("should not decrypt ECDH-ES message with secp256k1 key")
+	}
+}
+
+func TestECDSAVerifierCurveMismatch(t *testing.T) {
+	signer, err := NewSigner(ES256, ecTestKey256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := signer.Sign([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := ecEncrypterVerifier{publicKey: &ecTestKey384.PublicKey}
+	input := computeAuthData(obj.payload, &obj.Signatures[0])
+	err = verifier.verifyPayload(input, obj.Signatures[0].Signature, ES256)
+	if err == nil {
+		t.Error("should not verify ES256 signature with P-384 key")
+	}
+}
+
+func TestVectorsES256(t *testing.T) {
+	// Example from RFC 7515 appendix A.3
+	var key JsonWebKey
+	err := key.UnmarshalJSON([]byte(`{"kty":"EC","crv":"P-256",
+		"x":"f83OJ3D2xF1Bg8vub9tLe1gHMzV76e8Tus9uPHvRVEU",
+		"y":"x_FEzRu9m36HLN_tue659LNpXW6pCyStikYjKIWI5a0"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := "eyJhbGciOiJFUzI1NiJ9." +
+		"eyJpc3MiOiJqb2UiLA0KICJleHAiOjEzMDA4MTkzODAsDQogImh0dHA6Ly9leGFtcGxlLmNvbS9pc19yb290Ijp0cnVlfQ." +
+		"DtEhU3ljbEg8L38VWAfUAqOyKAM6-Xx-F4GawxaepmXFCgfTjDxw5djxLa8ISlSApmWQxfKTUJqPP3-Kg6NU1Q"
+
+	obj, err := ParseSigned(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := obj.Verify(&key); err != nil {
+		t.Error("failed to verify RFC 7515 example:", err)
+	}
+
+	// The same signature in DER encoding must not be accepted
+	r := new(big.Int).SetBytes(obj.Signatures[0].Signature[:32])
+	s := new(big.Int).SetBytes(obj.Signatures[0].Signature[32:])
+	der, _ := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	obj.Signatures[0].Signature = der
+	if _, err := obj.Verify(&key); err == nil {
+		t.Error("should reject DER-encoded ECDSA signature")
+	}
+}
+
+func TestES512SignatureSize(t *testing.T) {
+	signer, err := NewSigner(ES512, ecTestKey521)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := []byte("Lorem ipsum dolor sit amet")
+
+	// R and S are frequently shorter than 66 bytes, so sign repeatedly to make
+	// sure the left-padding is exercised.
+	for i := 0; i < 50; i++ {
+		obj, err := signer.Sign(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(obj.Signatures[0].Signature) != 132 {
+			t.Fatalf("expected 132 byte ES512 signature, got %d bytes", len(obj.Signatures[0].Signature))
+		}
+
+		output, err := obj.Verify(&ecTestKey521.PublicKey)
+		if err != nil {
+			t.Fatal("unable to verify ES512 signature:", err)
+		}
+		if !bytes.Equal(output, input) {
+			t.Fatal("verified payload does not match input")
+		}
+
+		verifier := ecEncrypterVerifier{publicKey: &ecTestKey521.PublicKey}
+		authData := computeAuthData(obj.payload, &obj.Signatures[0])
+		signature := obj.Signatures[0].Signature
+
+		// Signatures that are not exactly 132 bytes must be rejected
+		if verifier.verifyPayload(authData, signature[1:], ES512) == nil {
+			t.Fatal("should reject truncated ES512 signature")
+		}
+		if verifier.verifyPayload(authData, append([]byte{0}, signature...), ES512) == nil {
+			t.Fatal("should reject over-long ES512 signature")
+		}
+	}
+}
+
+func TestPSSSaltLength(t *testing.T) {
+	hashes := map[SignatureAlgorithm]crypto.Hash{
+		PS256: crypto.SHA256,
+		PS384: crypto.SHA384,
+		PS512: crypto.SHA512,
+	}
+
+	input := []byte("Lorem ipsum dolor sit amet")
+
+	for alg, hash := range hashes {
+		signer, err := NewSigner(alg, rsaTestKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		obj, err := signer.Sign(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hasher := hash.New()
+		_, _ = hasher.Write(computeAuthData(obj.payload, &obj.Signatures[0]))
+
+		// Salt must be exactly as long as the hash output (RFC 7518, section 3.5)
+		opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+		err = rsa.VerifyPSS(&rsaTestKey.PublicKey, hash, hasher.Sum(nil), obj.Signatures[0].Signature, opts)
+		if err != nil {
+			t.Errorf("%s signature does not use hash-length salt: %s", alg, err)
+		}
+	}
+}
+
 func TestInvalidECPublicKey(t *testing.T) {
 	// Invalid key
 	invalid := &ecdsa.PrivateKey{
@@ -466,3 +770,138 @@ func TestInvalidAlgorithmEC(t *testing.T) {
 		t.Fatal("should not accept invalid/unsupported algorithm")
 	}
 }
+
+// Keys from draft-madden-jose-ecdh-1pu-04, Appendix A
+var (
+	ecdh1PUAliceKey = &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     fromBase64Int("WKn-ZIGevcwGIyyrzFoZNBdaq9_TsqzGl96oc0CWuis"),
+			Y:     fromBase64Int("y77t-RvAHRKTsSGdIYUfweuOvwrvDD-Q3Hv5J0fSKbE"),
+		},
+		D: fromBase64Int("Hndv7ZZjs_ke8o9zXYo3iq-Yr8SewI5vrqd0pAvEPqg"),
+	}
+	ecdh1PUBobKey = &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     fromBase64Int("weNJy2HscCSM6AEDTDg04biOvhFhyyWvOHQfeF_PxMQ"),
+			Y:     fromBase64Int("e8lnCO-AlStT-NJVX-crhB7QRYhiix03illJOVAOyck"),
+		},
+		D: fromBase64Int("VEmDZpDXXK8p8N0Cndsxs924q6nS1RXFASRl6BfUqdw"),
+	}
+	ecdh1PUEphemeralKey = &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     fromBase64Int("gI0GAILBdu7T53akrFmMyGcsF3n5dO7MmwNBHKW5SV0"),
+			Y:     fromBase64Int("SLW_xSffzlPWrHEVI30DHM_4egVwt3NQqeUD7nMFpps"),
+		},
+		D: fromBase64Int("0_NxaRPUMQoAJt50Gz8YiTr8gRTwyEaCumd-MToTmIo"),
+	}
+)
+
+// Build a compact ECDH-1PU message from Alice to Bob. The wrap function gets
+// the content tag and returns the encrypted key.
+func makeECDH1PUMessage(t *testing.T, alg KeyAlgorithm, enc ContentEncryption, cek []byte, wrap func(tag []byte) []byte) string {
+	protected := &rawHeader{
+		Alg:  string(alg),
+		Enc:  enc,
+		Apu:  newBuffer([]byte("Alice")),
+		Apv:  newBuffer([]byte("Bob")),
+		Skid: "alice",
+		Epk:  &JsonWebKey{Key: &ecdh1PUEphemeralKey.PublicKey},
+	}
+	serializedProtected := base64URLEncode(mustSerializeJSON(protected))
+
+	parts, err := getContentCipher(enc).encrypt(cek, []byte(serializedProtected), []byte("Three is a magic number."))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fmt.Sprintf("%s.%s.%s.%s.%s",
+		serializedProtected,
+		base64URLEncode(wrap(parts.tag)),
+		base64URLEncode(parts.iv),
+		base64URLEncode(parts.ciphertext),
+		base64URLEncode(parts.tag))
+}
+
+func TestDecryptECDH1PU(t *testing.T) {
+	// Derived key for the direct key agreement example in the draft
+	cek := fromHexBytes("6caf13723d14850ad4b42cd6dde935bffd2fff00a9ba70de05c203a5e1722ca7")
+	msg := makeECDH1PUMessage(t, ECDH_1PU, A256GCM, cek, func([]byte) []byte { return nil })
+
+	obj, err := ParseEncrypted(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Header.SenderKeyID != "alice" {
+		t.Error("expected skid header to be available")
+	}
+
+	plaintext, err := obj.Decrypt(&ECDH1PUDecryptionKey{
+		RecipientKey: ecdh1PUBobKey,
+		SenderKey:    &ecdh1PUAliceKey.PublicKey,
+	})
+	if err != nil || string(plaintext) != "Three is a magic number." {
+		t.Error("failed to decrypt ECDH-1PU message:", err)
+	}
+
+	// Sender authentication: a different sender key must fail
+	_, err = obj.Decrypt(&ECDH1PUDecryptionKey{
+		RecipientKey: ecdh1PUBobKey,
+		SenderKey:    &ecTestKey256.PublicKey,
+	})
+	if err == nil {
+		t.Error("should not decrypt with wrong sender key")
+	}
+
+	// Plain ECDH-ES decryption must not work either
+	if _, err = obj.Decrypt(ecdh1PUBobKey); err == nil {
+		t.Error("should not decrypt ECDH-1PU message with ECDH-ES key")
+	}
+}
+
+func TestDecryptECDH1PUKeyWrap(t *testing.T) {
+	cek := make([]byte, 64)
+	_, _ = io.ReadFull(rand.Reader, cek)
+
+	// Sender side of the key agreement
+	ze := ecdhSharedSecret(ecdh1PUEphemeralKey, &ecdh1PUBobKey.PublicKey)
+	zs := ecdhSharedSecret(ecdh1PUAliceKey, &ecdh1PUBobKey.PublicKey)
+
+	msg := makeECDH1PUMessage(t, ECDH_1PU_A256KW, A256CBC_HS512, cek, func(tag []byte) []byte {
+		kek := josecipher.DeriveECDH1PU(string(ECDH_1PU_A256KW), []byte("Alice"), []byte("Bob"), tag, ze, zs, 32)
+		block, _ := aes.NewCipher(kek)
+		wrapped, err := josecipher.KeyWrap(block, cek)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wrapped
+	})
+
+	obj, err := ParseEncrypted(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := &ECDH1PUDecryptionKey{
+		RecipientKey: ecdh1PUBobKey,
+		SenderKey:    &ecdh1PUAliceKey.PublicKey,
+	}
+	plaintext, err := obj.Decrypt(key)
+	if err != nil || string(plaintext) != "Three is a magic number." {
+		t.Error("failed to decrypt ECDH-1PU+A256KW message:", err)
+	}
+
+	// Key wrapping requires AES-CBC-HMAC content encryption
+	msg = makeECDH1PUMessage(t, ECDH_1PU_A256KW, A256GCM, cek[:32], func([]byte) []byte { return nil })
+	obj, err = ParseEncrypted(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := ecdh1PUDecrypter{recipientKey: key.RecipientKey, senderKey: key.SenderKey}
+	_, err = dec.decryptKey(obj.mergedHeaders(nil), &obj.recipients[0], randomKeyGenerator{size: 32})
+	if err == nil {
+		t.Error("should reject ECDH-1PU+A256KW with AES-GCM")
+	}
+}
@@ -0,0 +1,331 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package awskms implements the opaque signer and key decrypter interfaces of
+// go-jose on top of asymmetric AWS KMS keys, so that JWS objects can be signed
+// and JWE objects decrypted without the private key ever leaving KMS.
+package awskms
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/square/go-jose"
+)
+
+// Client is the subset of the AWS KMS API used by this package. It's
+// implemented by *kms.Client.
+type Client interface {
+	GetPublicKey(ctx context.Context, params *kms.GetPublicKeyInput, optFns ...func(*kms.Options)) (*kms.GetPublicKeyOutput, error)
+	Sign(ctx context.Context, params *kms.SignInput, optFns ...func(*kms.Options)) (*kms.SignOutput, error)
+	Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+// Signer is a jose.OpaqueSigner backed by an asymmetric KMS key with key
+// usage SIGN_VERIFY. Use it with jose.NewSigner in place of a private key.
+type Signer struct {
+	client Client
+	keyID  string
+	public *jose.JsonWebKey
+	algs   map[jose.SignatureAlgorithm]types.SigningAlgorithmSpec
+}
+
+// Decrypter is a jose.OpaqueKeyDecrypter backed by an asymmetric RSA KMS key
+// with key usage ENCRYPT_DECRYPT. Use it with JsonWebEncryption.Decrypt in
+// place of a private key. Its public key can be used to encrypt to it.
+type Decrypter struct {
+	client Client
+	keyID  string
+	public *jose.JsonWebKey
+	algs   map[jose.KeyAlgorithm]types.EncryptionAlgorithmSpec
+}
+
+// NewSigner creates a signer for the given KMS key, which may be given as a
+// key ID, key ARN, alias name or alias ARN. The public key is fetched from KMS
+// once; its RFC 7638 thumbprint is used as key ID.
+func NewSigner(ctx context.Context, client Client, keyID string) (*Signer, error) {
+	out, public, err := getPublicKey(ctx, client, keyID, types.KeyUsageTypeSignVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	algs := map[jose.SignatureAlgorithm]types.SigningAlgorithmSpec{}
+	for _, spec := range out.SigningAlgorithms {
+		if alg, ok := signatureAlgorithm(spec, public.Key); ok {
+			algs[alg] = spec
+		}
+	}
+	if len(algs) == 0 {
+		return nil, fmt.Errorf("square/go-jose/awskms: key spec %s not supported", out.KeySpec)
+	}
+
+	return &Signer{
+		client: client,
+		keyID:  keyID,
+		public: public,
+		algs:   algs,
+	}, nil
+}
+
+// Public returns the public key of the KMS key.
+func (s *Signer) Public() *jose.JsonWebKey {
+	public := *s.public
+	return &public
+}
+
+// Algs returns the signature algorithms supported by the KMS key.
+func (s *Signer) Algs() []jose.SignatureAlgorithm {
+	return sortedAlgs(s.algs)
+}
+
+// SignPayload signs the payload with the KMS key. The payload is hashed
+// locally (except for EdDSA) so that it's not limited by the maximum message
+// size of KMS, and ECDSA signatures are converted from ASN.1 DER to the
+// R || S format of JWS.
+func (s *Signer) SignPayload(payload []byte, alg jose.SignatureAlgorithm) ([]byte, error) {
+	spec, ok := s.algs[alg]
+	if !ok {
+		return nil, jose.ErrUnsupportedAlgorithm
+	}
+
+	input := &kms.SignInput{
+		KeyId:            aws.String(s.keyID),
+		SigningAlgorithm: spec,
+		Message:          payload,
+		MessageType:      types.MessageTypeRaw,
+	}
+	if hash := signatureHash(alg); hash != 0 {
+		hasher := hash.New()
+		_, _ = hasher.Write(payload)
+		input.Message = hasher.Sum(nil)
+		input.MessageType = types.MessageTypeDigest
+	}
+
+	out, err := s.client.Sign(context.Background(), input)
+	if err != nil {
+		return nil, err
+	}
+
+	if public, ok := s.public.Key.(*ecdsa.PublicKey); ok {
+		return rawECDSASignature(out.Signature, public.Curve)
+	}
+	return out.Signature, nil
+}
+
+// NewDecrypter creates a key decrypter for the given KMS key, which may be
+// given as a key ID, key ARN, alias name or alias ARN. The public key is
+// fetched from KMS once; its RFC 7638 thumbprint is used as key ID.
+func NewDecrypter(ctx context.Context, client Client, keyID string) (*Decrypter, error) {
+	out, public, err := getPublicKey(ctx, client, keyID, types.KeyUsageTypeEncryptDecrypt)
+	if err != nil {
+		return nil, err
+	}
+
+	algs := map[jose.KeyAlgorithm]types.EncryptionAlgorithmSpec{}
+	if _, ok := public.Key.(*rsa.PublicKey); ok {
+		for _, spec := range out.EncryptionAlgorithms {
+			switch spec {
+			case types.EncryptionAlgorithmSpecRsaesOaepSha1:
+				algs[jose.RSA_OAEP] = spec
+			case types.EncryptionAlgorithmSpecRsaesOaepSha256:
+				algs[jose.RSA_OAEP_256] = spec
+			}
+		}
+	}
+	if len(algs) == 0 {
+		return nil, fmt.Errorf("square/go-jose/awskms: key spec %s not supported", out.KeySpec)
+	}
+
+	return &Decrypter{
+		client: client,
+		keyID:  keyID,
+		public: public,
+		algs:   algs,
+	}, nil
+}
+
+// Public returns the public key of the KMS key, for use with
+// jose.NewEncrypter.
+func (d *Decrypter) Public() *jose.JsonWebKey {
+	public := *d.public
+	return &public
+}
+
+// Algs returns the key management algorithms supported by the KMS key.
+func (d *Decrypter) Algs() []jose.KeyAlgorithm {
+	var algs []jose.KeyAlgorithm
+	for _, alg := range []jose.KeyAlgorithm{jose.RSA_OAEP, jose.RSA_OAEP_256} {
+		if _, ok := d.algs[alg]; ok {
+			algs = append(algs, alg)
+		}
+	}
+	return algs
+}
+
+// DecryptKey decrypts the encrypted content encryption key with the KMS key.
+func (d *Decrypter) DecryptKey(encryptedKey []byte, header jose.JoseHeader) ([]byte, error) {
+	return d.DecryptKeyContext(context.Background(), encryptedKey, header)
+}
+
+// DecryptKeyContext is like DecryptKey, but the call to KMS is aborted if the
+// context is cancelled. It's used by jose.JsonWebEncryption.DecryptContext.
+func (d *Decrypter) DecryptKeyContext(ctx context.Context, encryptedKey []byte, header jose.JoseHeader) ([]byte, error) {
+	spec, ok := d.algs[jose.KeyAlgorithm(header.Algorithm)]
+	if !ok {
+		return nil, jose.ErrUnsupportedAlgorithm
+	}
+
+	out, err := d.client.Decrypt(ctx, &kms.DecryptInput{
+		KeyId:               aws.String(d.keyID),
+		CiphertextBlob:      encryptedKey,
+		EncryptionAlgorithm: spec,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Plaintext, nil
+}
+
+// Fetch and parse the public key of a KMS key, which must have the given key
+// usage.
+func getPublicKey(ctx context.Context, client Client, keyID string, usage types.KeyUsageType) (*kms.GetPublicKeyOutput, *jose.JsonWebKey, error) {
+	out, err := client.GetPublicKey(ctx, &kms.GetPublicKeyInput{
+		KeyId: aws.String(keyID),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if out.KeyUsage != usage {
+		return nil, nil, fmt.Errorf("square/go-jose/awskms: key usage is %s, expected %s", out.KeyUsage, usage)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(out.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	public := &jose.JsonWebKey{Key: key}
+	thumbprint, err := public.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, nil, err
+	}
+	public.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+
+	return out, public, nil
+}
+
+// Map a KMS signing algorithm to the JOSE signature algorithm, taking the
+// curve of ECDSA keys into account.
+func signatureAlgorithm(spec types.SigningAlgorithmSpec, key interface{}) (jose.SignatureAlgorithm, bool) {
+	switch spec {
+	case types.SigningAlgorithmSpecRsassaPkcs1V15Sha256:
+		return jose.RS256, true
+	case types.SigningAlgorithmSpecRsassaPkcs1V15Sha384:
+		return jose.RS384, true
+	case types.SigningAlgorithmSpecRsassaPkcs1V15Sha512:
+		return jose.RS512, true
+	case types.SigningAlgorithmSpecRsassaPssSha256:
+		return jose.PS256, true
+	case types.SigningAlgorithmSpecRsassaPssSha384:
+		return jose.PS384, true
+	case types.SigningAlgorithmSpecRsassaPssSha512:
+		return jose.PS512, true
+	case types.SigningAlgorithmSpecEd25519Sha512:
+		return jose.EdDSA, true
+	}
+
+	// KMS uses the hash function to name ECDSA algorithms, whereas JOSE ties
+	// each algorithm to a single curve.
+	public, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return "", false
+	}
+	switch {
+	case spec == types.SigningAlgorithmSpecEcdsaSha256 && public.Curve == elliptic.P256():
+		return jose.ES256, true
+	case spec == types.SigningAlgorithmSpecEcdsaSha384 && public.Curve == elliptic.P384():
+		return jose.ES384, true
+	case spec == types.SigningAlgorithmSpecEcdsaSha512 && public.Curve == elliptic.P521():
+		return jose.ES512, true
+	}
+
+	return "", false
+}
+
+// Get the hash function of a signature algorithm, or zero for EdDSA which
+// signs the message itself.
+func signatureHash(alg jose.SignatureAlgorithm) crypto.Hash {
+	switch alg {
+	case jose.RS256, jose.PS256, jose.ES256:
+		return crypto.SHA256
+	case jose.RS384, jose.PS384, jose.ES384:
+		return crypto.SHA384
+	case jose.RS512, jose.PS512, jose.ES512:
+		return crypto.SHA512
+	default:
+		return 0
+	}
+}
+
+// Convert an ASN.1 DER encoded ECDSA signature, as produced by KMS, to the
+// fixed size concatenation of R and S used by JWS.
+func rawECDSASignature(der []byte, curve elliptic.Curve) ([]byte, error) {
+	var sig struct {
+		R, S *big.Int
+	}
+	rest, err := asn1.Unmarshal(der, &sig)
+	if err != nil || len(rest) > 0 || sig.R == nil || sig.S == nil {
+		return nil, errors.New("square/go-jose/awskms: invalid ECDSA signature from KMS")
+	}
+
+	keyBytes := (curve.Params().BitSize + 7) / 8
+	if sig.R.Sign() <= 0 || sig.S.Sign() <= 0 || sig.R.BitLen() > 8*keyBytes || sig.S.BitLen() > 8*keyBytes {
+		return nil, errors.New("square/go-jose/awskms: invalid ECDSA signature from KMS")
+	}
+
+	out := make([]byte, 2*keyBytes)
+	sig.R.FillBytes(out[:keyBytes])
+	sig.S.FillBytes(out[keyBytes:])
+	return out, nil
+}
+
+// Return the algorithms in a map in a stable order.
+func sortedAlgs(algs map[jose.SignatureAlgorithm]types.SigningAlgorithmSpec) []jose.SignatureAlgorithm {
+	var out []jose.SignatureAlgorithm
+	for _, alg := range []jose.SignatureAlgorithm{
+		jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512,
+		jose.ES256, jose.ES384, jose.ES512, jose.EdDSA,
+	} {
+		if _, ok := algs[alg]; ok {
+			out = append(out, alg)
+		}
+	}
+	return out
+}
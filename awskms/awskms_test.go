@@ -0,0 +1,317 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package awskms
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/square/go-jose"
+)
+
+// A fake KMS client backed by local keys.
+type fakeKMS struct {
+	keys  map[string]crypto.Signer
+	usage types.KeyUsageType
+
+	// Context of the last call to Decrypt
+	ctx context.Context
+}
+
+func (f *fakeKMS) GetPublicKey(ctx context.Context, params *kms.GetPublicKeyInput, optFns ...func(*kms.Options)) (*kms.GetPublicKeyOutput, error) {
+	key, ok := f.keys[*params.KeyId]
+	if !ok {
+		return nil, errors.New("NotFoundException")
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	out := &kms.GetPublicKeyOutput{
+		KeyId:     params.KeyId,
+		KeyUsage:  f.usage,
+		PublicKey: der,
+	}
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		out.KeySpec = types.KeySpecRsa2048
+		out.SigningAlgorithms = []types.SigningAlgorithmSpec{
+			types.SigningAlgorithmSpecRsassaPkcs1V15Sha256,
+			types.SigningAlgorithmSpecRsassaPssSha512,
+		}
+		out.EncryptionAlgorithms = []types.EncryptionAlgorithmSpec{
+			types.EncryptionAlgorithmSpecRsaesOaepSha1,
+			types.EncryptionAlgorithmSpecRsaesOaepSha256,
+		}
+	case *ecdsa.PrivateKey:
+		out.SigningAlgorithms = []types.SigningAlgorithmSpec{
+			types.SigningAlgorithmSpecEcdsaSha256,
+			types.SigningAlgorithmSpecEcdsaSha384,
+			types.SigningAlgorithmSpecEcdsaSha512,
+		}
+	case ed25519.PrivateKey:
+		out.KeySpec = types.KeySpecEccNistEdwards25519
+		out.SigningAlgorithms = []types.SigningAlgorithmSpec{
+			types.SigningAlgorithmSpecEd25519Sha512,
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeKMS) Sign(ctx context.Context, params *kms.SignInput, optFns ...func(*kms.Options)) (*kms.SignOutput, error) {
+	key := f.keys[*params.KeyId]
+
+	var opts crypto.SignerOpts
+	switch params.SigningAlgorithm {
+	case types.SigningAlgorithmSpecRsassaPkcs1V15Sha256, types.SigningAlgorithmSpecEcdsaSha256:
+		opts = crypto.SHA256
+	case types.SigningAlgorithmSpecEcdsaSha384:
+		opts = crypto.SHA384
+	case types.SigningAlgorithmSpecEcdsaSha512:
+		opts = crypto.SHA512
+	case types.SigningAlgorithmSpecRsassaPssSha512:
+		opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA512}
+	case types.SigningAlgorithmSpecEd25519Sha512:
+		if params.MessageType != types.MessageTypeRaw {
+			return nil, errors.New("ValidationException")
+		}
+		opts = crypto.Hash(0)
+	}
+	if opts.HashFunc() != 0 && params.MessageType != types.MessageTypeDigest {
+		return nil, errors.New("ValidationException")
+	}
+
+	// Like crypto.Signer, KMS returns ASN.1 DER encoded ECDSA signatures.
+	signature, err := key.Sign(rand.Reader, params.Message, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.SignOutput{Signature: signature, SigningAlgorithm: params.SigningAlgorithm}, nil
+}
+
+func (f *fakeKMS) Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	f.ctx = ctx
+	key := f.keys[*params.KeyId].(*rsa.PrivateKey)
+
+	hash := crypto.SHA1
+	if params.EncryptionAlgorithm == types.EncryptionAlgorithmSpecRsaesOaepSha256 {
+		hash = crypto.SHA256
+	}
+
+	plaintext, err := rsa.DecryptOAEP(hash.New(), rand.Reader, key, params.CiphertextBlob, nil)
+	if err != nil {
+		return nil, errors.New("InvalidCiphertextException")
+	}
+	return &kms.DecryptOutput{Plaintext: plaintext}, nil
+}
+
+func TestSigner(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p256Key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	p521Key, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	client := &fakeKMS{
+		keys: map[string]crypto.Signer{
+			"rsa":  rsaKey,
+			"p256": p256Key,
+			"p384": p384Key,
+			"p521": p521Key,
+			"ed":   edKey,
+		},
+		usage: types.KeyUsageTypeSignVerify,
+	}
+
+	for _, tc := range []struct {
+		keyID string
+		algs  []jose.SignatureAlgorithm
+	}{
+		{"rsa", []jose.SignatureAlgorithm{jose.RS256, jose.PS512}},
+		{"p256", []jose.SignatureAlgorithm{jose.ES256}},
+		{"p384", []jose.SignatureAlgorithm{jose.ES384}},
+		{"p521", []jose.SignatureAlgorithm{jose.ES512}},
+		{"ed", []jose.SignatureAlgorithm{jose.EdDSA}},
+	} {
+		kmsSigner, err := NewSigner(context.Background(), client, tc.keyID)
+		if err != nil {
+			t.Fatal(tc.keyID, err)
+		}
+
+		algs := kmsSigner.Algs()
+		if len(algs) != len(tc.algs) {
+			t.Fatal(tc.keyID, "unexpected algorithms", algs)
+		}
+
+		for i, alg := range tc.algs {
+			if algs[i] != alg {
+				t.Error(tc.keyID, "unexpected algorithms", algs)
+			}
+
+			signer, err := jose.NewSigner(alg, kmsSigner)
+			if err != nil {
+				t.Fatal(tc.keyID, alg, err)
+			}
+
+			input := []byte("Lorem ipsum dolor sit amet")
+			obj, err := signer.Sign(input)
+			if err != nil {
+				t.Fatal(tc.keyID, alg, err)
+			}
+
+			serialized, _ := obj.CompactSerialize()
+			parsed, err := jose.ParseSigned(serialized)
+			if err != nil {
+				t.Fatal(tc.keyID, alg, err)
+			}
+			if parsed.Signatures[0].Header.KeyID != kmsSigner.Public().KeyID {
+				t.Error(tc.keyID, alg, "expected thumbprint as key ID")
+			}
+
+			output, err := parsed.Verify(client.keys[tc.keyID].Public())
+			if err != nil {
+				t.Error(tc.keyID, alg, "error on verify:", err)
+			} else if !bytes.Equal(output, input) {
+				t.Error(tc.keyID, alg, "input/output do not match", output, input)
+			}
+		}
+	}
+
+	if _, err := NewSigner(context.Background(), client, "unknown"); err == nil {
+		t.Error("should fail with unknown key")
+	}
+
+	client.usage = types.KeyUsageTypeEncryptDecrypt
+	if _, err := NewSigner(context.Background(), client, "rsa"); err == nil {
+		t.Error("should reject key with wrong key usage")
+	}
+}
+
+func TestDecrypter(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	client := &fakeKMS{
+		keys:  map[string]crypto.Signer{"rsa": rsaKey},
+		usage: types.KeyUsageTypeEncryptDecrypt,
+	}
+
+	decrypter, err := NewDecrypter(context.Background(), client, "rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, alg := range decrypter.Algs() {
+		encrypter, err := jose.NewEncrypter(alg, jose.A128GCM, decrypter.Public())
+		if err != nil {
+			t.Fatal(alg, err)
+		}
+
+		input := []byte("Lorem ipsum dolor sit amet")
+		obj, err := encrypter.Encrypt(input)
+		if err != nil {
+			t.Fatal(alg, err)
+		}
+
+		serialized, _ := obj.CompactSerialize()
+		parsed, err := jose.ParseEncrypted(serialized)
+		if err != nil {
+			t.Fatal(alg, err)
+		}
+
+		output, err := parsed.Decrypt(decrypter)
+		if err != nil {
+			t.Error(alg, "error on decrypt:", err)
+		} else if !bytes.Equal(output, input) {
+			t.Error(alg, "input/output do not match", output, input)
+		}
+	}
+
+	encrypter, _ := jose.NewEncrypter(jose.RSA1_5, jose.A128GCM, decrypter.Public())
+	obj, _ := encrypter.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if _, err := obj.Decrypt(decrypter); err == nil {
+		t.Error("should reject algorithm not supported by KMS")
+	}
+}
+
+type contextKey struct{}
+
+func TestDecrypterContext(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	client := &fakeKMS{
+		keys:  map[string]crypto.Signer{"rsa": rsaKey},
+		usage: types.KeyUsageTypeEncryptDecrypt,
+	}
+
+	decrypter, err := NewDecrypter(context.Background(), client, "rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypter, _ := jose.NewEncrypter(jose.RSA_OAEP, jose.A128GCM, decrypter.Public())
+	obj, _ := encrypter.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+
+	ctx := context.WithValue(context.Background(), contextKey{}, "value")
+	if _, err := obj.DecryptContext(ctx, decrypter); err != nil {
+		t.Fatal("error on decrypt:", err)
+	}
+	if client.ctx == nil || client.ctx.Value(contextKey{}) != "value" {
+		t.Error("context should be passed to KMS")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	client.ctx = nil
+	if _, err := obj.DecryptContext(ctx, decrypter); err != context.Canceled {
+		t.Error("should not decrypt with cancelled context", err)
+	}
+	if client.ctx != nil {
+		t.Error("should not call KMS with cancelled context")
+	}
+}
+
+func TestRawECDSASignature(t *testing.T) {
+	for _, der := range [][]byte{
+		{},
+		{0x30, 0x00},
+		{0x30, 0x06, 0x02, 0x01, 0x01, 0x02, 0x01, 0x00},
+		{0x30, 0x06, 0x02, 0x01, 0x01, 0x02, 0x01, 0x01, 0x00},
+	} {
+		if _, err := rawECDSASignature(der, elliptic.P256()); err == nil {
+			t.Error("should reject invalid signature", der)
+		}
+	}
+
+	out, err := rawECDSASignature([]byte{0x30, 0x06, 0x02, 0x01, 0x01, 0x02, 0x01, 0x02}, elliptic.P256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 64 || out[31] != 1 || out[63] != 2 {
+		t.Error("unexpected raw signature", out)
+	}
+}
@@ -194,3 +194,154 @@ func unpadBuffer(buffer []byte, blockSize int) ([]byte, error) {
 
 	return buffer[:len(buffer)-count], nil
 }
+
+// CBCHMACEncrypter encrypts a message with CBC+HMAC in chunks, producing the
+// same output as the AEAD returned by NewCBCHMAC without holding the whole
+// message in memory.
+type CBCHMACEncrypter struct {
+	cbc          cipher.BlockMode
+	mac          hash.Hash
+	aadBits      uint64
+	authtagBytes int
+	buffer       []byte
+}
+
+// CBCHMACDecrypter decrypts a message encrypted with CBC+HMAC in chunks. Note
+// that the plaintext returned by Update is not authenticated until Finish has
+// succeeded.
+type CBCHMACDecrypter struct {
+	cbc          cipher.BlockMode
+	mac          hash.Hash
+	aadBits      uint64
+	authtagBytes int
+	buffer       []byte
+}
+
+// NewCBCHMACEncrypter creates a streaming CBC+HMAC encrypter with the given
+// key, nonce and additional authenticated data.
+func NewCBCHMACEncrypter(key, nonce, data []byte, newBlockCipher func([]byte) (cipher.Block, error)) (*CBCHMACEncrypter, error) {
+	aead, err := NewCBCHMAC(key, newBlockCipher)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := aead.(*cbcAEAD)
+	if len(nonce) != nonceBytes {
+		return nil, errors.New("square/go-jose: invalid nonce length")
+	}
+
+	return &CBCHMACEncrypter{
+		cbc:          cipher.NewCBCEncrypter(ctx.blockCipher, nonce),
+		mac:          ctx.newMac(data, nonce),
+		aadBits:      uint64(len(data)) * 8,
+		authtagBytes: ctx.authtagBytes,
+	}, nil
+}
+
+// Update encrypts the next chunk of plaintext and returns the ciphertext for
+// all complete blocks processed so far.
+func (ctx *CBCHMACEncrypter) Update(plaintext []byte) []byte {
+	ctx.buffer = append(ctx.buffer, plaintext...)
+	n := len(ctx.buffer) - len(ctx.buffer)%ctx.cbc.BlockSize()
+
+	out := make([]byte, n)
+	ctx.cbc.CryptBlocks(out, ctx.buffer[:n])
+	ctx.buffer = append(ctx.buffer[:0], ctx.buffer[n:]...)
+
+	// According to documentation, Write() on hash.Hash never fails.
+	_, _ = ctx.mac.Write(out)
+	return out
+}
+
+// Finish pads and encrypts the remaining plaintext, and returns the final
+// ciphertext along with the authentication tag.
+func (ctx *CBCHMACEncrypter) Finish() (ciphertext, tag []byte) {
+	padded := padBuffer(ctx.buffer, ctx.cbc.BlockSize())
+	ciphertext = make([]byte, len(padded))
+	ctx.cbc.CryptBlocks(ciphertext, padded)
+	ctx.buffer = nil
+
+	_, _ = ctx.mac.Write(ciphertext)
+	return ciphertext, finishMac(ctx.mac, ctx.aadBits, ctx.authtagBytes)
+}
+
+// NewCBCHMACDecrypter creates a streaming CBC+HMAC decrypter with the given
+// key, nonce and additional authenticated data.
+func NewCBCHMACDecrypter(key, nonce, data []byte, newBlockCipher func([]byte) (cipher.Block, error)) (*CBCHMACDecrypter, error) {
+	aead, err := NewCBCHMAC(key, newBlockCipher)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := aead.(*cbcAEAD)
+	if len(nonce) != nonceBytes {
+		return nil, errors.New("square/go-jose: invalid nonce length")
+	}
+
+	return &CBCHMACDecrypter{
+		cbc:          cipher.NewCBCDecrypter(ctx.blockCipher, nonce),
+		mac:          ctx.newMac(data, nonce),
+		aadBits:      uint64(len(data)) * 8,
+		authtagBytes: ctx.authtagBytes,
+	}, nil
+}
+
+// Update decrypts the next chunk of ciphertext and returns the plaintext for
+// all complete blocks processed so far, except for the last block, which is
+// held back until Finish as it contains the padding.
+func (ctx *CBCHMACDecrypter) Update(ciphertext []byte) []byte {
+	_, _ = ctx.mac.Write(ciphertext)
+
+	ctx.buffer = append(ctx.buffer, ciphertext...)
+	blockSize := ctx.cbc.BlockSize()
+	n := len(ctx.buffer) - len(ctx.buffer)%blockSize
+	if n == len(ctx.buffer) {
+		// Keep the block that may be the last one
+		n -= blockSize
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	out := make([]byte, n)
+	ctx.cbc.CryptBlocks(out, ctx.buffer[:n])
+	ctx.buffer = append(ctx.buffer[:0], ctx.buffer[n:]...)
+	return out
+}
+
+// Finish checks the authentication tag and returns the remaining plaintext,
+// with the padding removed.
+func (ctx *CBCHMACDecrypter) Finish(tag []byte) ([]byte, error) {
+	expectedTag := finishMac(ctx.mac, ctx.aadBits, ctx.authtagBytes)
+	if subtle.ConstantTimeCompare(expectedTag, tag) != 1 {
+		return nil, errors.New("square/go-jose: invalid ciphertext (auth tag mismatch)")
+	}
+
+	blockSize := ctx.cbc.BlockSize()
+	if len(ctx.buffer) != blockSize {
+		return nil, errors.New("square/go-jose: invalid ciphertext (invalid length)")
+	}
+
+	buffer := make([]byte, blockSize)
+	ctx.cbc.CryptBlocks(buffer, ctx.buffer)
+	ctx.buffer = nil
+
+	return unpadBuffer(buffer, blockSize)
+}
+
+// Create an HMAC for the auth tag, with the additional data and nonce
+// already written.
+func (ctx *cbcAEAD) newMac(aad, nonce []byte) hash.Hash {
+	mac := hmac.New(ctx.hash, ctx.integrityKey)
+	_, _ = mac.Write(aad)
+	_, _ = mac.Write(nonce)
+	return mac
+}
+
+// Complete an auth tag after all ciphertext has been written.
+func finishMac(mac hash.Hash, aadBits uint64, authtagBytes int) []byte {
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], aadBits)
+	_, _ = mac.Write(length[:])
+	return mac.Sum(nil)[:authtagBytes]
+}
@@ -496,3 +496,96 @@ func BenchmarkDecryptAES256_CBCHMAC_1MB(b *testing.B) {
 func BenchmarkDecryptAES256_CBCHMAC_64MB(b *testing.B) {
 	benchDecryptCBCHMAC(b, 32, 67108864)
 }
+
+func TestAESCBCStreamRoundtrip(t *testing.T) {
+	for _, keySize := range []int{32, 48, 64} {
+		key := make([]byte, keySize)
+		nonce := make([]byte, 16)
+		aad := []byte("additional data")
+		_, _ = io.ReadFull(rand.Reader, key)
+		_, _ = io.ReadFull(rand.Reader, nonce)
+
+		aead, err := NewCBCHMAC(key, aes.NewCipher)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, size := range []int{0, 1, 15, 16, 17, 100, 1000} {
+			plaintext := make([]byte, size)
+			_, _ = io.ReadFull(rand.Reader, plaintext)
+			expected := aead.Seal(nil, nonce, plaintext, aad)
+
+			// Encrypt in chunks of varying size
+			enc, err := NewCBCHMACEncrypter(key, nonce, aad, aes.NewCipher)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ciphertext []byte
+			for i, chunk := 0, 1; i < size; i, chunk = i+chunk, chunk+3 {
+				end := i + chunk
+				if end > size {
+					end = size
+				}
+				ciphertext = append(ciphertext, enc.Update(plaintext[i:end])...)
+			}
+			final, tag := enc.Finish()
+			ciphertext = append(ciphertext, final...)
+
+			if !bytes.Equal(append(ciphertext, tag...), expected) {
+				t.Error("streaming output does not match AEAD output", keySize, size)
+			}
+
+			// Decrypt in chunks of varying size
+			dec, err := NewCBCHMACDecrypter(key, nonce, aad, aes.NewCipher)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var output []byte
+			for i, chunk := 0, 5; i < len(ciphertext); i, chunk = i+chunk, chunk+7 {
+				end := i + chunk
+				if end > len(ciphertext) {
+					end = len(ciphertext)
+				}
+				output = append(output, dec.Update(ciphertext[i:end])...)
+			}
+			final, err = dec.Finish(tag)
+			if err != nil {
+				t.Error("error on decrypt", keySize, size, err)
+			}
+			output = append(output, final...)
+
+			if !bytes.Equal(output, plaintext) {
+				t.Error("plaintext mismatch", keySize, size)
+			}
+		}
+	}
+}
+
+func TestAESCBCStreamInvalidTag(t *testing.T) {
+	key := make([]byte, 32)
+	nonce := make([]byte, 16)
+
+	enc, _ := NewCBCHMACEncrypter(key, nonce, nil, aes.NewCipher)
+	ciphertext := enc.Update([]byte("Lorem ipsum dolor sit amet"))
+	final, tag := enc.Finish()
+	ciphertext = append(ciphertext, final...)
+
+	tag[0] ^= 1
+	dec, _ := NewCBCHMACDecrypter(key, nonce, nil, aes.NewCipher)
+	dec.Update(ciphertext)
+	if _, err := dec.Finish(tag); err == nil {
+		t.Error("should reject invalid tag")
+	}
+
+	// Ciphertext which isn't a multiple of the block size
+	tag[0] ^= 1
+	dec, _ = NewCBCHMACDecrypter(key, nonce, nil, aes.NewCipher)
+	dec.Update(ciphertext[:len(ciphertext)-1])
+	if _, err := dec.Finish(tag); err == nil {
+		t.Error("should reject truncated ciphertext")
+	}
+
+	if _, err := NewCBCHMACEncrypter(key, nonce[:8], nil, aes.NewCipher); err == nil {
+		t.Error("should reject invalid nonce")
+	}
+}
@@ -0,0 +1,60 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package josecipher
+
+import (
+	"crypto"
+	"encoding/binary"
+)
+
+// DeriveECDH1PU derives a shared encryption key using ECDH-1PU/ConcatKDF as
+// described in draft-madden-jose-ecdh-1pu-04. The ze and zs inputs are the
+// ephemeral-static and static-static ECDH shared secrets, which are combined
+// as Z = Ze || Zs. In key wrapping mode, the authentication tag of the content
+// encryption must be passed as ccTag (it is appended to the SuppPubInfo), in
+// direct key agreement mode it must be nil. Output size may be at most 1<<16
+// bytes (64 KiB).
+func DeriveECDH1PU(alg string, apuData, apvData, ccTag, ze, zs []byte, size int) []byte {
+	if size > 1<<16 {
+		panic("ECDH-1PU output size too large, must be less than or equal to 1<<16")
+	}
+
+	// algId, partyUInfo, partyVInfo inputs must be prefixed with the length
+	algID := lengthPrefixed([]byte(alg))
+	ptyUInfo := lengthPrefixed(apuData)
+	ptyVInfo := lengthPrefixed(apvData)
+
+	// suppPubInfo is the encoded length of the output size in bits, followed
+	// by the (length-prefixed) tag in key wrapping mode
+	supPubInfo := make([]byte, 4)
+	binary.BigEndian.PutUint32(supPubInfo, uint32(size)*8)
+	if ccTag != nil {
+		supPubInfo = append(supPubInfo, lengthPrefixed(ccTag)...)
+	}
+
+	z := make([]byte, 0, len(ze)+len(zs))
+	z = append(z, ze...)
+	z = append(z, zs...)
+
+	reader := NewConcatKDF(crypto.SHA256, z, algID, ptyUInfo, ptyVInfo, supPubInfo, []byte{})
+
+	key := make([]byte, size)
+
+	// Read on the KDF will never fail
+	_, _ = reader.Read(key)
+	return key
+}
@@ -0,0 +1,56 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package josecipher
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func mustHex(data string) []byte {
+	out, err := hex.DecodeString(data)
+	if err != nil {
+		panic("Invalid test data")
+	}
+	return out
+}
+
+// Test vector from draft-madden-jose-ecdh-1pu-04, Appendix A
+func TestVectorECDH1PU(t *testing.T) {
+	ze := mustHex("9e56d91d817135d372834283bf84269cfb316ea3da806a48f6daa7798cfe90c4")
+	zs := mustHex("e3ca3474384c9f62b30bfd4c688b3e7d4110a1b4badc3cc54ef7b81241efd50d")
+	expected := mustHex("6caf13723d14850ad4b42cd6dde935bffd2fff00a9ba70de05c203a5e1722ca7")
+
+	output := DeriveECDH1PU("A256GCM", []byte("Alice"), []byte("Bob"), nil, ze, zs, 32)
+
+	if !bytes.Equal(output, expected) {
+		t.Error("output did not match what we expect, got", output, "wanted", expected)
+	}
+}
+
+func TestECDH1PUTagChangesKey(t *testing.T) {
+	ze := bytes.Repeat([]byte{1}, 32)
+	zs := bytes.Repeat([]byte{2}, 32)
+
+	direct := DeriveECDH1PU("ECDH-1PU+A256KW", nil, nil, nil, ze, zs, 32)
+	tagged := DeriveECDH1PU("ECDH-1PU+A256KW", nil, nil, []byte("tag"), ze, zs, 32)
+
+	if bytes.Equal(direct, tagged) {
+		t.Error("tag should be bound into the derived key")
+	}
+}
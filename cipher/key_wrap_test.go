@@ -40,13 +40,20 @@ func TestAesKeyWrap(t *testing.T) {
 
 	expected2, _ := hex.DecodeString("A8F9BC1612C68B3FF6E6F4FBE30E71E4769C8B80A32CB8958CD5D17D6B254DA1")
 
+	kek3, _ := hex.DecodeString("000102030405060708090A0B0C0D0E0F1011121314151617")
+	cek3, _ := hex.DecodeString("00112233445566778899AABBCCDDEEFF0001020304050607")
+
+	expected3, _ := hex.DecodeString("031D33264E15D33268F24EC260743EDCE1C6C7DDEE725A936BA814915C6762D2")
+
 	block0, _ := aes.NewCipher(kek0)
 	block1, _ := aes.NewCipher(kek1)
 	block2, _ := aes.NewCipher(kek2)
+	block3, _ := aes.NewCipher(kek3)
 
 	out0, _ := KeyWrap(block0, cek0)
 	out1, _ := KeyWrap(block1, cek1)
 	out2, _ := KeyWrap(block2, cek2)
+	out3, _ := KeyWrap(block3, cek3)
 
 	if bytes.Compare(out0, expected0) != 0 {
 		t.Error("output 0 not as expected, got", out0, "wanted", expected0)
@@ -60,9 +67,14 @@ func TestAesKeyWrap(t *testing.T) {
 		t.Error("output 2 not as expected, got", out2, "wanted", expected2)
 	}
 
+	if bytes.Compare(out3, expected3) != 0 {
+		t.Error("output 3 not as expected, got", out3, "wanted", expected3)
+	}
+
 	unwrap0, _ := KeyUnwrap(block0, out0)
 	unwrap1, _ := KeyUnwrap(block1, out1)
 	unwrap2, _ := KeyUnwrap(block2, out2)
+	unwrap3, _ := KeyUnwrap(block3, out3)
 
 	if bytes.Compare(unwrap0, cek0) != 0 {
 		t.Error("key unwrap did not return original input, got", unwrap0, "wanted", cek0)
@@ -75,6 +87,10 @@ func TestAesKeyWrap(t *testing.T) {
 	if bytes.Compare(unwrap2, cek2) != 0 {
 		t.Error("key unwrap did not return original input, got", unwrap2, "wanted", cek2)
 	}
+
+	if bytes.Compare(unwrap3, cek3) != 0 {
+		t.Error("key unwrap did not return original input, got", unwrap3, "wanted", cek3)
+	}
 }
 
 func TestAesKeyWrapInvalid(t *testing.T) {
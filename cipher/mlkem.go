@@ -0,0 +1,28 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package josecipher
+
+// DeriveMLKEM derives a shared encryption key from an ML-KEM shared secret
+// using ConcatKDF, in the same way as DeriveECDHES does for an ECDH shared
+// secret. Output size may be at most 1<<16 bytes (64 KiB).
+func DeriveMLKEM(alg string, apuData, apvData, z []byte, size int) []byte {
+	if size > 1<<16 {
+		panic("ML-KEM output size too large, must be less than or equal to 1<<16")
+	}
+
+	return deriveConcatKDF(alg, apuData, apvData, z, size)
+}
@@ -0,0 +1,42 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package josecipher
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDeriveMLKEM(t *testing.T) {
+	z := bytes.Repeat([]byte{7}, 32)
+
+	direct := DeriveMLKEM("A256GCM", nil, nil, z, 32)
+	wrapped := DeriveMLKEM("ML-KEM-1024+A256KW", nil, nil, z, 32)
+
+	if len(direct) != 32 || len(wrapped) != 32 {
+		t.Fatal("unexpected output size")
+	}
+	if bytes.Equal(direct, wrapped) {
+		t.Error("algorithm should be bound into the derived key")
+	}
+	if !bytes.Equal(direct, DeriveMLKEM("A256GCM", nil, nil, z, 32)) {
+		t.Error("derivation should be deterministic")
+	}
+	if bytes.Equal(direct, DeriveMLKEM("A256GCM", []byte("Alice"), nil, z, 32)) {
+		t.Error("apu should be bound into the derived key")
+	}
+}
@@ -0,0 +1,103 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package josecipher
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"math/big"
+	"testing"
+)
+
+func fromHex(s string) *big.Int {
+	n, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic("invalid test data")
+	}
+	return n
+}
+
+// Multiples of the base point taken from SEC 2 test data.
+func TestSecp256k1Arithmetic(t *testing.T) {
+	curve := Secp256k1()
+	params := curve.Params()
+
+	x2 := fromHex("C6047F9441ED7D6D3045406E95C07CD85C778E4B8CEF3CA7ABAC09B95C709EE5")
+	y2 := fromHex("1AE168FEA63DC339A3C58419466CEAEEF7F632653266D0E1236431A950CFE52A")
+	x3 := fromHex("F9308A019258C31049344F85F89D5229B531C845836F99B08601F113BCE036F9")
+	y3 := fromHex("388F7B0F632DE8140FE337E62A37F3566500A99934C2231B6CB9FD7584B8E672")
+
+	if !curve.IsOnCurve(params.Gx, params.Gy) || !curve.IsOnCurve(x2, y2) || !curve.IsOnCurve(x3, y3) {
+		t.Fatal("test points should be on curve")
+	}
+	if curve.IsOnCurve(params.Gx, y2) {
+		t.Error("invalid point should not be on curve")
+	}
+
+	x, y := curve.Double(params.Gx, params.Gy)
+	if x.Cmp(x2) != 0 || y.Cmp(y2) != 0 {
+		t.Error("2G does not match")
+	}
+	x, y = curve.ScalarBaseMult([]byte{2})
+	if x.Cmp(x2) != 0 || y.Cmp(y2) != 0 {
+		t.Error("ScalarBaseMult(2) does not match")
+	}
+	x, y = curve.Add(x2, y2, params.Gx, params.Gy)
+	if x.Cmp(x3) != 0 || y.Cmp(y3) != 0 {
+		t.Error("2G + G does not match")
+	}
+	x, y = curve.ScalarMult(params.Gx, params.Gy, []byte{3})
+	if x.Cmp(x3) != 0 || y.Cmp(y3) != 0 {
+		t.Error("ScalarMult(G, 3) does not match")
+	}
+
+	// (n - 1)G = -G, and nG is the point at infinity
+	nMinus1 := new(big.Int).Sub(params.N, big.NewInt(1))
+	x, y = curve.ScalarBaseMult(nMinus1.Bytes())
+	if x.Cmp(params.Gx) != 0 || y.Cmp(new(big.Int).Sub(params.P, params.Gy)) != 0 {
+		t.Error("(n-1)G should equal -G")
+	}
+	x, y = curve.ScalarBaseMult(params.N.Bytes())
+	if x.Sign() != 0 || y.Sign() != 0 {
+		t.Error("nG should be the point at infinity")
+	}
+}
+
+func TestSecp256k1ECDSA(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(Secp256k1(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !priv.Curve.IsOnCurve(priv.X, priv.Y) {
+		t.Fatal("generated public key not on curve")
+	}
+
+	digest := sha256.Sum256([]byte("Lorem ipsum dolor sit amet"))
+	r, s, err := ecdsa.Sign(rand.Reader, priv, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.Verify(&priv.PublicKey, digest[:], r, s) {
+		t.Error("unable to verify secp256k1 signature")
+	}
+
+	digest[0] ^= 1
+	if ecdsa.Verify(&priv.PublicKey, digest[:], r, s) {
+		t.Error("should not verify signature over different digest")
+	}
+}
@@ -0,0 +1,117 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jose
+
+import (
+	"context"
+	"errors"
+)
+
+// KeyResolver is implemented by key sources that may have to do I/O to find
+// the key for an object, such as a remote JWK Set (see package jwks). It may
+// be passed to VerifyContext or DecryptContext in place of a key. The
+// resolver is called with the (merged) headers of the signature or recipient
+// and should return the key to use, or nil if it has no matching key.
+type KeyResolver interface {
+	ResolveContext(ctx context.Context, header JoseHeader) (interface{}, error)
+}
+
+// OpaqueKeyDecrypterContext is implemented by opaque key decrypters which do
+// I/O, e.g. calls to a cloud KMS. When such a decrypter is passed to
+// DecryptContext (or returned by a KeyResolver), DecryptKeyContext is called
+// with the context instead of DecryptKey.
+type OpaqueKeyDecrypterContext interface {
+	OpaqueKeyDecrypter
+	DecryptKeyContext(ctx context.Context, encryptedKey []byte, header JoseHeader) ([]byte, error)
+}
+
+// An OpaqueKeyDecrypter which calls DecryptKeyContext with a fixed context.
+type contextKeyDecrypter struct {
+	ctx       context.Context
+	decrypter OpaqueKeyDecrypterContext
+}
+
+func (d contextKeyDecrypter) DecryptKey(encryptedKey []byte, header JoseHeader) ([]byte, error) {
+	return d.decrypter.DecryptKeyContext(d.ctx, encryptedKey, header)
+}
+
+// Bind a decryption key to the given context, if it can use one.
+func withContext(ctx context.Context, key interface{}) interface{} {
+	if decrypter, ok := key.(OpaqueKeyDecrypterContext); ok {
+		return contextKeyDecrypter{ctx: ctx, decrypter: decrypter}
+	}
+	return key
+}
+
+// VerifyContext validates the signature on the object like Verify, so that
+// callers can apply timeouts and cancellation to verification paths which do
+// I/O. The verification key may be a KeyResolver, which is called with the
+// context and the headers of the signature to find the key. An error is
+// returned without verifying if the context is done.
+func (obj JsonWebSignature) VerifyContext(ctx context.Context, verificationKey interface{}) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if resolver, ok := verificationKey.(KeyResolver); ok {
+		if len(obj.Signatures) != 1 {
+			return nil, errors.New("square/go-jose: too many signatures in payload; expecting only one")
+		}
+
+		headers := obj.Signatures[0].mergedHeaders()
+		key, err := resolver.ResolveContext(ctx, headers.sanitized())
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			return nil, ErrCryptoFailure
+		}
+		verificationKey = key
+	}
+
+	return obj.Verify(verificationKey)
+}
+
+// DecryptContext decrypts and validates the object like Decrypt, so that
+// callers can apply timeouts and cancellation to decryption paths which do
+// I/O. The decryption key may be a KeyResolver, which is called with the
+// context and the merged headers of the recipient to find the key, or an
+// OpaqueKeyDecrypterContext. An error is returned without decrypting if the
+// context is done.
+func (obj JsonWebEncryption) DecryptContext(ctx context.Context, decryptionKey interface{}) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if resolver, ok := decryptionKey.(KeyResolver); ok {
+		if len(obj.recipients) != 1 {
+			return nil, errors.New("square/go-jose: too many recipients in payload; expecting only one")
+		}
+
+		headers := obj.mergedHeaders(&obj.recipients[0])
+		key, err := resolver.ResolveContext(ctx, headers.sanitized())
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			return nil, ErrCryptoFailure
+		}
+		decryptionKey = key
+	}
+
+	return obj.Decrypt(withContext(ctx, decryptionKey))
+}
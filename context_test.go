@@ -0,0 +1,131 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jose
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+// A key resolver backed by a map from key ID to key.
+type mapResolver map[string]interface{}
+
+func (r mapResolver) ResolveContext(ctx context.Context, header JoseHeader) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r[header.KeyID], nil
+}
+
+// A KMS stand-in which records the context of the last call.
+type contextKMS struct {
+	testKMS
+	ctx context.Context
+}
+
+func (k *contextKMS) DecryptKeyContext(ctx context.Context, encryptedKey []byte, header JoseHeader) ([]byte, error) {
+	k.ctx = ctx
+	return k.DecryptKey(encryptedKey, header)
+}
+
+type testContextKey struct{}
+
+func TestVerifyContext(t *testing.T) {
+	input := []byte("Lorem ipsum dolor sit amet")
+	key := &JsonWebKey{Key: ecTestKey256, KeyID: "key-1"}
+
+	signer, err := NewSigner(ES256, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := signer.Sign(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolver := mapResolver{"key-1": &ecTestKey256.PublicKey}
+	output, err := obj.VerifyContext(context.Background(), resolver)
+	if err != nil || !bytes.Equal(output, input) {
+		t.Error("unable to verify with resolver", err)
+	}
+
+	output, err = obj.VerifyContext(context.Background(), &ecTestKey256.PublicKey)
+	if err != nil || !bytes.Equal(output, input) {
+		t.Error("unable to verify with key", err)
+	}
+
+	if _, err := obj.VerifyContext(context.Background(), mapResolver{}); err != ErrCryptoFailure {
+		t.Error("should fail without key", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := obj.VerifyContext(ctx, &ecTestKey256.PublicKey); err != context.Canceled {
+		t.Error("should not verify with cancelled context", err)
+	}
+}
+
+func TestDecryptContext(t *testing.T) {
+	input := []byte("Lorem ipsum dolor sit amet")
+	kms := &contextKMS{testKMS: testKMS{keyID: "kms-key", key: []byte("0123456789abcdef")}}
+
+	enc, err := NewEncrypter(A128KW, A128GCM, kms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := enc.Encrypt(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), testContextKey{}, "value")
+	for _, key := range []interface{}{kms, mapResolver{"kms-key": kms}} {
+		kms.ctx = nil
+		output, err := obj.DecryptContext(ctx, key)
+		if err != nil || !bytes.Equal(output, input) {
+			t.Error("unable to decrypt", err)
+		}
+		if kms.ctx == nil || kms.ctx.Value(testContextKey{}) != "value" {
+			t.Error("context should be passed to key decrypter")
+		}
+	}
+
+	if _, err := obj.DecryptContext(ctx, mapResolver{}); err != ErrCryptoFailure {
+		t.Error("should fail without key", err)
+	}
+
+	failing := errors.New("unavailable")
+	if _, err := obj.DecryptContext(ctx, failingResolver{failing}); err != failing {
+		t.Error("should return resolver error", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := obj.DecryptContext(ctx, kms); err != context.Canceled {
+		t.Error("should not decrypt with cancelled context", err)
+	}
+}
+
+type failingResolver struct {
+	err error
+}
+
+func (r failingResolver) ResolveContext(ctx context.Context, header JoseHeader) (interface{}, error) {
+	return nil, r.err
+}
@@ -17,11 +17,17 @@
 package jose
 
 import (
+	"crypto"
+	"crypto/ecdh"
 	"crypto/ecdsa"
+	"crypto/mlkem"
 	"crypto/rsa"
 	"errors"
 	"fmt"
+	"io"
 	"reflect"
+
+	"github.com/square/go-jose/json"
 )
 
 // Encrypter represents an encrypter which produces an encrypted JWE object.
@@ -29,6 +35,13 @@ type Encrypter interface {
 	Encrypt(plaintext []byte) (*JsonWebEncryption, error)
 	EncryptWithAuthData(plaintext []byte, aad []byte) (*JsonWebEncryption, error)
 	SetCompression(alg CompressionAlgorithm)
+	SetType(typ string)
+	SetContentType(cty string)
+	SetExtraHeader(name string, value interface{}) error
+	SetCriticalExtensions(names []string)
+	SetPBES2Count(count int) error
+	SetContentKey(cek []byte) error
+	EncryptStream(w io.Writer) (io.WriteCloser, error)
 }
 
 // MultiEncrypter represents an encrypter which supports multiple recipients.
@@ -36,6 +49,11 @@ type MultiEncrypter interface {
 	Encrypt(plaintext []byte) (*JsonWebEncryption, error)
 	EncryptWithAuthData(plaintext []byte, aad []byte) (*JsonWebEncryption, error)
 	SetCompression(alg CompressionAlgorithm)
+	SetType(typ string)
+	SetContentType(cty string)
+	SetExtraHeader(name string, value interface{}) error
+	SetCriticalExtensions(names []string)
+	SetPBES2Count(count int) error
 	AddRecipient(alg KeyAlgorithm, encryptionKey interface{}) error
 }
 
@@ -57,6 +75,13 @@ type keyEncrypter interface {
 	encryptKey(cek []byte, alg KeyAlgorithm) (recipientInfo, error) // Encrypt a key
 }
 
+// A key encrypter for algorithms where the encrypted key depends on the
+// content authentication tag (ECDH-1PU with key wrapping). The headers are
+// generated up front, the returned function wraps the key given the tag.
+type deferredKeyEncrypter interface {
+	encryptKeyDeferred(cek []byte, alg KeyAlgorithm) (recipientInfo, func(tag []byte) ([]byte, error), error)
+}
+
 // A generic key decrypter
 type keyDecrypter interface {
 	decryptKey(headers rawHeader, recipient *recipientInfo, generator keyGenerator) ([]byte, error) // Decrypt a key
@@ -66,6 +91,11 @@ type keyDecrypter interface {
 type genericEncrypter struct {
 	contentAlg     ContentEncryption
 	compressionAlg CompressionAlgorithm
+	typ            string
+	cty            string
+	extra          map[string]interface{}
+	critical       []string
+	pbes2Count     int
 	cipher         contentCipher
 	recipients     []recipientKeyInfo
 	keyGenerator   keyGenerator
@@ -82,6 +112,77 @@ func (ctx *genericEncrypter) SetCompression(compressionAlg CompressionAlgorithm)
 	ctx.compressionAlg = compressionAlg
 }
 
+// SetType sets the "typ" header of produced objects to the given media type,
+// e.g. "at+jwt". An empty string (the default) omits the header.
+func (ctx *genericEncrypter) SetType(typ string) {
+	ctx.typ = typ
+}
+
+// SetContentType sets the "cty" header of produced objects to the media type
+// of the plaintext, e.g. "JWT" for nested tokens. An empty string (the
+// default) omits the header.
+func (ctx *genericEncrypter) SetContentType(cty string) {
+	ctx.cty = cty
+}
+
+// SetExtraHeader sets a custom parameter in the protected header of produced
+// objects. The value must be serializable to JSON. Parameters which are set by
+// the library itself, such as "alg" or "enc", can't be overridden.
+func (ctx *genericEncrypter) SetExtraHeader(name string, value interface{}) error {
+	if knownHeaders[name] {
+		return fmt.Errorf("square/go-jose: header parameter '%s' is set by the library", name)
+	}
+	if ctx.extra == nil {
+		ctx.extra = map[string]interface{}{}
+	}
+	ctx.extra[name] = value
+	return nil
+}
+
+// SetCriticalExtensions lists custom header parameters that recipients must
+// understand in order to process produced objects, in the "crit" header. Each
+// parameter must be present in the protected header (see SetExtraHeader), and
+// must not be one of the parameters registered by RFC 7516.
+func (ctx *genericEncrypter) SetCriticalExtensions(names []string) {
+	ctx.critical = copyCriticalNames(names)
+}
+
+// SetPBES2Count sets the PBES2 iteration count (p2c) used for recipients with
+// a password, instead of DefaultPBES2Count. Counts below DefaultMinPBES2Count
+// are rejected, as recipients reject them by default.
+func (ctx *genericEncrypter) SetPBES2Count(count int) error {
+	if count < DefaultMinPBES2Count {
+		return fmt.Errorf("square/go-jose: PBES2 iteration count must be at least %d", DefaultMinPBES2Count)
+	}
+
+	ctx.pbes2Count = count
+	for _, recipient := range ctx.recipients {
+		if encrypter, ok := recipient.keyEncrypter.(*symmetricKeyCipher); ok {
+			encrypter.p2c = count
+		}
+	}
+	return nil
+}
+
+// SetContentKey sets the content encryption key to use, instead of the key the
+// encrypter was created with. This is only supported in direct encryption mode
+// (as other modes generate a fresh key for each message), and is meant for
+// reproducing test vectors or for protocols which establish the key by other
+// means. The key size must match the content encryption algorithm.
+func (ctx *genericEncrypter) SetContentKey(cek []byte) error {
+	if len(ctx.recipients) != 1 || ctx.recipients[0].keyAlg != DIRECT {
+		return errors.New("square/go-jose: content key can only be set in direct encryption mode")
+	}
+	if len(cek) != ctx.cipher.keySize() {
+		return ErrInvalidKeySize
+	}
+
+	ctx.keyGenerator = staticKeyGenerator{
+		key: copyBytes(cek),
+	}
+	return nil
+}
+
 // NewEncrypter creates an appropriate encrypter based on the key type
 func NewEncrypter(alg KeyAlgorithm, enc ContentEncryption, encryptionKey interface{}) (Encrypter, error) {
 	encrypter := &genericEncrypter{
@@ -95,10 +196,17 @@ func NewEncrypter(alg KeyAlgorithm, enc ContentEncryption, encryptionKey interfa
 		return nil, ErrUnsupportedAlgorithm
 	}
 
+	if jwk, ok := encryptionKey.(JsonWebKey); ok {
+		encryptionKey = &jwk
+	}
+
 	var keyID string
 	var rawKey interface{}
 	switch encryptionKey := encryptionKey.(type) {
 	case *JsonWebKey:
+		if err := encryptionKey.checkOperation("encrypt"); err != nil {
+			return nil, err
+		}
 		keyID = encryptionKey.KeyID
 		rawKey = encryptionKey.Key
 	default:
@@ -111,6 +219,9 @@ func NewEncrypter(alg KeyAlgorithm, enc ContentEncryption, encryptionKey interfa
 		if reflect.TypeOf(rawKey) != reflect.TypeOf([]byte{}) {
 			return nil, ErrUnsupportedKeyType
 		}
+		if len(rawKey.([]byte)) != encrypter.cipher.keySize() {
+			return nil, ErrInvalidKeySize
+		}
 		encrypter.keyGenerator = staticKeyGenerator{
 			key: rawKey.([]byte),
 		}
@@ -126,12 +237,55 @@ func NewEncrypter(alg KeyAlgorithm, enc ContentEncryption, encryptionKey interfa
 		if typeOf != reflect.TypeOf(&ecdsa.PublicKey{}) {
 			return nil, ErrUnsupportedKeyType
 		}
+		recipient, err := newECDHRecipient(alg, rawKey.(*ecdsa.PublicKey))
+		if err != nil {
+			return nil, err
+		}
 		encrypter.keyGenerator = ecKeyGenerator{
 			size:      encrypter.cipher.keySize(),
 			algID:     string(enc),
 			publicKey: rawKey.(*ecdsa.PublicKey),
 		}
-		recipient, _ := newECDHRecipient(alg, rawKey.(*ecdsa.PublicKey))
+		if keyID != "" {
+			recipient.keyID = keyID
+		}
+		encrypter.recipients = []recipientKeyInfo{recipient}
+		return encrypter, nil
+	case ECDH_1PU:
+		// ECDH-1PU (w/o key wrapping) is similar to ECDH-ES
+		key, ok := rawKey.(*ECDH1PUEncryptionKey)
+		if !ok {
+			return nil, ErrUnsupportedKeyType
+		}
+		recipient, err := newECDH1PURecipient(alg, key)
+		if err != nil {
+			return nil, err
+		}
+		encrypter.keyGenerator = ecdh1PUKeyGenerator{
+			size:      encrypter.cipher.keySize(),
+			algID:     string(enc),
+			encrypter: *recipient.keyEncrypter.(*ecdh1PUEncrypter),
+		}
+		if keyID != "" {
+			recipient.keyID = keyID
+		}
+		encrypter.recipients = []recipientKeyInfo{recipient}
+		return encrypter, nil
+	case ML_KEM_768, ML_KEM_1024:
+		// ML-KEM (w/o key wrapping) is similar to ECDH-ES
+		recipient, err := makeJWERecipient(alg, rawKey)
+		if err != nil {
+			return nil, err
+		}
+		keyEncrypter, ok := recipient.keyEncrypter.(*mlkemEncrypter)
+		if !ok {
+			return nil, ErrUnsupportedKeyType
+		}
+		encrypter.keyGenerator = mlkemKeyGenerator{
+			size:      encrypter.cipher.keySize(),
+			algID:     string(enc),
+			publicKey: keyEncrypter.publicKey,
+		}
 		if keyID != "" {
 			recipient.keyID = keyID
 		}
@@ -172,16 +326,33 @@ func (ctx *genericEncrypter) AddRecipient(alg KeyAlgorithm, encryptionKey interf
 	var recipient recipientKeyInfo
 
 	switch alg {
-	case DIRECT, ECDH_ES:
+	case DIRECT, ECDH_ES, ECDH_1PU, ML_KEM_768, ML_KEM_1024:
 		return fmt.Errorf("square/go-jose: key algorithm '%s' not supported in multi-recipient mode", alg)
+	case ECDH_1PU_A128KW, ECDH_1PU_A192KW, ECDH_1PU_A256KW:
+		// Key wrapping binds the content tag into the key derivation, which
+		// requires the tag to be computed before the key, i.e. AES-CBC-HMAC.
+		switch ctx.contentAlg {
+		case A128CBC_HS256, A192CBC_HS384, A256CBC_HS512:
+		default:
+			return fmt.Errorf("square/go-jose: %s requires an AES-CBC-HMAC content encryption algorithm", alg)
+		}
 	}
 
 	recipient, err = makeJWERecipient(alg, encryptionKey)
+	if err != nil {
+		return err
+	}
 
-	if err == nil {
-		ctx.recipients = append(ctx.recipients, recipient)
+	switch encrypter := recipient.keyEncrypter.(type) {
+	case *hpkeEncrypter:
+		// HPKE binds the content encryption algorithm into the encrypted key
+		encrypter.enc = ctx.contentAlg
+	case *symmetricKeyCipher:
+		encrypter.p2c = ctx.pbes2Count
 	}
-	return err
+
+	ctx.recipients = append(ctx.recipients, recipient)
+	return nil
 }
 
 func makeJWERecipient(alg KeyAlgorithm, encryptionKey interface{}) (recipientKeyInfo, error) {
@@ -190,14 +361,29 @@ func makeJWERecipient(alg KeyAlgorithm, encryptionKey interface{}) (recipientKey
 		return newRSARecipient(alg, encryptionKey)
 	case *ecdsa.PublicKey:
 		return newECDHRecipient(alg, encryptionKey)
+	case *ECDH1PUEncryptionKey:
+		return newECDH1PURecipient(alg, encryptionKey)
+	case *ecdh.PublicKey:
+		return newHPKERecipient(alg, encryptionKey)
+	case *mlkem.EncapsulationKey768:
+		return newMLKEMRecipient(alg, encryptionKey)
+	case *mlkem.EncapsulationKey1024:
+		return newMLKEMRecipient(alg, encryptionKey)
 	case []byte:
 		return newSymmetricRecipient(alg, encryptionKey)
 	case *JsonWebKey:
+		if err := encryptionKey.checkOperation("encrypt"); err != nil {
+			return recipientKeyInfo{}, err
+		}
 		recipient, err := makeJWERecipient(alg, encryptionKey.Key)
 		if err == nil && encryptionKey.KeyID != "" {
 			recipient.keyID = encryptionKey.KeyID
 		}
 		return recipient, err
+	case JsonWebKey:
+		return makeJWERecipient(alg, &encryptionKey)
+	case OpaqueKeyEncrypter:
+		return newOpaqueKeyEncrypter(alg, encryptionKey)
 	default:
 		return recipientKeyInfo{}, ErrUnsupportedKeyType
 	}
@@ -218,13 +404,61 @@ func newDecrypter(decryptionKey interface{}) (keyDecrypter, error) {
 		return &symmetricKeyCipher{
 			key: decryptionKey,
 		}, nil
+	case *ECDH1PUDecryptionKey:
+		return &ecdh1PUDecrypter{
+			recipientKey: decryptionKey.RecipientKey,
+			senderKey:    decryptionKey.SenderKey,
+		}, nil
+	case *ecdh.PrivateKey:
+		return &hpkeDecrypter{
+			privateKey: decryptionKey,
+		}, nil
+	case *mlkem.DecapsulationKey768:
+		return &mlkemDecrypter{
+			privateKey: decryptionKey,
+		}, nil
+	case *mlkem.DecapsulationKey1024:
+		return &mlkemDecrypter{
+			privateKey: decryptionKey,
+		}, nil
 	case *JsonWebKey:
+		if err := decryptionKey.checkOperation("decrypt"); err != nil {
+			return nil, err
+		}
 		return newDecrypter(decryptionKey.Key)
+	case JsonWebKey:
+		return newDecrypter(&decryptionKey)
+	case OpaqueKeyDecrypter:
+		return &opaqueKeyDecrypter{
+			decrypter: decryptionKey,
+		}, nil
+	case crypto.Decrypter:
+		// Any other RSA key, e.g. one held in a hardware module.
+		return newCryptoDecrypter(decryptionKey)
 	default:
 		return nil, ErrUnsupportedKeyType
 	}
 }
 
+// newKeyDecrypter creates a key decrypter for this object. Some key management
+// algorithms depend on the content tag (ECDH-1PU with key wrapping) or on the
+// options the object was parsed with (PBES2).
+func (obj JsonWebEncryption) newKeyDecrypter(decryptionKey interface{}) (keyDecrypter, error) {
+	decrypter, err := newDecrypter(decryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	switch d := decrypter.(type) {
+	case *ecdh1PUDecrypter:
+		d.tag = obj.tag
+	case *symmetricKeyCipher:
+		d.minP2c, d.maxP2c = obj.opts.MinPBES2Count, obj.opts.MaxPBES2Count
+	}
+
+	return decrypter, nil
+}
+
 // Implementation of encrypt method producing a JWE object.
 func (ctx *genericEncrypter) Encrypt(plaintext []byte) (*JsonWebEncryption, error) {
 	return ctx.EncryptWithAuthData(plaintext, nil)
@@ -232,29 +466,91 @@ func (ctx *genericEncrypter) Encrypt(plaintext []byte) (*JsonWebEncryption, erro
 
 // Implementation of encrypt method producing a JWE object.
 func (ctx *genericEncrypter) EncryptWithAuthData(plaintext, aad []byte) (*JsonWebEncryption, error) {
+	obj, cek, deferred, err := ctx.newObject(aad)
+	if err != nil {
+		return nil, err
+	}
+
+	if ctx.compressionAlg != NONE {
+		plaintext, err = compress(ctx.compressionAlg, plaintext)
+		if err != nil {
+			return nil, err
+		}
+
+		obj.protected.Zip = ctx.compressionAlg
+	}
+
+	authData := obj.computeAuthData()
+	parts, err := ctx.cipher.encrypt(cek, authData, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	obj.iv = parts.iv
+	obj.ciphertext = parts.ciphertext
+	obj.tag = parts.tag
+
+	for i, wrap := range deferred {
+		if wrap == nil {
+			continue
+		}
+		obj.recipients[i].encryptedKey, err = wrap(obj.tag)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return obj, nil
+}
+
+// Create a JWE object with the headers and encrypted keys for all recipients,
+// and return it along with the content encryption key and the key wrapping
+// functions for recipients which depend on the content tag.
+func (ctx *genericEncrypter) newObject(aad []byte) (*JsonWebEncryption, []byte, []func(tag []byte) ([]byte, error), error) {
 	obj := &JsonWebEncryption{}
-	obj.aad = aad
+	if len(aad) > 0 {
+		// An empty "aad" member is read back as absent when parsing, so
+		// treat empty data as absent to begin with.
+		obj.aad = aad
+	}
 
 	obj.protected = &rawHeader{
-		Enc: ctx.contentAlg,
+		Enc:  ctx.contentAlg,
+		Typ:  ctx.typ,
+		Cty:  ctx.cty,
+		Crit: ctx.critical,
+	}
+	obj.protected.merge(&rawHeader{Extra: ctx.extra})
+
+	err := checkCriticalNames(obj.protected)
+	if err != nil {
+		return nil, nil, nil, err
 	}
 	obj.recipients = make([]recipientInfo, len(ctx.recipients))
 
 	if len(ctx.recipients) == 0 {
-		return nil, fmt.Errorf("square/go-jose: no recipients to encrypt to")
+		return nil, nil, nil, fmt.Errorf("square/go-jose: no recipients to encrypt to")
 	}
 
 	cek, headers, err := ctx.keyGenerator.genKey()
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
 	obj.protected.merge(&headers)
 
+	// Key wrapping functions for recipients which depend on the content tag
+	deferred := make([]func(tag []byte) ([]byte, error), len(ctx.recipients))
+
 	for i, info := range ctx.recipients {
-		recipient, err := info.keyEncrypter.encryptKey(cek, info.keyAlg)
+		var recipient recipientInfo
+		if encrypter, ok := info.keyEncrypter.(deferredKeyEncrypter); ok {
+			recipient, deferred[i], err = encrypter.encryptKeyDeferred(cek, info.keyAlg)
+		} else {
+			recipient, err = info.keyEncrypter.encryptKey(cek, info.keyAlg)
+		}
 		if err != nil {
-			return nil, err
+			return nil, nil, nil, err
 		}
 
 		recipient.header.Alg = string(info.keyAlg)
@@ -271,50 +567,117 @@ func (ctx *genericEncrypter) EncryptWithAuthData(plaintext, aad []byte) (*JsonWe
 		obj.recipients[0].header = nil
 	}
 
-	if ctx.compressionAlg != NONE {
-		plaintext, err = compress(ctx.compressionAlg, plaintext)
-		if err != nil {
-			return nil, err
-		}
+	return obj, cek, deferred, nil
+}
 
-		obj.protected.Zip = ctx.compressionAlg
+// Decrypt and validate the object and return the plaintext. Note that this
+// function does not support multi-recipient, if you desire multi-recipient
+// decryption use DecryptMulti instead. If the key is a JWK with a key ID, the
+// recipient must have a matching (or absent) "kid" header, as in DecryptMulti.
+// If the key is a JsonWebKeySet, the candidate keys for the recipient are
+// tried in turn.
+func (obj JsonWebEncryption) Decrypt(decryptionKey interface{}) ([]byte, error) {
+	if len(obj.recipients) > 1 {
+		return nil, errors.New("square/go-jose: too many recipients in payload; expecting only one")
 	}
 
-	authData := obj.computeAuthData()
-	parts, err := ctx.cipher.encrypt(cek, authData, plaintext)
+	_, _, _, plaintext, err := obj.decryptRecipients(decryptionKey)
 	if err != nil {
 		return nil, err
 	}
 
-	obj.iv = parts.iv
-	obj.ciphertext = parts.ciphertext
-	obj.tag = parts.tag
+	return obj.decompress(plaintext)
+}
 
-	return obj, nil
+// DecryptMulti decrypts and validates the object and returns the plaintexts,
+// with support for multiple recipients. It returns the index of the recipient
+// for which the decryption was successful, the merged headers for that recipient,
+// and the plaintext. If the key is a JWK with a key ID, only recipients with a
+// matching (or absent) "kid" header are considered. If the key is a
+// JsonWebKeySet, the candidate keys for each recipient are tried in turn. If
+// no recipient can be decrypted, ErrPBES2CountTooLow or ErrPBES2CountTooHigh
+// is returned if a recipient was rejected for its iteration count, and
+// ErrCryptoFailure otherwise, unless the key can't be used for any recipient.
+func (obj JsonWebEncryption) DecryptMulti(decryptionKey interface{}) (int, JoseHeader, []byte, error) {
+	index, headers, _, plaintext, err := obj.decryptRecipients(decryptionKey)
+	if err != nil {
+		return -1, JoseHeader{}, nil, err
+	}
+
+	plaintext, err = obj.decompress(plaintext)
+	return index, headers.sanitized(), plaintext, err
 }
 
-// Decrypt and validate the object and return the plaintext. Note that this
-// function does not support multi-recipient, if you desire multi-recipient
-// decryption use DecryptMulti instead.
-func (obj JsonWebEncryption) Decrypt(decryptionKey interface{}) ([]byte, error) {
-	headers := obj.mergedHeaders(nil)
+// CanDecrypt checks whether the object can be decrypted with the given key,
+// i.e. that the key unwraps the content encryption key for one of the
+// recipients and that the authentication tag is valid. The plaintext is
+// discarded (and not decompressed). This is useful to scan stored objects for
+// ones encrypted to keys which are no longer in use.
+func (obj JsonWebEncryption) CanDecrypt(decryptionKey interface{}) bool {
+	_, _, _, _, err := obj.decryptRecipients(decryptionKey)
+	return err == nil
+}
 
-	if len(obj.recipients) > 1 {
-		return nil, errors.New("square/go-jose: too many recipients in payload; expecting only one")
+// DecryptWithResolver decrypts and validates the object and returns the
+// plaintext, resolving the decryption key for each recipient lazily. For each
+// recipient the resolver is called with the merged headers for that recipient
+// (so it can inspect e.g. the key ID or algorithm) and should return the key to
+// attempt decryption with, or nil to skip the recipient. The key is used as in
+// DecryptMulti, e.g. it may be a JsonWebKeySet. An error returned by the
+// resolver aborts decryption. It returns the index of the recipient for which
+// the decryption was successful, the merged headers for that recipient, and
+// the plaintext.
+func (obj JsonWebEncryption) DecryptWithResolver(resolve func(header JoseHeader) (interface{}, error)) (int, JoseHeader, []byte, error) {
+	index, headers, _, plaintext, err := obj.decryptRecipientsWith(func(headers rawHeader) ([]keyDecrypter, error) {
+		key, err := resolve(headers.sanitized())
+		if err != nil || key == nil {
+			return nil, err
+		}
+		return obj.keyDecrypters(key, headers)
+	})
+	if err != nil {
+		return -1, JoseHeader{}, nil, err
 	}
 
-	if len(headers.Crit) > 0 {
-		return nil, fmt.Errorf("square/go-jose: unsupported crit header")
+	plaintext, err = obj.decompress(plaintext)
+	return index, headers.sanitized(), plaintext, err
+}
+
+// Decompress the plaintext of the object if it has a "zip" header, up to the
+// size limit of the options it was parsed with.
+func (obj JsonWebEncryption) decompress(plaintext []byte) ([]byte, error) {
+	// The "zip" header parameter may only be present in the protected header.
+	if obj.protected == nil || obj.protected.Zip == "" {
+		return plaintext, nil
 	}
 
-	decrypter, err := newDecrypter(decryptionKey)
-	if err != nil {
-		return nil, err
+	return decompress(obj.protected.Zip, plaintext, obj.opts.maxDecompressedSize())
+}
+
+// Decrypt the content for the first recipient that works with the given key,
+// returning its index and headers along with the content encryption key and
+// the (still compressed) plaintext.
+func (obj JsonWebEncryption) decryptRecipients(decryptionKey interface{}) (int, rawHeader, []byte, []byte, error) {
+	return obj.decryptRecipientsWith(func(headers rawHeader) ([]keyDecrypter, error) {
+		return obj.keyDecrypters(decryptionKey, headers)
+	})
+}
+
+// Decrypt the content for the first recipient that works with one of the key
+// decrypters returned for it by resolve (see keyDecrypters), returning its
+// index and headers along with the content encryption key and the (still
+// compressed) plaintext. This is the loop shared by all ways of decrypting an
+// object; an error returned by resolve aborts decryption.
+func (obj JsonWebEncryption) decryptRecipientsWith(resolve func(headers rawHeader) ([]keyDecrypter, error)) (int, rawHeader, []byte, []byte, error) {
+	globalHeaders := obj.mergedHeaders(nil)
+
+	if len(globalHeaders.Crit) > 0 && !obj.critUnderstood {
+		return -1, rawHeader{}, nil, nil, fmt.Errorf("square/go-jose: unsupported crit header")
 	}
 
-	cipher := getContentCipher(headers.Enc)
+	cipher := getContentCipher(globalHeaders.Enc)
 	if cipher == nil {
-		return nil, fmt.Errorf("square/go-jose: unsupported enc value '%s'", string(headers.Enc))
+		return -1, rawHeader{}, nil, nil, fmt.Errorf("square/go-jose: unsupported enc value '%s'", string(globalHeaders.Enc))
 	}
 
 	generator := randomKeyGenerator{
@@ -329,88 +692,171 @@ func (obj JsonWebEncryption) Decrypt(decryptionKey interface{}) ([]byte, error)
 
 	authData := obj.computeAuthData()
 
-	var plaintext []byte
-	recipient := obj.recipients[0]
-	recipientHeaders := obj.mergedHeaders(&recipient)
+	var lastErr error
+	for i, recipient := range obj.recipients {
+		recipientHeaders := obj.mergedHeaders(&recipient)
 
-	cek, err := decrypter.decryptKey(recipientHeaders, &recipient, generator)
-	if err == nil {
-		// Found a valid CEK -- let's try to decrypt.
-		plaintext, err = cipher.decrypt(cek, authData, parts)
-	}
+		decrypters, err := resolve(recipientHeaders)
+		if err != nil {
+			return -1, rawHeader{}, nil, nil, err
+		}
 
-	if plaintext == nil {
-		return nil, ErrCryptoFailure
+		for _, decrypter := range decrypters {
+			cek, err := decrypter.decryptKey(recipientHeaders, &recipient, generator)
+			if err == nil {
+				// Found a valid CEK -- let's try to decrypt.
+				var plaintext []byte
+				plaintext, err = cipher.decrypt(cek, authData, parts)
+				if err == nil {
+					return i, recipientHeaders, cek, plaintext, nil
+				}
+			}
+			lastErr = decryptError(lastErr, err)
+		}
 	}
 
-	// The "zip" header parameter may only be present in the protected header.
-	if obj.protected.Zip != "" {
-		plaintext, err = decompress(obj.protected.Zip, plaintext)
+	if lastErr == nil {
+		lastErr = ErrCryptoFailure
 	}
-
-	return plaintext, err
+	return -1, rawHeader{}, nil, nil, lastErr
 }
 
-// DecryptMulti decrypts and validates the object and returns the plaintexts,
-// with support for multiple recipients. It returns the index of the recipient
-// for which the decryption was successful, the merged headers for that recipient,
-// and the plaintext.
-func (obj JsonWebEncryption) DecryptMulti(decryptionKey interface{}) (int, JoseHeader, []byte, error) {
-	globalHeaders := obj.mergedHeaders(nil)
+// keyDecrypters returns the key decrypters to try for a recipient with the
+// given headers: none if the key is a JWK with a different key ID, and one for
+// each candidate key if it's a JsonWebKeySet. Keys in a set which can't be
+// used for decryption are skipped.
+func (obj JsonWebEncryption) keyDecrypters(key interface{}, headers rawHeader) ([]keyDecrypter, error) {
+	if set, ok := keySet(key); ok {
+		var decrypters []keyDecrypter
+		for _, candidate := range set.candidates(headers, "enc") {
+			if decrypter, err := obj.newKeyDecrypter(candidate); err == nil {
+				decrypters = append(decrypters, decrypter)
+			}
+		}
+		return decrypters, nil
+	}
 
-	if len(globalHeaders.Crit) > 0 {
-		return -1, JoseHeader{}, nil, fmt.Errorf("square/go-jose: unsupported crit header")
+	if !keyIDMatches(key, headers.Kid) {
+		// Recipient uses a different key
+		return nil, nil
 	}
 
-	decrypter, err := newDecrypter(decryptionKey)
+	decrypter, err := obj.newKeyDecrypter(key)
 	if err != nil {
-		return -1, JoseHeader{}, nil, err
+		return nil, err
 	}
+	return []keyDecrypter{decrypter}, nil
+}
 
-	cipher := getContentCipher(globalHeaders.Enc)
-	if cipher == nil {
-		return -1, JoseHeader{}, nil, fmt.Errorf("square/go-jose: unsupported enc value '%s'", string(globalHeaders.Enc))
+// decryptError chooses the error to return when no recipient of an object
+// could be decrypted, given the error so far and the error for another
+// attempt. Errors from unwrapping the key or authenticating the content are
+// all reported as ErrCryptoFailure, so as not to give an oracle. A PBES2
+// iteration count outside the accepted bounds is reported over any other
+// error, and ErrCryptoFailure over a key which can't be used for a recipient.
+func decryptError(current, err error) error {
+	rank := func(err error) int {
+		switch err {
+		case nil:
+			return 0
+		case ErrInvalidKeySize, ErrUnsupportedAlgorithm:
+			return 1
+		case ErrPBES2CountTooLow, ErrPBES2CountTooHigh:
+			return 3
+		default:
+			return 2
+		}
 	}
 
-	generator := randomKeyGenerator{
-		size: cipher.keySize(),
+	if rank(err) == 2 {
+		err = ErrCryptoFailure
 	}
-
-	parts := &aeadParts{
-		iv:         obj.iv,
-		ciphertext: obj.ciphertext,
-		tag:        obj.tag,
+	if rank(err) > rank(current) {
+		return err
 	}
+	return current
+}
 
-	authData := obj.computeAuthData()
-
-	index := -1
-	var plaintext []byte
-	var headers rawHeader
+// AddRecipient grants access to the object to another key, without decrypting
+// and re-encrypting the content: the content encryption key is unwrapped with
+// the decryption key of an existing recipient, and wrapped for the new key
+// with the given key management algorithm. The content is authenticated to
+// check that the unwrapped key is correct. This is only possible if the
+// headers of the new recipient don't clash with the headers shared by all
+// recipients; in particular, objects with a single recipient usually carry
+// its "alg" header in the (integrity protected) shared header, e.g. all
+// objects in compact serialization. Direct key agreement and encryption
+// algorithms can't be used for the new recipient, as with MultiEncrypter.
+func (obj *JsonWebEncryption) AddRecipient(decryptionKey interface{}, alg KeyAlgorithm, encryptionKey interface{}) error {
+	_, _, cek, _, err := obj.decryptRecipients(decryptionKey)
+	if err != nil {
+		return err
+	}
 
-	for i, recipient := range obj.recipients {
-		recipientHeaders := obj.mergedHeaders(&recipient)
+	encrypter := &genericEncrypter{
+		contentAlg: obj.mergedHeaders(nil).Enc,
+	}
+	err = encrypter.AddRecipient(alg, encryptionKey)
+	if err != nil {
+		return err
+	}
+	info := encrypter.recipients[0]
 
-		cek, err := decrypter.decryptKey(recipientHeaders, &recipient, generator)
+	var recipient recipientInfo
+	if keyEncrypter, ok := info.keyEncrypter.(deferredKeyEncrypter); ok {
+		var wrap func(tag []byte) ([]byte, error)
+		recipient, wrap, err = keyEncrypter.encryptKeyDeferred(cek, info.keyAlg)
 		if err == nil {
-			// Found a valid CEK -- let's try to decrypt.
-			plaintext, err = cipher.decrypt(cek, authData, parts)
-			if err == nil {
-				index = i
-				headers = recipientHeaders
-				break
-			}
+			recipient.encryptedKey, err = wrap(obj.tag)
 		}
+	} else {
+		recipient, err = info.keyEncrypter.encryptKey(cek, info.keyAlg)
+	}
+	if err != nil {
+		return err
 	}
 
-	if plaintext == nil || err != nil {
-		return -1, JoseHeader{}, nil, ErrCryptoFailure
+	recipient.header.Alg = string(info.keyAlg)
+	if info.keyID != "" {
+		recipient.header.Kid = info.keyID
 	}
 
-	// The "zip" header parameter may only be present in the protected header.
-	if obj.protected.Zip != "" {
-		plaintext, err = decompress(obj.protected.Zip, plaintext)
+	// Header parameter names must be disjoint (RFC 7516 section 7.2.1).
+	shared := map[string]interface{}{}
+	err = json.Unmarshal(mustSerializeJSON(obj.mergedHeaders(nil)), &shared)
+	if err != nil {
+		return err
+	}
+	var added map[string]interface{}
+	err = json.Unmarshal(mustSerializeJSON(recipient.header), &added)
+	if err != nil {
+		return err
+	}
+	for name := range added {
+		if _, ok := shared[name]; ok {
+			return fmt.Errorf("square/go-jose: header parameter '%s' is shared by all recipients, can't add recipient", name)
+		}
 	}
 
-	return index, headers.sanitized(), plaintext, err
+	obj.recipients = append(obj.recipients, recipient)
+	obj.compact = false
+	obj.original = nil
+	return nil
+}
+
+// RemoveRecipient removes the recipient with the given index from the object,
+// e.g. to replace a recipient with one added by AddRecipient. The index of
+// the recipient for a key can be found with DecryptMulti. The last recipient
+// can't be removed.
+func (obj *JsonWebEncryption) RemoveRecipient(index int) error {
+	if index < 0 || index >= len(obj.recipients) {
+		return errors.New("square/go-jose: recipient index out of range")
+	}
+	if len(obj.recipients) == 1 {
+		return errors.New("square/go-jose: can't remove the only recipient")
+	}
+
+	obj.recipients = append(obj.recipients[:index:index], obj.recipients[index+1:]...)
+	obj.original = nil
+	return nil
 }
@@ -18,13 +18,24 @@ package jose
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/hpke"
+	"crypto/mlkem"
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/square/go-jose/json"
 )
 
 // We generate only a single RSA and EC key for testing, speeds up tests.
@@ -84,8 +95,8 @@ func TestRoundtripsJWE(t *testing.T) {
 	// Test matrix
 	keyAlgs := []KeyAlgorithm{
 		DIRECT, ECDH_ES, ECDH_ES_A128KW, ECDH_ES_A192KW, ECDH_ES_A256KW, A128KW, A192KW, A256KW,
-		RSA1_5, RSA_OAEP, RSA_OAEP_256, A128GCMKW, A192GCMKW, A256GCMKW}
-	encAlgs := []ContentEncryption{A128GCM, A192GCM, A256GCM, A128CBC_HS256, A192CBC_HS384, A256CBC_HS512}
+		RSA1_5, RSA_OAEP, RSA_OAEP_256, RSA_OAEP_384, RSA_OAEP_512, A128GCMKW, A192GCMKW, A256GCMKW}
+	encAlgs := []ContentEncryption{A128GCM, A192GCM, A256GCM, A128CBC_HS256, A192CBC_HS384, A256CBC_HS512, C20P, XC20P}
 	zipAlgs := []CompressionAlgorithm{NONE, DEFLATE}
 
 	serializers := []func(*JsonWebEncryption) (string, error){
@@ -121,7 +132,7 @@ func TestRoundtripsJWE(t *testing.T) {
 func TestRoundtripsJWECorrupted(t *testing.T) {
 	// Test matrix
 	keyAlgs := []KeyAlgorithm{DIRECT, ECDH_ES, ECDH_ES_A128KW, A128KW, RSA1_5, RSA_OAEP, RSA_OAEP_256, A128GCMKW}
-	encAlgs := []ContentEncryption{A128GCM, A192GCM, A256GCM, A128CBC_HS256, A192CBC_HS384, A256CBC_HS512}
+	encAlgs := []ContentEncryption{A128GCM, A192GCM, A256GCM, A128CBC_HS256, A192CBC_HS384, A256CBC_HS512, C20P, XC20P}
 	zipAlgs := []CompressionAlgorithm{NONE, DEFLATE}
 
 	serializers := []func(*JsonWebEncryption) (string, error){
@@ -185,6 +196,186 @@ func TestRoundtripsJWECorrupted(t *testing.T) {
 	}
 }
 
+func TestEmptyPlaintextJWE(t *testing.T) {
+	key := make([]byte, 32)
+	for _, enc := range []ContentEncryption{A256GCM, A256CBC_HS512} {
+		encrypter, err := NewEncrypter(A256KW, enc, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		obj, err := encrypter.Encrypt([]byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// CBC still needs a full block of padding, GCM produces no ciphertext
+		ciphertextLen := 0
+		if enc == A256CBC_HS512 {
+			ciphertextLen = 16
+		}
+		if len(obj.ciphertext)+len(obj.tag) < ciphertextLen+16 {
+			t.Errorf("unexpected ciphertext/tag size for %s: %d/%d", enc, len(obj.ciphertext), len(obj.tag))
+		}
+
+		msg, err := obj.CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := ParseEncrypted(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		plaintext, err := parsed.Decrypt(key)
+		if err != nil || len(plaintext) != 0 {
+			t.Errorf("failed to decrypt empty plaintext with %s: %v", enc, err)
+		}
+
+		_, _, plaintext, err = parsed.DecryptMulti(key)
+		if err != nil || len(plaintext) != 0 {
+			t.Errorf("failed to decrypt empty plaintext with %s: %v", enc, err)
+		}
+
+		// The tag must still authenticate
+		parsed.tag[0] ^= 1
+		if _, err := parsed.Decrypt(key); err == nil {
+			t.Errorf("should not decrypt empty plaintext with corrupted tag (%s)", enc)
+		}
+	}
+}
+
+func TestCanDecrypt(t *testing.T) {
+	enc, err := NewMultiEncrypter(A128GCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = enc.AddRecipient(RSA_OAEP, &rsaTestKey.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = enc.AddRecipient(A128KW, []byte("0123456789abcdef")); err != nil {
+		t.Fatal(err)
+	}
+	enc.SetCompression(DEFLATE)
+
+	obj, err := enc.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !obj.CanDecrypt(rsaTestKey) || !obj.CanDecrypt([]byte("0123456789abcdef")) {
+		t.Error("should be able to decrypt with recipient keys")
+	}
+	if obj.CanDecrypt([]byte("fedcba9876543210")) || obj.CanDecrypt(ecTestKey256) {
+		t.Error("should not be able to decrypt with other keys")
+	}
+
+	// The tag is verified
+	obj.tag[0] ^= 1
+	if obj.CanDecrypt(rsaTestKey) {
+		t.Error("should not be able to decrypt with corrupted tag")
+	}
+}
+
+func TestDecryptCompressionLimit(t *testing.T) {
+	enc, err := NewEncrypter(A128KW, A128GCM, []byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.SetCompression(DEFLATE)
+
+	// Highly compressible plaintext, inflating to 100 times its compressed size
+	input := make([]byte, 1<<20)
+	obj, err := enc.Encrypt(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(obj.ciphertext) > len(input)/100 {
+		t.Fatal("expected plaintext to be compressed")
+	}
+
+	output, err := obj.Decrypt([]byte("0123456789abcdef"))
+	if err != nil || !bytes.Equal(input, output) {
+		t.Error("should decrypt plaintext within the limit", err)
+	}
+
+	serialized, _ := obj.CompactSerialize()
+	obj, err = ParseEncryptedWithOptions(serialized, ParseOptions{MaxDecompressedSize: 1 << 19})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := obj.Decrypt([]byte("0123456789abcdef")); err != ErrDecompressedSizeTooLarge {
+		t.Error("should reject plaintext over the limit", err)
+	}
+	if _, _, _, err := obj.DecryptMulti([]byte("0123456789abcdef")); err != ErrDecompressedSizeTooLarge {
+		t.Error("should reject plaintext over the limit", err)
+	}
+	_, _, _, err = obj.DecryptWithResolver(func(JoseHeader) (interface{}, error) {
+		return []byte("0123456789abcdef"), nil
+	})
+	if err != ErrDecompressedSizeTooLarge {
+		t.Error("should reject plaintext over the limit", err)
+	}
+
+	obj, err = ParseEncryptedWithOptions(serialized, ParseOptions{MaxDecompressedSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := obj.Decrypt([]byte("0123456789abcdef")); err != nil {
+		t.Error("should decrypt plaintext within the configured limit", err)
+	}
+}
+
+func TestEncrypterContentKey(t *testing.T) {
+	cek := fromHexBytes("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	iv := fromHexBytes("000102030405060708090a0b")
+
+	encrypt := func() *JsonWebEncryption {
+		randReader = bytes.NewReader(iv)
+		defer resetRandReader()
+
+		enc, err := NewEncrypter(DIRECT, A256GCM, make([]byte, 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := enc.SetContentKey(cek); err != nil {
+			t.Fatal(err)
+		}
+		obj, err := enc.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return obj
+	}
+
+	first, second := encrypt(), encrypt()
+	if !bytes.Equal(first.ciphertext, second.ciphertext) || !bytes.Equal(first.tag, second.tag) {
+		t.Error("fixed content key and IV should yield reproducible ciphertext")
+	}
+
+	plaintext, err := first.Decrypt(cek)
+	if err != nil || string(plaintext) != "Lorem ipsum dolor sit amet" {
+		t.Error("failed to decrypt with content key:", err)
+	}
+
+	enc, err := NewEncrypter(DIRECT, A256GCM, cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.SetContentKey(cek[:16]); err != ErrInvalidKeySize {
+		t.Error("should reject content key of wrong size, got:", err)
+	}
+
+	enc, err = NewEncrypter(A256KW, A256GCM, cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.SetContentKey(cek); err == nil {
+		t.Error("should only allow setting content key in direct mode")
+	}
+}
+
 func TestEncrypterWithJWKAndKeyID(t *testing.T) {
 	enc, err := NewEncrypter(A128KW, A128GCM, &JsonWebKey{
 		KeyID: "test-id",
@@ -210,6 +401,117 @@ func TestEncrypterWithJWKAndKeyID(t *testing.T) {
 	}
 }
 
+func TestDecryptKeyIDSelection(t *testing.T) {
+	key1 := JsonWebKey{Key: []byte("0123456789abcdef"), KeyID: "key1"}
+	key2 := JsonWebKey{Key: []byte("0123456789abcdef"), KeyID: "key2"}
+
+	// Key given by value, its key ID is emitted in the recipient header
+	enc, err := NewEncrypter(A128KW, A128GCM, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := enc.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err = ParseEncrypted(obj.FullSerialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Header.KeyID != "key1" {
+		t.Error("unexpected kid in header", obj.Header.KeyID)
+	}
+
+	if _, _, _, err := obj.DecryptMulti(key1); err != nil {
+		t.Error("should decrypt with matching key ID", err)
+	}
+	if _, _, _, err := obj.DecryptMulti(&key2); err != ErrCryptoFailure {
+		t.Error("should not decrypt with different key ID", err)
+	}
+	if _, _, _, err := obj.DecryptMulti(key2.Key); err != nil {
+		t.Error("should decrypt with raw key", err)
+	}
+
+	// Single recipient decryption selects keys the same way
+	if _, err := obj.Decrypt(key1); err != nil {
+		t.Error("should decrypt with matching key ID", err)
+	}
+	if _, err := obj.Decrypt(&key2); err != ErrCryptoFailure {
+		t.Error("should not decrypt with different key ID", err)
+	}
+	if _, err := obj.Decrypt(key2.Key); err != nil {
+		t.Error("should decrypt with raw key", err)
+	}
+}
+
+func TestDecryptWithKeySet(t *testing.T) {
+	rsaKey := JsonWebKey{Key: rsaTestKey, KeyID: "rsa"}
+	symKey := JsonWebKey{Key: []byte("0123456789abcdef"), KeyID: "sym"}
+
+	enc, err := NewMultiEncrypter(A128GCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = enc.AddRecipient(RSA_OAEP, &JsonWebKey{Key: &rsaTestKey.PublicKey, KeyID: "rsa"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = enc.AddRecipient(A128KW, symKey); err != nil {
+		t.Fatal(err)
+	}
+	input := []byte("Lorem ipsum dolor sit amet")
+	obj, err := enc.Encrypt(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err = ParseEncrypted(obj.FullSerialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys with a different key ID, algorithm or use are skipped
+	decoy := JsonWebKey{Key: []byte("fedcba9876543210"), KeyID: "sym"}
+	wrongAlg := symKey
+	wrongAlg.Algorithm = string(A256KW)
+	wrongUse := symKey
+	wrongUse.Use = "sig"
+
+	set := JsonWebKeySet{Keys: []JsonWebKey{decoy, wrongAlg, symKey}}
+	index, header, output, err := obj.DecryptMulti(set)
+	if err != nil {
+		t.Fatal("error on decrypt with key set:", err)
+	}
+	if index != 1 || header.KeyID != "sym" || !bytes.Equal(input, output) {
+		t.Errorf("expected recipient 1, got %d with %v", index, header)
+	}
+
+	index, header, _, err = obj.DecryptMulti(&JsonWebKeySet{Keys: []JsonWebKey{symKey, rsaKey}})
+	if err != nil || index != 0 || header.KeyID != "rsa" {
+		t.Errorf("expected recipient 0, got %d with %v (%v)", index, header, err)
+	}
+
+	for _, keys := range [][]JsonWebKey{nil, {decoy}, {wrongAlg, wrongUse}} {
+		if _, _, _, err := obj.DecryptMulti(&JsonWebKeySet{Keys: keys}); err != ErrCryptoFailure {
+			t.Error("should not decrypt without a matching key", err)
+		}
+	}
+
+	// Single recipient
+	singleEnc, err := NewEncrypter(A128KW, A128GCM, symKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	single, err := singleEnc.Encrypt(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output, err := single.Decrypt(&set); err != nil || !bytes.Equal(input, output) {
+		t.Error("unable to decrypt with key set", err)
+	}
+	if _, err := obj.Decrypt(&set); err == nil {
+		t.Error("should not decrypt multiple recipients with Decrypt")
+	}
+}
+
 func TestEncrypterWithBrokenRand(t *testing.T) {
 	keyAlgs := []KeyAlgorithm{ECDH_ES_A128KW, A128KW, RSA1_5, RSA_OAEP, RSA_OAEP_256, A128GCMKW}
 	encAlgs := []ContentEncryption{A128GCM, A192GCM, A256GCM, A128CBC_HS256, A192CBC_HS384, A256CBC_HS512}
@@ -242,6 +544,499 @@ func TestEncrypterWithBrokenRand(t *testing.T) {
 	}
 }
 
+func TestMultiRecipientECDH(t *testing.T) {
+	enc, err := NewMultiEncrypter(A128CBC_HS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.AddRecipient(ECDH_ES_A128KW, &ecTestKey256.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.AddRecipient(ECDH_ES_A256KW, &ecTestKey384.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+
+	input := []byte("Lorem ipsum dolor sit amet")
+	obj, err := enc.Encrypt(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseEncrypted(obj.FullSerialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each recipient gets its own ephemeral key, in its per-recipient header.
+	if parsed.protected.Epk != nil {
+		t.Error("epk should not be in the shared protected header")
+	}
+	for i, recipient := range parsed.recipients {
+		if recipient.header == nil || recipient.header.Epk == nil {
+			t.Fatal("missing epk in header of recipient", i)
+		}
+	}
+
+	for i, key := range []interface{}{ecTestKey256, ecTestKey384} {
+		index, _, output, err := parsed.DecryptMulti(key)
+		if err != nil {
+			t.Fatal("error on decrypt: ", err)
+		}
+		if index != i {
+			t.Errorf("recipient index should be %d, was %d", i, index)
+		}
+		if !bytes.Equal(input, output) {
+			t.Error("Decrypted output does not match input", output, input)
+		}
+	}
+}
+
+func TestECDH1PURoundtrip(t *testing.T) {
+	encryptionKey := &ECDH1PUEncryptionKey{
+		SenderKey:    ecdh1PUAliceKey,
+		SenderKeyID:  "alice",
+		RecipientKey: &ecdh1PUBobKey.PublicKey,
+	}
+	decryptionKey := &ECDH1PUDecryptionKey{
+		RecipientKey: ecdh1PUBobKey,
+		SenderKey:    &ecdh1PUAliceKey.PublicKey,
+	}
+
+	input := []byte("Lorem ipsum dolor sit amet")
+
+	for _, alg := range []KeyAlgorithm{ECDH_1PU, ECDH_1PU_A128KW, ECDH_1PU_A192KW, ECDH_1PU_A256KW} {
+		enc, err := NewEncrypter(alg, A128CBC_HS256, encryptionKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		obj, err := enc.Encrypt(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		serialized, err := obj.CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := ParseEncrypted(serialized)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.Header.SenderKeyID != "alice" {
+			t.Error("expected skid header for", alg)
+		}
+
+		output, err := parsed.Decrypt(decryptionKey)
+		if err != nil {
+			t.Error("unable to decrypt", alg, err)
+		} else if !bytes.Equal(input, output) {
+			t.Error("decrypted output does not match input for", alg)
+		}
+
+		// The message must only decrypt with the expected sender key
+		_, err = parsed.Decrypt(&ECDH1PUDecryptionKey{
+			RecipientKey: ecdh1PUBobKey,
+			SenderKey:    &ecTestKey256.PublicKey,
+		})
+		if err == nil {
+			t.Error("should not decrypt with wrong sender key for", alg)
+		}
+	}
+
+	// Key wrapping modes require AES-CBC-HMAC content encryption
+	if _, err := NewEncrypter(ECDH_1PU_A128KW, A128GCM, encryptionKey); err == nil {
+		t.Error("should not accept ECDH-1PU+A128KW with AES-GCM")
+	}
+
+	// Sender and recipient keys must be on the same curve
+	_, err := NewEncrypter(ECDH_1PU, A128GCM, &ECDH1PUEncryptionKey{
+		SenderKey:    ecTestKey384,
+		RecipientKey: &ecdh1PUBobKey.PublicKey,
+	})
+	if err == nil {
+		t.Error("should not accept sender and recipient keys on different curves")
+	}
+}
+
+func TestMultiRecipientECDH1PU(t *testing.T) {
+	carolKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc, err := NewMultiEncrypter(A256CBC_HS512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.AddRecipient(ECDH_1PU, &ECDH1PUEncryptionKey{SenderKey: ecdh1PUAliceKey, RecipientKey: &ecdh1PUBobKey.PublicKey}); err == nil {
+		t.Error("should not accept direct ECDH-1PU in multi-recipient mode")
+	}
+	for _, recipient := range []*ecdsa.PublicKey{&ecdh1PUBobKey.PublicKey, &carolKey.PublicKey} {
+		err := enc.AddRecipient(ECDH_1PU_A256KW, &ECDH1PUEncryptionKey{
+			SenderKey:    ecdh1PUAliceKey,
+			RecipientKey: recipient,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	input := []byte("Lorem ipsum dolor sit amet")
+	obj, err := enc.Encrypt(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseEncrypted(obj.FullSerialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, key := range []*ecdsa.PrivateKey{ecdh1PUBobKey, carolKey} {
+		index, _, output, err := parsed.DecryptMulti(&ECDH1PUDecryptionKey{
+			RecipientKey: key,
+			SenderKey:    &ecdh1PUAliceKey.PublicKey,
+		})
+		if err != nil {
+			t.Fatal("error on decrypt: ", err)
+		}
+		if index != i {
+			t.Errorf("recipient index should be %d, was %d", i, index)
+		}
+		if !bytes.Equal(input, output) {
+			t.Error("Decrypted output does not match input", output, input)
+		}
+	}
+}
+
+func TestHPKE(t *testing.T) {
+	curves := map[KeyAlgorithm]ecdh.Curve{
+		HPKE_0_KE: ecdh.P256(),
+		HPKE_1_KE: ecdh.P384(),
+		HPKE_2_KE: ecdh.P521(),
+		HPKE_3_KE: ecdh.X25519(),
+		HPKE_4_KE: ecdh.X25519(),
+	}
+
+	input := []byte("Lorem ipsum dolor sit amet")
+
+	for alg, curve := range curves {
+		key, err := curve.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		enc, err := NewEncrypter(alg, A256GCM, key.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		obj, err := enc.Encrypt(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		serialized, err := obj.CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := ParseEncrypted(serialized)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.protected.Ek == nil {
+			t.Error("missing ek header for", alg)
+		}
+
+		output, err := parsed.Decrypt(key)
+		if err != nil {
+			t.Error("unable to decrypt", alg, err)
+		} else if !bytes.Equal(input, output) {
+			t.Error("decrypted output does not match input for", alg)
+		}
+
+		// Corrupted encrypted key
+		parsed.recipients[0].encryptedKey[0] ^= 1
+		if _, err := parsed.Decrypt(key); err != ErrCryptoFailure {
+			t.Error("should not decrypt corrupted encrypted key for", alg, err)
+		}
+	}
+
+	// Key must be on the curve of the algorithm
+	x25519Key, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	if _, err := NewEncrypter(HPKE_0_KE, A128GCM, x25519Key.PublicKey()); err == nil {
+		t.Error("should not accept HPKE-0-KE with X25519 key")
+	}
+	if _, err := NewEncrypter(ECDH_ES_A128KW, A128GCM, x25519Key.PublicKey()); err != ErrUnsupportedAlgorithm {
+		t.Error("should not accept X25519 key for ECDH-ES", err)
+	}
+
+	// An HPKE key can't decrypt messages using classic algorithms, which is
+	// reported as an unsupported algorithm rather than a crypto failure.
+	enc, err := NewEncrypter(RSA_OAEP, A128GCM, &rsaTestKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := enc.Encrypt(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := obj.Decrypt(x25519Key); err != ErrUnsupportedAlgorithm {
+		t.Error("expected unsupported algorithm error, got", err)
+	}
+}
+
+func TestHPKERecipientStructure(t *testing.T) {
+	// Recipient_structure from draft-ietf-jose-hpke-encrypt for enc A128GCM
+	expected := []byte("JOSE-HPKE rcpt\xffA128GCM\xff")
+	if info := hpkeRecipientInfo(A128GCM); !bytes.Equal(info, expected) {
+		t.Errorf("unexpected HPKE info %x, expected %x", info, expected)
+	}
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := []byte("Lorem ipsum dolor sit amet")
+
+	// An object built with HPKE directly, as specified in the draft, can be
+	// decrypted.
+	pk, err := hpke.NewDHKEMPublicKey(key.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek, sender, err := hpke.NewSender(pk, hpke.HKDFSHA256(), hpke.AES128GCM(), expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cek := make([]byte, 16)
+	_, _ = io.ReadFull(rand.Reader, cek)
+	encryptedKey, err := sender.Seal(nil, cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	protected := base64URLEncode([]byte(`{"alg":"HPKE-3-KE","enc":"A128GCM","ek":"` + base64URLEncode(ek) + `"}`))
+	block, _ := aes.NewCipher(cek)
+	aead, _ := cipher.NewGCM(block)
+	iv := make([]byte, aead.NonceSize())
+	_, _ = io.ReadFull(rand.Reader, iv)
+	sealed := aead.Seal(nil, iv, input, []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-aead.Overhead()], sealed[len(sealed)-aead.Overhead():]
+
+	obj, err := ParseEncrypted(strings.Join([]string{
+		protected,
+		base64URLEncode(encryptedKey),
+		base64URLEncode(iv),
+		base64URLEncode(ciphertext),
+		base64URLEncode(tag),
+	}, "."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := obj.Decrypt(key)
+	if err != nil {
+		t.Error("unable to decrypt object built from draft", err)
+	} else if !bytes.Equal(input, output) {
+		t.Error("decrypted output does not match input")
+	}
+
+	// The encrypted key of an object we produce can be opened with the
+	// Recipient_structure, and only with the structure for its enc.
+	enc, err := NewEncrypter(HPKE_3_KE, A128GCM, key.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err = enc.Encrypt(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk, err := hpke.NewDHKEMPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range [][]byte{expected, hpkeRecipientInfo(A256GCM), nil} {
+		recipient, err := hpke.NewRecipient(obj.protected.Ek.bytes(), sk, hpke.HKDFSHA256(), hpke.AES128GCM(), info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = recipient.Open(nil, obj.recipients[0].encryptedKey)
+		if bytes.Equal(info, expected) && err != nil {
+			t.Error("unable to open encrypted key with Recipient_structure", err)
+		} else if !bytes.Equal(info, expected) && err == nil {
+			t.Errorf("encrypted key should not open with info %x", info)
+		}
+	}
+}
+
+func TestMultiRecipientHPKE(t *testing.T) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc, err := NewMultiEncrypter(A128GCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.AddRecipient(RSA_OAEP, &rsaTestKey.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.AddRecipient(HPKE_4_KE, key.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	input := []byte("Lorem ipsum dolor sit amet")
+	obj, err := enc.Encrypt(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseEncrypted(obj.FullSerialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, key := range []interface{}{rsaTestKey, key} {
+		index, _, output, err := parsed.DecryptMulti(key)
+		if err != nil {
+			t.Fatal("error on decrypt: ", err)
+		}
+		if index != i {
+			t.Errorf("recipient index should be %d, was %d", i, index)
+		}
+		if !bytes.Equal(input, output) {
+			t.Error("Decrypted output does not match input", output, input)
+		}
+	}
+}
+
+func TestMLKEM(t *testing.T) {
+	key768, _ := mlkem.GenerateKey768()
+	key1024, _ := mlkem.GenerateKey1024()
+
+	keys := map[KeyAlgorithm][2]interface{}{
+		ML_KEM_768:         {key768.EncapsulationKey(), key768},
+		ML_KEM_768_A192KW:  {key768.EncapsulationKey(), key768},
+		ML_KEM_1024:        {key1024.EncapsulationKey(), key1024},
+		ML_KEM_1024_A256KW: {key1024.EncapsulationKey(), key1024},
+	}
+
+	input := []byte("Lorem ipsum dolor sit amet")
+
+	for alg, pair := range keys {
+		for _, contentAlg := range []ContentEncryption{A128GCM, A256CBC_HS512} {
+			enc, err := NewEncrypter(alg, contentAlg, pair[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			obj, err := enc.Encrypt(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			serialized, err := obj.CompactSerialize()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			parsed, err := ParseEncrypted(serialized)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.protected.Ek == nil {
+				t.Error("missing ek header for", alg)
+			}
+
+			output, err := parsed.Decrypt(pair[1])
+			if err != nil {
+				t.Error("unable to decrypt", alg, contentAlg, err)
+			} else if !bytes.Equal(input, output) {
+				t.Error("decrypted output does not match input for", alg, contentAlg)
+			}
+
+			// Corrupted ciphertext in ek header
+			parsed.protected.Ek.data[0] ^= 1
+			if _, err := parsed.Decrypt(pair[1]); err != ErrCryptoFailure {
+				t.Error("should not decrypt corrupted ek header for", alg, err)
+			}
+		}
+	}
+
+	// Key must match the parameter set of the algorithm
+	if _, err := NewEncrypter(ML_KEM_1024, A128GCM, key768.EncapsulationKey()); err == nil {
+		t.Error("should not accept ML-KEM-1024 with ML-KEM-768 key")
+	}
+	if _, err := NewEncrypter(ML_KEM_768_A192KW, A128GCM, key1024.EncapsulationKey()); err == nil {
+		t.Error("should not accept ML-KEM-768+A192KW with ML-KEM-1024 key")
+	}
+	if _, err := NewEncrypter(ML_KEM_768, A128GCM, &rsaTestKey.PublicKey); err != ErrUnsupportedAlgorithm {
+		t.Error("should not accept RSA key for ML-KEM", err)
+	}
+
+	// A message for ML-KEM-1024 can't be decrypted with an ML-KEM-768 key
+	enc, err := NewEncrypter(ML_KEM_1024, A128GCM, key1024.EncapsulationKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := enc.Encrypt(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := obj.Decrypt(key768); err == nil {
+		t.Error("should not decrypt ML-KEM-1024 message with ML-KEM-768 key")
+	}
+}
+
+func TestMultiRecipientMLKEM(t *testing.T) {
+	key, err := mlkem.GenerateKey768()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc, err := NewMultiEncrypter(A128GCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.AddRecipient(ML_KEM_768, key.EncapsulationKey()); err == nil {
+		t.Error("should not accept direct ML-KEM in multi-recipient mode")
+	}
+	if err := enc.AddRecipient(RSA_OAEP, &rsaTestKey.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.AddRecipient(ML_KEM_768_A192KW, key.EncapsulationKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	input := []byte("Lorem ipsum dolor sit amet")
+	obj, err := enc.Encrypt(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseEncrypted(obj.FullSerialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, key := range []interface{}{rsaTestKey, key} {
+		index, _, output, err := parsed.DecryptMulti(key)
+		if err != nil {
+			t.Fatal("error on decrypt: ", err)
+		}
+		if index != i {
+			t.Errorf("recipient index should be %d, was %d", i, index)
+		}
+		if !bytes.Equal(input, output) {
+			t.Error("Decrypted output does not match input", output, input)
+		}
+	}
+}
+
 func TestNewEncrypterErrors(t *testing.T) {
 	_, err := NewEncrypter("XYZ", "XYZ", nil)
 	if err == nil {
@@ -282,74 +1077,224 @@ func TestMultiRecipientJWE(t *testing.T) {
 
 	err = enc.AddRecipient(A256GCMKW, sharedKey)
 	if err != nil {
-		t.Fatal("error when adding AES recipient: ", err)
+		t.Fatal("error when adding AES recipient: ", err)
+	}
+
+	input := []byte("Lorem ipsum dolor sit amet")
+	obj, err := enc.Encrypt(input)
+	if err != nil {
+		t.Fatal("error in encrypt: ", err)
+	}
+
+	msg := obj.FullSerialize()
+
+	parsed, err := ParseEncrypted(msg)
+	if err != nil {
+		t.Fatal("error in parse: ", err)
+	}
+
+	i, _, output, err := parsed.DecryptMulti(rsaTestKey)
+	if err != nil {
+		t.Fatal("error on decrypt with RSA: ", err)
+	}
+
+	if i != 0 {
+		t.Fatal("recipient index should be 0 for RSA key")
+	}
+
+	if bytes.Compare(input, output) != 0 {
+		t.Fatal("Decrypted output does not match input: ", output, input)
+	}
+
+	i, _, output, err = parsed.DecryptMulti(sharedKey)
+	if err != nil {
+		t.Fatal("error on decrypt with AES: ", err)
+	}
+
+	if i != 1 {
+		t.Fatal("recipient index should be 1 for shared key")
+	}
+
+	if bytes.Compare(input, output) != 0 {
+		t.Fatal("Decrypted output does not match input", output, input)
+	}
+}
+
+func TestMultiRecipientErrors(t *testing.T) {
+	enc, err := NewMultiEncrypter(A128GCM)
+	if err != nil {
+		panic(err)
+	}
+
+	input := []byte("Lorem ipsum dolor sit amet")
+	_, err = enc.Encrypt(input)
+	if err == nil {
+		t.Error("should fail when encrypting to zero recipients")
+	}
+
+	err = enc.AddRecipient(DIRECT, nil)
+	if err == nil {
+		t.Error("should reject DIRECT mode when encrypting to multiple recipients")
+	}
+
+	err = enc.AddRecipient(ECDH_ES, nil)
+	if err == nil {
+		t.Error("should reject ECDH_ES mode when encrypting to multiple recipients")
+	}
+
+	err = enc.AddRecipient(RSA1_5, nil)
+	if err == nil {
+		t.Error("should reject invalid recipient key")
+	}
+}
+
+func TestDecryptWithResolver(t *testing.T) {
+	key1 := []byte("0123456789ABCDEF")
+	key2 := []byte("FEDCBA9876543210")
+
+	enc, err := NewMultiEncrypter(A128GCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = enc.AddRecipient(A128KW, &JsonWebKey{KeyID: "key-1", Key: key1}); err != nil {
+		t.Fatal(err)
+	}
+	if err = enc.AddRecipient(A128KW, &JsonWebKey{KeyID: "key-2", Key: key2}); err != nil {
+		t.Fatal(err)
 	}
 
 	input := []byte("Lorem ipsum dolor sit amet")
 	obj, err := enc.Encrypt(input)
 	if err != nil {
-		t.Fatal("error in encrypt: ", err)
+		t.Fatal(err)
 	}
 
-	msg := obj.FullSerialize()
-
-	parsed, err := ParseEncrypted(msg)
+	parsed, err := ParseEncrypted(obj.FullSerialize())
 	if err != nil {
-		t.Fatal("error in parse: ", err)
+		t.Fatal(err)
 	}
 
-	i, _, output, err := parsed.DecryptMulti(rsaTestKey)
+	var seen []string
+	i, header, output, err := parsed.DecryptWithResolver(func(header JoseHeader) (interface{}, error) {
+		seen = append(seen, header.KeyID)
+		if header.KeyID == "key-2" {
+			return key2, nil
+		}
+		return nil, nil
+	})
 	if err != nil {
-		t.Fatal("error on decrypt with RSA: ", err)
+		t.Fatal("error on decrypt with resolver:", err)
 	}
-
-	if i != 0 {
-		t.Fatal("recipient index should be 0 for RSA key")
+	if i != 1 || header.KeyID != "key-2" {
+		t.Errorf("expected recipient 1 with kid 'key-2', got %d with kid '%s'", i, header.KeyID)
+	}
+	if !bytes.Equal(input, output) {
+		t.Error("decrypted output does not match input")
+	}
+	if len(seen) != 2 || seen[0] != "key-1" || seen[1] != "key-2" {
+		t.Errorf("resolver called with unexpected headers: %v", seen)
 	}
 
-	if bytes.Compare(input, output) != 0 {
-		t.Fatal("Decrypted output does not match input: ", output, input)
+	// Resolver never returns a key
+	_, _, _, err = parsed.DecryptWithResolver(func(header JoseHeader) (interface{}, error) {
+		return nil, nil
+	})
+	if err != ErrCryptoFailure {
+		t.Error("should fail when resolver returns no keys")
 	}
 
-	i, _, output, err = parsed.DecryptMulti(sharedKey)
+	// Resolver returns the same key for every recipient
+	_, _, _, err = parsed.DecryptWithResolver(func(header JoseHeader) (interface{}, error) {
+		return key1, nil
+	})
 	if err != nil {
-		t.Fatal("error on decrypt with AES: ", err)
+		t.Error("should decrypt when resolver returns key for first recipient", err)
 	}
 
-	if i != 1 {
-		t.Fatal("recipient index should be 1 for shared key")
+	// Resolver errors are propagated
+	resolverErr := errors.New("resolver failure")
+	_, _, _, err = parsed.DecryptWithResolver(func(header JoseHeader) (interface{}, error) {
+		return nil, resolverErr
+	})
+	if err != resolverErr {
+		t.Error("should propagate resolver error")
 	}
 
-	if bytes.Compare(input, output) != 0 {
-		t.Fatal("Decrypted output does not match input", output, input)
+	// Keys from the resolver are selected as in DecryptMulti: JWKs must
+	// match the key ID of the recipient, and key sets are supported.
+	i, _, _, err = parsed.DecryptWithResolver(func(header JoseHeader) (interface{}, error) {
+		return &JsonWebKey{KeyID: "key-2", Key: key2}, nil
+	})
+	if err != nil || i != 1 {
+		t.Error("should skip recipients with a different key ID", i, err)
+	}
+	set := JsonWebKeySet{Keys: []JsonWebKey{{KeyID: "key-1", Key: key2}, {KeyID: "key-2", Key: key2}}}
+	i, _, _, err = parsed.DecryptWithResolver(func(header JoseHeader) (interface{}, error) {
+		return set, nil
+	})
+	if err != nil || i != 1 {
+		t.Error("should decrypt with key set from resolver", i, err)
 	}
 }
 
-func TestMultiRecipientErrors(t *testing.T) {
+func TestCustomRecipientHeaders(t *testing.T) {
+	key := []byte("0123456789ABCDEF")
+
 	enc, err := NewMultiEncrypter(A128GCM)
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
+	}
+	if err = enc.AddRecipient(A128KW, key); err != nil {
+		t.Fatal(err)
+	}
+	if err = enc.AddRecipient(A128KW, key); err != nil {
+		t.Fatal(err)
 	}
 
 	input := []byte("Lorem ipsum dolor sit amet")
-	_, err = enc.Encrypt(input)
-	if err == nil {
-		t.Error("should fail when encrypting to zero recipients")
+	obj, err := enc.Encrypt(input)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	err = enc.AddRecipient(DIRECT, nil)
-	if err == nil {
-		t.Error("should reject DIRECT mode when encrypting to multiple recipients")
+	// Add an application-specific routing token to the second recipient.
+	var raw map[string]interface{}
+	if err = json.Unmarshal([]byte(obj.FullSerialize()), &raw); err != nil {
+		t.Fatal(err)
+	}
+	recipient := raw["recipients"].([]interface{})[1].(map[string]interface{})
+	recipient["header"].(map[string]interface{})["svt"] = "route-42"
+	msg, err := json.Marshal(raw)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	err = enc.AddRecipient(ECDH_ES, nil)
-	if err == nil {
-		t.Error("should reject ECDH_ES mode when encrypting to multiple recipients")
+	parsed, err := ParseEncrypted(string(msg))
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	err = enc.AddRecipient(RSA1_5, nil)
-	if err == nil {
-		t.Error("should reject invalid recipient key")
+	if parsed.recipients[0].header.Extra["svt"] != nil {
+		t.Error("custom header should only be present on second recipient")
+	}
+	if parsed.recipients[1].header.Extra["svt"] != "route-42" {
+		t.Error("custom header did not survive parsing")
+	}
+
+	i, header, output, err := parsed.DecryptWithResolver(func(header JoseHeader) (interface{}, error) {
+		if header.ExtraHeaders["svt"] == "route-42" {
+			return key, nil
+		}
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal("error on decrypt with resolver:", err)
+	}
+	if i != 1 || header.ExtraHeaders["svt"] != "route-42" {
+		t.Errorf("expected recipient 1 with custom header, got %d with %v", i, header.ExtraHeaders)
+	}
+	if !bytes.Equal(input, output) {
+		t.Error("decrypted output does not match input")
 	}
 }
 
@@ -401,7 +1346,7 @@ func generateTestKeys(keyAlg KeyAlgorithm, encAlg ContentEncryption) []testKey {
 		return symmetricTestKey(24)
 	case A256GCMKW, A256KW:
 		return symmetricTestKey(32)
-	case RSA1_5, RSA_OAEP, RSA_OAEP_256:
+	case RSA1_5, RSA_OAEP, RSA_OAEP_256, RSA_OAEP_384, RSA_OAEP_512:
 		return []testKey{testKey{
 			dec: rsaTestKey,
 			enc: &rsaTestKey.PublicKey,
@@ -437,19 +1382,19 @@ var (
 		"64MB": make([]byte, 67108864),
 	}
 
-	symKey, _, _ = randomKeyGenerator{size: 32}.genKey()
+	symKey, _, _ = randomKeyGenerator{size: 64}.genKey()
 
 	encrypters = map[string]Encrypter{
 		"OAEPAndGCM":          mustEncrypter(RSA_OAEP, A128GCM, &rsaTestKey.PublicKey),
 		"PKCSAndGCM":          mustEncrypter(RSA1_5, A128GCM, &rsaTestKey.PublicKey),
 		"OAEPAndCBC":          mustEncrypter(RSA_OAEP, A128CBC_HS256, &rsaTestKey.PublicKey),
 		"PKCSAndCBC":          mustEncrypter(RSA1_5, A128CBC_HS256, &rsaTestKey.PublicKey),
-		"DirectGCM128":        mustEncrypter(DIRECT, A128GCM, symKey),
-		"DirectCBC128":        mustEncrypter(DIRECT, A128CBC_HS256, symKey),
-		"DirectGCM256":        mustEncrypter(DIRECT, A256GCM, symKey),
+		"DirectGCM128":        mustEncrypter(DIRECT, A128GCM, symKey[:16]),
+		"DirectCBC128":        mustEncrypter(DIRECT, A128CBC_HS256, symKey[:32]),
+		"DirectGCM256":        mustEncrypter(DIRECT, A256GCM, symKey[:32]),
 		"DirectCBC256":        mustEncrypter(DIRECT, A256CBC_HS512, symKey),
-		"AESKWAndGCM128":      mustEncrypter(A128KW, A128GCM, symKey),
-		"AESKWAndCBC256":      mustEncrypter(A256KW, A256GCM, symKey),
+		"AESKWAndGCM128":      mustEncrypter(A128KW, A128GCM, symKey[:16]),
+		"AESKWAndCBC256":      mustEncrypter(A256KW, A256GCM, symKey[:32]),
 		"ECDHOnP256AndGCM128": mustEncrypter(ECDH_ES, A128GCM, &ecTestKey256.PublicKey),
 		"ECDHOnP384AndGCM128": mustEncrypter(ECDH_ES, A128GCM, &ecTestKey384.PublicKey),
 		"ECDHOnP521AndGCM128": mustEncrypter(ECDH_ES, A128GCM, &ecTestKey521.PublicKey),
@@ -607,13 +1552,13 @@ var (
 		"OAEPAndCBC": rsaTestKey,
 		"PKCSAndCBC": rsaTestKey,
 
-		"DirectGCM128": symKey,
-		"DirectCBC128": symKey,
-		"DirectGCM256": symKey,
+		"DirectGCM128": symKey[:16],
+		"DirectCBC128": symKey[:32],
+		"DirectGCM256": symKey[:32],
 		"DirectCBC256": symKey,
 
-		"AESKWAndGCM128": symKey,
-		"AESKWAndCBC256": symKey,
+		"AESKWAndGCM128": symKey[:16],
+		"AESKWAndCBC256": symKey[:32],
 
 		"ECDHOnP256AndGCM128": ecTestKey256,
 		"ECDHOnP384AndGCM128": ecTestKey384,
@@ -783,3 +1728,452 @@ func mustEncrypter(keyAlg KeyAlgorithm, encAlg ContentEncryption, encryptionKey
 	}
 	return enc
 }
+
+func TestEncrypterType(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	enc, err := NewEncrypter(A128KW, A128GCM, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.SetType("application/secevent+jwt")
+	enc.SetContentType("JWT")
+
+	obj, err := enc.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := obj.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseEncrypted(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parsed.Decrypt(key); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := parsed.Header.CheckType("secevent+jwt"); err != nil {
+		t.Error("typ should match:", err)
+	}
+	if parsed.Header.ContentType != "JWT" {
+		t.Error("cty should match:", parsed.Header.ContentType)
+	}
+}
+
+func TestCriticalExtensionsJWE(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	enc, err := NewMultiEncrypter(A128GCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.AddRecipient(A128KW, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.SetExtraHeader("ppt", "shaken"); err != nil {
+		t.Fatal(err)
+	}
+	enc.SetCriticalExtensions([]string{"ppt"})
+
+	obj, err := enc.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := obj.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseEncryptedWithOptions(msg, ParseOptions{UnderstoodExtensions: []string{"ppt"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := parsed.DecryptMulti(key); err != nil {
+		t.Error("understood critical header should decrypt:", err)
+	}
+	if parsed.Header.ExtraHeaders["ppt"] != "shaken" {
+		t.Error("critical header should be in the protected header")
+	}
+
+	if _, err := ParseEncryptedWithOptions(msg, ParseOptions{UnderstoodExtensions: []string{"other"}}); err == nil {
+		t.Error("should reject critical header not understood")
+	}
+	parsed, err = ParseEncrypted(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parsed.Decrypt(key); err == nil {
+		t.Error("should not decrypt without understanding critical header")
+	}
+
+	enc.SetCriticalExtensions([]string{"epk"})
+	if _, err := enc.Encrypt([]byte("Lorem ipsum dolor sit amet")); err == nil {
+		t.Error("should reject registered header marked as critical")
+	}
+}
+
+func TestPBES2(t *testing.T) {
+	password := []byte("Thus from my lips, by yours, my sin is purged.")
+	input := []byte("Lorem ipsum dolor sit amet")
+
+	for _, alg := range []KeyAlgorithm{PBES2_HS256_A128KW, PBES2_HS384_A192KW, PBES2_HS512_A256KW} {
+		enc, err := NewEncrypter(alg, A128CBC_HS256, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := enc.SetPBES2Count(4096); err != nil {
+			t.Fatal(err)
+		}
+		obj, err := enc.Encrypt(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := obj.CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := ParseEncrypted(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.protected.P2c != 4096 || len(parsed.protected.P2s.bytes()) != 16 {
+			t.Error("expected p2s and p2c headers", alg)
+		}
+
+		output, err := parsed.Decrypt(password)
+		if err != nil || !bytes.Equal(output, input) {
+			t.Error("failed to decrypt with password", alg, err)
+		}
+		if _, err := parsed.Decrypt([]byte("wrong password")); err != ErrCryptoFailure {
+			t.Error("should not decrypt with wrong password", alg, err)
+		}
+	}
+}
+
+func TestPBES2CountLimits(t *testing.T) {
+	password := []byte("password")
+
+	encrypt := func(count int, opts ParseOptions) *JsonWebEncryption {
+		enc, err := NewEncrypter(PBES2_HS256_A128KW, A128GCM, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := enc.SetPBES2Count(count); err != nil {
+			t.Fatal(err)
+		}
+		obj, err := enc.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		serialized, _ := obj.CompactSerialize()
+		obj, err = ParseEncryptedWithOptions(serialized, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return obj
+	}
+
+	if _, err := encrypt(DefaultMinPBES2Count, ParseOptions{}).Decrypt(password); err != nil {
+		t.Error("should accept p2c at default minimum:", err)
+	}
+
+	opts := ParseOptions{MinPBES2Count: 2000}
+	if _, err := encrypt(1999, opts).Decrypt(password); err != ErrPBES2CountTooLow {
+		t.Error("expected error for p2c below minimum, got", err)
+	}
+	if _, err := encrypt(2000, opts).Decrypt(password); err != nil {
+		t.Error("should accept p2c at minimum:", err)
+	}
+
+	// Lower the maximum rather than running a huge number of iterations.
+	opts = ParseOptions{MaxPBES2Count: 2000}
+	if _, err := encrypt(2001, opts).Decrypt(password); err != ErrPBES2CountTooHigh {
+		t.Error("expected error for p2c above maximum, got", err)
+	}
+
+	enc, err := NewEncrypter(PBES2_HS256_A128KW, A128GCM, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.SetPBES2Count(DefaultMinPBES2Count - 1); err == nil {
+		t.Error("should not set p2c below default minimum")
+	}
+}
+
+func TestPBES2CountLimitsMulti(t *testing.T) {
+	password := []byte("password")
+
+	enc, err := NewMultiEncrypter(A128GCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.SetPBES2Count(2001); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.AddRecipient(RSA_OAEP, &rsaTestKey.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.AddRecipient(PBES2_HS256_A128KW, password); err != nil {
+		t.Fatal(err)
+	}
+	obj, err := enc.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseEncryptedWithOptions(obj.FullSerialize(), ParseOptions{MaxPBES2Count: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The count error is reported, rather than a generic crypto failure, for
+	// all ways of decrypting the object.
+	set := JsonWebKeySet{Keys: []JsonWebKey{{Key: password}}}
+	for _, key := range []interface{}{password, &JsonWebKey{Key: password}, set} {
+		if _, _, _, err := parsed.DecryptMulti(key); err != ErrPBES2CountTooHigh {
+			t.Errorf("expected error for p2c above maximum with %T, got %v", key, err)
+		}
+		_, _, _, err := parsed.DecryptWithResolver(func(JoseHeader) (interface{}, error) {
+			return key, nil
+		})
+		if err != ErrPBES2CountTooHigh {
+			t.Errorf("expected error for p2c above maximum with resolver and %T, got %v", key, err)
+		}
+		if parsed.CanDecrypt(key) {
+			t.Errorf("should not decrypt with p2c above maximum with %T", key)
+		}
+	}
+
+	// Other recipients can still be decrypted
+	if index, _, _, err := parsed.DecryptMulti(rsaTestKey); err != nil || index != 0 {
+		t.Error("unable to decrypt other recipient", index, err)
+	}
+
+	parsed, err = ParseEncrypted(obj.FullSerialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index, _, _, err := parsed.DecryptMulti(set); err != nil || index != 1 {
+		t.Error("should decrypt with p2c within bounds", index, err)
+	}
+}
+
+func TestPBES2RecipientLimit(t *testing.T) {
+	// Many PBES2 recipients with the highest accepted count would each cost a
+	// full key derivation on decrypt, so such messages are rejected up front.
+	recipient := `{"header":{"alg":"PBES2-HS256+A128KW","p2s":"` + base64URLEncode(make([]byte, 16)) +
+		`","p2c":` + strconv.Itoa(DefaultMaxPBES2Count) + `},"encrypted_key":"` + base64URLEncode(make([]byte, 24)) + `"}`
+	recipients := make([]string, 100)
+	for i := range recipients {
+		recipients[i] = recipient
+	}
+	msg := `{"protected":"` + base64URLEncode([]byte(`{"enc":"A128GCM"}`)) + `","recipients":[` + strings.Join(recipients, ",") +
+		`],"iv":"` + base64URLEncode(make([]byte, 12)) + `","ciphertext":"AA","tag":"` + base64URLEncode(make([]byte, 16)) + `"}`
+
+	for _, opts := range []ParseOptions{{}, {MaxPBES2Recipients: 2}} {
+		start := time.Now()
+		if _, err := ParseEncryptedWithOptions(msg, opts); err == nil {
+			t.Errorf("should reject message with many PBES2 recipients with %+v", opts)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Error("rejecting PBES2 recipients should not derive keys, took", elapsed)
+		}
+	}
+
+	// More PBES2 recipients can be allowed explicitly.
+	enc, err := NewMultiEncrypter(A128GCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.SetPBES2Count(DefaultMinPBES2Count); err != nil {
+		t.Fatal(err)
+	}
+	for _, password := range []string{"password 1", "password 2"} {
+		if err := enc.AddRecipient(PBES2_HS256_A128KW, []byte(password)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	obj, err := enc.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseEncrypted(obj.FullSerialize()); err == nil {
+		t.Error("should reject two PBES2 recipients by default")
+	}
+	parsed, err := ParseEncryptedWithOptions(obj.FullSerialize(), ParseOptions{MaxPBES2Recipients: 2})
+	if err != nil {
+		t.Fatal("should accept two PBES2 recipients when allowed:", err)
+	}
+	if index, _, _, err := parsed.DecryptMulti([]byte("password 2")); err != nil || index != 1 {
+		t.Error("unable to decrypt second PBES2 recipient", index, err)
+	}
+}
+
+func TestAddRecipientToObject(t *testing.T) {
+	aesKey := []byte("0123456789abcdef")
+	input := []byte("Lorem ipsum dolor sit amet")
+
+	enc, err := NewMultiEncrypter(A128CBC_HS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = enc.AddRecipient(A128KW, &JsonWebKey{Key: aesKey, KeyID: "aes"})
+	_ = enc.AddRecipient(RSA_OAEP, &rsaTestKey.PublicKey)
+	obj, err := enc.EncryptWithAuthData(input, []byte("aad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := obj.ciphertext
+
+	// Granting access doesn't require re-encrypting
+	for _, tc := range []struct {
+		alg           KeyAlgorithm
+		encryptionKey interface{}
+		decryptionKey interface{}
+	}{
+		{ECDH_ES_A128KW, &ecTestKey256.PublicKey, ecTestKey256},
+		{ECDH_1PU_A128KW, &ECDH1PUEncryptionKey{SenderKey: ecTestKey384, RecipientKey: &ecTestKey384.PublicKey}, &ECDH1PUDecryptionKey{RecipientKey: ecTestKey384, SenderKey: &ecTestKey384.PublicKey}},
+	} {
+		if err := obj.AddRecipient(rsaTestKey, tc.alg, tc.encryptionKey); err != nil {
+			t.Fatal(tc.alg, err)
+		}
+		if !bytes.Equal(obj.ciphertext, ciphertext) {
+			t.Error("ciphertext should be unchanged")
+		}
+
+		parsed, err := ParseEncrypted(obj.FullSerialize())
+		if err != nil {
+			t.Fatal(tc.alg, err)
+		}
+		index, _, output, err := parsed.DecryptMulti(tc.decryptionKey)
+		if err != nil || !bytes.Equal(output, input) {
+			t.Error(tc.alg, "unable to decrypt for new recipient", err)
+		}
+		if index != len(obj.recipients)-1 {
+			t.Error(tc.alg, "new recipient should be last, got", index)
+		}
+	}
+
+	// Replace the first recipient
+	if err := obj.RemoveRecipient(0); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseEncrypted(obj.FullSerialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := parsed.DecryptMulti(aesKey); err == nil {
+		t.Error("removed recipient should not decrypt")
+	}
+	if _, _, _, err := parsed.DecryptMulti(rsaTestKey); err != nil {
+		t.Error("remaining recipient should decrypt", err)
+	}
+
+	// The only remaining recipient uses RSA, which the AES key can't decrypt
+	if err := obj.AddRecipient(aesKey, A128KW, aesKey); err != ErrUnsupportedAlgorithm {
+		t.Error("should fail without a valid decryption key", err)
+	}
+	if err := obj.AddRecipient(rsaTestKey, DIRECT, aesKey); err == nil {
+		t.Error("should reject direct encryption")
+	}
+	if err := obj.RemoveRecipient(len(obj.recipients)); err == nil {
+		t.Error("should reject index out of range")
+	}
+	for len(obj.recipients) > 1 {
+		_ = obj.RemoveRecipient(0)
+	}
+	if err := obj.RemoveRecipient(0); err == nil {
+		t.Error("should not remove the only recipient")
+	}
+
+	// A parsed object is no longer in its parsed format once modified.
+	obj, err = enc.EncryptWithAuthData(input, []byte("aad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err = ParseEncrypted(obj.FullSerialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format := parsed.SerializationFormat(); format != FullGeneral {
+		t.Error("expected general format after parsing, got", format)
+	}
+	if err := parsed.AddRecipient(rsaTestKey, ECDH_ES_A128KW, &ecTestKey256.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	if format := parsed.SerializationFormat(); format != Unparsed {
+		t.Error("expected no serialization format after adding a recipient, got", format)
+	}
+	reparsed, err := ParseEncrypted(parsed.FullSerializeOriginal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, output, err := reparsed.DecryptMulti(ecTestKey256); err != nil || !bytes.Equal(output, input) {
+		t.Error("unable to decrypt for recipient added to parsed object", err)
+	}
+
+	parsed, err = ParseEncrypted(obj.FullSerialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parsed.RemoveRecipient(0); err != nil {
+		t.Fatal(err)
+	}
+	if format := parsed.SerializationFormat(); format != Unparsed {
+		t.Error("expected no serialization format after removing a recipient, got", format)
+	}
+
+	// The alg header of a single recipient is in the protected header
+	single, _ := NewEncrypter(A128KW, A128GCM, aesKey)
+	obj, _ = single.Encrypt(input)
+	if err := obj.AddRecipient(aesKey, RSA_OAEP, &rsaTestKey.PublicKey); err == nil {
+		t.Error("should reject recipient with header clashing with shared headers")
+	}
+}
+
+func TestMultiRecipientAuthData(t *testing.T) {
+	aesKey := []byte("0123456789abcdef")
+	input := []byte("Lorem ipsum dolor sit amet")
+
+	for _, aad := range [][]byte{nil, {}, []byte("aad"), make([]byte, 1000)} {
+		enc, err := NewMultiEncrypter(A128GCM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = enc.AddRecipient(A128KW, aesKey)
+		_ = enc.AddRecipient(RSA_OAEP, &rsaTestKey.PublicKey)
+		_ = enc.AddRecipient(ECDH_ES_A128KW, &ecTestKey256.PublicKey)
+
+		obj, err := enc.EncryptWithAuthData(input, aad)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := ParseEncrypted(obj.FullSerialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(parsed.GetAuthData(), aad) {
+			t.Error("auth data should be preserved", aad)
+		}
+
+		for _, key := range []interface{}{aesKey, rsaTestKey, ecTestKey256} {
+			_, _, output, err := parsed.DecryptMulti(key)
+			if err != nil || !bytes.Equal(output, input) {
+				t.Error("unable to decrypt with auth data", aad, err)
+			}
+		}
+
+		// The auth data is authenticated
+		if len(aad) > 0 {
+			parsed.aad[0] ^= 1
+			if _, _, _, err := parsed.DecryptMulti(aesKey); err == nil {
+				t.Error("should reject modified auth data")
+			}
+		}
+	}
+}
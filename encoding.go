@@ -21,6 +21,7 @@ import (
 	"compress/flate"
 	"encoding/base64"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"math/big"
 	"regexp"
@@ -31,6 +32,13 @@ import (
 
 var stripWhitespaceRegex = regexp.MustCompile("\\s")
 
+// DefaultMaxDecompressedSize is the maximum size of a decompressed plaintext
+// when decrypting a JWE with a "zip" header, unless another limit is set in
+// ParseOptions. Objects which inflate to more than this are rejected with
+// ErrDecompressedSizeTooLarge, so that a small malicious object can't exhaust
+// the memory of the receiver.
+const DefaultMaxDecompressedSize = 10 << 20
+
 // Url-safe base64 encode that strips padding
 func base64URLEncode(data []byte) string {
 	var result = base64.URLEncoding.EncodeToString(data)
@@ -44,6 +52,23 @@ func base64URLDecode(data string) ([]byte, error) {
 	return base64.URLEncoding.DecodeString(data)
 }
 
+// Url-safe base64 decoder that decodes into the given buffer, which must be at
+// least base64.RawURLEncoding.DecodedLen(len(data)) bytes long, and returns the
+// number of bytes written. It accepts exactly the same inputs as
+// base64URLDecode, but doesn't allocate.
+func base64URLDecodeInto(dst, data []byte) (int, error) {
+	if bytes.HasSuffix(data, []byte("=")) {
+		// Padding is optional, but it must be correct if present.
+		trimmed := bytes.TrimRight(data, "=")
+		padding := len(data) - len(trimmed) + (4-len(data)%4)%4
+		if padding != (4-len(trimmed)%4)%4 {
+			return 0, base64.CorruptInputError(len(trimmed))
+		}
+		data = trimmed
+	}
+	return base64.RawURLEncoding.Decode(dst, data)
+}
+
 // Helper function to serialize known-good objects.
 // Precondition: value is not a nil pointer.
 func mustSerializeJSON(value interface{}) []byte {
@@ -83,11 +108,11 @@ func compress(algorithm CompressionAlgorithm, input []byte) ([]byte, error) {
 	}
 }
 
-// Perform decompression based on algorithm
-func decompress(algorithm CompressionAlgorithm, input []byte) ([]byte, error) {
+// Perform decompression based on algorithm, up to maxSize bytes
+func decompress(algorithm CompressionAlgorithm, input []byte, maxSize int64) ([]byte, error) {
 	switch algorithm {
 	case DEFLATE:
-		return inflate(input)
+		return inflate(input, maxSize)
 	default:
 		return nil, ErrUnsupportedAlgorithm
 	}
@@ -105,15 +130,18 @@ func deflate(input []byte) ([]byte, error) {
 	return output.Bytes(), err
 }
 
-// Decompress with DEFLATE
-func inflate(input []byte) ([]byte, error) {
+// Decompress with DEFLATE, up to maxSize bytes
+func inflate(input []byte, maxSize int64) ([]byte, error) {
 	output := new(bytes.Buffer)
 	reader := flate.NewReader(bytes.NewBuffer(input))
 
-	_, err := io.Copy(output, reader)
+	n, err := io.Copy(output, io.LimitReader(reader, maxSize+1))
 	if err != nil {
 		return nil, err
 	}
+	if n > maxSize {
+		return nil, ErrDecompressedSizeTooLarge
+	}
 
 	err = reader.Close()
 	return output.Bytes(), err
@@ -122,6 +150,9 @@ func inflate(input []byte) ([]byte, error) {
 // byteBuffer represents a slice of bytes that can be serialized to url-safe base64.
 type byteBuffer struct {
 	data []byte
+
+	// Set if the buffer was parsed from padded base64 data.
+	padded bool
 }
 
 func newBuffer(data []byte) *byteBuffer {
@@ -162,12 +193,15 @@ func (b *byteBuffer) UnmarshalJSON(data []byte) error {
 		return nil
 	}
 
+	// Padding is accepted here, but recorded so that callers can reject it
+	// where padded input is not allowed (see ParseOptions).
 	decoded, err := base64URLDecode(encoded)
 	if err != nil {
 		return err
 	}
 
 	*b = *newBuffer(decoded)
+	b.padded = strings.HasSuffix(encoded, "=")
 
 	return nil
 }
@@ -191,3 +225,40 @@ func (b byteBuffer) bigInt() *big.Int {
 func (b byteBuffer) toInt() int {
 	return int(b.bigInt().Int64())
 }
+
+// limitedArray decodes a JSON array element by element, failing as soon as it
+// has more than max elements, so that a hostile message can't make the parser
+// allocate and decode more elements than the limit. Each element is passed to
+// decode, which reads it from the decoder.
+type limitedArray struct {
+	name   string
+	max    int
+	decode func(dec *json.Decoder) error
+}
+
+func (a *limitedArray) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return nil
+	}
+	if token != json.Delim('[') {
+		return fmt.Errorf("square/go-jose: invalid %s, expected an array", a.name)
+	}
+
+	for n := 0; dec.More(); n++ {
+		if n == a.max {
+			return fmt.Errorf("square/go-jose: too many %s in message, limit is %d", a.name, a.max)
+		}
+		err = a.decode(dec)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = dec.Token()
+	return err
+}
@@ -18,6 +18,7 @@ package jose
 
 import (
 	"bytes"
+	"encoding/base64"
 	"strings"
 	"testing"
 )
@@ -73,6 +74,77 @@ func TestBase64URLDecode(t *testing.T) {
 	}
 }
 
+func TestBase64URLDecodeInto(t *testing.T) {
+	inputs := []string{
+		"", "AA", "AAE", "AAEC", "AAECAw", "_-8", "AA==", "AAE=", "AA=", "AAECAw==",
+		// Invalid input
+		"A", "AAECA", "A===", "AA===", "AAEC=", "AA=A", "AA+/", "AA!", "AA\x00", "=",
+	}
+
+	for _, input := range inputs {
+		expected, expectedErr := base64URLDecode(input)
+
+		dst := make([]byte, base64.RawURLEncoding.DecodedLen(len(input)))
+		n, err := base64URLDecodeInto(dst, []byte(input))
+		if (err != nil) != (expectedErr != nil) {
+			t.Errorf("inconsistent error decoding '%s': %v, expected %v", input, err, expectedErr)
+			continue
+		}
+		if err == nil && !bytes.Equal(dst[:n], expected) {
+			t.Errorf("inconsistent result decoding '%s': %x, expected %x", input, dst[:n], expected)
+		}
+	}
+}
+
+func TestDecodeCompactParts(t *testing.T) {
+	parts := bytes.Split([]byte("AA.AAE.AAEC"), []byte("."))
+	err := ParseOptions{}.decodeCompactParts(parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parts[0], []byte{0}) || !bytes.Equal(parts[1], []byte{0, 1}) || !bytes.Equal(parts[2], []byte{0, 1, 2}) {
+		t.Error("failed to decode compact parts", parts)
+	}
+
+	// Parts must not overlap
+	parts[0] = append(parts[0], 0xff)
+	if !bytes.Equal(parts[1], []byte{0, 1}) {
+		t.Error("appending to a part should not modify the next one")
+	}
+
+	parts = bytes.Split([]byte("AA==.AAE"), []byte("."))
+	if err := (ParseOptions{}).decodeCompactParts(parts); err == nil {
+		t.Error("should reject padded part")
+	}
+	parts = bytes.Split([]byte("AA==.AAE"), []byte("."))
+	if err := (ParseOptions{AllowPaddedBase64: true}).decodeCompactParts(parts); err != nil {
+		t.Error("should accept padded part if allowed:", err)
+	}
+}
+
+func BenchmarkBase64URLDecode(b *testing.B) {
+	input := base64URLEncode(make([]byte, 256))
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := base64URLDecode(input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBase64URLDecodeInto(b *testing.B) {
+	input := []byte(base64URLEncode(make([]byte, 256)))
+	dst := make([]byte, base64.RawURLEncoding.DecodedLen(len(input)))
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := base64URLDecodeInto(dst, input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func TestDeflateRoundtrip(t *testing.T) {
 	original := []byte("Lorem ipsum dolor sit amet")
 
@@ -81,7 +153,7 @@ func TestDeflateRoundtrip(t *testing.T) {
 		panic(err)
 	}
 
-	output, err := inflate(compressed)
+	output, err := inflate(compressed, DefaultMaxDecompressedSize)
 	if err != nil {
 		panic(err)
 	}
@@ -91,18 +163,36 @@ func TestDeflateRoundtrip(t *testing.T) {
 	}
 }
 
+func TestInflateLimit(t *testing.T) {
+	compressed, err := deflate(make([]byte, 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inflate(compressed, 1024); err != nil {
+		t.Error("should inflate data up to the limit", err)
+	}
+
+	compressed, err = deflate(make([]byte, 1025))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inflate(compressed, 1024); err != ErrDecompressedSizeTooLarge {
+		t.Error("should not inflate data over the limit", err)
+	}
+}
+
 func TestInvalidCompression(t *testing.T) {
 	_, err := compress("XYZ", []byte{})
 	if err == nil {
 		t.Error("should not accept invalid algorithm")
 	}
 
-	_, err = decompress("XYZ", []byte{})
+	_, err = decompress("XYZ", []byte{}, DefaultMaxDecompressedSize)
 	if err == nil {
 		t.Error("should not accept invalid algorithm")
 	}
 
-	_, err = decompress(DEFLATE, []byte{1, 2, 3, 4})
+	_, err = decompress(DEFLATE, []byte{1, 2, 3, 4}, DefaultMaxDecompressedSize)
 	if err == nil {
 		t.Error("should not accept invalid data")
 	}
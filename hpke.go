@@ -0,0 +1,160 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jose
+
+import (
+	"crypto/ecdh"
+	"crypto/hpke"
+	"errors"
+	"fmt"
+)
+
+// A key encrypter for HPKE
+type hpkeEncrypter struct {
+	publicKey *ecdh.PublicKey
+	enc       ContentEncryption
+}
+
+// A key decrypter for HPKE
+type hpkeDecrypter struct {
+	privateKey *ecdh.PrivateKey
+}
+
+// Build the HPKE info for key encryption, which binds the content encryption
+// algorithm of the object into the encrypted key. This is the
+// Recipient_structure of draft-ietf-jose-hpke-encrypt, with empty
+// recipient_extra_info:
+//
+//	ASCII("JOSE-HPKE rcpt") || BYTE(255) || ASCII(enc) || BYTE(255)
+func hpkeRecipientInfo(enc ContentEncryption) []byte {
+	info := make([]byte, 0, len("JOSE-HPKE rcpt")+len(enc)+2)
+	info = append(info, "JOSE-HPKE rcpt"...)
+	info = append(info, 0xff)
+	info = append(info, enc...)
+	info = append(info, 0xff)
+	return info
+}
+
+// Get the HPKE cipher suite for the given key management algorithm.
+func hpkeCipherSuite(alg KeyAlgorithm) (ecdh.Curve, hpke.KDF, hpke.AEAD, error) {
+	switch alg {
+	case HPKE_0_KE:
+		return ecdh.P256(), hpke.HKDFSHA256(), hpke.AES128GCM(), nil
+	case HPKE_1_KE:
+		return ecdh.P384(), hpke.HKDFSHA384(), hpke.AES256GCM(), nil
+	case HPKE_2_KE:
+		return ecdh.P521(), hpke.HKDFSHA512(), hpke.AES256GCM(), nil
+	case HPKE_3_KE:
+		return ecdh.X25519(), hpke.HKDFSHA256(), hpke.AES128GCM(), nil
+	case HPKE_4_KE:
+		return ecdh.X25519(), hpke.HKDFSHA256(), hpke.ChaCha20Poly1305(), nil
+	default:
+		return nil, nil, nil, ErrUnsupportedAlgorithm
+	}
+}
+
+// newHPKERecipient creates recipientKeyInfo based on the given key.
+func newHPKERecipient(keyAlg KeyAlgorithm, publicKey *ecdh.PublicKey) (recipientKeyInfo, error) {
+	curve, _, _, err := hpkeCipherSuite(keyAlg)
+	if err != nil {
+		return recipientKeyInfo{}, err
+	}
+
+	if publicKey == nil {
+		return recipientKeyInfo{}, errors.New("invalid public key")
+	}
+	if publicKey.Curve() != curve {
+		return recipientKeyInfo{}, fmt.Errorf("square/go-jose: %s requires a key on curve %s", keyAlg, curve)
+	}
+
+	return recipientKeyInfo{
+		keyAlg: keyAlg,
+		keyEncrypter: &hpkeEncrypter{
+			publicKey: publicKey,
+		},
+	}, nil
+}
+
+// Encrypt the given payload and update the object. The encapsulated key is
+// sent in the "ek" header, the HPKE ciphertext is the encrypted key.
+func (ctx hpkeEncrypter) encryptKey(cek []byte, alg KeyAlgorithm) (recipientInfo, error) {
+	_, kdf, aead, err := hpkeCipherSuite(alg)
+	if err != nil {
+		return recipientInfo{}, err
+	}
+
+	pk, err := hpke.NewDHKEMPublicKey(ctx.publicKey)
+	if err != nil {
+		return recipientInfo{}, err
+	}
+
+	enc, sender, err := hpke.NewSender(pk, kdf, aead, hpkeRecipientInfo(ctx.enc))
+	if err != nil {
+		return recipientInfo{}, err
+	}
+
+	encryptedKey, err := sender.Seal(nil, cek)
+	if err != nil {
+		return recipientInfo{}, err
+	}
+
+	return recipientInfo{
+		encryptedKey: encryptedKey,
+		header: &rawHeader{
+			Ek: newBuffer(enc),
+		},
+	}, nil
+}
+
+// Decrypt the given payload and return the content encryption key. Objects
+// using any other key management algorithm are rejected with
+// ErrUnsupportedAlgorithm, as an HPKE key can't be used to decrypt them.
+func (ctx hpkeDecrypter) decryptKey(headers rawHeader, recipient *recipientInfo, generator keyGenerator) ([]byte, error) {
+	curve, kdf, aead, err := hpkeCipherSuite(KeyAlgorithm(headers.Alg))
+	if err != nil {
+		return nil, err
+	}
+
+	if ctx.privateKey.Curve() != curve {
+		return nil, fmt.Errorf("square/go-jose: %s requires a key on curve %s", headers.Alg, curve)
+	}
+
+	if headers.Ek == nil {
+		return nil, errors.New("square/go-jose: missing ek header")
+	}
+
+	sk, err := hpke.NewDHKEMPrivateKey(ctx.privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	receiver, err := hpke.NewRecipient(headers.Ek.bytes(), sk, kdf, aead, hpkeRecipientInfo(ContentEncryption(headers.Enc)))
+	if err != nil {
+		return nil, err
+	}
+
+	cek, err := receiver.Open(nil, recipient.encryptedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cek) != generator.keySize() {
+		return nil, ErrCryptoFailure
+	}
+
+	return cek, nil
+}
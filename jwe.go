@@ -17,12 +17,23 @@
 package jose
 
 import (
+	"bytes"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/square/go-jose/json"
 )
 
+// DefaultMaxRecipients is the maximum number of recipients accepted when
+// parsing a JWE object in full serialization format, unless another limit is
+// set in ParseOptions. Each recipient may cost a key unwrap operation on
+// decrypt, so messages declaring more recipients than this are rejected to
+// bound the work an attacker can force on the receiver.
+const DefaultMaxRecipients = 250
+
 // rawJsonWebEncryption represents a raw JWE JSON object. Used for parsing/serializing.
 type rawJsonWebEncryption struct {
 	Protected    *byteBuffer        `json:"protected,omitempty"`
@@ -42,6 +53,24 @@ type rawRecipientInfo struct {
 	EncryptedKey string     `json:"encrypted_key,omitempty"`
 }
 
+// SerializationFormat describes the serialization format a JWE object was
+// parsed from.
+type SerializationFormat int
+
+const (
+	// Unparsed indicates that the object was not produced by parsing a message,
+	// e.g. because it was freshly created by an Encrypter.
+	Unparsed SerializationFormat = iota
+	// Compact indicates the compact serialization format.
+	Compact
+	// FullFlattened indicates the flattened variant of the full (JSON)
+	// serialization format, used for messages with a single recipient.
+	FullFlattened
+	// FullGeneral indicates the general variant of the full (JSON)
+	// serialization format, with a "recipients" array.
+	FullGeneral
+)
+
 // JsonWebEncryption represents an encrypted JWE object after parsing.
 type JsonWebEncryption struct {
 	Header                   JoseHeader
@@ -49,6 +78,18 @@ type JsonWebEncryption struct {
 	recipients               []recipientInfo
 	aad, iv, ciphertext, tag []byte
 	original                 *rawJsonWebEncryption
+	compact                  bool
+
+	// The protected header as parsed, which is authenticated as is. It's
+	// kept when the object is modified, unlike original.
+	protectedRaw []byte
+
+	// Set if all critical header parameters were understood while parsing.
+	critUnderstood bool
+
+	// Options the object was parsed with, for the limits applied when
+	// decrypting it.
+	opts ParseOptions
 }
 
 // recipientInfo represents a raw JWE Per-Recipient header JSON object after parsing.
@@ -59,13 +100,84 @@ type recipientInfo struct {
 
 // GetAuthData retrieves the (optional) authenticated data attached to the object.
 func (obj JsonWebEncryption) GetAuthData() []byte {
-	if obj.aad != nil {
-		out := make([]byte, len(obj.aad))
-		copy(out, obj.aad)
-		return out
+	return copyBytes(obj.aad)
+}
+
+// IV retrieves a copy of the initialization vector of the object.
+func (obj JsonWebEncryption) IV() []byte {
+	return copyBytes(obj.iv)
+}
+
+// Ciphertext retrieves a copy of the (still encrypted) ciphertext of the object.
+func (obj JsonWebEncryption) Ciphertext() []byte {
+	return copyBytes(obj.ciphertext)
+}
+
+// Tag retrieves a copy of the authentication tag of the object.
+func (obj JsonWebEncryption) Tag() []byte {
+	return copyBytes(obj.tag)
+}
+
+// EncryptedKeys retrieves a copy of the encrypted key of each recipient of the
+// object, in order. The encrypted key is empty for direct encryption and
+// direct key agreement (dir and ECDH-ES).
+func (obj JsonWebEncryption) EncryptedKeys() [][]byte {
+	keys := make([][]byte, len(obj.recipients))
+	for i, recipient := range obj.recipients {
+		keys[i] = copyBytes(recipient.encryptedKey)
+	}
+	return keys
+}
+
+// AuthenticatedData returns the exact additional authenticated data input to
+// the content cipher, i.e. ASCII(BASE64URL(protected header)), followed by '.'
+// and BASE64URL(aad) if the object carries additional authenticated data (see
+// GetAuthData). This is meant for debugging, auditing and external tooling.
+func (obj JsonWebEncryption) AuthenticatedData() []byte {
+	return obj.computeAuthData()
+}
+
+// Copy a byte slice, so callers can't modify the internal state of an object.
+func copyBytes(in []byte) []byte {
+	if in == nil {
+		return nil
 	}
 
-	return nil
+	out := make([]byte, len(in))
+	copy(out, in)
+	return out
+}
+
+// SerializationFormat returns the serialization format the object was parsed
+// from, or Unparsed once its recipients are changed with AddRecipient or
+// RemoveRecipient. This is purely informational; it does not restrict how the
+// object may be serialized again.
+func (obj JsonWebEncryption) SerializationFormat() SerializationFormat {
+	switch {
+	case obj.original == nil:
+		return Unparsed
+	case obj.compact:
+		return Compact
+	case len(obj.original.Recipients) > 0:
+		return FullGeneral
+	default:
+		return FullFlattened
+	}
+}
+
+// RecipientHeaders returns the headers of each recipient of the object, in
+// order, merging the shared (protected and unprotected) headers with the
+// per-recipient header. Unlike Header, these include per-recipient parameters
+// such as "alg" or "kid" of each recipient, along with any header parameters
+// not understood by this library, so that callers can apply policy before
+// choosing a decryption key. Note that unprotected headers are not
+// authenticated, even once the object has been decrypted.
+func (obj JsonWebEncryption) RecipientHeaders() []JoseHeader {
+	headers := make([]JoseHeader, len(obj.recipients))
+	for i := range obj.recipients {
+		headers[i] = obj.mergedHeaders(&obj.recipients[i]).sanitized()
+	}
+	return headers
 }
 
 // Get the merged header values
@@ -83,15 +195,7 @@ func (obj JsonWebEncryption) mergedHeaders(recipient *recipientInfo) rawHeader {
 
 // Get the additional authenticated data from a JWE object.
 func (obj JsonWebEncryption) computeAuthData() []byte {
-	var protected string
-
-	if obj.original != nil {
-		protected = obj.original.Protected.base64()
-	} else {
-		protected = base64URLEncode(mustSerializeJSON((obj.protected)))
-	}
-
-	output := []byte(protected)
+	output := []byte(base64URLEncode(obj.serializedProtected()))
 	if obj.aad != nil {
 		output = append(output, '.')
 		output = append(output, []byte(base64URLEncode(obj.aad))...)
@@ -100,32 +204,78 @@ func (obj JsonWebEncryption) computeAuthData() []byte {
 	return output
 }
 
+// Get the serialized protected header, preferring the parsed bytes (if any)
+// since the header may contain members not preserved by marshaling.
+func (obj JsonWebEncryption) serializedProtected() []byte {
+	if obj.protectedRaw != nil || obj.protected == nil {
+		return obj.protectedRaw
+	}
+	return mustSerializeJSON(obj.protected)
+}
+
 // ParseEncrypted parses an encrypted message in compact or full serialization format.
 func ParseEncrypted(input string) (*JsonWebEncryption, error) {
-	input = stripWhitespace(input)
-	if strings.HasPrefix(input, "{") {
-		return parseEncryptedFull(input)
+	return ParseEncryptedWithOptions(input, ParseOptions{})
+}
+
+// ParseEncryptedWithOptions parses an encrypted message in compact or full
+// serialization format, using the given (non-default) parse options.
+func ParseEncryptedWithOptions(input string, opts ParseOptions) (*JsonWebEncryption, error) {
+	err := opts.checkInputSize(input)
+	if err != nil {
+		return nil, err
 	}
 
-	return parseEncryptedCompact(input)
+	stripped := stripWhitespace(input)
+	if strings.HasPrefix(stripped, "{") {
+		return parseEncryptedFull(stripped, opts)
+	}
+
+	return parseEncryptedCompact(stripped, opts)
 }
 
 // parseEncryptedFull parses a message in compact format.
-func parseEncryptedFull(input string) (*JsonWebEncryption, error) {
+func parseEncryptedFull(input string, opts ParseOptions) (*JsonWebEncryption, error) {
 	var parsed rawJsonWebEncryption
-	err := json.Unmarshal([]byte(input), &parsed)
+
+	// The recipients are decoded through a limitedArray, which shadows the
+	// field of the embedded raw object.
+	limited := struct {
+		*rawJsonWebEncryption
+		Recipients *limitedArray `json:"recipients,omitempty"`
+	}{
+		rawJsonWebEncryption: &parsed,
+		Recipients: &limitedArray{
+			name: "recipients",
+			max:  opts.maxRecipients(),
+			decode: func(dec *json.Decoder) error {
+				var recipient rawRecipientInfo
+				err := dec.Decode(&recipient)
+				parsed.Recipients = append(parsed.Recipients, recipient)
+				return err
+			},
+		},
+	}
+	err := json.Unmarshal([]byte(input), &limited)
 	if err != nil {
 		return nil, err
 	}
 
-	return parsed.sanitized()
+	return parsed.sanitized(opts)
 }
 
 // sanitized produces a cleaned-up JWE object from the raw JSON.
-func (parsed *rawJsonWebEncryption) sanitized() (*JsonWebEncryption, error) {
+func (parsed *rawJsonWebEncryption) sanitized(opts ParseOptions) (*JsonWebEncryption, error) {
 	obj := &JsonWebEncryption{
-		original:    parsed,
-		unprotected: parsed.Unprotected,
+		original:     parsed,
+		protectedRaw: parsed.Protected.bytes(),
+		unprotected:  parsed.Unprotected,
+		opts:         opts,
+	}
+
+	err := opts.checkPadding(parsed.Protected, parsed.Aad, parsed.EncryptedKey, parsed.Iv, parsed.Ciphertext, parsed.Tag)
+	if err != nil {
+		return nil, err
 	}
 
 	// Check that there is not a nonce in the unprotected headers
@@ -134,6 +284,11 @@ func (parsed *rawJsonWebEncryption) sanitized() (*JsonWebEncryption, error) {
 		return nil, ErrUnprotectedNonce
 	}
 
+	err = opts.checkHeaderSize(parsed.Protected)
+	if err != nil {
+		return nil, err
+	}
+
 	if parsed.Protected != nil && len(parsed.Protected.bytes()) > 0 {
 		err := json.Unmarshal(parsed.Protected.bytes(), &obj.protected)
 		if err != nil {
@@ -155,7 +310,7 @@ func (parsed *rawJsonWebEncryption) sanitized() (*JsonWebEncryption, error) {
 	} else {
 		obj.recipients = make([]recipientInfo, len(parsed.Recipients))
 		for r := range parsed.Recipients {
-			encryptedKey, err := base64URLDecode(parsed.Recipients[r].EncryptedKey)
+			encryptedKey, err := opts.base64URLDecode(parsed.Recipients[r].EncryptedKey)
 			if err != nil {
 				return nil, err
 			}
@@ -170,11 +325,43 @@ func (parsed *rawJsonWebEncryption) sanitized() (*JsonWebEncryption, error) {
 		}
 	}
 
+	pbes2Recipients := 0
 	for _, recipient := range obj.recipients {
 		headers := obj.mergedHeaders(&recipient)
 		if headers.Alg == "" || headers.Enc == "" {
 			return nil, fmt.Errorf("square/go-jose: message is missing alg/enc headers")
 		}
+
+		switch KeyAlgorithm(headers.Alg) {
+		case PBES2_HS256_A128KW, PBES2_HS384_A192KW, PBES2_HS512_A256KW:
+			pbes2Recipients++
+			if pbes2Recipients > opts.maxPBES2Recipients() {
+				return nil, fmt.Errorf("square/go-jose: too many PBES2 recipients in message, limit is %d", opts.maxPBES2Recipients())
+			}
+		}
+		if headers.B64 != nil {
+			return nil, errors.New("square/go-jose: b64 header is not defined for JWE")
+		}
+
+		err = opts.checkEncryptionAlgorithms(headers.Alg, string(headers.Enc))
+		if err != nil {
+			return nil, err
+		}
+
+		err = opts.checkHeaders(obj.protected, obj.unprotected, recipient.header)
+		if err != nil {
+			return nil, err
+		}
+
+		err = opts.checkHeaderPadding(obj.protected, obj.unprotected, recipient.header)
+		if err != nil {
+			return nil, err
+		}
+
+		obj.critUnderstood, err = opts.checkCritical(obj.protected, obj.unprotected, recipient.header)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	obj.iv = parsed.Iv.bytes()
@@ -186,56 +373,47 @@ func (parsed *rawJsonWebEncryption) sanitized() (*JsonWebEncryption, error) {
 }
 
 // parseEncryptedCompact parses a message in compact format.
-func parseEncryptedCompact(input string) (*JsonWebEncryption, error) {
-	parts := strings.Split(input, ".")
+func parseEncryptedCompact(input string, opts ParseOptions) (*JsonWebEncryption, error) {
+	parts := bytes.Split([]byte(input), []byte("."))
 	if len(parts) != 5 {
 		return nil, fmt.Errorf("square/go-jose: compact JWE format must have five parts")
 	}
 
-	rawProtected, err := base64URLDecode(parts[0])
+	err := opts.checkPartSizes(parts)
 	if err != nil {
 		return nil, err
 	}
 
-	encryptedKey, err := base64URLDecode(parts[1])
+	err = opts.decodeCompactParts(parts)
 	if err != nil {
 		return nil, err
 	}
 
-	iv, err := base64URLDecode(parts[2])
-	if err != nil {
-		return nil, err
-	}
-
-	ciphertext, err := base64URLDecode(parts[3])
-	if err != nil {
-		return nil, err
+	raw := &rawJsonWebEncryption{
+		Protected:    newBuffer(parts[0]),
+		EncryptedKey: newBuffer(parts[1]),
+		Iv:           newBuffer(parts[2]),
+		Ciphertext:   newBuffer(parts[3]),
+		Tag:          newBuffer(parts[4]),
 	}
 
-	tag, err := base64URLDecode(parts[4])
+	obj, err := raw.sanitized(opts)
 	if err != nil {
 		return nil, err
 	}
 
-	raw := &rawJsonWebEncryption{
-		Protected:    newBuffer(rawProtected),
-		EncryptedKey: newBuffer(encryptedKey),
-		Iv:           newBuffer(iv),
-		Ciphertext:   newBuffer(ciphertext),
-		Tag:          newBuffer(tag),
-	}
-
-	return raw.sanitized()
+	obj.compact = true
+	return obj, nil
 }
 
 // CompactSerialize serializes an object using the compact serialization format.
 func (obj JsonWebEncryption) CompactSerialize() (string, error) {
-	if len(obj.recipients) != 1 || obj.unprotected != nil ||
+	if len(obj.recipients) != 1 || obj.unprotected != nil || obj.aad != nil ||
 		obj.protected == nil || obj.recipients[0].header != nil {
 		return "", ErrNotSupported
 	}
 
-	serializedProtected := mustSerializeJSON(obj.protected)
+	serializedProtected := obj.serializedProtected()
 
 	return fmt.Sprintf(
 		"%s.%s.%s.%s.%s",
@@ -246,8 +424,69 @@ func (obj JsonWebEncryption) CompactSerialize() (string, error) {
 		base64URLEncode(obj.tag)), nil
 }
 
+// ConvertToFull converts an encrypted message in compact serialization format
+// to the full (JSON) serialization format. The message is not decrypted.
+func ConvertToFull(compact string) (string, error) {
+	if strings.HasPrefix(stripWhitespace(compact), "{") {
+		return "", errors.New("square/go-jose: message is not in compact format")
+	}
+
+	obj, err := ParseEncrypted(compact)
+	if err != nil {
+		return "", err
+	}
+
+	return obj.FullSerialize(), nil
+}
+
+// ConvertToCompact converts an encrypted message in full (JSON) serialization
+// format to the compact serialization format. The message is not decrypted.
+// Returns ErrNotSupported if the message uses features that can't be
+// represented in compact form, such as multiple recipients, unprotected
+// headers or additional authenticated data.
+func ConvertToCompact(full string) (string, error) {
+	if !strings.HasPrefix(stripWhitespace(full), "{") {
+		return "", errors.New("square/go-jose: message is not in full serialization format")
+	}
+
+	obj, err := ParseEncrypted(full)
+	if err != nil {
+		return "", err
+	}
+
+	return obj.CompactSerialize()
+}
+
+// FullSerializeOriginal returns the full JSON serialization of an object that
+// was parsed from the full serialization format, re-serialized from the parsed
+// message rather than from the recipients and headers of the object. This
+// preserves the syntax (flattened or general) and the presence of its members,
+// along with the protected and per-recipient headers as parsed; whitespace and
+// unknown members of the message are not preserved. For all other objects it
+// is equivalent to FullSerialize.
+func (obj JsonWebEncryption) FullSerializeOriginal() string {
+	if obj.original != nil && !obj.compact {
+		return string(mustSerializeJSON(obj.original))
+	}
+	return obj.FullSerialize()
+}
+
 // FullSerialize serializes an object using the full JSON serialization format.
+// Objects with a single recipient use the flattened syntax, others the general
+// syntax.
 func (obj JsonWebEncryption) FullSerialize() string {
+	return obj.fullSerialize(len(obj.recipients) > 1)
+}
+
+// FullSerializeGeneral serializes an object using the general syntax of the
+// full JSON serialization format, with a "recipients" array, even if there is
+// only a single recipient. This is for receivers which don't accept the
+// flattened syntax.
+func (obj JsonWebEncryption) FullSerializeGeneral() string {
+	return obj.fullSerialize(true)
+}
+
+func (obj JsonWebEncryption) fullSerialize(general bool) string {
 	raw := rawJsonWebEncryption{
 		Unprotected:  obj.unprotected,
 		Iv:           newBuffer(obj.iv),
@@ -258,7 +497,8 @@ func (obj JsonWebEncryption) FullSerialize() string {
 		Recipients:   []rawRecipientInfo{},
 	}
 
-	if len(obj.recipients) > 1 {
+	if general {
+		raw.EncryptedKey = nil
 		for _, recipient := range obj.recipients {
 			info := rawRecipientInfo{
 				Header:       recipient.header,
@@ -273,8 +513,141 @@ func (obj JsonWebEncryption) FullSerialize() string {
 	}
 
 	if obj.protected != nil {
-		raw.Protected = newBuffer(mustSerializeJSON(obj.protected))
+		raw.Protected = newBuffer(obj.serializedProtected())
 	}
 
 	return string(mustSerializeJSON(raw))
 }
+
+// EstimateOptions describes the optional header values of a message whose
+// size is estimated with EstimateCompactSizeWithOptions. The zero value
+// describes a message without any of them.
+type EstimateOptions struct {
+	// KeyID is the "kid" header of the recipient.
+	KeyID string
+	// Type and ContentType are the "typ" and "cty" headers (see SetType and
+	// SetContentType).
+	Type        string
+	ContentType string
+	// Compression is the "zip" header (see SetCompression).
+	Compression CompressionAlgorithm
+	// SenderKeyID and PartyUInfo are the "skid" and "apu" headers of an
+	// ECDH-1PU message.
+	SenderKeyID string
+	PartyUInfo  []byte
+	// PBES2Count is the iteration count of a PBES2 message (see
+	// SetPBES2Count), zero means DefaultPBES2Count.
+	PBES2Count int
+	// ExtraHeaders are any other header values (see SetExtraHeader),
+	// including "crit".
+	ExtraHeaders map[string]interface{}
+}
+
+// EstimateCompactSize returns an upper bound on the length of the compact
+// serialization of a message with the given plaintext length, encrypted with
+// the given key management and content encryption algorithms. It's meant for
+// capacity planning (e.g. to check that a token fits into a cookie), so it
+// assumes RSA keys of at most 4096 bits. Optional header values like "kid" are
+// not accounted for, use EstimateCompactSizeWithOptions for messages that have
+// them. Compression is not taken into account either, plaintextLen should be
+// the size of the input to the content cipher. Returns zero if the algorithm
+// combination is not supported.
+func EstimateCompactSize(plaintextLen int, alg KeyAlgorithm, enc ContentEncryption) int {
+	return EstimateCompactSizeWithOptions(plaintextLen, alg, enc, EstimateOptions{})
+}
+
+// EstimateCompactSizeWithOptions is like EstimateCompactSize, but also accounts
+// for the optional header values described by the given options.
+func EstimateCompactSizeWithOptions(plaintextLen int, alg KeyAlgorithm, enc ContentEncryption, opts EstimateOptions) int {
+	var keySize, ivSize, tagSize, ciphertextLen int
+	switch enc {
+	case A128GCM, A192GCM, A256GCM:
+		keySize = getContentCipher(enc).keySize()
+		ivSize, tagSize = 12, 16
+		ciphertextLen = plaintextLen
+	case C20P, XC20P:
+		keySize = getContentCipher(enc).keySize()
+		ivSize, tagSize = 12, 16
+		if enc == XC20P {
+			ivSize = 24
+		}
+		ciphertextLen = plaintextLen
+	case A128CBC_HS256, A192CBC_HS384, A256CBC_HS512:
+		// Tag is the truncated HMAC, half the size of the composite key.
+		keySize = getContentCipher(enc).keySize()
+		ivSize, tagSize = 16, keySize/2
+		// PKCS#7 padding always adds between 1 and 16 bytes.
+		ciphertextLen = (plaintextLen/16 + 1) * 16
+	default:
+		return 0
+	}
+
+	encodedLen := base64.RawURLEncoding.EncodedLen
+	header := len(`{"alg":"","enc":""}`) + len(alg) + len(enc)
+
+	// Each optional value costs a separator, its quoted name and a colon.
+	param := func(name string, value interface{}) int {
+		return len(`,"":`) + len(name) + len(mustSerializeJSON(value))
+	}
+	for name, value := range map[string]string{
+		"kid":  opts.KeyID,
+		"typ":  opts.Type,
+		"cty":  opts.ContentType,
+		"zip":  string(opts.Compression),
+		"skid": opts.SenderKeyID,
+	} {
+		if value != "" {
+			header += param(name, value)
+		}
+	}
+	if len(opts.PartyUInfo) > 0 {
+		header += len(`,"apu":""`) + encodedLen(len(opts.PartyUInfo))
+	}
+	for name, value := range opts.ExtraHeaders {
+		header += param(name, value)
+	}
+
+	p2c := opts.PBES2Count
+	if p2c == 0 {
+		p2c = DefaultPBES2Count
+	}
+
+	var encryptedKeyLen int
+	switch alg {
+	case DIRECT:
+	case ECDH_ES, ECDH_1PU:
+		header += len(`,"epk":{"kty":"EC","crv":"P-521","x":"","y":""}`) + 2*encodedLen(66)
+	case ECDH_ES_A128KW, ECDH_ES_A192KW, ECDH_ES_A256KW, ECDH_1PU_A128KW, ECDH_1PU_A192KW, ECDH_1PU_A256KW:
+		header += len(`,"epk":{"kty":"EC","crv":"P-521","x":"","y":""}`) + 2*encodedLen(66)
+		encryptedKeyLen = keySize + 8
+	case A128KW, A192KW, A256KW:
+		encryptedKeyLen = keySize + 8
+	case A128GCMKW, A192GCMKW, A256GCMKW:
+		header += len(`,"iv":"","tag":""`) + encodedLen(12) + encodedLen(16)
+		encryptedKeyLen = keySize
+	case PBES2_HS256_A128KW, PBES2_HS384_A192KW, PBES2_HS512_A256KW:
+		header += len(`,"p2s":"","p2c":`) + encodedLen(16) + len(strconv.Itoa(p2c))
+		encryptedKeyLen = keySize + 8
+	case RSA1_5, RSA_OAEP, RSA_OAEP_256, RSA_OAEP_384, RSA_OAEP_512:
+		encryptedKeyLen = 512
+	case HPKE_0_KE, HPKE_1_KE, HPKE_2_KE, HPKE_3_KE, HPKE_4_KE:
+		// Encapsulated key is an uncompressed point, at most 133 bytes for P-521.
+		header += len(`,"ek":""`) + encodedLen(133)
+		encryptedKeyLen = keySize + 16
+	case ML_KEM_768, ML_KEM_1024:
+		// The ML-KEM ciphertext is at most 1568 bytes for ML-KEM-1024.
+		header += len(`,"ek":""`) + encodedLen(1568)
+	case ML_KEM_768_A192KW, ML_KEM_1024_A256KW:
+		header += len(`,"ek":""`) + encodedLen(1568)
+		encryptedKeyLen = keySize + 8
+	default:
+		return 0
+	}
+
+	// Splitting n bytes into two base64 parts costs at most one extra character
+	// compared to encoding them as a whole, so bound ciphertext and tag together.
+	return encodedLen(header) + 1 +
+		encodedLen(encryptedKeyLen) + 1 +
+		encodedLen(ivSize) + 1 +
+		encodedLen(ciphertextLen+tagSize) + 2
+}
@@ -20,9 +20,13 @@ import (
 	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/mlkem"
 	"crypto/rsa"
 	"math/big"
+	"strings"
 	"testing"
+
+	"github.com/square/go-jose/json"
 )
 
 func TestCompactParseJWE(t *testing.T) {
@@ -63,6 +67,13 @@ func TestCompactParseJWE(t *testing.T) {
 	}
 }
 
+func TestRejectB64HeaderJWE(t *testing.T) {
+	protected := base64URLEncode([]byte(`{"alg":"dir","enc":"A128GCM","b64":false,"crit":["b64"]}`))
+	if _, err := ParseEncrypted(protected + "..dGVzdA.dGVzdA.dGVzdA"); err == nil {
+		t.Error("should not accept b64 header in JWE")
+	}
+}
+
 func TestFullParseJWE(t *testing.T) {
 	// Messages that should succeed to parse
 	successes := []string{
@@ -119,6 +130,196 @@ func TestFullParseJWE(t *testing.T) {
 	}
 }
 
+func TestRecipientHeadersJWE(t *testing.T) {
+	msg := `{"protected":"` + base64URLEncode([]byte(`{"enc":"A128GCM","zip":"DEF","crit":["exp"],"exp":1}`)) + `",` +
+		`"unprotected":{"jku":"https://example.com/jwks"},` +
+		`"recipients":[` +
+		`{"header":{"alg":"RSA-OAEP","kid":"rsa"},"encrypted_key":"QUJD"},` +
+		`{"header":{"alg":"A128KW","kid":"aes","policy":"strict"},"encrypted_key":"QUJD"}],` +
+		`"iv":"QUJD","ciphertext":"QUJD","tag":"QUJD"}`
+
+	obj, err := ParseEncryptedWithOptions(msg, ParseOptions{UnderstoodExtensions: []string{"exp"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := obj.RecipientHeaders()
+	if len(headers) != 2 {
+		t.Fatal("expected headers for two recipients, got", len(headers))
+	}
+
+	for i, expected := range []struct{ alg, kid string }{{"RSA-OAEP", "rsa"}, {"A128KW", "aes"}} {
+		header := headers[i]
+		if header.Algorithm != expected.alg || header.KeyID != expected.kid {
+			t.Error("unexpected per-recipient headers", i, header.Algorithm, header.KeyID)
+		}
+		if header.Encryption != A128GCM || header.Compression != DEFLATE {
+			t.Error("shared headers should be merged", i, header.Encryption, header.Compression)
+		}
+		if len(header.Critical) != 1 || header.Critical[0] != "exp" {
+			t.Error("unexpected crit header", i, header.Critical)
+		}
+		if header.ExtraHeaders["exp"] != float64(1) || header.ExtraHeaders["jku"] != "https://example.com/jwks" {
+			t.Error("unexpected extra headers", i, header.ExtraHeaders)
+		}
+	}
+
+	if headers[1].ExtraHeaders["policy"] != "strict" {
+		t.Error("per-recipient extra headers should be included", headers[1].ExtraHeaders)
+	}
+	if _, ok := headers[0].ExtraHeaders["policy"]; ok {
+		t.Error("per-recipient headers should not leak into other recipients")
+	}
+
+	// Shared headers don't include the per-recipient ones
+	if obj.Header.KeyID != "" || obj.Header.Encryption != A128GCM {
+		t.Error("unexpected shared headers", obj.Header)
+	}
+}
+
+func TestMaxRecipientsJWE(t *testing.T) {
+	makeMessage := func(n int) string {
+		recipients := make([]string, n)
+		for i := range recipients {
+			recipients[i] = "{\"header\":{\"alg\":\"XYZ\"},\"encrypted_key\":\"QUJD\"}"
+		}
+		return "{\"protected\":\"\",\"unprotected\":{\"enc\":\"XYZ\"},\"recipients\":[" +
+			strings.Join(recipients, ",") + "],\"iv\":\"QUJD\",\"ciphertext\":\"QUJD\",\"tag\":\"QUJD\"}"
+	}
+
+	_, err := ParseEncrypted(makeMessage(DefaultMaxRecipients))
+	if err != nil {
+		t.Error("unable to parse message with maximum number of recipients:", err)
+	}
+
+	_, err = ParseEncrypted(makeMessage(DefaultMaxRecipients + 1))
+	if err == nil {
+		t.Error("able to parse message with too many recipients")
+	}
+
+	opts := ParseOptions{MaxRecipients: 2}
+
+	_, err = ParseEncryptedWithOptions(makeMessage(2), opts)
+	if err != nil {
+		t.Error("unable to parse message under configured limit:", err)
+	}
+
+	_, err = ParseEncryptedWithOptions(makeMessage(3), opts)
+	if err == nil {
+		t.Error("able to parse message over configured limit")
+	}
+
+	// Recipients past the limit aren't decoded
+	message := strings.Replace(makeMessage(2), "]", ",\"invalid\"]", 1)
+	_, err = ParseEncryptedWithOptions(message, opts)
+	if err == nil || !strings.Contains(err.Error(), "too many recipients") {
+		t.Error("should reject message before decoding recipient past limit:", err)
+	}
+}
+
+func TestSerializationFormatJWE(t *testing.T) {
+	cases := []struct {
+		input  string
+		format SerializationFormat
+	}{
+		{
+			"eyJhbGciOiJSU0EtT0FFUCIsImVuYyI6IkExMjhHQ00ifQ.dGVzdA.dGVzdA.dGVzdA.dGVzdA",
+			Compact,
+		},
+		{
+			"{\"protected\":\"eyJhbGciOiJYWVoiLCJlbmMiOiJYWVoifQo\",\"encrypted_key\":\"QUJD\",\"iv\":\"QUJD\",\"ciphertext\":\"QUJD\",\"tag\":\"QUJD\"}",
+			FullFlattened,
+		},
+		{
+			"{\"protected\":\"\",\"unprotected\":{\"enc\":\"XYZ\"},\"recipients\":[{\"header\":{\"alg\":\"XYZ\"},\"encrypted_key\":\"QUJD\"}],\"iv\":\"QUJD\",\"ciphertext\":\"QUJD\",\"tag\":\"QUJD\"}",
+			FullGeneral,
+		},
+	}
+
+	for _, c := range cases {
+		obj, err := ParseEncrypted(c.input)
+		if err != nil {
+			t.Error("unable to parse valid message", err, c.input)
+			continue
+		}
+		if obj.SerializationFormat() != c.format {
+			t.Errorf("expected format %d, got %d for message %s", c.format, obj.SerializationFormat(), c.input)
+		}
+	}
+
+	enc, err := NewEncrypter(A128KW, A128GCM, []byte("0123456789ABCDEF"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := enc.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.SerializationFormat() != Unparsed {
+		t.Error("freshly encrypted object should not report a parsed format")
+	}
+
+	for serialized, format := range map[string]SerializationFormat{
+		obj.FullSerialize():        FullFlattened,
+		obj.FullSerializeGeneral(): FullGeneral,
+	} {
+		parsed, err := ParseEncrypted(serialized)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.SerializationFormat() != format {
+			t.Errorf("expected format %d, got %d for message %s", format, parsed.SerializationFormat(), serialized)
+		}
+		if strings.Contains(serialized, `"recipients"`) != (format == FullGeneral) {
+			t.Error("unexpected serialization", serialized)
+		}
+		if _, err := parsed.Decrypt([]byte("0123456789ABCDEF")); err != nil {
+			t.Error("unable to decrypt", err, serialized)
+		}
+	}
+}
+
+func TestRawPartsAccessorsJWE(t *testing.T) {
+	msg := "eyJhbGciOiJSU0EtT0FFUCIsImVuYyI6IkExMjhHQ00ifQ.dGVzdA.QUJD.REVG.R0hJ"
+	obj, err := ParseEncrypted(msg)
+	if err != nil {
+		t.Fatal("unable to parse valid message:", err)
+	}
+
+	if !bytes.Equal(obj.IV(), []byte("ABC")) {
+		t.Errorf("unexpected IV: %q", obj.IV())
+	}
+	if !bytes.Equal(obj.Ciphertext(), []byte("DEF")) {
+		t.Errorf("unexpected ciphertext: %q", obj.Ciphertext())
+	}
+	if !bytes.Equal(obj.Tag(), []byte("GHI")) {
+		t.Errorf("unexpected tag: %q", obj.Tag())
+	}
+	if keys := obj.EncryptedKeys(); len(keys) != 1 || !bytes.Equal(keys[0], []byte("test")) {
+		t.Errorf("unexpected encrypted keys: %q", keys)
+	}
+	if aad := obj.AuthenticatedData(); string(aad) != strings.Split(msg, ".")[0] {
+		t.Errorf("unexpected authenticated data: %q", aad)
+	}
+
+	// Mutating returned slices must not affect the object
+	obj.IV()[0] = 'X'
+	obj.Ciphertext()[0] = 'X'
+	obj.Tag()[0] = 'X'
+	obj.EncryptedKeys()[0][0] = 'X'
+
+	if !bytes.Equal(obj.IV(), []byte("ABC")) ||
+		!bytes.Equal(obj.Ciphertext(), []byte("DEF")) ||
+		!bytes.Equal(obj.Tag(), []byte("GHI")) ||
+		!bytes.Equal(obj.EncryptedKeys()[0], []byte("test")) {
+		t.Error("mutating returned slices changed object")
+	}
+
+	if (&JsonWebEncryption{}).IV() != nil {
+		t.Error("expected nil IV for empty object")
+	}
+}
+
 func TestMissingInvalidHeaders(t *testing.T) {
 	obj := &JsonWebEncryption{
 		protected:   &rawHeader{Enc: A128GCM},
@@ -535,3 +736,595 @@ func TestSampleJose4jJWEMessagesECDH(t *testing.T) {
 		}
 	}
 }
+
+func TestPaddedBase64JWE(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	enc, err := NewEncrypter(A128KW, A128GCM, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A 16-byte GCM tag encodes to 22 characters, so it needs two pad bytes.
+	obj, err := enc.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact, err := obj.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseEncrypted(compact + "=="); err == nil {
+		t.Error("should not accept padded base64url by default")
+	}
+
+	parsed, err := ParseEncryptedWithOptions(compact+"==", ParseOptions{AllowPaddedBase64: true})
+	if err != nil {
+		t.Fatal("should accept padded base64url when allowed:", err)
+	}
+	plaintext, err := parsed.Decrypt(key)
+	if err != nil || string(plaintext) != "Lorem ipsum dolor sit amet" {
+		t.Error("failed to decrypt message with padded tag:", err)
+	}
+
+	// Buffers inside the header, like the key wrapping tag, are checked too.
+	multi, err := NewMultiEncrypter(A128GCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := multi.AddRecipient(A128GCMKW, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	obj, err = multi.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var full map[string]interface{}
+	if err := json.Unmarshal([]byte(obj.FullSerialize()), &full); err != nil {
+		t.Fatal(err)
+	}
+	recipient := full["recipients"].([]interface{})[0].(map[string]interface{})
+	header := recipient["header"].(map[string]interface{})
+	header["tag"] = header["tag"].(string) + "=="
+	padded, err := json.Marshal(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseEncrypted(string(padded)); err == nil {
+		t.Error("should not accept padded base64url in header by default")
+	}
+
+	parsed, err = ParseEncryptedWithOptions(string(padded), ParseOptions{AllowPaddedBase64: true})
+	if err != nil {
+		t.Fatal("should accept padded base64url in header when allowed:", err)
+	}
+	_, _, plaintext, err = parsed.DecryptMulti(key)
+	if err != nil || string(plaintext) != "Lorem ipsum dolor sit amet" {
+		t.Error("failed to decrypt message with padded key wrapping tag:", err)
+	}
+}
+
+func TestEstimateCompactSize(t *testing.T) {
+	aesKey := func(size int) []byte { return make([]byte, size) }
+	hpkeKey, _ := ecTestKey521.ECDH()
+	mlkemKey, _ := mlkem.GenerateKey1024()
+	cases := []struct {
+		alg KeyAlgorithm
+		enc ContentEncryption
+		key interface{}
+	}{
+		{DIRECT, A128GCM, aesKey(16)},
+		{DIRECT, A256CBC_HS512, aesKey(64)},
+		{A128KW, A128GCM, aesKey(16)},
+		{A256KW, A128CBC_HS256, aesKey(32)},
+		{A192GCMKW, A192GCM, aesKey(24)},
+		{RSA1_5, A128CBC_HS256, &rsaTestKey.PublicKey},
+		{RSA_OAEP_256, A256GCM, &rsaTestKey.PublicKey},
+		{RSA_OAEP_512, A256CBC_HS512, &rsaTestKey.PublicKey},
+		{ECDH_ES, A128GCM, &ecTestKey521.PublicKey},
+		{ECDH_ES_A256KW, A256CBC_HS512, &ecTestKey521.PublicKey},
+		{PBES2_HS512_A256KW, A256GCM, []byte("password")},
+		{A256KW, XC20P, aesKey(32)},
+		{ECDH_1PU_A256KW, A256CBC_HS512, &ECDH1PUEncryptionKey{SenderKey: ecTestKey521, RecipientKey: &ecTestKey521.PublicKey}},
+		{HPKE_2_KE, A256GCM, hpkeKey.PublicKey()},
+		{ML_KEM_1024, A256GCM, mlkemKey.EncapsulationKey()},
+		{ML_KEM_1024_A256KW, A256CBC_HS512, mlkemKey.EncapsulationKey()},
+	}
+
+	for _, c := range cases {
+		enc, err := NewEncrypter(c.alg, c.enc, c.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, size := range []int{0, 1, 15, 16, 17, 1000} {
+			obj, err := enc.Encrypt(make([]byte, size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := obj.CompactSerialize()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			estimate := EstimateCompactSize(size, c.alg, c.enc)
+			if estimate < len(msg) {
+				t.Errorf("estimate for %s/%s with %d bytes too small: %d < %d", c.alg, c.enc, size, estimate, len(msg))
+			}
+		}
+	}
+
+	if EstimateCompactSize(100, KeyAlgorithm("XYZ"), A128GCM) != 0 ||
+		EstimateCompactSize(100, A128KW, ContentEncryption("XYZ")) != 0 {
+		t.Error("estimate should be zero for unsupported algorithms")
+	}
+}
+
+func TestEstimateCompactSizeWithOptions(t *testing.T) {
+	kid := strings.Repeat("k", 100)
+	cases := []struct {
+		alg   KeyAlgorithm
+		enc   ContentEncryption
+		key   interface{}
+		opts  EstimateOptions
+		setup func(enc Encrypter) error
+	}{
+		{
+			alg:  A128KW,
+			enc:  A128GCM,
+			key:  &JsonWebKey{Key: make([]byte, 16), KeyID: kid},
+			opts: EstimateOptions{KeyID: kid, Type: "JWT", ContentType: "application/example+json", Compression: DEFLATE},
+			setup: func(enc Encrypter) error {
+				enc.SetType("JWT")
+				enc.SetContentType("application/example+json")
+				enc.SetCompression(DEFLATE)
+				return nil
+			},
+		},
+		{
+			alg:  A256KW,
+			enc:  A256GCM,
+			key:  &JsonWebKey{Key: make([]byte, 32), KeyID: kid},
+			opts: EstimateOptions{KeyID: kid, ExtraHeaders: map[string]interface{}{"iss": "<issuer>", "crit": []string{"iss"}}},
+			setup: func(enc Encrypter) error {
+				enc.SetCriticalExtensions([]string{"iss"})
+				return enc.SetExtraHeader("iss", "<issuer>")
+			},
+		},
+		{
+			alg:  PBES2_HS256_A128KW,
+			enc:  A128CBC_HS256,
+			key:  &JsonWebKey{Key: []byte("password"), KeyID: kid},
+			opts: EstimateOptions{KeyID: kid, PBES2Count: 1000000},
+			setup: func(enc Encrypter) error {
+				return enc.SetPBES2Count(1000000)
+			},
+		},
+		{
+			alg:  ECDH_1PU,
+			enc:  A256GCM,
+			key:  &ECDH1PUEncryptionKey{SenderKey: ecTestKey521, SenderKeyID: kid, RecipientKey: &ecTestKey521.PublicKey},
+			opts: EstimateOptions{SenderKeyID: kid},
+		},
+		{
+			alg:  ECDH_1PU_A256KW,
+			enc:  A256CBC_HS512,
+			key:  &ECDH1PUEncryptionKey{SenderKey: ecTestKey521, SenderKeyID: kid, RecipientKey: &ecTestKey521.PublicKey},
+			opts: EstimateOptions{SenderKeyID: kid},
+		},
+	}
+
+	for _, c := range cases {
+		enc, err := NewEncrypter(c.alg, c.enc, c.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.setup != nil {
+			if err := c.setup(enc); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, size := range []int{0, 1, 16, 1000} {
+			plaintext := make([]byte, size)
+			obj, err := enc.Encrypt(plaintext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := obj.CompactSerialize()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The estimate takes the size of the input to the content cipher.
+			if c.opts.Compression != "" {
+				compressed, err := compress(c.opts.Compression, plaintext)
+				if err != nil {
+					t.Fatal(err)
+				}
+				size = len(compressed)
+			}
+
+			estimate := EstimateCompactSizeWithOptions(size, c.alg, c.enc, c.opts)
+			if estimate < len(msg) {
+				t.Errorf("estimate for %s/%s with %d bytes too small: %d < %d", c.alg, c.enc, size, estimate, len(msg))
+			}
+			if EstimateCompactSize(size, c.alg, c.enc) >= len(msg) {
+				t.Errorf("estimate for %s/%s without options should not cover the optional headers", c.alg, c.enc)
+			}
+		}
+	}
+
+	// An apu value is accounted for as well, its 30 bytes take up 40 characters
+	// in the header, which itself grows by a third when encoded.
+	base := EstimateCompactSize(100, ECDH_1PU, A256GCM)
+	withAPU := EstimateCompactSizeWithOptions(100, ECDH_1PU, A256GCM, EstimateOptions{PartyUInfo: make([]byte, 30)})
+	if withAPU-base < len(`,"apu":""`)+40 {
+		t.Errorf("estimate with apu not large enough: %d vs %d without", withAPU, base)
+	}
+}
+
+func TestStrictHeadersJWE(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	enc, err := NewEncrypter(A128KW, A128GCM, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := enc.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add an unknown parameter to the shared unprotected header
+	msg := strings.Replace(obj.FullSerialize(), "{", `{"unprotected":{"foo":"bar"},`, 1)
+
+	parsed, err := ParseEncrypted(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Header.ExtraHeaders["foo"] != "bar" {
+		t.Error("unknown header parameter should be available in ExtraHeaders")
+	}
+
+	if _, err := ParseEncryptedWithOptions(msg, ParseOptions{StrictHeaders: true}); err == nil {
+		t.Error("should reject unknown header parameter in strict mode")
+	}
+	if _, err := ParseEncryptedWithOptions(obj.FullSerialize(), ParseOptions{StrictHeaders: true}); err != nil {
+		t.Error("should accept message without unknown parameters in strict mode:", err)
+	}
+}
+
+func TestAllowedAlgorithmsJWE(t *testing.T) {
+	enc, err := NewEncrypter(A128KW, A128GCM, []byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := enc.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact, _ := obj.CompactSerialize()
+
+	for _, opts := range []ParseOptions{
+		{KeyAlgorithms: []KeyAlgorithm{A128KW}},
+		{ContentEncryption: []ContentEncryption{A256GCM, A128GCM}},
+		{KeyAlgorithms: []KeyAlgorithm{RSA_OAEP, A128KW}, ContentEncryption: []ContentEncryption{A128GCM}},
+	} {
+		if _, err := ParseEncryptedWithOptions(compact, opts); err != nil {
+			t.Error("should accept allowed algorithms:", opts, err)
+		}
+	}
+
+	for _, opts := range []ParseOptions{
+		{KeyAlgorithms: []KeyAlgorithm{RSA_OAEP}},
+		{ContentEncryption: []ContentEncryption{A256GCM}},
+		{KeyAlgorithms: []KeyAlgorithm{A128KW}, ContentEncryption: []ContentEncryption{A128CBC_HS256}},
+	} {
+		for _, msg := range []string{compact, obj.FullSerialize()} {
+			if _, err := ParseEncryptedWithOptions(msg, opts); err == nil {
+				t.Error("should reject algorithms not in allow-list:", opts, msg)
+			}
+		}
+	}
+}
+
+func TestSizeLimitsJWE(t *testing.T) {
+	enc, err := NewEncrypter(A128KW, A128GCM, []byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := enc.Encrypt(make([]byte, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact, _ := obj.CompactSerialize()
+	full := obj.FullSerialize()
+	protected := len(obj.serializedProtected())
+
+	for _, msg := range []string{compact, full} {
+		for _, tc := range []struct {
+			opts ParseOptions
+			ok   bool
+		}{
+			{ParseOptions{MaxInputSize: len(msg)}, true},
+			{ParseOptions{MaxInputSize: len(msg) - 1}, false},
+			{ParseOptions{MaxHeaderSize: protected}, true},
+			{ParseOptions{MaxHeaderSize: protected - 1}, false},
+		} {
+			_, err := ParseEncryptedWithOptions(msg, tc.opts)
+			if tc.ok && err != nil {
+				t.Error("should accept message within limits:", tc.opts, err)
+			}
+			if !tc.ok && err == nil {
+				t.Error("should reject message over limits:", tc.opts)
+			}
+		}
+	}
+
+	// The ciphertext is the largest part
+	ciphertextSize := len(strings.Split(compact, ".")[3])
+	if _, err := ParseEncryptedWithOptions(compact, ParseOptions{MaxPartSize: ciphertextSize}); err != nil {
+		t.Error("should accept parts within limit:", err)
+	}
+	if _, err := ParseEncryptedWithOptions(compact, ParseOptions{MaxPartSize: ciphertextSize - 1}); err == nil {
+		t.Error("should reject part over limit")
+	}
+}
+
+func TestFullSerializeOriginalJWE(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	enc, err := NewMultiEncrypter(A128GCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.AddRecipient(A128KW, &JsonWebKey{Key: key, KeyID: "key"}); err != nil {
+		t.Fatal(err)
+	}
+	obj, err := enc.EncryptWithAuthData([]byte("Lorem ipsum dolor sit amet"), []byte("aad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// General syntax with a single recipient, padded with whitespace and with
+	// an unknown top-level member.
+	general := obj.FullSerializeGeneral()
+	msg := "{\n  " + strings.NewReplacer(",", ",\n  ", ":", ": ").Replace(general[1:len(general)-1]) + `,
+  "x": 1
+}`
+
+	parsed, err := ParseEncrypted(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.FullSerializeOriginal() != general {
+		t.Errorf("expected re-serialization of parsed message, got %s", parsed.FullSerializeOriginal())
+	}
+	if parsed.FullSerialize() == general {
+		t.Error("expected FullSerialize to use flattened syntax")
+	}
+	if _, err := ParseEncrypted(parsed.FullSerializeOriginal()); err != nil {
+		t.Error("unable to parse re-serialized message", err)
+	}
+
+	// Freshly created objects use the canonical serialization
+	single, err := NewEncrypter(A128KW, A128GCM, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := single.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh.FullSerializeOriginal() != fresh.FullSerialize() {
+		t.Error("unparsed object should use canonical serialization")
+	}
+
+	// Compact messages have no original full serialization
+	compact, _ := fresh.CompactSerialize()
+	parsed, err = ParseEncrypted(compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.FullSerializeOriginal() != parsed.FullSerialize() {
+		t.Error("compact object should use canonical serialization")
+	}
+}
+
+func TestConvertSerializationJWE(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	enc, err := NewEncrypter(A128KW, A128GCM, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := enc.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact, err := obj.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Also use a protected header with non-canonical member order and an
+	// unregistered member, which must be preserved exactly.
+	parts := strings.Split(compact, ".")
+	parts[0] = base64URLEncode([]byte(`{"enc":"A128GCM","x":1,"alg":"A128KW"}`))
+
+	for _, input := range []string{compact, strings.Join(parts, ".")} {
+		full, err := ConvertToFull(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := ConvertToCompact(full)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != input {
+			t.Errorf("compact->full->compact should yield original, got %s, wanted %s", output, input)
+		}
+	}
+
+	// Converted message must still decrypt
+	full, _ := ConvertToFull(compact)
+	parsed, err := ParseEncrypted(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parsed.Decrypt(key); err != nil {
+		t.Error("failed to decrypt converted message:", err)
+	}
+
+	// Wrong input formats
+	if _, err := ConvertToFull(full); err == nil {
+		t.Error("should reject full serialization input in ConvertToFull")
+	}
+	if _, err := ConvertToCompact(compact); err == nil {
+		t.Error("should reject compact input in ConvertToCompact")
+	}
+
+	// Features not representable in compact form
+	withAAD, err := enc.EncryptWithAuthData([]byte("Lorem ipsum dolor sit amet"), []byte("aad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ConvertToCompact(withAAD.FullSerialize()); err != ErrNotSupported {
+		t.Error("should not convert message with AAD to compact form, got:", err)
+	}
+
+	multi, err := NewMultiEncrypter(A128GCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = multi.AddRecipient(A128KW, key)
+	_ = multi.AddRecipient(RSA_OAEP, &rsaTestKey.PublicKey)
+	multiObj, err := multi.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ConvertToCompact(multiObj.FullSerialize()); err != ErrNotSupported {
+		t.Error("should not convert multi-recipient message to compact form, got:", err)
+	}
+}
+
+func BenchmarkParseEncryptedCompact(b *testing.B) {
+	enc, err := NewEncrypter(A128KW, A128GCM, []byte("0123456789abcdef"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	obj, err := enc.Encrypt(make([]byte, 1024))
+	if err != nil {
+		b.Fatal(err)
+	}
+	msg, err := obj.CompactSerialize()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseEncrypted(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestVectorsAESKW(t *testing.T) {
+	// Example from RFC 7516 appendix A.3
+	key, err := base64URLDecode("GawgguFyGrWKav7AX4VKUg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := stripWhitespace(`
+		eyJhbGciOiJBMTI4S1ciLCJlbmMiOiJBMTI4Q0JDLUhTMjU2In0.
+		6KB707dM9YTIgHtLvtgWQ8mKwboJW3of9locizkDTHzBC2IlrT1oOQ.
+		AxY8DCtDaGlsbGljb3RoZQ.
+		KDlTtXchhZTGufMYmOYGS4HffxPSUrfmqCHXaI9wOGY.
+		U0m_YmjN04DJvceFICbCVQ`)
+
+	obj, err := ParseEncrypted(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := obj.Decrypt(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "Live long and prosper." {
+		t.Error("unexpected plaintext", string(plaintext))
+	}
+
+	// Other key sizes must be rejected for A128KW
+	if _, err := obj.Decrypt(append(key, key[:8]...)); err != ErrInvalidKeySize {
+		t.Error("expected invalid key size error, got", err)
+	}
+}
+
+func TestUnknownHeadersRoundTripJWE(t *testing.T) {
+	key := []byte("0123456789ABCDEF")
+	enc, err := NewEncrypter(A128KW, A128GCM, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = enc.SetExtraHeader("ext", "protected"); err != nil {
+		t.Fatal(err)
+	}
+	obj, err := enc.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compact, err := obj.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseEncrypted(compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := parsed.CompactSerialize(); again != compact {
+		t.Errorf("compact serialization changed, got %s, expected %s", again, compact)
+	}
+
+	// Add extensions to the shared and per-recipient unprotected headers.
+	var raw map[string]interface{}
+	if err = json.Unmarshal([]byte(obj.FullSerialize()), &raw); err != nil {
+		t.Fatal(err)
+	}
+	raw["unprotected"] = map[string]interface{}{"shared": "yes"}
+	raw["header"] = map[string]interface{}{"route": []interface{}{"a", "b"}}
+	msg, err := json.Marshal(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, general := range []bool{false, true} {
+		parsed, err := ParseEncrypted(string(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		serialized := parsed.FullSerialize()
+		if general {
+			serialized = parsed.FullSerializeGeneral()
+		}
+
+		reparsed, err := ParseEncrypted(serialized)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := reparsed.RecipientHeaders()[0]
+		if header.ExtraHeaders["ext"] != "protected" || header.ExtraHeaders["shared"] != "yes" {
+			t.Error("shared extensions lost on re-serialization", serialized)
+		}
+		if route, _ := header.ExtraHeaders["route"].([]interface{}); len(route) != 2 || route[1] != "b" {
+			t.Error("recipient extension lost on re-serialization", serialized)
+		}
+		if _, err := reparsed.Decrypt(key); err != nil {
+			t.Error("unable to decrypt re-serialized object", err)
+		}
+	}
+}
@@ -17,9 +17,14 @@
 package jose
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/ecdh"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
+	"crypto/mldsa"
+	"crypto/mlkem"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
@@ -29,6 +34,7 @@ import (
 	"reflect"
 	"strings"
 
+	"github.com/square/go-jose/cipher"
 	"github.com/square/go-jose/json"
 )
 
@@ -44,8 +50,9 @@ type rawJsonWebKey struct {
 	Y   *byteBuffer `json:"y,omitempty"`
 	N   *byteBuffer `json:"n,omitempty"`
 	E   *byteBuffer `json:"e,omitempty"`
+	Pub *byteBuffer `json:"pub,omitempty"`
 	// -- Following fields are only used for private keys --
-	// RSA uses D, P and Q, while ECDSA uses only D. Fields Dp, Dq, and Qi are
+	// RSA uses D, P and Q, while ECDSA and EdDSA use only D. Fields Dp, Dq, and Qi are
 	// completely optional. Therefore for RSA/ECDSA, D != nil is a contract that
 	// we have a private key whereas D == nil means we have only a public key.
 	D  *byteBuffer `json:"d,omitempty"`
@@ -54,10 +61,24 @@ type rawJsonWebKey struct {
 	Dp *byteBuffer `json:"dp,omitempty"`
 	Dq *byteBuffer `json:"dq,omitempty"`
 	Qi *byteBuffer `json:"qi,omitempty"`
+	// AKP (ML-DSA, ML-KEM) private keys use Priv, the private key seed.
+	Priv *byteBuffer `json:"priv,omitempty"`
+	// Permitted key operations
+	KeyOps []string `json:"key_ops,omitempty"`
 	// Certificates
 	X5c []string `json:"x5c,omitempty"`
 }
 
+// Check whether any member of the key was parsed from padded base64 data.
+func (key rawJsonWebKey) padded() bool {
+	for _, b := range []*byteBuffer{key.K, key.X, key.Y, key.N, key.E, key.Pub, key.D, key.P, key.Q, key.Dp, key.Dq, key.Qi, key.Priv} {
+		if b != nil && b.padded {
+			return true
+		}
+	}
+	return false
+}
+
 // JsonWebKey represents a public or private key in JWK format.
 type JsonWebKey struct {
 	Key          interface{}
@@ -65,6 +86,10 @@ type JsonWebKey struct {
 	KeyID        string
 	Algorithm    string
 	Use          string
+	KeyOps       []string
+
+	// Set if the key was parsed from padded base64 data.
+	padded bool
 }
 
 // MarshalJSON serializes the given key to its JSON representation.
@@ -81,6 +106,26 @@ func (k JsonWebKey) MarshalJSON() ([]byte, error) {
 		raw, err = fromEcPrivateKey(key)
 	case *rsa.PrivateKey:
 		raw, err = fromRsaPrivateKey(key)
+	case ed25519.PublicKey:
+		raw, err = fromEdPublicKey(key)
+	case ed25519.PrivateKey:
+		raw, err = fromEdPrivateKey(key)
+	case *ecdh.PublicKey:
+		raw, err = fromX25519PublicKey(key)
+	case *ecdh.PrivateKey:
+		raw, err = fromX25519PrivateKey(key)
+	case *mldsa.PublicKey:
+		raw, err = fromMLDSAPublicKey(key)
+	case *mldsa.PrivateKey:
+		raw, err = fromMLDSAPrivateKey(key)
+	case *mlkem.EncapsulationKey768:
+		raw = fromMLKEMPublicKey(ML_KEM_768, key.Bytes())
+	case *mlkem.EncapsulationKey1024:
+		raw = fromMLKEMPublicKey(ML_KEM_1024, key.Bytes())
+	case *mlkem.DecapsulationKey768:
+		raw = fromMLKEMPrivateKey(ML_KEM_768, key.EncapsulationKey().Bytes(), key.Bytes())
+	case *mlkem.DecapsulationKey1024:
+		raw = fromMLKEMPrivateKey(ML_KEM_1024, key.EncapsulationKey().Bytes(), key.Bytes())
 	case []byte:
 		raw, err = fromSymmetricKey(key)
 	default:
@@ -91,9 +136,21 @@ func (k JsonWebKey) MarshalJSON() ([]byte, error) {
 		return nil, err
 	}
 
+	// AKP keys carry their algorithm, which can't be overridden except by one
+	// using the same parameter set (ML-KEM with or without key wrapping).
+	if raw.Kty == "AKP" && k.Algorithm != "" && k.Algorithm != raw.Alg {
+		if !sameMLKEMParameters(KeyAlgorithm(k.Algorithm), KeyAlgorithm(raw.Alg)) {
+			return nil, fmt.Errorf("square/go-jose: algorithm '%s' does not match %s key", k.Algorithm, raw.Alg)
+		}
+		raw.Alg = k.Algorithm
+	}
+	if raw.Kty != "AKP" {
+		raw.Alg = k.Algorithm
+	}
+
 	raw.Kid = k.KeyID
-	raw.Alg = k.Algorithm
 	raw.Use = k.Use
+	raw.KeyOps = k.KeyOps
 
 	for _, cert := range k.Certificates {
 		raw.X5c = append(raw.X5c, base64.StdEncoding.EncodeToString(cert.Raw))
@@ -110,6 +167,11 @@ func (k *JsonWebKey) UnmarshalJSON(data []byte) (err error) {
 		return err
 	}
 
+	err = checkKeyOps(raw.Use, raw.KeyOps)
+	if err != nil {
+		return err
+	}
+
 	var key interface{}
 	switch raw.Kty {
 	case "EC":
@@ -124,6 +186,29 @@ func (k *JsonWebKey) UnmarshalJSON(data []byte) (err error) {
 		} else {
 			key, err = raw.rsaPublicKey()
 		}
+	case "OKP":
+		switch {
+		case raw.Crv == "X25519" && raw.D != nil:
+			key, err = raw.x25519PrivateKey()
+		case raw.Crv == "X25519":
+			key, err = raw.x25519PublicKey()
+		case raw.D != nil:
+			key, err = raw.edPrivateKey()
+		default:
+			key, err = raw.edPublicKey()
+		}
+	case "AKP":
+		_, _, kemErr := mlkemParameters(KeyAlgorithm(raw.Alg))
+		switch {
+		case kemErr == nil && raw.Priv != nil:
+			key, err = raw.mlkemPrivateKey()
+		case kemErr == nil:
+			key, err = raw.mlkemPublicKey()
+		case raw.Priv != nil:
+			key, err = raw.mldsaPrivateKey()
+		default:
+			key, err = raw.mldsaPublicKey()
+		}
 	case "oct":
 		key, err = raw.symmetricKey()
 	default:
@@ -131,7 +216,7 @@ func (k *JsonWebKey) UnmarshalJSON(data []byte) (err error) {
 	}
 
 	if err == nil {
-		*k = JsonWebKey{Key: key, KeyID: raw.Kid, Algorithm: raw.Alg, Use: raw.Use}
+		*k = JsonWebKey{Key: key, KeyID: raw.Kid, Algorithm: raw.Alg, Use: raw.Use, KeyOps: raw.KeyOps, padded: raw.padded()}
 	}
 
 	k.Certificates = make([]*x509.Certificate, len(raw.X5c))
@@ -149,7 +234,70 @@ func (k *JsonWebKey) UnmarshalJSON(data []byte) (err error) {
 	return
 }
 
-// JsonWebKeySet represents a JWK Set object.
+// Key operations (as used in "key_ops") permitted for each "use" value.
+var keyOpsForUse = map[string][]string{
+	"sig": {"sign", "verify"},
+	"enc": {"encrypt", "decrypt", "wrapKey", "unwrapKey", "deriveKey", "deriveBits"},
+}
+
+// Key operations (as used in "key_ops") that permit each operation of this
+// library. Key management for JWE may be expressed as key wrapping or (for
+// ECDH) key derivation, so these are accepted along with encrypt/decrypt.
+var keyOpsForOperation = map[string][]string{
+	"sign":    {"sign"},
+	"verify":  {"verify"},
+	"encrypt": {"encrypt", "wrapKey", "deriveKey"},
+	"decrypt": {"decrypt", "unwrapKey", "deriveKey"},
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// checkKeyOps verifies that key_ops contains no duplicates, and that it is
+// consistent with use if both are present (see RFC 7517, section 4.3).
+func checkKeyOps(use string, keyOps []string) error {
+	for i, op := range keyOps {
+		if containsString(keyOps[:i], op) {
+			return fmt.Errorf("square/go-jose: duplicate value '%s' in key_ops", op)
+		}
+		if allowed, ok := keyOpsForUse[use]; ok && !containsString(allowed, op) {
+			return fmt.Errorf("square/go-jose: key_ops value '%s' inconsistent with use '%s'", op, use)
+		}
+	}
+	return nil
+}
+
+// checkOperation returns an error if the key_ops (and use) of the key do not
+// permit using it for the given operation (sign, verify, encrypt or decrypt).
+func (k *JsonWebKey) checkOperation(op string) error {
+	err := checkKeyOps(k.Use, k.KeyOps)
+	if err != nil {
+		return err
+	}
+
+	if len(k.KeyOps) == 0 {
+		return nil
+	}
+
+	for _, permitted := range keyOpsForOperation[op] {
+		if containsString(k.KeyOps, permitted) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("square/go-jose: key_ops of key do not permit operation '%s'", op)
+}
+
+// JsonWebKeySet represents a JWK Set object. A key set may be passed as the
+// key to Verify, VerifyMulti, Decrypt and DecryptMulti, in which case the keys
+// with the key ID of the object (if any), and with a matching "alg" and "use"
+// (if set on the key), are tried in turn.
 type JsonWebKeySet struct {
 	Keys []JsonWebKey `json:"keys"`
 }
@@ -169,8 +317,58 @@ func (s *JsonWebKeySet) Key(kid string) []JsonWebKey {
 	return keys
 }
 
+// candidates returns the keys in the set which may be used for an object with
+// the given header, for the given use ("sig" or "enc").
+func (s *JsonWebKeySet) candidates(header rawHeader, use string) []*JsonWebKey {
+	var keys []*JsonWebKey
+	for i := range s.Keys {
+		key := &s.Keys[i]
+		if header.Kid != "" && key.KeyID != header.Kid {
+			continue
+		}
+		if key.Algorithm != "" && key.Algorithm != header.Alg {
+			continue
+		}
+		if key.Use != "" && key.Use != use {
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// keySet returns the key set if the given key is one, see JsonWebKeySet.
+func keySet(key interface{}) (*JsonWebKeySet, bool) {
+	switch key := key.(type) {
+	case *JsonWebKeySet:
+		return key, true
+	case JsonWebKeySet:
+		return &key, true
+	}
+	return nil, false
+}
+
+// keyIDMatches reports whether the given key may be used for an object with
+// the given "kid" header. Only JWKs carry a key ID; other keys, as well as JWKs
+// without a key ID or objects without a "kid" header, match any object.
+func keyIDMatches(key interface{}, kid string) bool {
+	var keyID string
+	switch key := key.(type) {
+	case *JsonWebKey:
+		keyID = key.KeyID
+	case JsonWebKey:
+		keyID = key.KeyID
+	}
+
+	return keyID == "" || kid == "" || keyID == kid
+}
+
 const rsaThumbprintTemplate = `{"e":"%s","kty":"RSA","n":"%s"}`
 const ecThumbprintTemplate = `{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`
+const okpThumbprintTemplate = `{"crv":"%s","kty":"OKP","x":"%s"}`
+const akpThumbprintTemplate = `{"alg":"%s","kty":"AKP","pub":"%s"}`
+const octThumbprintTemplate = `{"k":"%s","kty":"oct"}`
 
 func ecThumbprintInput(curve elliptic.Curve, x, y *big.Int) (string, error) {
 	coordLength := curveSize(curve)
@@ -184,6 +382,25 @@ func ecThumbprintInput(curve elliptic.Curve, x, y *big.Int) (string, error) {
 		newFixedSizeBuffer(y.Bytes(), coordLength).base64()), nil
 }
 
+func x25519ThumbprintInput(pub *ecdh.PublicKey) (string, error) {
+	if pub.Curve() != ecdh.X25519() {
+		return "", errors.New("square/go-jose: unsupported ecdh curve, only X25519 is supported")
+	}
+
+	return fmt.Sprintf(okpThumbprintTemplate, "X25519", newBuffer(pub.Bytes()).base64()), nil
+}
+
+// mlkemThumbprintInput computes the thumbprint input of an ML-KEM key. The
+// algorithm of the JWK is used if it matches the key, otherwise the one for
+// direct key agreement.
+func mlkemThumbprintInput(alg string, keyAlg KeyAlgorithm, pub []byte) string {
+	if sameMLKEMParameters(KeyAlgorithm(alg), keyAlg) {
+		keyAlg = KeyAlgorithm(alg)
+	}
+
+	return fmt.Sprintf(akpThumbprintTemplate, keyAlg, newBuffer(pub).base64())
+}
+
 func rsaThumbprintInput(n *big.Int, e int) (string, error) {
 	return fmt.Sprintf(rsaThumbprintTemplate,
 		newBufferFromInt(uint64(e)).base64(),
@@ -204,6 +421,29 @@ func (k *JsonWebKey) Thumbprint(hash crypto.Hash) ([]byte, error) {
 		input, err = rsaThumbprintInput(key.N, key.E)
 	case *rsa.PrivateKey:
 		input, err = rsaThumbprintInput(key.N, key.E)
+	case ed25519.PublicKey:
+		input = fmt.Sprintf(okpThumbprintTemplate, "Ed25519", newBuffer(key).base64())
+	case ed25519.PrivateKey:
+		input = fmt.Sprintf(okpThumbprintTemplate, "Ed25519", newBuffer(key.Public().(ed25519.PublicKey)).base64())
+	case *ecdh.PublicKey:
+		input, err = x25519ThumbprintInput(key)
+	case *ecdh.PrivateKey:
+		input, err = x25519ThumbprintInput(key.PublicKey())
+	case *mldsa.PublicKey:
+		input = fmt.Sprintf(akpThumbprintTemplate, key.Parameters(), newBuffer(key.Bytes()).base64())
+	case *mldsa.PrivateKey:
+		pub := key.PublicKey()
+		input = fmt.Sprintf(akpThumbprintTemplate, pub.Parameters(), newBuffer(pub.Bytes()).base64())
+	case *mlkem.EncapsulationKey768:
+		input = mlkemThumbprintInput(k.Algorithm, ML_KEM_768, key.Bytes())
+	case *mlkem.EncapsulationKey1024:
+		input = mlkemThumbprintInput(k.Algorithm, ML_KEM_1024, key.Bytes())
+	case *mlkem.DecapsulationKey768:
+		input = mlkemThumbprintInput(k.Algorithm, ML_KEM_768, key.EncapsulationKey().Bytes())
+	case *mlkem.DecapsulationKey1024:
+		input = mlkemThumbprintInput(k.Algorithm, ML_KEM_1024, key.EncapsulationKey().Bytes())
+	case []byte:
+		input = fmt.Sprintf(octThumbprintTemplate, newBuffer(key).base64())
 	default:
 		return nil, fmt.Errorf("square/go-jose: unknown key type '%s'", reflect.TypeOf(key))
 	}
@@ -217,10 +457,97 @@ func (k *JsonWebKey) Thumbprint(hash crypto.Hash) ([]byte, error) {
 	return h.Sum(nil), nil
 }
 
+// Prefix of JWK thumbprint URIs (RFC 9278).
+const thumbprintURIPrefix = "urn:ietf:params:oauth:jwk-thumbprint:"
+
+// Names of the hash algorithms used in JWK thumbprint URIs, as registered in
+// the IANA Named Information Hash Algorithm registry.
+var thumbprintURIHashes = map[crypto.Hash]string{
+	crypto.SHA256: "sha-256",
+	crypto.SHA384: "sha-384",
+	crypto.SHA512: "sha-512",
+}
+
+// ThumbprintURI computes the JWK Thumbprint URI (RFC 9278) of a key using the
+// indicated hash algorithm, e.g. for use as a "kid" or in a "cnf" claim. Only
+// SHA-256, SHA-384 and SHA-512 are supported.
+func (k *JsonWebKey) ThumbprintURI(hash crypto.Hash) (string, error) {
+	name, ok := thumbprintURIHashes[hash]
+	if !ok {
+		return "", fmt.Errorf("square/go-jose: unsupported thumbprint hash '%s'", hash)
+	}
+
+	thumbprint, err := k.Thumbprint(hash)
+	if err != nil {
+		return "", err
+	}
+
+	return thumbprintURIPrefix + name + ":" + base64URLEncode(thumbprint), nil
+}
+
+// ParseThumbprintURI parses a JWK Thumbprint URI (RFC 9278), returning the hash
+// algorithm and the thumbprint. Compare the thumbprint against the one of a
+// key (see Thumbprint) to check whether the URI identifies that key.
+func ParseThumbprintURI(uri string) (crypto.Hash, []byte, error) {
+	if !strings.HasPrefix(uri, thumbprintURIPrefix) {
+		return 0, nil, errors.New("square/go-jose: not a JWK thumbprint URI")
+	}
+
+	parts := strings.Split(strings.TrimPrefix(uri, thumbprintURIPrefix), ":")
+	if len(parts) != 2 {
+		return 0, nil, errors.New("square/go-jose: malformed JWK thumbprint URI")
+	}
+
+	for hash, name := range thumbprintURIHashes {
+		if name != parts[0] {
+			continue
+		}
+
+		thumbprint, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil || len(thumbprint) != hash.Size() {
+			return 0, nil, errors.New("square/go-jose: malformed JWK thumbprint URI")
+		}
+		return hash, thumbprint, nil
+	}
+
+	return 0, nil, fmt.Errorf("square/go-jose: unsupported thumbprint hash '%s'", parts[0])
+}
+
+// Public returns a copy of the JWK with the private key replaced by its
+// public key. For public keys it returns an unchanged copy, and for symmetric
+// keys (or unknown key types) a JWK without key, which is not Valid.
+func (k *JsonWebKey) Public() JsonWebKey {
+	public := *k
+
+	switch key := k.Key.(type) {
+	case *ecdsa.PrivateKey:
+		public.Key = &key.PublicKey
+	case *rsa.PrivateKey:
+		public.Key = &key.PublicKey
+	case ed25519.PrivateKey:
+		public.Key = key.Public().(ed25519.PublicKey)
+	case *ecdh.PrivateKey:
+		public.Key = key.PublicKey()
+	case *mldsa.PrivateKey:
+		public.Key = key.PublicKey()
+	case *mlkem.DecapsulationKey768:
+		public.Key = key.EncapsulationKey()
+	case *mlkem.DecapsulationKey1024:
+		public.Key = key.EncapsulationKey()
+	default:
+		if !k.IsPublic() {
+			return JsonWebKey{}
+		}
+	}
+
+	return public
+}
+
 // IsPublic returns true if the JWK represents a public key (not symmetric, not private).
 func (k *JsonWebKey) IsPublic() bool {
 	switch k.Key.(type) {
-	case *ecdsa.PublicKey, *rsa.PublicKey:
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey, *ecdh.PublicKey, *mldsa.PublicKey,
+		*mlkem.EncapsulationKey768, *mlkem.EncapsulationKey1024:
 		return true
 	default:
 		return false
@@ -249,6 +576,19 @@ func (k *JsonWebKey) Valid() bool {
 		if key.N == nil || key.E == 0 || key.D == nil || len(key.Primes) < 2 {
 			return false
 		}
+	case ed25519.PublicKey:
+		if len(key) != ed25519.PublicKeySize {
+			return false
+		}
+	case ed25519.PrivateKey:
+		if len(key) != ed25519.PrivateKeySize {
+			return false
+		}
+	case *ecdh.PublicKey, *ecdh.PrivateKey, *mldsa.PublicKey, *mldsa.PrivateKey,
+		*mlkem.EncapsulationKey768, *mlkem.EncapsulationKey1024,
+		*mlkem.DecapsulationKey768, *mlkem.DecapsulationKey1024:
+		// Keys can only be created through crypto/ecdh, crypto/mldsa or
+		// crypto/mlkem, which validate them
 	default:
 		return false
 	}
@@ -283,6 +623,8 @@ func (key rawJsonWebKey) ecPublicKey() (*ecdsa.PublicKey, error) {
 		curve = elliptic.P384()
 	case "P-521":
 		curve = elliptic.P521()
+	case "secp256k1":
+		curve = josecipher.Secp256k1()
 	default:
 		return nil, fmt.Errorf("square/go-jose: unsupported elliptic curve '%s'", key.Crv)
 	}
@@ -402,6 +744,8 @@ func (key rawJsonWebKey) ecPrivateKey() (*ecdsa.PrivateKey, error) {
 		curve = elliptic.P384()
 	case "P-521":
 		curve = elliptic.P521()
+	case "secp256k1":
+		curve = josecipher.Secp256k1()
 	default:
 		return nil, fmt.Errorf("square/go-jose: unsupported elliptic curve '%s'", key.Crv)
 	}
@@ -449,6 +793,258 @@ func fromSymmetricKey(key []byte) (*rawJsonWebKey, error) {
 	}, nil
 }
 
+func (key rawJsonWebKey) edPublicKey() (ed25519.PublicKey, error) {
+	if key.Crv != "Ed25519" {
+		return nil, fmt.Errorf("square/go-jose: unsupported OKP curve '%s'", key.Crv)
+	}
+
+	if key.X == nil || len(key.X.bytes()) != ed25519.PublicKeySize {
+		return nil, errors.New("square/go-jose: invalid Ed25519 key, missing or malformed x value")
+	}
+
+	return ed25519.PublicKey(key.X.bytes()), nil
+}
+
+func fromEdPublicKey(pub ed25519.PublicKey) (*rawJsonWebKey, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("square/go-jose: invalid Ed25519 key")
+	}
+
+	return &rawJsonWebKey{
+		Kty: "OKP",
+		Crv: "Ed25519",
+		X:   newBuffer(pub),
+	}, nil
+}
+
+func (key rawJsonWebKey) edPrivateKey() (ed25519.PrivateKey, error) {
+	public, err := key.edPublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key.D.bytes()) != ed25519.SeedSize {
+		return nil, errors.New("square/go-jose: invalid Ed25519 private key, malformed d value")
+	}
+
+	// The private key is the seed, check that it matches the public key.
+	private := ed25519.NewKeyFromSeed(key.D.bytes())
+	if !public.Equal(private.Public()) {
+		return nil, errors.New("square/go-jose: invalid Ed25519 private key, x does not match d")
+	}
+
+	return private, nil
+}
+
+func fromEdPrivateKey(priv ed25519.PrivateKey) (*rawJsonWebKey, error) {
+	if len(priv) != ed25519.PrivateKeySize {
+		return nil, errors.New("square/go-jose: invalid Ed25519 private key")
+	}
+
+	raw, err := fromEdPublicKey(priv.Public().(ed25519.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+
+	raw.D = newBuffer(priv.Seed())
+
+	return raw, nil
+}
+
+func (key rawJsonWebKey) x25519PublicKey() (*ecdh.PublicKey, error) {
+	if key.X == nil {
+		return nil, errors.New("square/go-jose: invalid X25519 key, missing x value")
+	}
+
+	pub, err := ecdh.X25519().NewPublicKey(key.X.bytes())
+	if err != nil {
+		return nil, errors.New("square/go-jose: invalid X25519 key, malformed x value")
+	}
+
+	return pub, nil
+}
+
+func fromX25519PublicKey(pub *ecdh.PublicKey) (*rawJsonWebKey, error) {
+	if pub == nil || pub.Curve() != ecdh.X25519() {
+		return nil, errors.New("square/go-jose: unsupported ecdh key, only X25519 keys can be serialized")
+	}
+
+	return &rawJsonWebKey{
+		Kty: "OKP",
+		Crv: "X25519",
+		X:   newBuffer(pub.Bytes()),
+	}, nil
+}
+
+func (key rawJsonWebKey) x25519PrivateKey() (*ecdh.PrivateKey, error) {
+	public, err := key.x25519PublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	private, err := ecdh.X25519().NewPrivateKey(key.D.bytes())
+	if err != nil {
+		return nil, errors.New("square/go-jose: invalid X25519 private key, malformed d value")
+	}
+	if !public.Equal(private.PublicKey()) {
+		return nil, errors.New("square/go-jose: invalid X25519 private key, x does not match d")
+	}
+
+	return private, nil
+}
+
+func fromX25519PrivateKey(priv *ecdh.PrivateKey) (*rawJsonWebKey, error) {
+	if priv == nil {
+		return nil, errors.New("square/go-jose: invalid X25519 private key")
+	}
+
+	raw, err := fromX25519PublicKey(priv.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	raw.D = newBuffer(priv.Bytes())
+
+	return raw, nil
+}
+
+func (key rawJsonWebKey) mldsaPublicKey() (*mldsa.PublicKey, error) {
+	params, err := mldsaParameters(SignatureAlgorithm(key.Alg))
+	if err != nil {
+		return nil, fmt.Errorf("square/go-jose: unsupported AKP algorithm '%s'", key.Alg)
+	}
+
+	if key.Pub == nil {
+		return nil, errors.New("square/go-jose: invalid AKP key, missing pub value")
+	}
+
+	pub, err := mldsa.NewPublicKey(params, key.Pub.bytes())
+	if err != nil {
+		return nil, errors.New("square/go-jose: invalid AKP key, malformed pub value")
+	}
+
+	return pub, nil
+}
+
+func fromMLDSAPublicKey(pub *mldsa.PublicKey) (*rawJsonWebKey, error) {
+	if pub == nil {
+		return nil, errors.New("square/go-jose: invalid ML-DSA key")
+	}
+
+	return &rawJsonWebKey{
+		Kty: "AKP",
+		Alg: pub.Parameters().String(),
+		Pub: newBuffer(pub.Bytes()),
+	}, nil
+}
+
+func (key rawJsonWebKey) mldsaPrivateKey() (*mldsa.PrivateKey, error) {
+	public, err := key.mldsaPublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	private, err := mldsa.NewPrivateKey(public.Parameters(), key.Priv.bytes())
+	if err != nil {
+		return nil, errors.New("square/go-jose: invalid AKP private key, malformed priv value")
+	}
+	if !public.Equal(private.PublicKey()) {
+		return nil, errors.New("square/go-jose: invalid AKP private key, pub does not match priv")
+	}
+
+	return private, nil
+}
+
+func fromMLDSAPrivateKey(priv *mldsa.PrivateKey) (*rawJsonWebKey, error) {
+	if priv == nil {
+		return nil, errors.New("square/go-jose: invalid ML-DSA private key")
+	}
+
+	raw, err := fromMLDSAPublicKey(priv.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	raw.Priv = newBuffer(priv.Bytes())
+
+	return raw, nil
+}
+
+func (key rawJsonWebKey) mlkemPublicKey() (interface{}, error) {
+	keySize, _, err := mlkemParameters(KeyAlgorithm(key.Alg))
+	if err != nil {
+		return nil, fmt.Errorf("square/go-jose: unsupported AKP algorithm '%s'", key.Alg)
+	}
+
+	if key.Pub == nil {
+		return nil, errors.New("square/go-jose: invalid AKP key, missing pub value")
+	}
+
+	var pub interface{}
+	switch keySize {
+	case mlkem.EncapsulationKeySize768:
+		pub, err = mlkem.NewEncapsulationKey768(key.Pub.bytes())
+	case mlkem.EncapsulationKeySize1024:
+		pub, err = mlkem.NewEncapsulationKey1024(key.Pub.bytes())
+	}
+	if err != nil {
+		return nil, errors.New("square/go-jose: invalid AKP key, malformed pub value")
+	}
+
+	return pub, nil
+}
+
+func fromMLKEMPublicKey(alg KeyAlgorithm, pub []byte) *rawJsonWebKey {
+	return &rawJsonWebKey{
+		Kty: "AKP",
+		Alg: string(alg),
+		Pub: newBuffer(pub),
+	}
+}
+
+func (key rawJsonWebKey) mlkemPrivateKey() (interface{}, error) {
+	keySize, _, err := mlkemParameters(KeyAlgorithm(key.Alg))
+	if err != nil {
+		return nil, fmt.Errorf("square/go-jose: unsupported AKP algorithm '%s'", key.Alg)
+	}
+
+	if key.Pub == nil {
+		return nil, errors.New("square/go-jose: invalid AKP key, missing pub value")
+	}
+
+	var private interface{}
+	var pub []byte
+	switch keySize {
+	case mlkem.EncapsulationKeySize768:
+		var dk *mlkem.DecapsulationKey768
+		dk, err = mlkem.NewDecapsulationKey768(key.Priv.bytes())
+		if err == nil {
+			private, pub = dk, dk.EncapsulationKey().Bytes()
+		}
+	case mlkem.EncapsulationKeySize1024:
+		var dk *mlkem.DecapsulationKey1024
+		dk, err = mlkem.NewDecapsulationKey1024(key.Priv.bytes())
+		if err == nil {
+			private, pub = dk, dk.EncapsulationKey().Bytes()
+		}
+	}
+	if err != nil {
+		return nil, errors.New("square/go-jose: invalid AKP private key, malformed priv value")
+	}
+	if !bytes.Equal(pub, key.Pub.bytes()) {
+		return nil, errors.New("square/go-jose: invalid AKP private key, pub does not match priv")
+	}
+
+	return private, nil
+}
+
+func fromMLKEMPrivateKey(alg KeyAlgorithm, pub, seed []byte) *rawJsonWebKey {
+	raw := fromMLKEMPublicKey(alg, pub)
+	raw.Priv = newBuffer(seed)
+
+	return raw
+}
+
 func (key rawJsonWebKey) symmetricKey() ([]byte, error) {
 	if key.K == nil {
 		return nil, fmt.Errorf("square/go-jose: invalid OCT (symmetric) key, missing k value")
@@ -19,16 +19,24 @@ package jose
 import (
 	"bytes"
 	"crypto"
+	"crypto/ecdh"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
+	"crypto/mldsa"
+	"crypto/mlkem"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/hex"
 	"fmt"
 	"math/big"
 	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/square/go-jose/cipher"
 	"github.com/square/go-jose/json"
 )
 
@@ -533,6 +541,57 @@ func TestThumbprint(t *testing.T) {
 	}
 }
 
+func TestThumbprintURI(t *testing.T) {
+	var jwk JsonWebKey
+	if err := jwk.UnmarshalJSON([]byte(cookbookJWKs[0])); err != nil {
+		t.Fatal(err)
+	}
+	expected := "urn:ietf:params:oauth:jwk-thumbprint:sha-256:" + base64URLEncode(fromHexBytes(cookbookJWKThumbprints[0]))
+
+	uri, err := jwk.ThumbprintURI(crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri != expected {
+		t.Error("incorrect thumbprint URI:", uri, expected)
+	}
+
+	hash, thumbprint, err := ParseThumbprintURI(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp, _ := jwk.Thumbprint(crypto.SHA256)
+	if hash != crypto.SHA256 || !bytes.Equal(thumbprint, tp) {
+		t.Error("parsed thumbprint URI does not match key")
+	}
+
+	uri, err = jwk.ThumbprintURI(crypto.SHA512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash, _, err := ParseThumbprintURI(uri); err != nil || hash != crypto.SHA512 {
+		t.Error("unable to parse SHA-512 thumbprint URI", uri, err)
+	}
+
+	if _, err := jwk.ThumbprintURI(crypto.SHA1); err == nil {
+		t.Error("should not create thumbprint URI with SHA-1")
+	}
+
+	invalid := []string{
+		"urn:ietf:params:oauth:jwk-thumbprint:sha-256",
+		"urn:ietf:params:oauth:jwk-thumbprint:sha-1:NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs",
+		"urn:ietf:params:oauth:jwk-thumbprint:sha-256:NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9X",
+		"urn:ietf:params:oauth:jwk-thumbprint:sha-256:NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs=",
+		"urn:ietf:params:oauth:jwk-thumbprint:sha-256:NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs:x",
+		"urn:example:NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs",
+	}
+	for _, uri := range invalid {
+		if _, _, err := ParseThumbprintURI(uri); err == nil {
+			t.Error("should not parse invalid thumbprint URI", uri)
+		}
+	}
+}
+
 func TestMarshalUnmarshalJWKSet(t *testing.T) {
 	jwk1 := JsonWebKey{Key: rsaTestKey, KeyID: "ABCDEFG", Algorithm: "foo"}
 	jwk2 := JsonWebKey{Key: rsaTestKey, KeyID: "GFEDCBA", Algorithm: "foo"}
@@ -660,3 +719,390 @@ func TestJWKValid(t *testing.T) {
 		}
 	}
 }
+
+func TestJWKEd25519(t *testing.T) {
+	// Examples from RFC 8037 appendix A
+	private := `{"kty":"OKP","crv":"Ed25519","d":"nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`
+	public := `{"kty":"OKP","crv":"Ed25519","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`
+
+	var priv, pub JsonWebKey
+	if err := priv.UnmarshalJSON([]byte(private)); err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.UnmarshalJSON([]byte(public)); err != nil {
+		t.Fatal(err)
+	}
+
+	privKey, ok := priv.Key.(ed25519.PrivateKey)
+	if !ok || !priv.Valid() || priv.IsPublic() {
+		t.Fatal("expected valid Ed25519 private key")
+	}
+	pubKey, ok := pub.Key.(ed25519.PublicKey)
+	if !ok || !pub.Valid() || !pub.IsPublic() {
+		t.Fatal("expected valid Ed25519 public key")
+	}
+	if !pubKey.Equal(privKey.Public()) {
+		t.Error("public key does not match private key")
+	}
+
+	for _, key := range []JsonWebKey{priv, pub} {
+		tp, err := key.Thumbprint(crypto.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if base64URLEncode(tp) != "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k" {
+			t.Error("unexpected thumbprint", base64URLEncode(tp))
+		}
+	}
+
+	// Round trip
+	out, err := json.Marshal(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var priv2 JsonWebKey
+	if err := priv2.UnmarshalJSON(out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(priv2.Key.(ed25519.PrivateKey), privKey) {
+		t.Error("private key did not round trip", string(out))
+	}
+
+	invalid := []string{
+		// Unsupported curve
+		`{"kty":"OKP","crv":"X448","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`,
+		// Short public key
+		`{"kty":"OKP","crv":"Ed25519","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcH"}`,
+		// Private key not matching public key
+		`{"kty":"OKP","crv":"Ed25519","d":"AWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`,
+	}
+	for _, data := range invalid {
+		var key JsonWebKey
+		if err := key.UnmarshalJSON([]byte(data)); err == nil {
+			t.Error("should reject invalid key", data)
+		}
+	}
+}
+
+func TestJWKX25519(t *testing.T) {
+	// Example from RFC 8037 appendix A.6
+	private := `{"kty":"OKP","crv":"X25519","d":"dwdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25LCo","x":"hSDwCYkwp1R0i33ctD73Wg2_Og0mOBr066SpjqqbTmo"}`
+
+	var priv JsonWebKey
+	if err := priv.UnmarshalJSON([]byte(private)); err != nil {
+		t.Fatal(err)
+	}
+	privKey, ok := priv.Key.(*ecdh.PrivateKey)
+	if !ok || !priv.Valid() || priv.IsPublic() {
+		t.Fatal("expected valid X25519 private key")
+	}
+
+	pub := JsonWebKey{Key: privKey.PublicKey()}
+	if !pub.IsPublic() {
+		t.Error("expected X25519 public key")
+	}
+
+	out, err := json.Marshal(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != `{"kty":"OKP","crv":"X25519","x":"hSDwCYkwp1R0i33ctD73Wg2_Og0mOBr066SpjqqbTmo"}` {
+		t.Error("unexpected serialization of public key", string(out))
+	}
+
+	tp1, err := priv.Thumbprint(crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp2, err := pub.Thumbprint(crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tp1, tp2) {
+		t.Error("thumbprints of public and private key do not match")
+	}
+
+	// Round trip
+	out, err = json.Marshal(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var priv2 JsonWebKey
+	if err := priv2.UnmarshalJSON(out); err != nil {
+		t.Fatal(err)
+	}
+	if !privKey.Equal(priv2.Key) {
+		t.Error("private key did not round trip", string(out))
+	}
+
+	// Only X25519 keys can be serialized
+	p256Key, _ := ecTestKey256.ECDH()
+	if _, err := json.Marshal(JsonWebKey{Key: p256Key.PublicKey()}); err == nil {
+		t.Error("should not serialize ecdh key on P-256")
+	}
+
+	// Private key not matching public key
+	mismatched := `{"kty":"OKP","crv":"X25519","d":"AwdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25LCo","x":"hSDwCYkwp1R0i33ctD73Wg2_Og0mOBr066SpjqqbTmo"}`
+	var key JsonWebKey
+	if err := key.UnmarshalJSON([]byte(mismatched)); err == nil {
+		t.Error("should reject mismatched X25519 private key")
+	}
+}
+
+func TestJWKMLDSA(t *testing.T) {
+	key, err := mldsa.GenerateKey(mldsa.MLDSA65())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []interface{}{key, key.PublicKey()} {
+		out, err := json.Marshal(JsonWebKey{Key: k, KeyID: "pq"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(out), `"kty":"AKP"`) || !strings.Contains(string(out), `"alg":"ML-DSA-65"`) {
+			t.Error("expected AKP key with ML-DSA-65 alg", string(out))
+		}
+
+		var jwk JsonWebKey
+		if err := jwk.UnmarshalJSON(out); err != nil {
+			t.Fatal(err)
+		}
+		if !jwk.Valid() || jwk.Algorithm != "ML-DSA-65" || jwk.KeyID != "pq" {
+			t.Error("AKP key did not round trip", string(out))
+		}
+
+		var public *mldsa.PublicKey
+		switch parsed := jwk.Key.(type) {
+		case *mldsa.PrivateKey:
+			if !key.Equal(parsed) {
+				t.Error("private key did not round trip")
+			}
+			public = parsed.PublicKey()
+		case *mldsa.PublicKey:
+			if !jwk.IsPublic() {
+				t.Error("expected public key")
+			}
+			public = parsed
+		}
+		if !key.PublicKey().Equal(public) {
+			t.Error("public key did not round trip")
+		}
+
+		tp1, err := jwk.Thumbprint(crypto.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := sha256.Sum256([]byte(`{"alg":"ML-DSA-65","kty":"AKP","pub":"` + base64URLEncode(key.PublicKey().Bytes()) + `"}`))
+		if !bytes.Equal(tp1, expected[:]) {
+			t.Error("unexpected thumbprint")
+		}
+	}
+
+	// The algorithm is determined by the key
+	if _, err := json.Marshal(JsonWebKey{Key: key, Algorithm: "ML-DSA-44"}); err == nil {
+		t.Error("should not serialize ML-DSA-65 key with ML-DSA-44 alg")
+	}
+
+	other, _ := mldsa.GenerateKey(mldsa.MLDSA65())
+	invalid := []string{
+		// Missing or unknown alg
+		`{"kty":"AKP","pub":"` + base64URLEncode(key.PublicKey().Bytes()) + `"}`,
+		`{"kty":"AKP","alg":"ML-DSA-44","pub":"` + base64URLEncode(key.PublicKey().Bytes()) + `"}`,
+		// Private key not matching public key
+		`{"kty":"AKP","alg":"ML-DSA-65","pub":"` + base64URLEncode(key.PublicKey().Bytes()) + `","priv":"` + base64URLEncode(other.Bytes()) + `"}`,
+	}
+	for _, data := range invalid {
+		var jwk JsonWebKey
+		if err := jwk.UnmarshalJSON([]byte(data)); err == nil {
+			t.Error("should reject invalid AKP key")
+		}
+	}
+}
+
+func TestJWKMLKEM(t *testing.T) {
+	key, err := mlkem.GenerateKey768()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := base64URLEncode(key.EncapsulationKey().Bytes())
+
+	for _, k := range []interface{}{key, key.EncapsulationKey()} {
+		for _, alg := range []string{"", "ML-KEM-768+A192KW"} {
+			out, err := json.Marshal(JsonWebKey{Key: k, Algorithm: alg})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if alg == "" {
+				alg = "ML-KEM-768"
+			}
+			if !strings.Contains(string(out), `"kty":"AKP"`) || !strings.Contains(string(out), `"alg":"`+alg+`"`) {
+				t.Error("expected AKP key with alg", alg, string(out))
+			}
+
+			var jwk JsonWebKey
+			if err := jwk.UnmarshalJSON(out); err != nil {
+				t.Fatal(err)
+			}
+			if !jwk.Valid() || jwk.Algorithm != alg {
+				t.Error("AKP key did not round trip", string(out))
+			}
+
+			switch parsed := jwk.Key.(type) {
+			case *mlkem.DecapsulationKey768:
+				if !bytes.Equal(parsed.Bytes(), key.Bytes()) {
+					t.Error("private key did not round trip")
+				}
+			case *mlkem.EncapsulationKey768:
+				if !jwk.IsPublic() || !bytes.Equal(parsed.Bytes(), key.EncapsulationKey().Bytes()) {
+					t.Error("public key did not round trip")
+				}
+			default:
+				t.Errorf("unexpected key type %T", parsed)
+			}
+
+			tp, err := jwk.Thumbprint(crypto.SHA256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := sha256.Sum256([]byte(`{"alg":"` + alg + `","kty":"AKP","pub":"` + pub + `"}`))
+			if !bytes.Equal(tp, expected[:]) {
+				t.Error("unexpected thumbprint")
+			}
+		}
+	}
+
+	// The algorithm must use the parameter set of the key
+	for _, alg := range []string{"ML-KEM-1024", "ML-DSA-65"} {
+		if _, err := json.Marshal(JsonWebKey{Key: key, Algorithm: alg}); err == nil {
+			t.Error("should not serialize ML-KEM-768 key with alg", alg)
+		}
+	}
+
+	other, _ := mlkem.GenerateKey768()
+	invalid := []string{
+		// Wrong parameter set
+		`{"kty":"AKP","alg":"ML-KEM-1024","pub":"` + pub + `"}`,
+		// Private key not matching public key
+		`{"kty":"AKP","alg":"ML-KEM-768","pub":"` + pub + `","priv":"` + base64URLEncode(other.Bytes()) + `"}`,
+		// Missing public key
+		`{"kty":"AKP","alg":"ML-KEM-768","priv":"` + base64URLEncode(key.Bytes()) + `"}`,
+	}
+	for _, data := range invalid {
+		var jwk JsonWebKey
+		if err := jwk.UnmarshalJSON([]byte(data)); err == nil {
+			t.Error("should reject invalid AKP key", data)
+		}
+	}
+}
+
+func TestJWKSecp256k1(t *testing.T) {
+	key, err := ecdsa.GenerateKey(josecipher.Secp256k1(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []interface{}{key, &key.PublicKey} {
+		out, err := json.Marshal(JsonWebKey{Key: k})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(out), `"crv":"secp256k1"`) {
+			t.Error("expected secp256k1 crv value", string(out))
+		}
+
+		var jwk JsonWebKey
+		if err := jwk.UnmarshalJSON(out); err != nil {
+			t.Fatal(err)
+		}
+		if !jwk.Valid() {
+			t.Error("secp256k1 key should be valid")
+		}
+
+		var curve elliptic.Curve
+		switch parsed := jwk.Key.(type) {
+		case *ecdsa.PrivateKey:
+			curve = parsed.Curve
+		case *ecdsa.PublicKey:
+			curve = parsed.Curve
+		}
+		if curve != josecipher.Secp256k1() {
+			t.Error("key did not round trip with secp256k1 curve", string(out))
+		}
+	}
+
+	// A P-256 point is not on secp256k1
+	p256, err := json.Marshal(JsonWebKey{Key: &ecTestKey256.PublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jwk JsonWebKey
+	err = jwk.UnmarshalJSON([]byte(strings.Replace(string(p256), `"crv":"P-256"`, `"crv":"secp256k1"`, 1)))
+	if err == nil {
+		t.Error("should reject point not on secp256k1")
+	}
+}
+
+func TestJWKKeyOps(t *testing.T) {
+	verifyOnly := &JsonWebKey{Key: &ecTestKey256.PublicKey, KeyOps: []string{"verify"}}
+
+	if _, err := NewSigner(ES256, &JsonWebKey{Key: ecTestKey256, KeyOps: []string{"verify"}}); err == nil {
+		t.Error("should not sign with a verify-only key")
+	}
+
+	signer, err := NewSigner(ES256, ecTestKey256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := signer.Sign([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := obj.Verify(verifyOnly); err != nil {
+		t.Error("should verify with a verify-only key:", err)
+	}
+
+	encryptOnly := &JsonWebKey{Key: []byte("0123456789abcdef"), KeyOps: []string{"encrypt"}}
+	enc, err := NewEncrypter(A128KW, A128GCM, encryptOnly)
+	if err != nil {
+		t.Fatal("should encrypt with an encrypt-only key:", err)
+	}
+	jwe, err := enc.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jwe.Decrypt(encryptOnly); err == nil {
+		t.Error("should not decrypt with an encrypt-only key")
+	}
+	if _, err := jwe.Decrypt(&JsonWebKey{Key: encryptOnly.Key, KeyOps: []string{"unwrapKey"}}); err != nil {
+		t.Error("should decrypt with an unwrapKey key:", err)
+	}
+
+	// key_ops survives a JSON round trip
+	var parsed JsonWebKey
+	data, err := json.Marshal(verifyOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed.KeyOps, []string{"verify"}) {
+		t.Error("key_ops not preserved:", parsed.KeyOps)
+	}
+
+	// Contradictions with use, and duplicates, are rejected
+	invalid := []string{
+		`{"kty":"oct","k":"MTIz","use":"sig","key_ops":["encrypt"]}`,
+		`{"kty":"oct","k":"MTIz","use":"enc","key_ops":["sign"]}`,
+		`{"kty":"oct","k":"MTIz","key_ops":["sign","sign"]}`,
+	}
+	for _, data := range invalid {
+		if err := json.Unmarshal([]byte(data), &parsed); err == nil {
+			t.Error("should reject key with invalid key_ops:", data)
+		}
+	}
+	if _, err := NewSigner(HS256, &JsonWebKey{Key: []byte("secret"), Use: "enc", KeyOps: []string{"sign"}}); err == nil {
+		t.Error("should not use key with key_ops inconsistent with use")
+	}
+}
@@ -0,0 +1,445 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package jwks fetches and caches JWK Sets (RFC 7517) published at a URL,
+// such as the jwks_uri of an OpenID Connect provider.
+package jwks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/square/go-jose"
+	"github.com/square/go-jose/json"
+)
+
+// DefaultTTL is the time for which fetched keys are cached by default.
+const DefaultTTL = time.Hour
+
+// DefaultMinRefreshInterval is the default minimum time between fetches of a
+// key set triggered by unknown key IDs.
+const DefaultMinRefreshInterval = time.Minute
+
+// DefaultTimeout is the default time limit for fetching a key set.
+const DefaultTimeout = 30 * time.Second
+
+// Maximum size of a JWK Set document, to bound memory use.
+const maxResponseSize = 1 << 20
+
+// ErrKeyNotFound is returned when no key in the set matches an object.
+var ErrKeyNotFound = errors.New("square/go-jose/jwks: no matching key found in key set")
+
+// RemoteKeySet is a JWK Set fetched over HTTP, which is cached for TTL and
+// fetched again once it expires. Objects with a key ID that is not in the
+// cached set also cause the set to be fetched again, at most once every
+// MinRefreshInterval, so that keys added by the issuer are picked up
+// without waiting for the cache to expire. It's safe for concurrent use.
+//
+// Concurrent callers share a single fetch, which is done without blocking
+// callers that still have valid keys. The fetch isn't bound to the context of
+// any caller, but limited by Timeout; each caller stops waiting when its own
+// context is cancelled, without affecting the others. If a fetch fails, the keys that were fetched last
+// remain in use even after they expire, and the set isn't fetched again for
+// MinRefreshInterval.
+type RemoteKeySet struct {
+	// URL of the JWK Set document.
+	URL string
+
+	// TTL for which fetched keys are cached, DefaultTTL if zero.
+	TTL time.Duration
+
+	// MinRefreshInterval is the minimum time between fetches triggered by
+	// unknown key IDs, and between a failed fetch and the next attempt,
+	// DefaultMinRefreshInterval if zero.
+	MinRefreshInterval time.Duration
+
+	// Timeout for fetching the key set, DefaultTimeout if zero.
+	Timeout time.Duration
+
+	// Client used to fetch the key set, http.DefaultClient if nil.
+	Client *http.Client
+
+	mu       sync.Mutex
+	keys     []jose.JsonWebKey
+	fetched  time.Time
+	expires  time.Time
+	failed   time.Time
+	err      error
+	inflight *fetchCall
+	now      func() time.Time
+}
+
+// A fetch of the key set in progress, shared by concurrent callers.
+type fetchCall struct {
+	done chan struct{}
+	keys []jose.JsonWebKey
+	err  error
+}
+
+// NewRemoteKeySet creates a key set for the JWK Set document at the given URL.
+// Keys are fetched when first needed.
+func NewRemoteKeySet(url string) *RemoteKeySet {
+	return &RemoteKeySet{URL: url}
+}
+
+// Keys returns all keys in the set, fetching them if the cache has expired.
+func (r *RemoteKeySet) Keys() ([]jose.JsonWebKey, error) {
+	return r.KeysContext(context.Background())
+}
+
+// KeysContext is like Keys, but waiting for the keys to be fetched is aborted
+// if the context is cancelled.
+func (r *RemoteKeySet) KeysContext(ctx context.Context) ([]jose.JsonWebKey, error) {
+	r.mu.Lock()
+	if r.keys != nil && r.clock().Before(r.expires) {
+		keys := r.keys
+		r.mu.Unlock()
+		return keys, nil
+	}
+
+	return r.refresh(ctx)
+}
+
+// Key returns the keys in the set with the given key ID. The set is fetched
+// again if there is no such key (see RemoteKeySet).
+func (r *RemoteKeySet) Key(kid string) ([]jose.JsonWebKey, error) {
+	return r.KeyContext(context.Background(), kid)
+}
+
+// KeyContext is like Key, but waiting for the keys to be fetched is aborted if
+// the context is cancelled.
+func (r *RemoteKeySet) KeyContext(ctx context.Context, kid string) ([]jose.JsonWebKey, error) {
+	keys, err := r.KeysContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	set := jose.JsonWebKeySet{Keys: keys}
+	if matches := set.Key(kid); len(matches) > 0 {
+		return matches, nil
+	}
+
+	keys, err = r.refreshUnknown(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	set = jose.JsonWebKeySet{Keys: keys}
+	return set.Key(kid), nil
+}
+
+// RefreshInBackground fetches the keys now and then every TTL in a separate
+// goroutine, until the context is cancelled. This avoids fetching the keys
+// when verifying an object once the cache has expired. Errors are ignored:
+// the keys that were fetched last remain in use.
+func (r *RemoteKeySet) RefreshInBackground(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(r.ttl())
+		defer ticker.Stop()
+
+		for {
+			r.mu.Lock()
+			r.refresh(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Fetch the keys and update the cache. It's called with r.mu held, which it
+// releases. If a fetch is already in progress, its result is used instead.
+// The fetch runs in its own goroutine with a context that is detached from
+// the caller's (keeping its values), so that a caller giving up early doesn't
+// fail the fetch for everyone else waiting on it.
+func (r *RemoteKeySet) refresh(ctx context.Context) ([]jose.JsonWebKey, error) {
+	// Back off after a failed fetch, using the stale keys if there are any.
+	if !r.failed.IsZero() && r.clock().Before(r.failed.Add(r.minRefreshInterval())) {
+		keys, err := r.keys, r.err
+		r.mu.Unlock()
+		if keys != nil {
+			return keys, nil
+		}
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		r.mu.Unlock()
+		return nil, err
+	}
+
+	call := r.inflight
+	if call == nil {
+		call = &fetchCall{done: make(chan struct{})}
+		r.inflight = call
+		r.mu.Unlock()
+		go r.fetch(context.WithoutCancel(ctx), call)
+	} else {
+		r.mu.Unlock()
+	}
+
+	select {
+	case <-call.done:
+		return call.keys, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Fetch the keys without holding r.mu and store the result in the cache and
+// in the call. On error the stale keys, if any, are kept and returned.
+func (r *RemoteKeySet) fetch(ctx context.Context, call *fetchCall) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout())
+	defer cancel()
+
+	now := r.clock()
+	keys, err := fetchKeys(ctx, r.client(), r.URL)
+
+	r.mu.Lock()
+	r.inflight = nil
+	r.fetched = now
+	if err == nil {
+		r.keys = keys
+		r.expires = now.Add(r.ttl())
+		r.failed = time.Time{}
+		r.err = nil
+	} else {
+		r.failed = now
+		r.err = err
+		if r.keys != nil {
+			keys, err = r.keys, nil
+		}
+	}
+	call.keys, call.err = keys, err
+	r.mu.Unlock()
+
+	close(call.done)
+}
+
+// Fetch the keys again after encountering an unknown key ID, unless they
+// were fetched less than MinRefreshInterval ago.
+func (r *RemoteKeySet) refreshUnknown(ctx context.Context) ([]jose.JsonWebKey, error) {
+	r.mu.Lock()
+	if r.keys != nil && r.clock().Before(r.fetched.Add(r.minRefreshInterval())) {
+		keys := r.keys
+		r.mu.Unlock()
+		return keys, nil
+	}
+
+	return r.refresh(ctx)
+}
+
+func (r *RemoteKeySet) clock() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+func (r *RemoteKeySet) ttl() time.Duration {
+	if r.TTL == 0 {
+		return DefaultTTL
+	}
+	return r.TTL
+}
+
+func (r *RemoteKeySet) minRefreshInterval() time.Duration {
+	if r.MinRefreshInterval == 0 {
+		return DefaultMinRefreshInterval
+	}
+	return r.MinRefreshInterval
+}
+
+func (r *RemoteKeySet) timeout() time.Duration {
+	if r.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return r.Timeout
+}
+
+func (r *RemoteKeySet) client() *http.Client {
+	if r.Client == nil {
+		return http.DefaultClient
+	}
+	return r.Client
+}
+
+// Resolve returns the key to use for an object with the given header, i.e.
+// the first key with the key ID (and algorithm, if set on the key) of the
+// header. If the header has no key ID, the only key in the set is used. The
+// set is fetched again if there is no key with the key ID (see RemoteKeySet).
+// It returns nil if no key matches, so it can be used directly as a resolver
+// for JsonWebEncryption.DecryptWithResolver. A RemoteKeySet is also a
+// jose.KeyResolver, for use with VerifyContext and DecryptContext.
+func (r *RemoteKeySet) Resolve(header jose.JoseHeader) (interface{}, error) {
+	return r.ResolveContext(context.Background(), header)
+}
+
+// ResolveContext is like Resolve, but waiting for the keys to be fetched is
+// aborted if the context is cancelled.
+func (r *RemoteKeySet) ResolveContext(ctx context.Context, header jose.JoseHeader) (interface{}, error) {
+	keys, err := r.KeysContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	key := findKey(keys, header)
+	if key == nil && header.KeyID != "" {
+		keys, err = r.refreshUnknown(ctx)
+		if err != nil {
+			return nil, err
+		}
+		key = findKey(keys, header)
+	}
+
+	if key == nil {
+		return nil, nil
+	}
+	return key, nil
+}
+
+// Verify validates the signature on the object with the key for its header
+// (see Resolve) and returns the payload. Like JsonWebSignature.Verify, it
+// doesn't support multiple signatures.
+func (r *RemoteKeySet) Verify(obj *jose.JsonWebSignature) ([]byte, error) {
+	return r.VerifyContext(context.Background(), obj)
+}
+
+// VerifyContext is like Verify, but waiting for the keys to be fetched is
+// aborted if the context is cancelled.
+func (r *RemoteKeySet) VerifyContext(ctx context.Context, obj *jose.JsonWebSignature) ([]byte, error) {
+	if len(obj.Signatures) != 1 {
+		return nil, errors.New("square/go-jose/jwks: expecting exactly one signature")
+	}
+
+	key, err := r.ResolveContext(ctx, obj.Signatures[0].Header)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, ErrKeyNotFound
+	}
+
+	return obj.Verify(key)
+}
+
+// EncryptionKey returns the first public key in the set which may be used
+// for encryption with the given key management algorithm, to select the
+// recipient key for NewEncrypter. Keys with "use" other than "enc", or with
+// a different "alg", are skipped.
+func (r *RemoteKeySet) EncryptionKey(alg jose.KeyAlgorithm) (*jose.JsonWebKey, error) {
+	return r.EncryptionKeyContext(context.Background(), alg)
+}
+
+// EncryptionKeyContext is like EncryptionKey, but waiting for the keys to be
+// fetched is aborted if the context is cancelled.
+func (r *RemoteKeySet) EncryptionKeyContext(ctx context.Context, alg jose.KeyAlgorithm) (*jose.JsonWebKey, error) {
+	keys, err := r.KeysContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range keys {
+		key := &keys[i]
+		if key.IsPublic() && (key.Use == "" || key.Use == "enc") && matchesAlgorithm(key, string(alg)) {
+			return key, nil
+		}
+	}
+
+	return nil, ErrKeyNotFound
+}
+
+// Find the key for an object with the given header, see Resolve.
+func findKey(keys []jose.JsonWebKey, header jose.JoseHeader) *jose.JsonWebKey {
+	if header.KeyID == "" {
+		if len(keys) == 1 && matchesAlgorithm(&keys[0], header.Algorithm) {
+			return &keys[0]
+		}
+		return nil
+	}
+
+	for i := range keys {
+		if keys[i].KeyID == header.KeyID && matchesAlgorithm(&keys[i], header.Algorithm) {
+			return &keys[i]
+		}
+	}
+
+	return nil
+}
+
+// Check that the key may be used with the given algorithm.
+func matchesAlgorithm(key *jose.JsonWebKey, alg string) bool {
+	return key.Algorithm == "" || key.Algorithm == alg
+}
+
+// Fetch and parse the JWK Set document at the given URL.
+func fetchKeys(ctx context.Context, client *http.Client, url string) ([]jose.JsonWebKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("square/go-jose/jwks: unable to fetch keys: %v", err)
+	}
+	req.Header.Set("Accept", "application/jwk-set+json, application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("square/go-jose/jwks: unable to fetch keys: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("square/go-jose/jwks: unable to fetch keys: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("square/go-jose/jwks: unable to fetch keys: %v", err)
+	}
+	if len(body) > maxResponseSize {
+		return nil, errors.New("square/go-jose/jwks: key set document too large")
+	}
+
+	return parseKeys(body)
+}
+
+// Parse a JWK Set document. Keys which can't be parsed, e.g. of types not
+// supported by this library, are skipped rather than failing the whole set.
+func parseKeys(data []byte) ([]jose.JsonWebKey, error) {
+	var raw struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("square/go-jose/jwks: invalid key set: %v", err)
+	}
+
+	keys := make([]jose.JsonWebKey, 0, len(raw.Keys))
+	for _, data := range raw.Keys {
+		var key jose.JsonWebKey
+		if key.UnmarshalJSON(data) == nil {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
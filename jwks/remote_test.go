@@ -0,0 +1,621 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwks
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/square/go-jose"
+	"github.com/square/go-jose/json"
+)
+
+var payload = []byte("Lorem ipsum dolor sit amet")
+
+// Serve the public keys of the given private keys as a JWK Set, counting the
+// number of requests.
+func serveKeys(t *testing.T, requests *int32, keys ...*jose.JsonWebKey) *httptest.Server {
+	set := jose.JsonWebKeySet{}
+	for _, key := range keys {
+		set.Keys = append(set.Keys, key.Public())
+	}
+	document, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(document)
+	}))
+}
+
+func generateKey(t *testing.T, alg jose.SignatureAlgorithm, kid string) *jose.JsonWebKey {
+	key, err := jose.GenerateSigningKey(alg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.KeyID = kid
+	return key
+}
+
+func sign(t *testing.T, key *jose.JsonWebKey) *jose.JsonWebSignature {
+	signer, err := jose.NewSigner(jose.SignatureAlgorithm(key.Algorithm), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer.SetEmbedJwk(false)
+	obj, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialized, err := obj.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err = jose.ParseSigned(serialized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+func TestRemoteKeySetVerify(t *testing.T) {
+	key1 := generateKey(t, jose.ES256, "key-1")
+	key2 := generateKey(t, jose.EdDSA, "key-2")
+	unknown := generateKey(t, jose.ES256, "key-3")
+
+	var requests int32
+	server := serveKeys(t, &requests, key1, key2)
+	defer server.Close()
+
+	keySet := NewRemoteKeySet(server.URL)
+
+	for _, key := range []*jose.JsonWebKey{key1, key2} {
+		output, err := keySet.Verify(sign(t, key))
+		if err != nil {
+			t.Error("unable to verify with remote key", key.KeyID, err)
+		}
+		if !bytes.Equal(output, payload) {
+			t.Error("payload mismatch")
+		}
+	}
+
+	if _, err := keySet.Verify(sign(t, unknown)); err != ErrKeyNotFound {
+		t.Error("should not find key for unknown key ID", err)
+	}
+
+	// Key ID matches, but not the key
+	unknown.KeyID = "key-1"
+	if _, err := keySet.Verify(sign(t, unknown)); err != jose.ErrCryptoFailure {
+		t.Error("should not verify signature by other key", err)
+	}
+
+	if requests != 1 {
+		t.Error("keys should be fetched once, got", requests)
+	}
+}
+
+func TestRemoteKeySetCache(t *testing.T) {
+	var requests int32
+	server := serveKeys(t, &requests, generateKey(t, jose.ES256, "key-1"))
+	defer server.Close()
+
+	now := time.Now()
+	keySet := NewRemoteKeySet(server.URL)
+	keySet.TTL = time.Minute
+	keySet.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		keys, err := keySet.Key("key-1")
+		if err != nil || len(keys) != 1 {
+			t.Fatal("unable to fetch keys", err)
+		}
+	}
+	if requests != 1 {
+		t.Error("keys should be cached, got requests:", requests)
+	}
+
+	now = now.Add(time.Minute)
+	if _, err := keySet.Keys(); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Error("keys should be fetched again after TTL, got requests:", requests)
+	}
+}
+
+func TestRemoteKeySetEncryptionKey(t *testing.T) {
+	sigKey := generateKey(t, jose.ES256, "sig")
+	encKey, err := jose.GenerateEncryptionKey(jose.ECDH_ES)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var requests int32
+	server := serveKeys(t, &requests, sigKey, encKey)
+	defer server.Close()
+
+	keySet := NewRemoteKeySet(server.URL)
+
+	recipient, err := keySet.EncryptionKey(jose.ECDH_ES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recipient.KeyID != encKey.KeyID {
+		t.Fatal("selected wrong recipient key", recipient.KeyID)
+	}
+
+	encrypter, err := jose.NewEncrypter(jose.ECDH_ES, jose.A128GCM, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := encrypter.Encrypt(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := obj.Decrypt(encKey)
+	if err != nil || !bytes.Equal(output, payload) {
+		t.Error("unable to decrypt for selected recipient", err)
+	}
+
+	if _, err := keySet.EncryptionKey(jose.RSA_OAEP); err != ErrKeyNotFound {
+		t.Error("should not find key for other algorithm", err)
+	}
+}
+
+func TestRemoteKeySetDecryptWithResolver(t *testing.T) {
+	key, err := jose.GenerateEncryptionKey(jose.A128KW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	document, err := json.Marshal(jose.JsonWebKeySet{Keys: []jose.JsonWebKey{*key}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(document)
+	}))
+	defer server.Close()
+
+	encrypter, err := jose.NewEncrypter(jose.A128KW, jose.A128GCM, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := encrypter.Encrypt(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keySet := NewRemoteKeySet(server.URL)
+	_, _, output, err := obj.DecryptWithResolver(keySet.Resolve)
+	if err != nil || !bytes.Equal(output, payload) {
+		t.Error("unable to decrypt with resolved key", err)
+	}
+}
+
+func TestRemoteKeySetErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		case "/invalid":
+			w.Write([]byte("{"))
+		case "/unsupported":
+			w.Write([]byte(`{"keys":[{"kty":"XYZ","kid":"a"},{"kty":"oct","kid":"b","k":"AAAA"}]}`))
+		}
+	}))
+	defer server.Close()
+
+	for _, path := range []string{"/missing", "/invalid"} {
+		if _, err := NewRemoteKeySet(server.URL + path).Keys(); err == nil {
+			t.Error("should fail to fetch keys from", path)
+		}
+	}
+
+	// Unsupported keys are skipped
+	keys, err := NewRemoteKeySet(server.URL + "/unsupported").Keys()
+	if err != nil || len(keys) != 1 || keys[0].KeyID != "b" {
+		t.Error("should skip unsupported keys", keys, err)
+	}
+}
+
+func TestRemoteKeySetUnknownKeyID(t *testing.T) {
+	key1 := generateKey(t, jose.ES256, "key-1")
+	key2 := generateKey(t, jose.ES256, "key-2")
+
+	var requests int32
+	var rotated atomic.Bool
+	document1, _ := json.Marshal(jose.JsonWebKeySet{Keys: []jose.JsonWebKey{key1.Public()}})
+	document2, _ := json.Marshal(jose.JsonWebKeySet{Keys: []jose.JsonWebKey{key1.Public(), key2.Public()}})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if rotated.Load() {
+			w.Write(document2)
+		} else {
+			w.Write(document1)
+		}
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	keySet := NewRemoteKeySet(server.URL)
+	keySet.MinRefreshInterval = time.Minute
+	keySet.now = func() time.Time { return now }
+
+	if _, err := keySet.Verify(sign(t, key1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unknown key IDs don't cause fetches within the refresh interval
+	for i := 0; i < 3; i++ {
+		if _, err := keySet.Verify(sign(t, key2)); err != ErrKeyNotFound {
+			t.Error("should not find key before rotation", err)
+		}
+	}
+	if requests != 1 {
+		t.Error("fetches for unknown key IDs should be rate limited, got requests:", requests)
+	}
+
+	// Issuer adds a new key, which is fetched once the interval has passed
+	rotated.Store(true)
+	now = now.Add(time.Minute)
+	if _, err := keySet.Verify(sign(t, key2)); err != nil {
+		t.Error("should fetch new key for unknown key ID", err)
+	}
+	if keys, err := keySet.Key("key-2"); err != nil || len(keys) != 1 {
+		t.Error("should find new key", err)
+	}
+	if requests != 2 {
+		t.Error("unexpected number of requests:", requests)
+	}
+}
+
+func TestRemoteKeySetContext(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	keySet := NewRemoteKeySet(server.URL)
+	if _, err := keySet.KeysContext(ctx); err == nil {
+		t.Error("fetching keys should be aborted when context is cancelled")
+	}
+}
+
+func TestRemoteKeySetResolverContext(t *testing.T) {
+	key := generateKey(t, jose.ES256, "key-1")
+
+	var requests int32
+	server := serveKeys(t, &requests, key)
+	defer server.Close()
+
+	keySet := NewRemoteKeySet(server.URL)
+
+	output, err := sign(t, key).VerifyContext(context.Background(), keySet)
+	if err != nil || !bytes.Equal(output, payload) {
+		t.Error("unable to verify with key set as resolver", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := sign(t, key).VerifyContext(ctx, keySet); err != context.Canceled {
+		t.Error("should not verify with cancelled context", err)
+	}
+
+	encKey, err := jose.GenerateEncryptionKey(jose.A128KW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encKey.KeyID = "key-2"
+	document, err := json.Marshal(jose.JsonWebKeySet{Keys: []jose.JsonWebKey{*encKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(document)
+	}))
+	defer encServer.Close()
+
+	encrypter, err := jose.NewEncrypter(jose.A128KW, jose.A128GCM, encKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := encrypter.Encrypt(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err = obj.DecryptContext(context.Background(), NewRemoteKeySet(encServer.URL))
+	if err != nil || !bytes.Equal(output, payload) {
+		t.Error("unable to decrypt with key set as resolver", err)
+	}
+}
+
+type countingTransport struct {
+	requests int32
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.requests, 1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestRemoteKeySetClient(t *testing.T) {
+	var requests int32
+	server := serveKeys(t, &requests, generateKey(t, jose.ES256, "key-1"))
+	defer server.Close()
+
+	transport := &countingTransport{}
+	keySet := NewRemoteKeySet(server.URL)
+	keySet.Client = &http.Client{Transport: transport}
+
+	if _, err := keySet.Keys(); err != nil {
+		t.Fatal(err)
+	}
+	if transport.requests != 1 {
+		t.Error("keys should be fetched with configured client")
+	}
+}
+
+func TestRemoteKeySetRefreshInBackground(t *testing.T) {
+	var requests int32
+	server := serveKeys(t, &requests, generateKey(t, jose.ES256, "key-1"))
+	defer server.Close()
+
+	keySet := NewRemoteKeySet(server.URL)
+	keySet.TTL = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	keySet.RefreshInBackground(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&requests) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	if atomic.LoadInt32(&requests) < 3 {
+		t.Error("keys should be refreshed in background")
+	}
+}
+
+func TestRemoteKeySetConcurrentFetch(t *testing.T) {
+	key := generateKey(t, jose.ES256, "key-1")
+	document, _ := json.Marshal(jose.JsonWebKeySet{Keys: []jose.JsonWebKey{key.Public()}})
+
+	var requests int32
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		started <- struct{}{}
+		<-release
+		w.Write(document)
+	}))
+	defer server.Close()
+
+	keySet := NewRemoteKeySet(server.URL)
+
+	results := make(chan error, 5)
+	go func() {
+		_, err := keySet.Keys()
+		results <- err
+	}()
+	<-started
+
+	// Other callers wait for the same fetch, but honour their own context
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := keySet.KeysContext(ctx); err != context.DeadlineExceeded {
+		t.Error("waiting for fetch should be aborted when context is cancelled", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		go func() {
+			_, err := keySet.Keys()
+			results <- err
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < 5; i++ {
+		if err := <-results; err != nil {
+			t.Error("unable to fetch keys", err)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Error("concurrent callers should share a fetch, got requests:", n)
+	}
+}
+
+func TestRemoteKeySetDetachedFetch(t *testing.T) {
+	key := generateKey(t, jose.ES256, "key-1")
+	document, _ := json.Marshal(jose.JsonWebKeySet{Keys: []jose.JsonWebKey{key.Public()}})
+
+	var requests int32
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		started <- struct{}{}
+		<-release
+		w.Write(document)
+	}))
+	defer server.Close()
+
+	keySet := NewRemoteKeySet(server.URL)
+
+	// The first caller starts the fetch with a short deadline, which must not
+	// fail the fetch for a second caller without one.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	first := make(chan error, 1)
+	go func() {
+		_, err := keySet.KeysContext(ctx)
+		first <- err
+	}()
+	<-started
+
+	second := make(chan error, 1)
+	go func() {
+		_, err := keySet.KeysContext(context.Background())
+		second <- err
+	}()
+
+	if err := <-first; err != context.DeadlineExceeded {
+		t.Error("first caller should stop waiting at its deadline", err)
+	}
+	close(release)
+	if err := <-second; err != nil {
+		t.Error("second caller should get keys fetched for the first", err)
+	}
+
+	keySet.mu.Lock()
+	failed := keySet.failed
+	keySet.mu.Unlock()
+	if !failed.IsZero() {
+		t.Error("cancelled caller should not be recorded as a failed fetch")
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Error("callers should share a fetch, got requests:", n)
+	}
+}
+
+func TestRemoteKeySetTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	keySet := NewRemoteKeySet(server.URL)
+	keySet.Timeout = 10 * time.Millisecond
+	if _, err := keySet.Keys(); err == nil {
+		t.Error("fetching keys should fail after the timeout")
+	}
+
+	keySet.mu.Lock()
+	failed := keySet.failed
+	keySet.mu.Unlock()
+	if failed.IsZero() {
+		t.Error("timed out fetch should be recorded as a failure")
+	}
+}
+
+func TestRemoteKeySetStaleKeys(t *testing.T) {
+	key := generateKey(t, jose.ES256, "key-1")
+	document, _ := json.Marshal(jose.JsonWebKeySet{Keys: []jose.JsonWebKey{key.Public()}})
+
+	var requests int32
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if failing.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(document)
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	keySet := NewRemoteKeySet(server.URL)
+	keySet.TTL = time.Minute
+	keySet.MinRefreshInterval = 10 * time.Second
+	keySet.now = func() time.Time { return now }
+
+	if _, err := keySet.Keys(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys that were fetched last are used after the TTL if the fetch fails
+	failing.Store(true)
+	now = now.Add(time.Minute)
+	if _, err := keySet.Verify(sign(t, key)); err != nil {
+		t.Error("should use stale keys when fetch fails", err)
+	}
+	if requests != 2 {
+		t.Error("unexpected number of requests:", requests)
+	}
+
+	// Failed fetches are rate limited
+	for i := 0; i < 3; i++ {
+		if keys, err := keySet.Keys(); err != nil || len(keys) != 1 {
+			t.Error("should use stale keys when fetch fails", err)
+		}
+	}
+	if requests != 2 {
+		t.Error("failed fetches should be rate limited, got requests:", requests)
+	}
+
+	// Keys are fetched again once the interval has passed
+	failing.Store(false)
+	now = now.Add(10 * time.Second)
+	if _, err := keySet.Keys(); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 3 {
+		t.Error("keys should be fetched again after interval, got requests:", requests)
+	}
+}
+
+func TestRemoteKeySetFailureBackoff(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	keySet := NewRemoteKeySet(server.URL)
+	keySet.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if _, err := keySet.Keys(); err == nil {
+			t.Error("should fail to fetch keys")
+		}
+	}
+	if requests != 1 {
+		t.Error("failed fetches should be rate limited, got requests:", requests)
+	}
+
+	now = now.Add(DefaultMinRefreshInterval)
+	if _, err := keySet.Keys(); err == nil {
+		t.Error("should fail to fetch keys")
+	}
+	if requests != 2 {
+		t.Error("keys should be fetched again after interval, got requests:", requests)
+	}
+}
@@ -17,6 +17,7 @@
 package jose
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"strings"
@@ -24,15 +25,54 @@ import (
 	"github.com/square/go-jose/json"
 )
 
+// DefaultMaxSignatures is the maximum number of signatures accepted when
+// parsing a JWS object in full serialization format, unless another limit is
+// set in ParseOptions. This bounds the work done on parsing and verifying a
+// hostile message.
+const DefaultMaxSignatures = 250
+
 // rawJsonWebSignature represents a raw JWS JSON object. Used for parsing/serializing.
 type rawJsonWebSignature struct {
-	Payload    *byteBuffer        `json:"payload,omitempty"`
+	Payload    *rawPayload        `json:"payload,omitempty"`
 	Signatures []rawSignatureInfo `json:"signatures,omitempty"`
 	Protected  *byteBuffer        `json:"protected,omitempty"`
 	Header     *rawHeader         `json:"header,omitempty"`
 	Signature  *byteBuffer        `json:"signature,omitempty"`
 }
 
+// rawPayload represents the payload of a JWS object as serialized. It is only
+// base64url encoded if the b64 header is absent or true (RFC 7797), so it can
+// only be decoded once the protected header has been parsed.
+type rawPayload struct {
+	serialized string
+}
+
+func newRawPayload(payload []byte, unencoded bool) *rawPayload {
+	if payload == nil {
+		return nil
+	}
+	if unencoded {
+		return &rawPayload{serialized: string(payload)}
+	}
+	return &rawPayload{serialized: base64URLEncode(payload)}
+}
+
+func (p *rawPayload) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.serialized)
+}
+
+func (p *rawPayload) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &p.serialized)
+}
+
+// Decode the payload according to the b64 header and the parse options.
+func (p *rawPayload) decode(unencoded bool, opts ParseOptions) ([]byte, error) {
+	if unencoded {
+		return []byte(p.serialized), nil
+	}
+	return opts.base64URLDecode(p.serialized)
+}
+
 // rawSignatureInfo represents a single JWS signature over the JWS payload and protected header.
 type rawSignatureInfo struct {
 	Protected *byteBuffer `json:"protected,omitempty"`
@@ -60,16 +100,52 @@ type Signature struct {
 	protected *rawHeader
 	header    *rawHeader
 	original  *rawSignatureInfo
+
+	// Set if all critical header parameters were understood while parsing.
+	critUnderstood bool
 }
 
 // ParseSigned parses a signed message in compact or full serialization format.
 func ParseSigned(input string) (*JsonWebSignature, error) {
+	return ParseSignedWithOptions(input, ParseOptions{})
+}
+
+// ParseSignedWithOptions parses a signed message in compact or full
+// serialization format, using the given (non-default) parse options.
+func ParseSignedWithOptions(input string, opts ParseOptions) (*JsonWebSignature, error) {
+	err := opts.checkInputSize(input)
+	if err != nil {
+		return nil, err
+	}
+
 	input = stripWhitespace(input)
 	if strings.HasPrefix(input, "{") {
-		return parseSignedFull(input)
+		return parseSignedFull(input, opts)
 	}
 
-	return parseSignedCompact(input)
+	return parseSignedCompact(input, opts)
+}
+
+// UnsafeGetPayloadWithoutVerification returns the payload of the object
+// WITHOUT VERIFYING ANY SIGNATURE. The returned data is untrusted: it may have
+// been created or modified by anyone. Only use this for debugging, or to
+// inspect the payload before deciding which key to verify it with, and always
+// call Verify (or VerifyMulti) before acting on the payload.
+func (obj JsonWebSignature) UnsafeGetPayloadWithoutVerification() []byte {
+	return copyBytes(obj.payload)
+}
+
+// SigningInput returns the exact bytes covered by the signature at the given
+// index, i.e. ASCII(BASE64URL(protected header) || '.' || BASE64URL(payload)),
+// with the payload as is if it is unencoded (RFC 7797). The raw signature value
+// is in Signature.Signature. This is meant for debugging, auditing and external
+// verification tools. For objects with a detached payload, the signing input
+// is computed over an empty payload.
+func (obj JsonWebSignature) SigningInput(index int) ([]byte, error) {
+	if index < 0 || index >= len(obj.Signatures) {
+		return nil, fmt.Errorf("square/go-jose: no signature at index %d", index)
+	}
+	return computeAuthData(obj.payload, &obj.Signatures[index]), nil
 }
 
 // Get a header value
@@ -80,48 +156,109 @@ func (sig Signature) mergedHeaders() rawHeader {
 	return out
 }
 
-// Compute data to be signed
-func (obj JsonWebSignature) computeAuthData(signature *Signature) []byte {
-	var serializedProtected string
+// Check whether the payload is unencoded, i.e. the protected header has "b64"
+// set to false (RFC 7797).
+func (sig Signature) unencodedPayload() bool {
+	return sig.protected != nil && sig.protected.B64 != nil && !*sig.protected.B64
+}
 
-	if signature.original != nil && signature.original.Protected != nil {
-		serializedProtected = signature.original.Protected.base64()
-	} else if signature.protected != nil {
-		serializedProtected = base64URLEncode(mustSerializeJSON(signature.protected))
-	} else {
-		serializedProtected = ""
+// Check the b64 header (RFC 7797), which must be integrity protected and
+// listed as critical.
+func checkB64Header(protected, header *rawHeader) error {
+	if header != nil && header.B64 != nil {
+		return errors.New("square/go-jose: b64 header must be integrity protected")
+	}
+	if protected != nil && protected.B64 != nil && !containsString(protected.Crit, "b64") {
+		return errors.New("square/go-jose: b64 header must be critical")
 	}
+	return nil
+}
+
+// Get the serialized protected header, preferring the original bytes (if any)
+// since the header may contain members not preserved by marshaling.
+func (sig Signature) serializedProtected() []byte {
+	if sig.original != nil && sig.original.Protected != nil {
+		return sig.original.Protected.bytes()
+	} else if sig.protected != nil {
+		return mustSerializeJSON(sig.protected)
+	}
+	return nil
+}
+
+// Compute data to be signed
+func computeAuthData(payload []byte, signature *Signature) []byte {
+	return signingInput(signature.serializedProtected(), payload, signature.unencodedPayload())
+}
 
-	return []byte(fmt.Sprintf("%s.%s",
-		serializedProtected,
-		base64URLEncode(obj.payload)))
+// Compute the JWS signing input, in which the payload is base64url encoded
+// unless it is unencoded (RFC 7797).
+func signingInput(serializedProtected, payload []byte, unencoded bool) []byte {
+	input := []byte(base64URLEncode(serializedProtected) + ".")
+	if unencoded {
+		return append(input, payload...)
+	}
+	return append(input, base64URLEncode(payload)...)
 }
 
 // parseSignedFull parses a message in full format.
-func parseSignedFull(input string) (*JsonWebSignature, error) {
+func parseSignedFull(input string, opts ParseOptions) (*JsonWebSignature, error) {
 	var parsed rawJsonWebSignature
-	err := json.Unmarshal([]byte(input), &parsed)
+
+	// The signatures are decoded through a limitedArray, which shadows the
+	// field of the embedded raw object.
+	limited := struct {
+		*rawJsonWebSignature
+		Signatures *limitedArray `json:"signatures,omitempty"`
+	}{
+		rawJsonWebSignature: &parsed,
+		Signatures: &limitedArray{
+			name: "signatures",
+			max:  opts.maxSignatures(),
+			decode: func(dec *json.Decoder) error {
+				var sig rawSignatureInfo
+				err := dec.Decode(&sig)
+				parsed.Signatures = append(parsed.Signatures, sig)
+				return err
+			},
+		},
+	}
+	err := json.Unmarshal([]byte(input), &limited)
 	if err != nil {
 		return nil, err
 	}
 
-	return parsed.sanitized()
+	return parsed.sanitized(opts)
 }
 
 // sanitized produces a cleaned-up JWS object from the raw JSON.
-func (parsed *rawJsonWebSignature) sanitized() (*JsonWebSignature, error) {
+func (parsed *rawJsonWebSignature) sanitized(opts ParseOptions) (*JsonWebSignature, error) {
 	if parsed.Payload == nil {
 		return nil, fmt.Errorf("square/go-jose: missing payload in JWS message")
 	}
 
+	err := opts.checkPadding(parsed.Protected, parsed.Signature)
+	if err != nil {
+		return nil, err
+	}
+	for _, sig := range parsed.Signatures {
+		err = opts.checkPadding(sig.Protected, sig.Signature)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	obj := &JsonWebSignature{
-		payload:    parsed.Payload.bytes(),
 		Signatures: make([]Signature, len(parsed.Signatures)),
 	}
 
 	if len(parsed.Signatures) == 0 {
 		// No signatures array, must be flattened serialization
 		signature := Signature{}
+		err = opts.checkHeaderSize(parsed.Protected)
+		if err != nil {
+			return nil, err
+		}
+
 		if parsed.Protected != nil && len(parsed.Protected.bytes()) > 0 {
 			signature.protected = &rawHeader{}
 			err := json.Unmarshal(parsed.Protected.bytes(), signature.protected)
@@ -135,8 +272,38 @@ func (parsed *rawJsonWebSignature) sanitized() (*JsonWebSignature, error) {
 			return nil, ErrUnprotectedNonce
 		}
 
+		err = opts.checkHeaders(signature.protected, parsed.Header)
+		if err != nil {
+			return nil, err
+		}
+
+		err = opts.checkHeaderPadding(signature.protected, parsed.Header)
+		if err != nil {
+			return nil, err
+		}
+
+		signature.critUnderstood, err = opts.checkCritical(signature.protected, parsed.Header)
+		if err != nil {
+			return nil, err
+		}
+
+		err = checkB64Header(signature.protected, parsed.Header)
+		if err != nil {
+			return nil, err
+		}
+
+		err = opts.checkEmbeddedKey(signature.protected, parsed.Header)
+		if err != nil {
+			return nil, err
+		}
+
 		signature.header = parsed.Header
 		signature.Signature = parsed.Signature.bytes()
+
+		err = opts.checkSignatureAlgorithm(signature.mergedHeaders().Alg)
+		if err != nil {
+			return nil, err
+		}
 		// Make a fake "original" rawSignatureInfo to store the unprocessed
 		// Protected header. This is necessary because the Protected header can
 		// contain arbitrary fields not registered as part of the spec. See
@@ -160,10 +327,20 @@ func (parsed *rawJsonWebSignature) sanitized() (*JsonWebSignature, error) {
 			return nil, errors.New("square/go-jose: invalid embedded jwk, must be public key")
 		}
 
+		_, err = signature.mergedHeaders().certificates()
+		if err != nil {
+			return nil, err
+		}
+
 		obj.Signatures = append(obj.Signatures, signature)
 	}
 
 	for i, sig := range parsed.Signatures {
+		err = opts.checkHeaderSize(sig.Protected)
+		if err != nil {
+			return nil, err
+		}
+
 		if sig.Protected != nil && len(sig.Protected.bytes()) > 0 {
 			obj.Signatures[i].protected = &rawHeader{}
 			err := json.Unmarshal(sig.Protected.bytes(), obj.Signatures[i].protected)
@@ -177,6 +354,32 @@ func (parsed *rawJsonWebSignature) sanitized() (*JsonWebSignature, error) {
 			return nil, ErrUnprotectedNonce
 		}
 
+		err = opts.checkHeaders(obj.Signatures[i].protected, sig.Header)
+		if err != nil {
+			return nil, err
+		}
+
+		err = opts.checkHeaderPadding(obj.Signatures[i].protected, sig.Header)
+		if err != nil {
+			return nil, err
+		}
+
+		obj.Signatures[i].critUnderstood, err = opts.checkCritical(obj.Signatures[i].protected, sig.Header)
+		if err != nil {
+			return nil, err
+		}
+
+		err = checkB64Header(obj.Signatures[i].protected, sig.Header)
+		if err != nil {
+			return nil, err
+		}
+
+		err = opts.checkEmbeddedKey(obj.Signatures[i].protected, sig.Header)
+		if err != nil {
+			return nil, err
+		}
+
+		obj.Signatures[i].header = sig.Header
 		obj.Signatures[i].Header = obj.Signatures[i].mergedHeaders().sanitized()
 		obj.Signatures[i].Signature = sig.Signature.bytes()
 
@@ -186,44 +389,64 @@ func (parsed *rawJsonWebSignature) sanitized() (*JsonWebSignature, error) {
 			return nil, errors.New("square/go-jose: invalid embedded jwk, must be public key")
 		}
 
+		_, err = obj.Signatures[i].mergedHeaders().certificates()
+		if err != nil {
+			return nil, err
+		}
+
 		// Copy value of sig
 		original := sig
-
-		obj.Signatures[i].header = sig.Header
 		obj.Signatures[i].original = &original
+
+		err = opts.checkSignatureAlgorithm(obj.Signatures[i].mergedHeaders().Alg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The payload is shared, so all signatures must agree on its encoding.
+	unencoded := len(obj.Signatures) > 0 && obj.Signatures[0].unencodedPayload()
+	for _, signature := range obj.Signatures {
+		if signature.unencodedPayload() != unencoded {
+			return nil, errors.New("square/go-jose: b64 header must be the same for all signatures")
+		}
+	}
+
+	obj.payload, err = parsed.Payload.decode(unencoded, opts)
+	if err != nil {
+		return nil, err
 	}
 
 	return obj, nil
 }
 
 // parseSignedCompact parses a message in compact format.
-func parseSignedCompact(input string) (*JsonWebSignature, error) {
-	parts := strings.Split(input, ".")
+func parseSignedCompact(input string, opts ParseOptions) (*JsonWebSignature, error) {
+	parts := bytes.Split([]byte(input), []byte("."))
 	if len(parts) != 3 {
 		return nil, fmt.Errorf("square/go-jose: compact JWS format must have three parts")
 	}
 
-	rawProtected, err := base64URLDecode(parts[0])
+	err := opts.checkPartSizes(parts)
 	if err != nil {
 		return nil, err
 	}
 
-	payload, err := base64URLDecode(parts[1])
-	if err != nil {
-		return nil, err
-	}
+	// The payload is decoded later, as it may be unencoded (RFC 7797).
+	payload := &rawPayload{serialized: string(parts[1])}
+	parts = [][]byte{parts[0], parts[2]}
 
-	signature, err := base64URLDecode(parts[2])
+	err = opts.decodeCompactParts(parts)
 	if err != nil {
 		return nil, err
 	}
 
 	raw := &rawJsonWebSignature{
-		Payload:   newBuffer(payload),
-		Protected: newBuffer(rawProtected),
-		Signature: newBuffer(signature),
+		Payload:   payload,
+		Protected: newBuffer(parts[0]),
+		Signature: newBuffer(parts[1]),
 	}
-	return raw.sanitized()
+	return raw.sanitized(opts)
 }
 
 // CompactSerialize serializes an object using the compact serialization format.
@@ -232,25 +455,68 @@ func (obj JsonWebSignature) CompactSerialize() (string, error) {
 		return "", ErrNotSupported
 	}
 
-	serializedProtected := mustSerializeJSON(obj.Signatures[0].protected)
+	serializedProtected := obj.Signatures[0].serializedProtected()
+	payload := newRawPayload(obj.payload, obj.Signatures[0].unencodedPayload())
+
+	// An unencoded payload can't be told apart from the other parts if it
+	// contains a period (RFC 7797, section 5.2).
+	if payload != nil && strings.Contains(payload.serialized, ".") {
+		return "", errors.New("square/go-jose: unencoded payload must not contain '.' in compact serialization")
+	}
+
+	var serializedPayload string
+	if payload != nil {
+		serializedPayload = payload.serialized
+	}
 
 	return fmt.Sprintf(
 		"%s.%s.%s",
 		base64URLEncode(serializedProtected),
-		base64URLEncode(obj.payload),
+		serializedPayload,
+		base64URLEncode(obj.Signatures[0].Signature)), nil
+}
+
+// DetachedCompactSerialize serializes an object using the compact
+// serialization format with detached content, i.e. with an empty payload part
+// (RFC 7515, appendix F). The payload must be transported separately, and
+// passed to DetachedVerify by the recipient.
+func (obj JsonWebSignature) DetachedCompactSerialize() (string, error) {
+	if len(obj.Signatures) != 1 || obj.Signatures[0].header != nil || obj.Signatures[0].protected == nil {
+		return "", ErrNotSupported
+	}
+
+	serializedProtected := obj.Signatures[0].serializedProtected()
+
+	return fmt.Sprintf(
+		"%s..%s",
+		base64URLEncode(serializedProtected),
 		base64URLEncode(obj.Signatures[0].Signature)), nil
 }
 
 // FullSerialize serializes an object using the full JSON serialization format.
+// Objects with a single signature use the flattened syntax, others the general
+// syntax.
 func (obj JsonWebSignature) FullSerialize() string {
+	return obj.fullSerialize(len(obj.Signatures) != 1)
+}
+
+// FullSerializeGeneral serializes an object using the general syntax of the
+// full JSON serialization format, with a "signatures" array, even if there is
+// only a single signature. This is for receivers which don't accept the
+// flattened syntax.
+func (obj JsonWebSignature) FullSerializeGeneral() string {
+	return obj.fullSerialize(true)
+}
+
+func (obj JsonWebSignature) fullSerialize(general bool) string {
+	unencoded := len(obj.Signatures) > 0 && obj.Signatures[0].unencodedPayload()
 	raw := rawJsonWebSignature{
-		Payload: newBuffer(obj.payload),
+		Payload: newRawPayload(obj.payload, unencoded),
 	}
 
-	if len(obj.Signatures) == 1 {
+	if !general {
 		if obj.Signatures[0].protected != nil {
-			serializedProtected := mustSerializeJSON(obj.Signatures[0].protected)
-			raw.Protected = newBuffer(serializedProtected)
+			raw.Protected = newBuffer(obj.Signatures[0].serializedProtected())
 		}
 		raw.Header = obj.Signatures[0].header
 		raw.Signature = newBuffer(obj.Signatures[0].Signature)
@@ -263,7 +529,7 @@ func (obj JsonWebSignature) FullSerialize() string {
 			}
 
 			if signature.protected != nil {
-				raw.Signatures[i].Protected = newBuffer(mustSerializeJSON(signature.protected))
+				raw.Signatures[i].Protected = newBuffer(signature.serializedProtected())
 			}
 		}
 	}
@@ -17,9 +17,15 @@
 package jose
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
 	"fmt"
 	"strings"
 	"testing"
+
+	"github.com/square/go-jose/json"
 )
 
 func TestEmbeddedHMAC(t *testing.T) {
@@ -32,6 +38,145 @@ func TestEmbeddedHMAC(t *testing.T) {
 	}
 }
 
+func TestEmbeddedKeyPolicy(t *testing.T) {
+	input := []byte("Lorem ipsum dolor sit amet")
+	sign := func(configure func(signer Signer)) string {
+		signer, err := NewSigner(ES256, ecTestKey256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		configure(signer)
+		obj, err := signer.Sign(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return obj.FullSerialize()
+	}
+
+	embedded := sign(func(signer Signer) {})
+	absent := sign(func(signer Signer) { signer.SetEmbedJwk(false) })
+	unprotected := sign(func(signer Signer) {
+		if err := signer.SetUnprotectedHeaders([]string{"jwk"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	substituted := sign(func(signer Signer) {
+		signer.SetProtectedHeaderHook(func(header map[string]interface{}) map[string]interface{} {
+			header["jwk"] = JsonWebKey{Key: &ecTestKey384.PublicKey}
+			return header
+		})
+	})
+
+	cases := []struct {
+		msg       string
+		forbidden bool // accepted with EmbeddedKeyForbidden
+		required  bool // accepted with EmbeddedKeyRequired
+		verifies  bool // verifies with VerifyWithEmbeddedKey
+	}{
+		{embedded, false, true, true},
+		{absent, true, false, false},
+		{unprotected, false, false, false},
+		{substituted, false, true, false},
+	}
+
+	for i, c := range cases {
+		_, err := ParseSignedWithOptions(c.msg, ParseOptions{EmbeddedKeys: EmbeddedKeyForbidden})
+		if (err == nil) != c.forbidden {
+			t.Errorf("case %d: unexpected result with embedded keys forbidden: %v", i, err)
+		}
+		_, err = ParseSignedWithOptions(c.msg, ParseOptions{EmbeddedKeys: EmbeddedKeyRequired})
+		if (err == nil) != c.required {
+			t.Errorf("case %d: unexpected result with embedded keys required: %v", i, err)
+		}
+
+		obj, err := ParseSigned(c.msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, output, err := obj.VerifyWithEmbeddedKey()
+		if (err == nil) != c.verifies {
+			t.Errorf("case %d: unexpected result verifying with embedded key: %v", i, err)
+		}
+		if err != nil {
+			continue
+		}
+		if !bytes.Equal(output, input) {
+			t.Errorf("case %d: verified payload does not match input", i)
+		}
+		if pub, ok := key.Key.(*ecdsa.PublicKey); !ok || !pub.Equal(&ecTestKey256.PublicKey) {
+			t.Errorf("case %d: unexpected embedded key %v", i, key.Key)
+		}
+	}
+}
+
+func TestSigningInput(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	signer, err := NewSigner(HS256, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := signer.Sign([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := obj.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(msg, ".")
+
+	parsed, err := ParseSigned(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, err := parsed.SigningInput(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(input) != parts[0]+"."+parts[1] {
+		t.Errorf("unexpected signing input: %s", input)
+	}
+
+	// The signing input and raw signature can be verified independently
+	mac := hmac.New(sha256.New, key)
+	mac.Write(input)
+	if !hmac.Equal(mac.Sum(nil), parsed.Signatures[0].Signature) {
+		t.Error("signature does not match signing input")
+	}
+
+	for _, index := range []int{-1, 1} {
+		if _, err := parsed.SigningInput(index); err == nil {
+			t.Errorf("expected error for signature index %d", index)
+		}
+	}
+}
+
+func TestUnsafeGetPayloadWithoutVerification(t *testing.T) {
+	// Signature is garbage, but the payload must still be returned as-is.
+	msg := "eyJhbGciOiJIUzI1NiJ9.TG9yZW0gaXBzdW0gZG9sb3Igc2l0IGFtZXQ.c2lnbmF0dXJl"
+
+	obj, err := ParseSigned(msg)
+	if err != nil {
+		t.Fatal("unable to parse valid message:", err)
+	}
+
+	payload := obj.UnsafeGetPayloadWithoutVerification()
+	if string(payload) != "Lorem ipsum dolor sit amet" {
+		t.Errorf("unexpected payload: %q", payload)
+	}
+
+	_, err = obj.Verify([]byte("secret"))
+	if err == nil {
+		t.Error("verification of invalid signature should fail")
+	}
+
+	// Mutating the returned payload must not affect the object
+	payload[0] = 'X'
+	if string(obj.UnsafeGetPayloadWithoutVerification()) != "Lorem ipsum dolor sit amet" {
+		t.Error("mutating returned payload changed object")
+	}
+}
+
 func TestCompactParseJWS(t *testing.T) {
 	// Should parse
 	msg := "eyJhbGciOiJYWVoifQ.cGF5bG9hZA.c2lnbmF0dXJl"
@@ -302,7 +447,7 @@ func TestSampleNimbusJWSMessagesHMAC(t *testing.T) {
 
 // Test vectors generated with nimbus-jose-jwt
 func TestErrorMissingPayloadJWS(t *testing.T) {
-	_, err := (&rawJsonWebSignature{}).sanitized()
+	_, err := (&rawJsonWebSignature{}).sanitized(ParseOptions{})
 	if err == nil {
 		t.Error("was able to parse message with missing payload")
 	}
@@ -310,3 +455,418 @@ func TestErrorMissingPayloadJWS(t *testing.T) {
 		t.Errorf("unexpected error message, should contain 'missing payload': %s", err)
 	}
 }
+
+func TestFullSerializeGeneralJWS(t *testing.T) {
+	signer, err := NewSigner(HS256, []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := signer.Sign([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(obj.FullSerialize(), `"signatures"`) {
+		t.Error("single signature should use flattened syntax by default")
+	}
+
+	msg := obj.FullSerializeGeneral()
+	if !strings.Contains(msg, `"signatures":[{`) {
+		t.Error("expected general syntax", msg)
+	}
+
+	parsed, err := ParseSigned(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parsed.Verify([]byte("0123456789abcdef0123456789abcdef")); err != nil {
+		t.Error("unable to verify", err)
+	}
+}
+
+func TestVectorsUnencodedPayload(t *testing.T) {
+	// Source: https://tools.ietf.org/html/rfc7797#section-4
+	key, _ := base64URLDecode("AyM1SysPpbyDfgZld3umj1qzKObwVMkoqQ-EstJQLr_T-1qS0gZH75aKtMN3Yj0iPS4hcgUuTwjAzZr1Z9CAow")
+	protected := "eyJhbGciOiJIUzI1NiIsImI2NCI6ZmFsc2UsImNyaXQiOlsiYjY0Il19"
+	signature := "A5dxf2s96_n5FLueVuW1Z_vh161FwXZC4YLPff6dmDY"
+
+	obj, err := ParseSigned(protected + ".." + signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := obj.DetachedVerify([]byte("$.02"), key); err != nil {
+		t.Error("unable to verify detached unencoded payload", err)
+	}
+
+	obj, err = ParseSigned(`{"protected":"` + protected + `","payload":"$.02","signature":"` + signature + `"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := obj.Verify(key)
+	if err != nil || string(payload) != "$.02" {
+		t.Error("unable to verify unencoded payload", err)
+	}
+
+	// The payload part can't contain a period in compact form
+	if _, err := obj.CompactSerialize(); err == nil {
+		t.Error("should not compact serialize payload with period")
+	}
+
+	invalid := []string{
+		// b64 must be critical
+		`{"protected":"` + base64URLEncode([]byte(`{"alg":"HS256","b64":false}`)) + `","payload":"$.02","signature":"` + signature + `"}`,
+		// b64 must be protected
+		`{"protected":"` + base64URLEncode([]byte(`{"alg":"HS256","crit":["b64"]}`)) + `","header":{"b64":false},"payload":"$.02","signature":"` + signature + `"}`,
+		// b64 must be consistent across signatures
+		`{"payload":"$.02","signatures":[{"protected":"` + protected + `","signature":"` + signature + `"},{"protected":"eyJhbGciOiJIUzI1NiJ9","signature":"` + signature + `"}]}`,
+	}
+	for _, msg := range invalid {
+		if _, err := ParseSigned(msg); err == nil {
+			t.Error("should not parse invalid b64 header", msg)
+		}
+	}
+}
+
+func TestPaddedBase64JWS(t *testing.T) {
+	signer, err := NewSigner(HS256, []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A 32-byte HMAC tag encodes to 43 characters, so it needs one pad byte.
+	obj, err := signer.Sign([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact, err := obj.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseSigned(compact + "="); err == nil {
+		t.Error("should not accept padded base64url by default")
+	}
+	if _, err := ParseSigned(obj.FullSerialize()[:len(obj.FullSerialize())-2] + `="}`); err == nil {
+		t.Error("should not accept padded base64url in full serialization by default")
+	}
+
+	parsed, err := ParseSignedWithOptions(compact+"=", ParseOptions{AllowPaddedBase64: true})
+	if err != nil {
+		t.Fatal("should accept padded base64url when allowed:", err)
+	}
+	payload, err := parsed.Verify([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil || string(payload) != "Lorem ipsum dolor sit amet" {
+		t.Error("failed to verify message with padded signature:", err)
+	}
+
+	// Output is never padded.
+	reserialized, _ := parsed.CompactSerialize()
+	if reserialized != compact {
+		t.Error("re-serialized message should not be padded")
+	}
+
+	// Buffers inside the header, including members of an embedded key, are
+	// checked too.
+	// A 32-byte P-256 coordinate encodes to 43 characters, so it needs one pad
+	// byte, as does a 20-byte SHA-1 thumbprint.
+	pub := ecTestKey256.PublicKey
+	jwk := fmt.Sprintf(`{"kty":"EC","crv":"P-256","x":"%s=","y":"%s="}`,
+		base64URLEncode(pub.X.FillBytes(make([]byte, 32))),
+		base64URLEncode(pub.Y.FillBytes(make([]byte, 32))))
+	for _, header := range []string{
+		`{"x5t":"` + base64URLEncode(make([]byte, 20)) + `="}`,
+		`{"jwk":` + jwk + `}`,
+	} {
+		full := obj.FullSerialize()
+		msg := full[:len(full)-1] + `,"header":` + header + `}`
+
+		if _, err := ParseSigned(msg); err == nil {
+			t.Errorf("should not accept padded base64url in header %s by default", header)
+		}
+		parsed, err := ParseSignedWithOptions(msg, ParseOptions{AllowPaddedBase64: true})
+		if err != nil {
+			t.Errorf("should accept padded base64url in header %s when allowed: %v", header, err)
+			continue
+		}
+		if _, err := parsed.Verify([]byte("0123456789abcdef0123456789abcdef")); err != nil {
+			t.Error("failed to verify message with padded header:", err)
+		}
+	}
+}
+
+func TestStrictHeadersJWS(t *testing.T) {
+	key := []byte("secret")
+	sign := func(protected string) string {
+		input := base64URLEncode([]byte(protected)) + "." + base64URLEncode([]byte("payload"))
+		sig, err := symmetricMac{key: key}.signPayload([]byte(input), HS256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return input + "." + base64URLEncode(sig.Signature)
+	}
+
+	msg := sign(`{"alg":"HS256","foo":"bar"}`)
+
+	// Lenient by default, unknown parameter is stashed
+	obj, err := ParseSigned(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Signatures[0].Header.ExtraHeaders["foo"] != "bar" {
+		t.Error("unknown header parameter should be available in ExtraHeaders")
+	}
+
+	strict := ParseOptions{StrictHeaders: true}
+	if _, err := ParseSignedWithOptions(msg, strict); err == nil {
+		t.Error("should reject unknown header parameter in strict mode")
+	}
+	if _, err := ParseSignedWithOptions(sign(`{"alg":"HS256","kid":"1"}`), strict); err != nil {
+		t.Error("should accept known header parameters in strict mode:", err)
+	}
+	if _, err := ParseSignedWithOptions(sign(`{"alg":"HS256","crit":["foo"],"foo":"bar"}`), strict); err != nil {
+		t.Error("should accept header parameters listed in crit in strict mode:", err)
+	}
+
+	// Also applies to unprotected headers in full serialization
+	full := fmt.Sprintf(`{"payload":"%s","protected":"%s","header":{"foo":"bar"},"signature":"%s"}`,
+		base64URLEncode([]byte("payload")), base64URLEncode([]byte(`{"alg":"HS256"}`)), strings.Split(sign(`{"alg":"HS256"}`), ".")[2])
+	if _, err := ParseSigned(full); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseSignedWithOptions(full, strict); err == nil {
+		t.Error("should reject unknown unprotected header parameter in strict mode")
+	}
+}
+
+func TestAllowedAlgorithmsJWS(t *testing.T) {
+	signer, err := NewSigner(HS256, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := signer.Sign([]byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact, _ := obj.CompactSerialize()
+
+	if _, err := ParseSignedWithOptions(compact, ParseOptions{SignatureAlgorithms: []SignatureAlgorithm{RS256, HS256}}); err != nil {
+		t.Error("should accept allowed algorithm:", err)
+	}
+	for _, msg := range []string{compact, obj.FullSerialize(), obj.FullSerializeGeneral()} {
+		if _, err := ParseSignedWithOptions(msg, ParseOptions{SignatureAlgorithms: []SignatureAlgorithm{RS256}}); err == nil {
+			t.Error("should reject algorithm not in allow-list", msg)
+		}
+	}
+
+	// Also applies to the alg header in unprotected headers
+	full := fmt.Sprintf(`{"payload":"%s","header":{"alg":"HS256"},"signature":"%s"}`,
+		base64URLEncode([]byte("payload")), base64URLEncode(obj.Signatures[0].Signature))
+	if _, err := ParseSigned(full); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseSignedWithOptions(full, ParseOptions{SignatureAlgorithms: []SignatureAlgorithm{RS256}}); err == nil {
+		t.Error("should reject algorithm in unprotected header not in allow-list")
+	}
+}
+
+func TestRejectNoneAlgorithm(t *testing.T) {
+	payload := base64URLEncode([]byte("payload"))
+	compact := base64URLEncode([]byte(`{"alg":"none"}`)) + "." + payload + "."
+	full := fmt.Sprintf(`{"payload":"%s","header":{"alg":"none"},"signature":""}`, payload)
+
+	for _, msg := range []string{compact, full} {
+		if _, err := ParseSigned(msg); err != ErrNoneAlgorithm {
+			t.Error("should reject alg none by default", msg, err)
+		}
+		if _, err := ParseSignedWithOptions(msg, ParseOptions{SignatureAlgorithms: []SignatureAlgorithm{algNone}}); err != ErrNoneAlgorithm {
+			t.Error("allow-list should not enable alg none", msg, err)
+		}
+
+		obj, err := ParseSignedWithOptions(msg, ParseOptions{UnsafeAllowNoneSignatureType: true})
+		if err != nil {
+			t.Error("should parse alg none if explicitly allowed", msg, err)
+			continue
+		}
+		if string(obj.UnsafeGetPayloadWithoutVerification()) != "payload" {
+			t.Error("payload mismatch")
+		}
+		if _, err := obj.Verify([]byte("secret")); err != ErrNoneAlgorithm {
+			t.Error("should never verify alg none", err)
+		}
+		if _, _, _, err := obj.VerifyMulti([]byte("secret")); err == nil {
+			t.Error("should never verify alg none")
+		}
+		if _, err := obj.VerifyAll([]byte("secret")); err != ErrNoneAlgorithm {
+			t.Error("should never verify alg none", err)
+		}
+	}
+
+	if _, err := NewSigner(algNone, []byte("secret")); err != ErrNoneAlgorithm {
+		t.Error("should not sign with alg none", err)
+	}
+}
+
+func TestMaxSignaturesJWS(t *testing.T) {
+	makeMessage := func(n int) string {
+		signatures := make([]string, n)
+		for i := range signatures {
+			signatures[i] = "{\"header\":{\"alg\":\"HS256\"},\"signature\":\"QUJD\"}"
+		}
+		return "{\"payload\":\"QUJD\",\"signatures\":[" + strings.Join(signatures, ",") + "]}"
+	}
+
+	if _, err := ParseSigned(makeMessage(DefaultMaxSignatures)); err != nil {
+		t.Error("unable to parse message with maximum number of signatures:", err)
+	}
+	if _, err := ParseSigned(makeMessage(DefaultMaxSignatures + 1)); err == nil {
+		t.Error("able to parse message with too many signatures")
+	}
+
+	opts := ParseOptions{MaxSignatures: 2}
+	if _, err := ParseSignedWithOptions(makeMessage(2), opts); err != nil {
+		t.Error("unable to parse message under configured limit:", err)
+	}
+	if _, err := ParseSignedWithOptions(makeMessage(3), opts); err == nil {
+		t.Error("able to parse message over configured limit")
+	}
+
+	// Signatures past the limit aren't decoded
+	message := strings.Replace(makeMessage(2), "]", ",\"invalid\"]", 1)
+	_, err := ParseSignedWithOptions(message, opts)
+	if err == nil || !strings.Contains(err.Error(), "too many signatures") {
+		t.Error("should reject message before decoding signature past limit:", err)
+	}
+}
+
+func TestSizeLimitsJWS(t *testing.T) {
+	signer, err := NewSigner(HS256, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := signer.Sign(make([]byte, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact, _ := obj.CompactSerialize()
+	full := obj.FullSerialize()
+	protected := len(obj.Signatures[0].serializedProtected())
+
+	for _, msg := range []string{compact, full} {
+		for _, tc := range []struct {
+			opts ParseOptions
+			ok   bool
+		}{
+			{ParseOptions{MaxInputSize: len(msg)}, true},
+			{ParseOptions{MaxInputSize: len(msg) - 1}, false},
+			{ParseOptions{MaxHeaderSize: protected}, true},
+			{ParseOptions{MaxHeaderSize: protected - 1}, false},
+		} {
+			_, err := ParseSignedWithOptions(msg, tc.opts)
+			if tc.ok && err != nil {
+				t.Error("should accept message within limits:", tc.opts, err)
+			}
+			if !tc.ok && err == nil {
+				t.Error("should reject message over limits:", tc.opts)
+			}
+		}
+	}
+
+	// The payload is the largest part
+	payloadSize := len(strings.Split(compact, ".")[1])
+	if _, err := ParseSignedWithOptions(compact, ParseOptions{MaxPartSize: payloadSize}); err != nil {
+		t.Error("should accept parts within limit:", err)
+	}
+	if _, err := ParseSignedWithOptions(compact, ParseOptions{MaxPartSize: payloadSize - 1}); err == nil {
+		t.Error("should reject part over limit")
+	}
+}
+
+func BenchmarkParseSignedCompact(b *testing.B) {
+	signer, err := NewSigner(HS256, []byte("secret"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	obj, err := signer.Sign(make([]byte, 1024))
+	if err != nil {
+		b.Fatal(err)
+	}
+	msg, err := obj.CompactSerialize()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseSigned(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestUnknownHeadersRoundTripJWS(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	signer, err := NewSigner(HS256, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = signer.SetExtraHeader("ext", "protected"); err != nil {
+		t.Fatal(err)
+	}
+	obj, err := signer.Sign([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compact, err := obj.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseSigned(compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := parsed.CompactSerialize(); again != compact {
+		t.Errorf("compact serialization changed, got %s, expected %s", again, compact)
+	}
+
+	// Add an extension to the unprotected header, as an intermediary might.
+	var raw map[string]interface{}
+	if err = json.Unmarshal([]byte(obj.FullSerialize()), &raw); err != nil {
+		t.Fatal(err)
+	}
+	raw["header"] = map[string]interface{}{
+		"route": map[string]interface{}{"hops": []interface{}{"a", "b"}},
+	}
+	msg, err := json.Marshal(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, general := range []bool{false, true} {
+		parsed, err := ParseSigned(string(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		serialized := parsed.FullSerialize()
+		if general {
+			serialized = parsed.FullSerializeGeneral()
+		}
+
+		reparsed, err := ParseSigned(serialized)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := reparsed.Signatures[0].Header
+		if header.ExtraHeaders["ext"] != "protected" {
+			t.Error("protected extension lost on re-serialization", serialized)
+		}
+		route, _ := header.ExtraHeaders["route"].(map[string]interface{})
+		if hops, _ := route["hops"].([]interface{}); len(hops) != 2 || hops[1] != "b" {
+			t.Error("unprotected extension lost on re-serialization", serialized)
+		}
+		if _, err := reparsed.Verify(key); err != nil {
+			t.Error("unable to verify re-serialized object", err)
+		}
+	}
+}
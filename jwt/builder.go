@@ -0,0 +1,228 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt
+
+import (
+	"bytes"
+
+	"github.com/square/go-jose"
+	"github.com/square/go-jose/json"
+)
+
+// Builder builds a JWT from claims. Each call to Claims returns a new builder
+// with the claims merged into those of the original builder, which is left
+// unchanged, so builders can be shared and reused.
+type Builder interface {
+	// Claims adds the given claims to the token, replacing any claims of the
+	// same name. The claims can be given as *Claims, as any other value
+	// that serializes to a JSON object (e.g. a struct with json tags for
+	// private claims), or as a map.
+	Claims(c interface{}) Builder
+	// CanonicalClaims returns a builder which serializes the claims as per
+	// the JSON Canonicalization Scheme (RFC 8785), so that the same logical
+	// claims always produce the same payload bytes, e.g. for systems that
+	// store and re-emit claims. Note that JCS represents numbers as IEEE 754
+	// doubles. Verification uses the received payload as is.
+	CanonicalClaims() Builder
+	// Token builds the token, as if it was parsed.
+	Token() (*JsonWebToken, error)
+	// CompactSerialize builds the token and serializes it in compact format,
+	// as used for JWTs.
+	CompactSerialize() (string, error)
+	// FullSerialize builds the token and serializes it in full (JSON) format.
+	FullSerialize() (string, error)
+	// Encrypt returns a builder for a nested token, which is the signed token
+	// encrypted with the given encrypter (see SignedAndEncrypted). Only signed
+	// tokens can be encrypted, building the nested token fails otherwise.
+	Encrypt(enc jose.Encrypter) NestedBuilder
+}
+
+type builder struct {
+	payload   map[string]interface{}
+	canonical bool
+	err       error
+}
+
+type signedBuilder struct {
+	builder
+	sig jose.Signer
+}
+
+type encryptedBuilder struct {
+	builder
+	enc jose.Encrypter
+}
+
+// Signed creates a builder for tokens signed with the given signer.
+func Signed(sig jose.Signer) Builder {
+	return &signedBuilder{sig: sig}
+}
+
+// Encrypted creates a builder for tokens encrypted with the given encrypter.
+func Encrypted(enc jose.Encrypter) Builder {
+	return &encryptedBuilder{enc: enc}
+}
+
+// Merge claims into a copy of the builder's payload.
+func (b builder) claims(c interface{}) builder {
+	if b.err != nil {
+		return b
+	}
+
+	claims, err := normalize(c)
+	if err != nil {
+		return builder{err: err}
+	}
+
+	payload := make(map[string]interface{}, len(b.payload)+len(claims))
+	for name, value := range b.payload {
+		payload[name] = value
+	}
+	for name, value := range claims {
+		payload[name] = value
+	}
+
+	return builder{payload: payload, canonical: b.canonical}
+}
+
+// Copy the builder, serializing its claims canonically.
+func (b builder) canonicalized() builder {
+	b.canonical = true
+	return b
+}
+
+// Serialize the claims for the token payload.
+func (b builder) serializedPayload() ([]byte, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if b.payload == nil {
+		return []byte("{}"), nil
+	}
+	if b.canonical {
+		return canonicalJSON(b.payload)
+	}
+	return json.Marshal(b.payload)
+}
+
+// Convert claims to a map of claim names to (JSON) values. Numbers are kept
+// as json.Number, so that they round-trip exactly.
+func normalize(c interface{}) (map[string]interface{}, error) {
+	serialized, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(serialized))
+	decoder.UseNumber()
+
+	var claims map[string]interface{}
+	err = decoder.Decode(&claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func (b *signedBuilder) Claims(c interface{}) Builder {
+	return &signedBuilder{builder: b.claims(c), sig: b.sig}
+}
+
+func (b *signedBuilder) CanonicalClaims() Builder {
+	return &signedBuilder{builder: b.canonicalized(), sig: b.sig}
+}
+
+func (b *signedBuilder) Token() (*JsonWebToken, error) {
+	serialized, err := b.CompactSerialize()
+	if err != nil {
+		return nil, err
+	}
+	return ParseSigned(serialized)
+}
+
+func (b *signedBuilder) CompactSerialize() (string, error) {
+	obj, err := b.sign()
+	if err != nil {
+		return "", err
+	}
+	return obj.CompactSerialize()
+}
+
+func (b *signedBuilder) FullSerialize() (string, error) {
+	obj, err := b.sign()
+	if err != nil {
+		return "", err
+	}
+	return obj.FullSerialize(), nil
+}
+
+func (b *signedBuilder) Encrypt(enc jose.Encrypter) NestedBuilder {
+	return &nestedBuilder{builder: b.builder, sig: b.sig, enc: enc}
+}
+
+func (b *signedBuilder) sign() (*jose.JsonWebSignature, error) {
+	payload, err := b.serializedPayload()
+	if err != nil {
+		return nil, err
+	}
+	return b.sig.Sign(payload)
+}
+
+func (b *encryptedBuilder) Claims(c interface{}) Builder {
+	return &encryptedBuilder{builder: b.claims(c), enc: b.enc}
+}
+
+func (b *encryptedBuilder) CanonicalClaims() Builder {
+	return &encryptedBuilder{builder: b.canonicalized(), enc: b.enc}
+}
+
+func (b *encryptedBuilder) Token() (*JsonWebToken, error) {
+	serialized, err := b.CompactSerialize()
+	if err != nil {
+		return nil, err
+	}
+	return ParseEncrypted(serialized)
+}
+
+func (b *encryptedBuilder) CompactSerialize() (string, error) {
+	obj, err := b.encrypt()
+	if err != nil {
+		return "", err
+	}
+	return obj.CompactSerialize()
+}
+
+func (b *encryptedBuilder) FullSerialize() (string, error) {
+	obj, err := b.encrypt()
+	if err != nil {
+		return "", err
+	}
+	return obj.FullSerialize(), nil
+}
+
+func (b *encryptedBuilder) Encrypt(enc jose.Encrypter) NestedBuilder {
+	return &nestedBuilder{builder: builder{err: errNotSigned}}
+}
+
+func (b *encryptedBuilder) encrypt() (*jose.JsonWebEncryption, error) {
+	payload, err := b.serializedPayload()
+	if err != nil {
+		return nil, err
+	}
+	return b.enc.Encrypt(payload)
+}
@@ -0,0 +1,137 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt
+
+import (
+	"math"
+	"testing"
+
+	"github.com/square/go-jose"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	// Source: RFC 8785, section 3.2.3 and appendix B
+	for _, tc := range []struct {
+		input, expected string
+	}{
+		{
+			`{"numbers": [333333333.33333329, 1E30, 4.50, 2e-3, 0.000000000000000000000000001],
+			  "string": "\u20ac$\u000F\u000aA'\u0042\u0022\u005c\\\"\/",
+			  "literals": [null, true, false]}`,
+			`{"literals":[null,true,false],"numbers":[333333333.3333333,1e+30,4.5,0.002,1e-27],"string":"€$\u000f\nA'B\"\\\\\"/"}`,
+		},
+		{
+			`{"\u20ac": 5, "\r": 1, "\ufb33": 7, "1": 2, "\ud83d\ude00": 6, "\u0080": 3, "\u00f6": 4}`,
+			"{\"\\r\":1,\"1\":2,\"\u0080\":3,\"\u00f6\":4,\"\u20ac\":5,\"\U0001F600\":6,\"\ufb33\":7}",
+		},
+		{`{"html": "<a&b>"}`, `{"html":"<a&b>"}`},
+	} {
+		claims, err := normalize(rawJSON(tc.input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := canonicalJSON(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(output) != tc.expected {
+			t.Errorf("expected %s, got %s", tc.expected, output)
+		}
+	}
+
+	for bits, expected := range map[uint64]string{
+		0x0000000000000000: "0",
+		0x8000000000000000: "0",
+		0x0000000000000001: "5e-324",
+		0x8000000000000001: "-5e-324",
+		0x7fefffffffffffff: "1.7976931348623157e+308",
+		0xffefffffffffffff: "-1.7976931348623157e+308",
+		0x4340000000000000: "9007199254740992",
+		0xc340000000000000: "-9007199254740992",
+		0x4430000000000000: "295147905179352830000",
+		0x44b52d02c7e14af5: "9.999999999999997e+22",
+		0x44b52d02c7e14af6: "1e+23",
+		0x44b52d02c7e14af7: "1.0000000000000001e+23",
+		0x444b1ae4d6e2ef4e: "999999999999999700000",
+		0x444b1ae4d6e2ef4f: "999999999999999900000",
+		0x444b1ae4d6e2ef50: "1e+21",
+		0x3eb0c6f7a0b5ed8c: "9.999999999999997e-7",
+		0x3eb0c6f7a0b5ed8d: "0.000001",
+		0x41b3de4355555553: "333333333.3333332",
+		0x41b3de4355555554: "333333333.33333325",
+		0x41b3de4355555555: "333333333.3333333",
+		0x41b3de4355555556: "333333333.3333334",
+		0xbff0000000000000: "-1",
+	} {
+		output, err := canonicalNumber(math.Float64frombits(bits))
+		if err != nil || output != expected {
+			t.Errorf("expected %s for %016x, got %s (%v)", expected, bits, output, err)
+		}
+	}
+}
+
+// rawJSON is a claims value which serializes to the given JSON.
+type rawJSON string
+
+func (r rawJSON) MarshalJSON() ([]byte, error) {
+	return []byte(r), nil
+}
+
+func TestCanonicalClaims(t *testing.T) {
+	signer, err := jose.NewSigner(jose.HS256, sharedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same logical claims, from differently-ordered Go values
+	type ordered struct {
+		Subject string  `json:"sub"`
+		Amount  float64 `json:"amount"`
+		Note    string  `json:"note"`
+	}
+	claims := []interface{}{
+		ordered{Subject: "subject", Amount: 100, Note: "<1>"},
+		map[string]interface{}{"note": "<1>", "amount": 1e2, "sub": "subject"},
+		rawJSON(`{"amount": 100.0, "note": "\u003c1\u003e", "sub": "subject"}`),
+	}
+
+	var tokens []string
+	for _, c := range claims {
+		token, err := Signed(signer).CanonicalClaims().Claims(c).CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, token)
+	}
+	for i := range tokens {
+		if tokens[i] != tokens[0] {
+			t.Errorf("canonical token %d differs: %s, expected %s", i, tokens[i], tokens[0])
+		}
+	}
+
+	obj, err := jose.ParseSigned(tokens[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := obj.Verify(sharedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"amount":100,"note":"<1>","sub":"subject"}`; string(payload) != expected {
+		t.Errorf("expected payload %s, got %s", expected, payload)
+	}
+}
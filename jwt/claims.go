@@ -0,0 +1,135 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/square/go-jose/json"
+)
+
+// Claims represents the registered claims of a JWT (RFC 7519, section 4.1).
+type Claims struct {
+	Issuer    string       `json:"iss,omitempty"`
+	Subject   string       `json:"sub,omitempty"`
+	Audience  Audience     `json:"aud,omitempty"`
+	Expiry    *NumericDate `json:"exp,omitempty"`
+	NotBefore *NumericDate `json:"nbf,omitempty"`
+	IssuedAt  *NumericDate `json:"iat,omitempty"`
+	ID        string       `json:"jti,omitempty"`
+}
+
+// NumericDate represents a time as the number of seconds since the epoch, as
+// used for the time claims of a JWT. Claims are *NumericDate, so that an
+// unset time (nil) is omitted instead of being serialized as 0.
+type NumericDate int64
+
+// NewNumericDate returns the time as a NumericDate, truncated to seconds. The
+// zero time returns nil, which omits the claim.
+func NewNumericDate(t time.Time) *NumericDate {
+	if t.IsZero() {
+		return nil
+	}
+
+	n := NumericDate(t.Unix())
+	return &n
+}
+
+// Time returns the time represented by the NumericDate, or the zero time if
+// it is nil.
+func (n *NumericDate) Time() time.Time {
+	if n == nil {
+		return time.Time{}
+	}
+	return time.Unix(int64(*n), 0)
+}
+
+// MarshalJSON serializes the NumericDate as an integer number of seconds.
+func (n NumericDate) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatInt(int64(n), 10)), nil
+}
+
+// UnmarshalJSON reads a NumericDate from a JSON number. Fractional seconds,
+// which are allowed by RFC 7519, are truncated.
+func (n *NumericDate) UnmarshalJSON(data []byte) error {
+	f, err := strconv.ParseFloat(string(data), 64)
+	if err != nil || math.IsNaN(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return fmt.Errorf("square/go-jose/jwt: expected number for NumericDate, got %s", data)
+	}
+
+	*n = NumericDate(f)
+	return nil
+}
+
+// MarshalSingleStringAsArray specifies if an Audience with a single value is
+// serialized as an array (the default), or as a bare string. Both forms are
+// allowed by RFC 7519, but some consumers only accept one of them.
+var MarshalSingleStringAsArray = true
+
+// Audience represents the recipients a JWT is intended for ("aud" claim),
+// which may be given as a single string or as an array of strings.
+type Audience []string
+
+// MarshalJSON serializes the audience as an array, or as a bare string if it
+// has a single value and MarshalSingleStringAsArray is false.
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 && !MarshalSingleStringAsArray {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+// UnmarshalJSON reads an audience from a string or an array of strings.
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+
+	switch value := value.(type) {
+	case string:
+		*a = Audience{value}
+	case []interface{}:
+		audience := make(Audience, len(value))
+		for i, item := range value {
+			s, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("square/go-jose/jwt: expected string or array of strings for aud, got %s", data)
+			}
+			audience[i] = s
+		}
+		*a = audience
+	default:
+		return fmt.Errorf("square/go-jose/jwt: expected string or array of strings for aud, got %s", data)
+	}
+
+	return nil
+}
+
+// Contains checks whether the audience includes the given value.
+func (a Audience) Contains(value string) bool {
+	for _, v := range a {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/square/go-jose/json"
+)
+
+func TestNumericDate(t *testing.T) {
+	now := time.Unix(1451606400, 500)
+
+	date := NewNumericDate(now)
+	if !date.Time().Equal(time.Unix(1451606400, 0)) {
+		t.Error("NumericDate should truncate to seconds", date.Time())
+	}
+
+	if NewNumericDate(time.Time{}) != nil {
+		t.Error("zero time should return nil NumericDate")
+	}
+	if !(*NumericDate)(nil).Time().IsZero() {
+		t.Error("nil NumericDate should return zero time")
+	}
+
+	// Unset times are omitted
+	serialized, err := json.Marshal(Claims{Expiry: date})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(serialized) != `{"exp":1451606400}` {
+		t.Error("unexpected serialization", string(serialized))
+	}
+
+	for input, expected := range map[string]int64{
+		`{"exp":1451606400}`:     1451606400,
+		`{"exp":1451606400.999}`: 1451606400,
+		`{"exp":1.4516064e9}`:    1451606400,
+	} {
+		var claims Claims
+		if err := json.Unmarshal([]byte(input), &claims); err != nil {
+			t.Error("unable to parse", input, err)
+			continue
+		}
+		if claims.Expiry == nil || int64(*claims.Expiry) != expected {
+			t.Error("unexpected expiry for", input, claims.Expiry)
+		}
+	}
+
+	var claims Claims
+	if err := json.Unmarshal([]byte(`{"exp":null}`), &claims); err != nil || claims.Expiry != nil {
+		t.Error("null should leave claim unset", err)
+	}
+
+	for _, input := range []string{`{"exp":"1451606400"}`, `{"exp":true}`, `{"exp":1e300}`} {
+		var claims Claims
+		if err := json.Unmarshal([]byte(input), &claims); err == nil {
+			t.Error("should not parse", input)
+		}
+	}
+}
+
+func TestAudience(t *testing.T) {
+	for input, expected := range map[string]Audience{
+		`{"aud":"a1"}`:        {"a1"},
+		`{"aud":["a1"]}`:      {"a1"},
+		`{"aud":["a1","a2"]}`: {"a1", "a2"},
+		`{"aud":[]}`:          {},
+	} {
+		var claims Claims
+		if err := json.Unmarshal([]byte(input), &claims); err != nil {
+			t.Error("unable to parse", input, err)
+			continue
+		}
+		if !reflect.DeepEqual(claims.Audience, expected) {
+			t.Error("unexpected audience for", input, claims.Audience)
+		}
+	}
+
+	for _, input := range []string{`{"aud":1}`, `{"aud":["a1",2]}`, `{"aud":{}}`} {
+		var claims Claims
+		if err := json.Unmarshal([]byte(input), &claims); err == nil {
+			t.Error("should not parse", input)
+		}
+	}
+
+	for _, tc := range []struct {
+		audience      Audience
+		singleAsArray bool
+		expected      string
+	}{
+		{Audience{"a1"}, true, `["a1"]`},
+		{Audience{"a1"}, false, `"a1"`},
+		{Audience{"a1", "a2"}, false, `["a1","a2"]`},
+	} {
+		MarshalSingleStringAsArray = tc.singleAsArray
+		serialized, err := json.Marshal(tc.audience)
+		if err != nil || string(serialized) != tc.expected {
+			t.Error("unexpected serialization", string(serialized), err)
+		}
+	}
+	MarshalSingleStringAsArray = true
+
+	audience := Audience{"a1", "a2"}
+	if !audience.Contains("a2") || audience.Contains("a3") || (Audience)(nil).Contains("a1") {
+		t.Error("Contains returned wrong result")
+	}
+}
@@ -0,0 +1,85 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package jwt implements JSON Web Tokens (RFC 7519) on top of the JWS and JWE
+// implementation in package jose.
+package jwt
+
+import (
+	"github.com/square/go-jose"
+	"github.com/square/go-jose/json"
+)
+
+// JsonWebToken represents a parsed JWT. Its claims can only be read by
+// verifying (for signed tokens) or decrypting (for encrypted tokens) it.
+type JsonWebToken struct {
+	// Headers of the underlying JWS signature or JWE object.
+	Headers []jose.JoseHeader
+
+	payload func(key interface{}) ([]byte, error)
+}
+
+// ParseSigned parses a signed token, in compact (or full) serialization.
+func ParseSigned(input string) (*JsonWebToken, error) {
+	sig, err := jose.ParseSigned(input)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make([]jose.JoseHeader, len(sig.Signatures))
+	for i, signature := range sig.Signatures {
+		headers[i] = signature.Header
+	}
+
+	return &JsonWebToken{
+		Headers: headers,
+		payload: sig.Verify,
+	}, nil
+}
+
+// ParseEncrypted parses an encrypted token, in compact (or full)
+// serialization.
+func ParseEncrypted(input string) (*JsonWebToken, error) {
+	enc, err := jose.ParseEncrypted(input)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JsonWebToken{
+		Headers: []jose.JoseHeader{enc.Header},
+		payload: enc.Decrypt,
+	}, nil
+}
+
+// Claims verifies or decrypts the token with the given key, and unmarshals
+// its claims into each of out. This allows reading the registered claims into
+// a *Claims, and private claims into a struct with json tags (or a map) at
+// the same time. Note that the claims are not validated.
+func (t *JsonWebToken) Claims(key interface{}, out ...interface{}) error {
+	payload, err := t.payload(key)
+	if err != nil {
+		return err
+	}
+
+	for _, dest := range out {
+		err = json.Unmarshal(payload, dest)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
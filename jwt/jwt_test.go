@@ -0,0 +1,212 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/square/go-jose"
+)
+
+var sharedKey = []byte("secretsecretsecretsecretsecretse")
+
+var testClaims = &Claims{
+	Issuer:    "issuer",
+	Subject:   "subject",
+	Audience:  Audience{"a1", "a2"},
+	Expiry:    NewNumericDate(time.Unix(1451606400, 0)),
+	NotBefore: NewNumericDate(time.Unix(1451606300, 0)),
+	IssuedAt:  NewNumericDate(time.Unix(1451606300, 0)),
+	ID:        "id",
+}
+
+func TestSignedRoundtrip(t *testing.T) {
+	signer, err := jose.NewSigner(jose.HS256, sharedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serialized, err := Signed(signer).Claims(testClaims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(serialized, ".") != 2 {
+		t.Error("token should be in compact serialization", serialized)
+	}
+
+	tok, err := ParseSigned(serialized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tok.Headers) != 1 || tok.Headers[0].Algorithm != "HS256" {
+		t.Error("unexpected headers", tok.Headers)
+	}
+
+	var claims Claims
+	err = tok.Claims(sharedKey, &claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&claims, testClaims) {
+		t.Errorf("claims changed in round trip: %+v", claims)
+	}
+
+	err = tok.Claims([]byte("othersecretothersecretothersecre"), &claims)
+	if err != jose.ErrCryptoFailure {
+		t.Error("should not verify token with wrong key", err)
+	}
+}
+
+func TestEncryptedRoundtrip(t *testing.T) {
+	encrypter, err := jose.NewEncrypter(jose.DIRECT, jose.A256GCM, sharedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tok, err := Encrypted(encrypter).Claims(testClaims).Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tok.Headers) != 1 || tok.Headers[0].Algorithm != "dir" {
+		t.Error("unexpected headers", tok.Headers)
+	}
+
+	var claims Claims
+	err = tok.Claims(sharedKey, &claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&claims, testClaims) {
+		t.Errorf("claims changed in round trip: %+v", claims)
+	}
+
+	serialized, err := Encrypted(encrypter).Claims(testClaims).FullSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err = ParseEncrypted(serialized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tok.Claims(sharedKey, &claims); err != nil {
+		t.Error("unable to decrypt token in full serialization", err)
+	}
+}
+
+func TestBuilderMergesClaims(t *testing.T) {
+	signer, err := jose.NewSigner(jose.HS256, sharedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := Signed(signer).Claims(&Claims{Issuer: "issuer", Subject: "subject"})
+	first := base.Claims(&Claims{Subject: "first", ID: "1"})
+	second := base.Claims(&Claims{ID: "2"})
+
+	for _, tc := range []struct {
+		builder  Builder
+		expected Claims
+	}{
+		{base, Claims{Issuer: "issuer", Subject: "subject"}},
+		{first, Claims{Issuer: "issuer", Subject: "first", ID: "1"}},
+		{second, Claims{Issuer: "issuer", Subject: "subject", ID: "2"}},
+	} {
+		tok, err := tc.builder.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var claims Claims
+		if err := tok.Claims(sharedKey, &claims); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(claims, tc.expected) {
+			t.Errorf("expected claims %+v, got %+v", tc.expected, claims)
+		}
+	}
+
+	// Tokens without claims have an empty object as payload
+	tok, err := Signed(signer).Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims Claims
+	if err := tok.Claims(sharedKey, &claims); err != nil || !reflect.DeepEqual(claims, Claims{}) {
+		t.Error("unexpected claims for empty token", claims, err)
+	}
+}
+
+func TestParseInvalidToken(t *testing.T) {
+	for _, input := range []string{"", "a.b", "a.b.c.d.e.f"} {
+		if _, err := ParseSigned(input); err == nil {
+			t.Error("should not parse invalid signed token", input)
+		}
+		if _, err := ParseEncrypted(input); err == nil {
+			t.Error("should not parse invalid encrypted token", input)
+		}
+	}
+}
+
+type privateClaims struct {
+	Scope string   `json:"scope,omitempty"`
+	Roles []string `json:"roles,omitempty"`
+}
+
+func TestCustomClaims(t *testing.T) {
+	signer, err := jose.NewSigner(jose.HS256, sharedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	custom := privateClaims{Scope: "read write", Roles: []string{"admin"}}
+	tok, err := Signed(signer).
+		Claims(testClaims).
+		Claims(custom).
+		Claims(map[string]interface{}{"tenant": "acme", "level": 3}).
+		Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var claims Claims
+	var private privateClaims
+	var all map[string]interface{}
+	err = tok.Claims(sharedKey, &claims, &private, &all)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(&claims, testClaims) {
+		t.Errorf("registered claims changed in round trip: %+v", claims)
+	}
+	if !reflect.DeepEqual(private, custom) {
+		t.Errorf("private claims changed in round trip: %+v", private)
+	}
+	if all["tenant"] != "acme" || all["level"] != float64(3) || all["iss"] != "issuer" {
+		t.Errorf("unexpected claims: %v", all)
+	}
+
+	// Claims must serialize to a JSON object
+	if _, err := Signed(signer).Claims("claims").CompactSerialize(); err == nil {
+		t.Error("should not build token with claims that are not an object")
+	}
+	if _, err := Signed(signer).Claims(func() {}).CompactSerialize(); err == nil {
+		t.Error("should not build token with unserializable claims")
+	}
+}
@@ -0,0 +1,184 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/square/go-jose"
+)
+
+// ErrInvalidContentType indicates that a nested token doesn't have the "cty"
+// header set to "JWT".
+var ErrInvalidContentType = errors.New("square/go-jose/jwt: expected content type to be JWT (cty header)")
+
+// NestedJsonWebToken represents a parsed nested JWT, i.e. a signed token
+// which is encrypted (RFC 7519, section 5.2).
+type NestedJsonWebToken struct {
+	// Headers of the (outer) JWE object.
+	Headers []jose.JoseHeader
+
+	enc *jose.JsonWebEncryption
+}
+
+// Returned when building a nested token from a token which isn't signed.
+var errNotSigned = errors.New("square/go-jose/jwt: only signed tokens can be encrypted")
+
+// NestedBuilder builds a nested token, which is signed and then encrypted. It
+// is created from a signed token builder with Builder.Encrypt, e.g.
+// Signed(sig).Claims(c).Encrypt(enc). As for SignedAndEncrypted, the
+// encrypter must set the content type to "JWT".
+type NestedBuilder interface {
+	// Token builds the token, which is returned as the inner signed token
+	// (as if it was parsed and decrypted).
+	Token() (*JsonWebToken, error)
+	// CompactSerialize builds the token and serializes the encrypted token
+	// in compact format, as used for JWTs.
+	CompactSerialize() (string, error)
+	// FullSerialize builds the token and serializes the encrypted token in
+	// full (JSON) format.
+	FullSerialize() (string, error)
+}
+
+type nestedBuilder struct {
+	builder
+	sig jose.Signer
+	enc jose.Encrypter
+}
+
+// SignedAndEncrypted creates a builder for nested tokens, which are signed
+// with the signer and then encrypted with the encrypter. Nested tokens must
+// have the content type "JWT", so the encrypter must be configured with
+// SetContentType("JWT") beforehand; serializing the token fails with
+// ErrInvalidContentType otherwise.
+func SignedAndEncrypted(sig jose.Signer, enc jose.Encrypter) Builder {
+	return &nestedBuilder{sig: sig, enc: enc}
+}
+
+func (b *nestedBuilder) Claims(c interface{}) Builder {
+	return &nestedBuilder{builder: b.claims(c), sig: b.sig, enc: b.enc}
+}
+
+func (b *nestedBuilder) CanonicalClaims() Builder {
+	return &nestedBuilder{builder: b.canonicalized(), sig: b.sig, enc: b.enc}
+}
+
+func (b *nestedBuilder) Encrypt(enc jose.Encrypter) NestedBuilder {
+	return &nestedBuilder{builder: builder{err: errNotSigned}}
+}
+
+// Token builds the token, which is returned as the inner signed token (as
+// if it was parsed and decrypted).
+func (b *nestedBuilder) Token() (*JsonWebToken, error) {
+	payload, err := b.serializedPayload()
+	if err != nil {
+		return nil, err
+	}
+	sig, err := b.sig.Sign(payload)
+	if err != nil {
+		return nil, err
+	}
+	serialized, err := sig.CompactSerialize()
+	if err != nil {
+		return nil, err
+	}
+	return ParseSigned(serialized)
+}
+
+func (b *nestedBuilder) CompactSerialize() (string, error) {
+	obj, err := b.encrypt()
+	if err != nil {
+		return "", err
+	}
+	return obj.CompactSerialize()
+}
+
+func (b *nestedBuilder) FullSerialize() (string, error) {
+	obj, err := b.encrypt()
+	if err != nil {
+		return "", err
+	}
+	return obj.FullSerialize(), nil
+}
+
+func (b *nestedBuilder) encrypt() (*jose.JsonWebEncryption, error) {
+	payload, err := b.serializedPayload()
+	if err != nil {
+		return nil, err
+	}
+	sig, err := b.sig.Sign(payload)
+	if err != nil {
+		return nil, err
+	}
+	serialized, err := sig.CompactSerialize()
+	if err != nil {
+		return nil, err
+	}
+	obj, err := b.enc.Encrypt([]byte(serialized))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, header := range obj.RecipientHeaders() {
+		if !strings.EqualFold(header.ContentType, "JWT") {
+			return nil, ErrInvalidContentType
+		}
+	}
+	return obj, nil
+}
+
+// ParseSignedAndEncrypted parses a nested token, in compact (or full)
+// serialization. The token must have the "cty" header set to "JWT".
+func ParseSignedAndEncrypted(input string) (*NestedJsonWebToken, error) {
+	enc, err := jose.ParseEncrypted(input)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.EqualFold(enc.Header.ContentType, "JWT") {
+		return nil, ErrInvalidContentType
+	}
+
+	return &NestedJsonWebToken{
+		Headers: []jose.JoseHeader{enc.Header},
+		enc:     enc,
+	}, nil
+}
+
+// Decrypt decrypts the token with the given key, and parses the inner signed
+// token. Its claims can then be read with JsonWebToken.Claims.
+func (t *NestedJsonWebToken) Decrypt(decryptionKey interface{}) (*JsonWebToken, error) {
+	payload, err := t.enc.Decrypt(decryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseSigned(string(payload))
+}
+
+// Claims decrypts the token with the decryption key, verifies the inner
+// signed token with the verification key, and unmarshals its claims into each
+// of out (see JsonWebToken.Claims). Note that the claims are not validated.
+func (t *NestedJsonWebToken) Claims(decryptionKey, verificationKey interface{}, out ...interface{}) error {
+	tok, err := t.Decrypt(decryptionKey)
+	if err != nil {
+		return err
+	}
+
+	return tok.Claims(verificationKey, out...)
+}
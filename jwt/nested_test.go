@@ -0,0 +1,182 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/square/go-jose"
+)
+
+func TestNestedRoundtrip(t *testing.T) {
+	signingKey, err := jose.GenerateSigningKey(jose.ES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verificationKey := signingKey.Public()
+
+	signer, err := jose.NewSigner(jose.ES256, signingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypter, err := jose.NewEncrypter(jose.DIRECT, jose.A256GCM, sharedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypter.SetContentType("JWT")
+
+	builder := SignedAndEncrypted(signer, encrypter).Claims(testClaims)
+	serialized, err := builder.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nested, err := ParseSignedAndEncrypted(serialized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nested.Headers[0].ContentType != "JWT" {
+		t.Error("nested token should have content type JWT", nested.Headers[0].ContentType)
+	}
+
+	var claims Claims
+	err = nested.Claims(sharedKey, &verificationKey, &claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&claims, testClaims) {
+		t.Errorf("claims changed in round trip: %+v", claims)
+	}
+
+	tok, err := nested.Decrypt(sharedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.Headers[0].Algorithm != "ES256" {
+		t.Error("unexpected inner token header", tok.Headers[0])
+	}
+
+	otherKey, err := jose.GenerateSigningKey(jose.ES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublic := otherKey.Public()
+	if err := nested.Claims(sharedKey, &otherPublic, &claims); err != jose.ErrCryptoFailure {
+		t.Error("should not verify inner token with wrong key", err)
+	}
+	if err := nested.Claims([]byte("othersecretothersecretothersecre"), &verificationKey, &claims); err == nil {
+		t.Error("should not decrypt token with wrong key")
+	}
+
+	// Token returns the inner signed token
+	tok, err = builder.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tok.Claims(&verificationKey, &claims); err != nil {
+		t.Error("unable to verify inner token", err)
+	}
+}
+
+func TestNestedFluentBuilder(t *testing.T) {
+	signingKey, err := jose.GenerateSigningKey(jose.ES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verificationKey := signingKey.Public()
+
+	signer, err := jose.NewSigner(jose.ES256, signingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypter, err := jose.NewEncrypter(jose.A256KW, jose.A256GCM, sharedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypter.SetContentType("JWT")
+
+	serialized, err := Signed(signer).Claims(testClaims).Encrypt(encrypter).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nested, err := ParseSignedAndEncrypted(serialized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims Claims
+	if err := nested.Claims(sharedKey, &verificationKey, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&claims, testClaims) {
+		t.Errorf("claims changed in round trip: %+v", claims)
+	}
+
+	// Without content type JWT, the nested token isn't built.
+	plain, err := jose.NewEncrypter(jose.A256KW, jose.A256GCM, sharedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Signed(signer).Claims(testClaims).Encrypt(plain).CompactSerialize(); err != ErrInvalidContentType {
+		t.Error("should not build nested token without content type JWT", err)
+	}
+
+	// Only signed tokens can be encrypted.
+	if _, err := Encrypted(encrypter).Claims(testClaims).Encrypt(encrypter).CompactSerialize(); err == nil {
+		t.Error("should not build nested token from encrypted token")
+	}
+	if _, err := SignedAndEncrypted(signer, encrypter).Encrypt(encrypter).Token(); err == nil {
+		t.Error("should not build nested token from nested token")
+	}
+}
+
+func TestNestedContentType(t *testing.T) {
+	encrypter, err := jose.NewEncrypter(jose.DIRECT, jose.A256GCM, sharedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Encrypted (but not nested) token
+	serialized, err := Encrypted(encrypter).Claims(testClaims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseSignedAndEncrypted(serialized); err != ErrInvalidContentType {
+		t.Error("should not parse token without content type JWT as nested", err)
+	}
+
+	// The encrypter isn't modified, so it must already set the content type.
+	signer, err := jose.NewSigner(jose.HS256, sharedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SignedAndEncrypted(signer, encrypter).Claims(testClaims).CompactSerialize(); err != ErrInvalidContentType {
+		t.Error("should not build nested token without content type JWT", err)
+	}
+	serialized, err = Encrypted(encrypter).Claims(testClaims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := jose.ParseEncrypted(serialized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Header.ContentType != "" {
+		t.Error("building a nested token should not change the encrypter", obj.Header.ContentType)
+	}
+}
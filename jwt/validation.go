@@ -0,0 +1,191 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt
+
+import (
+	"errors"
+	"time"
+)
+
+// DefaultLeeway is the clock skew allowed by Validate.
+const DefaultLeeway = time.Minute
+
+var (
+	// ErrInvalidIssuer indicates an invalid "iss" claim.
+	ErrInvalidIssuer = errors.New("square/go-jose/jwt: validation failed, invalid issuer claim (iss)")
+
+	// ErrInvalidSubject indicates an invalid "sub" claim.
+	ErrInvalidSubject = errors.New("square/go-jose/jwt: validation failed, invalid subject claim (sub)")
+
+	// ErrInvalidAudience indicates that the "aud" claim doesn't include the
+	// expected audience.
+	ErrInvalidAudience = errors.New("square/go-jose/jwt: validation failed, invalid audience claim (aud)")
+
+	// ErrInvalidID indicates an invalid "jti" claim.
+	ErrInvalidID = errors.New("square/go-jose/jwt: validation failed, invalid ID claim (jti)")
+
+	// ErrNotValidYet indicates that the token is used before the time in its
+	// "nbf" claim.
+	ErrNotValidYet = errors.New("square/go-jose/jwt: validation failed, token not valid yet (nbf)")
+
+	// ErrExpired indicates that the token is used after the time in its "exp"
+	// claim.
+	ErrExpired = errors.New("square/go-jose/jwt: validation failed, token is expired (exp)")
+
+	// ErrIssuedInTheFuture indicates that the "iat" claim is in the future.
+	ErrIssuedInTheFuture = errors.New("square/go-jose/jwt: validation failed, token issued in the future (iat)")
+
+	// ErrTooOld indicates that the token was issued longer than
+	// Expected.MaxAge ago, according to its "iat" claim.
+	ErrTooOld = errors.New("square/go-jose/jwt: validation failed, token issued too long ago (iat)")
+
+	// ErrMissingIssuedAt indicates that the token has no "iat" claim, which is
+	// required when Expected.MaxAge is set.
+	ErrMissingIssuedAt = errors.New("square/go-jose/jwt: validation failed, missing issued at claim (iat)")
+
+	// ErrReplayed indicates that a token with the same "jti" claim was
+	// already accepted, see ReplayChecker.
+	ErrReplayed = errors.New("square/go-jose/jwt: validation failed, token replayed (jti)")
+)
+
+// ReplayChecker is implemented by a store of the IDs ("jti" claims) of
+// accepted tokens, to reject tokens which are used more than once. This
+// package doesn't implement any storage; see Expected.ReplayChecker.
+type ReplayChecker interface {
+	// Seen reports whether a token with the given ID was already recorded.
+	Seen(jti string) (bool, error)
+	// Record stores the ID of an accepted token. The expiry of the token is
+	// passed along (zero if the token doesn't expire), after which the ID
+	// may be forgotten. Implementations shared between processes should
+	// return ErrReplayed if the ID was recorded concurrently.
+	Record(jti string, expiry time.Time) error
+}
+
+// Expected describes the expected values of the claims of a token. Empty
+// fields are not checked.
+type Expected struct {
+	// Issuer matches the "iss" claim exactly.
+	Issuer string
+	// Subject matches the "sub" claim exactly.
+	Subject string
+	// Audience lists the identifiers of the recipient, one of which must be
+	// in the "aud" claim.
+	Audience []string
+	// ID matches the "jti" claim exactly.
+	ID string
+	// Time is the time at which the token is validated, defaults to time.Now.
+	Time time.Time
+	// MaxAge, if non-zero, is the maximum time since the token was issued,
+	// regardless of its expiry. Tokens without an "iat" claim are rejected.
+	MaxAge time.Duration
+	// ReplayChecker, if set, rejects tokens whose "jti" claim was seen before
+	// with ErrReplayed, and records the ID of tokens that pass validation.
+	// Tokens without a "jti" claim are rejected.
+	ReplayChecker ReplayChecker
+}
+
+// WithTime returns a copy of the expectations with the validation time set.
+func (e Expected) WithTime(t time.Time) Expected {
+	e.Time = t
+	return e
+}
+
+// Validate checks the claims against the expected values, allowing for
+// DefaultLeeway of clock skew when checking the time claims. The time claims
+// ("exp", "nbf" and "iat") are checked if present, even if the expectations
+// are empty. Errors can be compared to the Err* values of this package.
+func (c Claims) Validate(e Expected) error {
+	return c.ValidateWithLeeway(e, DefaultLeeway)
+}
+
+// ValidateWithLeeway is like Validate, but allows for the given clock skew.
+func (c Claims) ValidateWithLeeway(e Expected, leeway time.Duration) error {
+	if e.Issuer != "" && e.Issuer != c.Issuer {
+		return ErrInvalidIssuer
+	}
+	if e.Subject != "" && e.Subject != c.Subject {
+		return ErrInvalidSubject
+	}
+	if e.ID != "" && e.ID != c.ID {
+		return ErrInvalidID
+	}
+	if len(e.Audience) > 0 && !containsAny(c.Audience, e.Audience) {
+		return ErrInvalidAudience
+	}
+
+	now := e.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	if c.NotBefore != nil && now.Add(leeway).Before(c.NotBefore.Time()) {
+		return ErrNotValidYet
+	}
+	if c.Expiry != nil && now.Add(-leeway).After(c.Expiry.Time()) {
+		return ErrExpired
+	}
+	if c.IssuedAt != nil && now.Add(leeway).Before(c.IssuedAt.Time()) {
+		return ErrIssuedInTheFuture
+	}
+
+	if e.MaxAge > 0 {
+		if c.IssuedAt == nil {
+			return ErrMissingIssuedAt
+		}
+		if now.Add(-leeway).After(c.IssuedAt.Time().Add(e.MaxAge)) {
+			return ErrTooOld
+		}
+	}
+
+	if e.ReplayChecker != nil {
+		return c.checkReplay(e.ReplayChecker)
+	}
+
+	return nil
+}
+
+// Check that the token wasn't seen before and record it, once all other
+// claims are valid.
+func (c Claims) checkReplay(checker ReplayChecker) error {
+	if c.ID == "" {
+		return ErrInvalidID
+	}
+
+	seen, err := checker.Seen(c.ID)
+	if err != nil {
+		return err
+	}
+	if seen {
+		return ErrReplayed
+	}
+
+	var expiry time.Time
+	if c.Expiry != nil {
+		expiry = c.Expiry.Time()
+	}
+	return checker.Record(c.ID, expiry)
+}
+
+// Check whether any of the wanted values is in the audience.
+func containsAny(audience Audience, wanted []string) bool {
+	for _, value := range wanted {
+		if audience.Contains(value) {
+			return true
+		}
+	}
+	return false
+}
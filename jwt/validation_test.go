@@ -0,0 +1,140 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1451606400, 0)
+	claims := Claims{
+		Issuer:    "issuer",
+		Subject:   "subject",
+		Audience:  Audience{"a1", "a2"},
+		Expiry:    NewNumericDate(now.Add(time.Hour)),
+		NotBefore: NewNumericDate(now.Add(-time.Hour)),
+		IssuedAt:  NewNumericDate(now.Add(-time.Hour)),
+		ID:        "id",
+	}
+
+	for _, tc := range []struct {
+		expected Expected
+		err      error
+	}{
+		{Expected{}.WithTime(now), nil},
+		{Expected{Issuer: "issuer", Subject: "subject", Audience: []string{"a2"}, ID: "id"}.WithTime(now), nil},
+		{Expected{Audience: []string{"a3", "a1"}}.WithTime(now), nil},
+		{Expected{Issuer: "other"}.WithTime(now), ErrInvalidIssuer},
+		{Expected{Subject: "other"}.WithTime(now), ErrInvalidSubject},
+		{Expected{Audience: []string{"a3"}}.WithTime(now), ErrInvalidAudience},
+		{Expected{ID: "other"}.WithTime(now), ErrInvalidID},
+		{Expected{}.WithTime(now.Add(-2 * time.Hour)), ErrNotValidYet},
+		{Expected{}.WithTime(now.Add(2 * time.Hour)), ErrExpired},
+		// Within the default leeway
+		{Expected{}.WithTime(now.Add(-time.Hour - 30*time.Second)), nil},
+		{Expected{}.WithTime(now.Add(time.Hour + 30*time.Second)), nil},
+		// Current time by default
+		{Expected{}, ErrExpired},
+	} {
+		if err := claims.Validate(tc.expected); err != tc.err {
+			t.Errorf("expected %v for %+v, got %v", tc.err, tc.expected, err)
+		}
+	}
+
+	if err := claims.ValidateWithLeeway(Expected{}.WithTime(now.Add(time.Hour+30*time.Second)), 0); err != ErrExpired {
+		t.Error("should not allow clock skew without leeway", err)
+	}
+	if err := claims.ValidateWithLeeway(Expected{}.WithTime(now.Add(3*time.Hour)), 3*time.Hour); err != nil {
+		t.Error("should allow clock skew within leeway", err)
+	}
+
+	future := Claims{IssuedAt: NewNumericDate(now.Add(time.Hour))}
+	if err := future.Validate(Expected{}.WithTime(now)); err != ErrIssuedInTheFuture {
+		t.Error("should reject token issued in the future", err)
+	}
+
+	// Maximum age since "iat", allowing for leeway
+	for _, tc := range []struct {
+		age time.Duration
+		err error
+	}{
+		{4 * time.Minute, nil},
+		{5*time.Minute + 30*time.Second, nil},
+		{7 * time.Minute, ErrTooOld},
+	} {
+		recent := Claims{IssuedAt: NewNumericDate(now.Add(-tc.age))}
+		if err := recent.Validate(Expected{MaxAge: 5 * time.Minute}.WithTime(now)); err != tc.err {
+			t.Errorf("expected %v for token issued %v ago, got %v", tc.err, tc.age, err)
+		}
+	}
+	if err := (Claims{}).Validate(Expected{MaxAge: 5 * time.Minute}); err != ErrMissingIssuedAt {
+		t.Error("should require iat with maximum age", err)
+	}
+
+	// Missing claims are only checked when expected
+	if err := (Claims{}).Validate(Expected{}); err != nil {
+		t.Error("empty claims should be valid without expectations", err)
+	}
+	if err := (Claims{}).Validate(Expected{Audience: []string{"a1"}}); err != ErrInvalidAudience {
+		t.Error("should reject missing audience", err)
+	}
+}
+
+// memoryReplayChecker is a ReplayChecker for tests.
+type memoryReplayChecker map[string]time.Time
+
+func (m memoryReplayChecker) Seen(jti string) (bool, error) {
+	_, ok := m[jti]
+	return ok, nil
+}
+
+func (m memoryReplayChecker) Record(jti string, expiry time.Time) error {
+	m[jti] = expiry
+	return nil
+}
+
+func TestValidateReplay(t *testing.T) {
+	now := time.Unix(1451606400, 0)
+	checker := memoryReplayChecker{}
+	expected := Expected{ReplayChecker: checker}.WithTime(now)
+
+	claims := Claims{ID: "once", Expiry: NewNumericDate(now.Add(time.Hour))}
+	if err := claims.Validate(expected); err != nil {
+		t.Fatal("first use should be valid", err)
+	}
+	if !checker[claims.ID].Equal(now.Add(time.Hour)) {
+		t.Error("token ID should be recorded with its expiry", checker)
+	}
+	if err := claims.Validate(expected); err != ErrReplayed {
+		t.Error("second use should be rejected", err)
+	}
+
+	// Invalid tokens are not recorded
+	expired := Claims{ID: "expired", Expiry: NewNumericDate(now.Add(-time.Hour))}
+	if err := expired.Validate(expected); err != ErrExpired {
+		t.Error("expected expired token", err)
+	}
+	if _, ok := checker["expired"]; ok {
+		t.Error("invalid token should not be recorded")
+	}
+
+	if err := (Claims{}).Validate(expected); err != ErrInvalidID {
+		t.Error("should require jti with replay checker", err)
+	}
+}
@@ -0,0 +1,143 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jose
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/mldsa"
+	"crypto/mlkem"
+	"crypto/rsa"
+	"io"
+)
+
+// Size of RSA keys created by GenerateSigningKey and GenerateEncryptionKey.
+var GeneratedRSAKeySize = 2048
+
+// GenerateSigningKey generates a new private key for the given signature
+// algorithm, with the key size or curve required by the algorithm. The key is
+// returned as a JWK for the algorithm, with use "sig" and the (SHA-256) JWK
+// Thumbprint as key ID. See JsonWebKey.Public for the corresponding public key.
+func GenerateSigningKey(alg SignatureAlgorithm) (*JsonWebKey, error) {
+	var key interface{}
+	var err error
+
+	switch alg {
+	case RS256, RS384, RS512, PS256, PS384, PS512:
+		key, err = rsa.GenerateKey(randReader, GeneratedRSAKeySize)
+	case ES256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), randReader)
+	case ES384:
+		key, err = ecdsa.GenerateKey(elliptic.P384(), randReader)
+	case ES512:
+		key, err = ecdsa.GenerateKey(elliptic.P521(), randReader)
+	case ES256K:
+		// ES256K keys can only be used for verification, see NewSigner.
+		return nil, ErrUnsupportedAlgorithm
+	case EdDSA:
+		_, key, err = ed25519.GenerateKey(randReader)
+	case HS256:
+		key, err = generateSymmetricKey(32)
+	case HS384:
+		key, err = generateSymmetricKey(48)
+	case HS512:
+		key, err = generateSymmetricKey(64)
+	case ML_DSA_44, ML_DSA_65, ML_DSA_87:
+		params, _ := mldsaParameters(alg)
+		key, err = mldsa.GenerateKey(params)
+	default:
+		return nil, ErrUnsupportedAlgorithm
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newGeneratedKey(key, string(alg), "sig")
+}
+
+// GenerateEncryptionKey generates a new private (or symmetric) key for the
+// given key management algorithm, with the key size or curve required by the
+// algorithm. ECDH keys are on P-256. The key is returned as a JWK for the
+// algorithm, with use "enc" and the (SHA-256) JWK Thumbprint as key ID. See
+// JsonWebKey.Public for the corresponding public key.
+//
+// Keys for direct encryption depend on the content encryption algorithm and
+// passwords for PBES2 must be chosen by the user, so neither are supported.
+func GenerateEncryptionKey(alg KeyAlgorithm) (*JsonWebKey, error) {
+	var key interface{}
+	var err error
+
+	switch alg {
+	case RSA1_5, RSA_OAEP, RSA_OAEP_256, RSA_OAEP_384, RSA_OAEP_512:
+		key, err = rsa.GenerateKey(randReader, GeneratedRSAKeySize)
+	case ECDH_ES, ECDH_ES_A128KW, ECDH_ES_A192KW, ECDH_ES_A256KW,
+		ECDH_1PU, ECDH_1PU_A128KW, ECDH_1PU_A192KW, ECDH_1PU_A256KW:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), randReader)
+	case A128KW, A128GCMKW:
+		key, err = generateSymmetricKey(16)
+	case A192KW, A192GCMKW:
+		key, err = generateSymmetricKey(24)
+	case A256KW, A256GCMKW:
+		key, err = generateSymmetricKey(32)
+	case HPKE_3_KE, HPKE_4_KE:
+		// Only X25519 keys can be represented as JWK (for now)
+		key, err = ecdh.X25519().GenerateKey(randReader)
+	case ML_KEM_768, ML_KEM_768_A192KW:
+		key, err = mlkem.GenerateKey768()
+	case ML_KEM_1024, ML_KEM_1024_A256KW:
+		key, err = mlkem.GenerateKey1024()
+	default:
+		return nil, ErrUnsupportedAlgorithm
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newGeneratedKey(key, string(alg), "enc")
+}
+
+// Generate a random symmetric key of the given size.
+func generateSymmetricKey(size int) ([]byte, error) {
+	key := make([]byte, size)
+	_, err := io.ReadFull(randReader, key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Wrap a generated key in a JWK, using its thumbprint as key ID.
+func newGeneratedKey(key interface{}, alg, use string) (*JsonWebKey, error) {
+	jwk := &JsonWebKey{
+		Key:       key,
+		Algorithm: alg,
+		Use:       use,
+	}
+
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	jwk.KeyID = base64URLEncode(thumbprint)
+
+	return jwk, nil
+}
@@ -0,0 +1,149 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jose
+
+import (
+	"crypto"
+	"testing"
+)
+
+func TestGenerateSigningKey(t *testing.T) {
+	for _, alg := range []SignatureAlgorithm{
+		RS256, RS384, RS512, PS256, PS384, PS512, ES256, ES384, ES512,
+		EdDSA, HS256, HS384, HS512, ML_DSA_44, ML_DSA_65, ML_DSA_87,
+	} {
+		jwk, err := GenerateSigningKey(alg)
+		if err != nil {
+			t.Error(alg, err)
+			continue
+		}
+
+		checkGeneratedKey(t, jwk, string(alg), "sig")
+
+		signer, err := NewSigner(alg, jwk)
+		if err != nil {
+			t.Error(alg, err)
+			continue
+		}
+		obj, err := signer.Sign([]byte("Lorem ipsum dolor sit amet"))
+		if err != nil {
+			t.Error(alg, err)
+			continue
+		}
+
+		verificationKey := interface{}(jwk)
+		if public := jwk.Public(); public.Valid() {
+			verificationKey = &public
+		}
+		_, err = obj.Verify(verificationKey)
+		if err != nil {
+			t.Error(alg, "unable to verify with generated key", err)
+		}
+	}
+
+	_, err := GenerateSigningKey("XYZ")
+	if err != ErrUnsupportedAlgorithm {
+		t.Error("should not generate key for unknown algorithm", err)
+	}
+
+	_, err = GenerateSigningKey(ES256K)
+	if err != ErrUnsupportedAlgorithm {
+		t.Error("should not generate ES256K key", err)
+	}
+}
+
+func TestGenerateEncryptionKey(t *testing.T) {
+	RSATestKeySize := GeneratedRSAKeySize
+	GeneratedRSAKeySize = 1024
+	defer func() { GeneratedRSAKeySize = RSATestKeySize }()
+
+	for _, alg := range []KeyAlgorithm{
+		RSA1_5, RSA_OAEP, RSA_OAEP_256, ECDH_ES, ECDH_ES_A128KW, ECDH_ES_A192KW,
+		ECDH_ES_A256KW, A128KW, A192KW, A256KW, A128GCMKW, A192GCMKW, A256GCMKW,
+		HPKE_3_KE, HPKE_4_KE, ML_KEM_768, ML_KEM_1024, ML_KEM_768_A192KW,
+		ML_KEM_1024_A256KW,
+	} {
+		jwk, err := GenerateEncryptionKey(alg)
+		if err != nil {
+			t.Error(alg, err)
+			continue
+		}
+
+		checkGeneratedKey(t, jwk, string(alg), "enc")
+
+		encryptionKey := interface{}(jwk)
+		if public := jwk.Public(); public.Valid() {
+			encryptionKey = &public
+		}
+		enc, err := NewEncrypter(alg, A128GCM, encryptionKey)
+		if err != nil {
+			t.Error(alg, err)
+			continue
+		}
+		obj, err := enc.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+		if err != nil {
+			t.Error(alg, err)
+			continue
+		}
+
+		_, err = obj.Decrypt(jwk)
+		if err != nil {
+			t.Error(alg, "unable to decrypt with generated key", err)
+		}
+	}
+
+	for _, alg := range []KeyAlgorithm{DIRECT, PBES2_HS256_A128KW, "XYZ"} {
+		_, err := GenerateEncryptionKey(alg)
+		if err != ErrUnsupportedAlgorithm {
+			t.Error("should not generate key for algorithm", alg, err)
+		}
+	}
+}
+
+func checkGeneratedKey(t *testing.T, jwk *JsonWebKey, alg, use string) {
+	if key, ok := jwk.Key.([]byte); ok {
+		if len(key) == 0 {
+			t.Error(alg, "generated symmetric key should not be empty")
+		}
+	} else if !jwk.Valid() || jwk.IsPublic() {
+		t.Error(alg, "generated key should be a valid private key")
+	}
+	if jwk.Algorithm != alg || jwk.Use != use {
+		t.Error(alg, "generated key has wrong alg/use", jwk.Algorithm, jwk.Use)
+	}
+
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil || jwk.KeyID != base64URLEncode(thumbprint) {
+		t.Error(alg, "generated key should have thumbprint as key ID", jwk.KeyID, err)
+	}
+
+	// Key should survive a JSON round trip
+	serialized, err := jwk.MarshalJSON()
+	if err != nil {
+		t.Error(alg, err)
+		return
+	}
+	var parsed JsonWebKey
+	err = parsed.UnmarshalJSON(serialized)
+	if err != nil {
+		t.Error(alg, err)
+		return
+	}
+	if parsed.KeyID != jwk.KeyID || parsed.Algorithm != alg {
+		t.Error(alg, "generated key changed in JSON round trip")
+	}
+}
@@ -0,0 +1,115 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jose
+
+import (
+	"crypto/mldsa"
+	"errors"
+	"fmt"
+)
+
+// A verifier for ML-DSA signatures
+type mldsaVerifier struct {
+	publicKey *mldsa.PublicKey
+}
+
+// A signer for ML-DSA signatures
+type mldsaSigner struct {
+	privateKey *mldsa.PrivateKey
+}
+
+// Get the ML-DSA parameter set for the given signature algorithm.
+func mldsaParameters(alg SignatureAlgorithm) (mldsa.Parameters, error) {
+	switch alg {
+	case ML_DSA_44:
+		return mldsa.MLDSA44(), nil
+	case ML_DSA_65:
+		return mldsa.MLDSA65(), nil
+	case ML_DSA_87:
+		return mldsa.MLDSA87(), nil
+	default:
+		return mldsa.Parameters{}, ErrUnsupportedAlgorithm
+	}
+}
+
+// checkMLDSAParameters verifies that an ML-DSA key has the parameter set
+// required by the given signature algorithm.
+func checkMLDSAParameters(alg SignatureAlgorithm, key *mldsa.PublicKey) error {
+	params, err := mldsaParameters(alg)
+	if err != nil {
+		return err
+	}
+
+	if key.Parameters() != params {
+		return fmt.Errorf("square/go-jose: %s requires a %s key, got %s instead", alg, params, key.Parameters())
+	}
+
+	return nil
+}
+
+// newMLDSASigner creates a recipientSigInfo based on the given key.
+func newMLDSASigner(sigAlg SignatureAlgorithm, privateKey *mldsa.PrivateKey) (recipientSigInfo, error) {
+	if privateKey == nil {
+		return recipientSigInfo{}, errors.New("invalid private key")
+	}
+
+	if err := checkMLDSAParameters(sigAlg, privateKey.PublicKey()); err != nil {
+		return recipientSigInfo{}, err
+	}
+
+	return recipientSigInfo{
+		sigAlg: sigAlg,
+		publicKey: &JsonWebKey{
+			Key:       privateKey.PublicKey(),
+			Algorithm: string(sigAlg),
+		},
+		signer: &mldsaSigner{
+			privateKey: privateKey,
+		},
+	}, nil
+}
+
+// Sign the given payload. ML-DSA signs the message itself (with an empty
+// context string), there is no separate hash function.
+func (ctx mldsaSigner) signPayload(payload []byte, alg SignatureAlgorithm) (Signature, error) {
+	if err := checkMLDSAParameters(alg, ctx.privateKey.PublicKey()); err != nil {
+		return Signature{}, err
+	}
+
+	signature, err := ctx.privateKey.Sign(randReader, payload, nil)
+	if err != nil {
+		return Signature{}, err
+	}
+
+	return Signature{
+		Signature: signature,
+		protected: &rawHeader{},
+	}, nil
+}
+
+// Verify the given payload
+func (ctx mldsaVerifier) verifyPayload(payload []byte, signature []byte, alg SignatureAlgorithm) error {
+	if err := checkMLDSAParameters(alg, ctx.publicKey); err != nil {
+		return err
+	}
+
+	if err := mldsa.Verify(ctx.publicKey, payload, signature, nil); err != nil {
+		return errors.New("square/go-jose: ml-dsa signature failed to verify")
+	}
+
+	return nil
+}
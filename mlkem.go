@@ -0,0 +1,195 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jose
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/mlkem"
+	"errors"
+
+	"github.com/square/go-jose/cipher"
+)
+
+// A key encrypter for ML-KEM
+type mlkemEncrypter struct {
+	publicKey crypto.Encapsulator
+}
+
+// A key decrypter for ML-KEM
+type mlkemDecrypter struct {
+	privateKey crypto.Decapsulator
+}
+
+// A key generator for ML-KEM (direct key agreement)
+type mlkemKeyGenerator struct {
+	size      int
+	algID     string
+	publicKey crypto.Encapsulator
+}
+
+// Get the size of the ML-KEM encapsulation key used by the given key
+// management algorithm, and the size of the key wrapping key (zero for
+// direct key agreement).
+func mlkemParameters(alg KeyAlgorithm) (keySize, kekSize int, err error) {
+	switch alg {
+	case ML_KEM_768:
+		return mlkem.EncapsulationKeySize768, 0, nil
+	case ML_KEM_768_A192KW:
+		return mlkem.EncapsulationKeySize768, 24, nil
+	case ML_KEM_1024:
+		return mlkem.EncapsulationKeySize1024, 0, nil
+	case ML_KEM_1024_A256KW:
+		return mlkem.EncapsulationKeySize1024, 32, nil
+	default:
+		return 0, 0, ErrUnsupportedAlgorithm
+	}
+}
+
+// sameMLKEMParameters returns true if both key management algorithms are
+// ML-KEM algorithms which use the same parameter set.
+func sameMLKEMParameters(alg1, alg2 KeyAlgorithm) bool {
+	size1, _, err1 := mlkemParameters(alg1)
+	size2, _, err2 := mlkemParameters(alg2)
+	return err1 == nil && err2 == nil && size1 == size2
+}
+
+// checkMLKEMKey verifies that an ML-KEM key has the parameter set required by
+// the given key management algorithm.
+func checkMLKEMKey(alg KeyAlgorithm, key crypto.Encapsulator) (int, error) {
+	keySize, kekSize, err := mlkemParameters(alg)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(key.Bytes()) != keySize {
+		return 0, errors.New("square/go-jose: ML-KEM key does not match key management algorithm")
+	}
+
+	return kekSize, nil
+}
+
+// newMLKEMRecipient creates recipientKeyInfo based on the given key.
+func newMLKEMRecipient(keyAlg KeyAlgorithm, publicKey crypto.Encapsulator) (recipientKeyInfo, error) {
+	if _, err := checkMLKEMKey(keyAlg, publicKey); err != nil {
+		return recipientKeyInfo{}, err
+	}
+
+	return recipientKeyInfo{
+		keyAlg: keyAlg,
+		keyEncrypter: &mlkemEncrypter{
+			publicKey: publicKey,
+		},
+	}, nil
+}
+
+// Encrypt the given payload and update the object.
+func (ctx mlkemEncrypter) encryptKey(cek []byte, alg KeyAlgorithm) (recipientInfo, error) {
+	kekSize, err := checkMLKEMKey(alg, ctx.publicKey)
+	if err != nil {
+		return recipientInfo{}, err
+	}
+
+	if kekSize == 0 {
+		// Direct key agreement doesn't wrap a key, the key generator has
+		// already derived the content encryption key.
+		return recipientInfo{
+			header: &rawHeader{},
+		}, nil
+	}
+
+	generator := mlkemKeyGenerator{
+		size:      kekSize,
+		algID:     string(alg),
+		publicKey: ctx.publicKey,
+	}
+
+	kek, header, err := generator.genKey()
+	if err != nil {
+		return recipientInfo{}, err
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return recipientInfo{}, err
+	}
+
+	jek, err := josecipher.KeyWrap(block, cek)
+	if err != nil {
+		return recipientInfo{}, err
+	}
+
+	return recipientInfo{
+		encryptedKey: jek,
+		header:       &header,
+	}, nil
+}
+
+// Get key size for ML-KEM key generator
+func (ctx mlkemKeyGenerator) keySize() int {
+	return ctx.size
+}
+
+// Get a content encryption key for ML-KEM. The ciphertext is sent in the "ek"
+// header.
+func (ctx mlkemKeyGenerator) genKey() ([]byte, rawHeader, error) {
+	sharedKey, ciphertext := ctx.publicKey.Encapsulate()
+
+	out := josecipher.DeriveMLKEM(ctx.algID, []byte{}, []byte{}, sharedKey, ctx.size)
+
+	headers := rawHeader{
+		Ek: newBuffer(ciphertext),
+	}
+
+	return out, headers, nil
+}
+
+// Decrypt the given payload and return the content encryption key.
+func (ctx mlkemDecrypter) decryptKey(headers rawHeader, recipient *recipientInfo, generator keyGenerator) ([]byte, error) {
+	kekSize, err := checkMLKEMKey(KeyAlgorithm(headers.Alg), ctx.privateKey.Encapsulator())
+	if err != nil {
+		return nil, err
+	}
+
+	if headers.Ek == nil {
+		return nil, errors.New("square/go-jose: missing ek header")
+	}
+
+	sharedKey, err := ctx.privateKey.Decapsulate(headers.Ek.bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	apuData := headers.Apu.bytes()
+	apvData := headers.Apv.bytes()
+
+	if kekSize == 0 {
+		// Direct key agreement, the encrypted key must be empty.
+		if len(recipient.encryptedKey) > 0 {
+			return nil, errors.New("square/go-jose: unexpected encrypted key for ML-KEM")
+		}
+		return josecipher.DeriveMLKEM(string(headers.Enc), apuData, apvData, sharedKey, generator.keySize()), nil
+	}
+
+	kek := josecipher.DeriveMLKEM(headers.Alg, apuData, apvData, sharedKey, kekSize)
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	return josecipher.KeyUnwrap(block, recipient.encryptedKey)
+}
@@ -0,0 +1,331 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jose
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+)
+
+// OpaqueSigner is an interface that supports signing payloads with opaque
+// private key(s). Private key operations performed by implementors may, for
+// example, occur in a hardware module or a cloud KMS, so that the private key
+// material never has to be in process memory. An OpaqueSigner may be passed
+// to NewSigner or AddRecipient in place of a private key.
+type OpaqueSigner interface {
+	// Public returns the public key of the current signing key. Its key ID
+	// and certificates, if any, are used for the "kid" and "x5c" headers.
+	Public() *JsonWebKey
+	// Algs returns a list of supported signing algorithms.
+	Algs() []SignatureAlgorithm
+	// SignPayload signs a payload (the JWS signing input) with the current
+	// signing key using the given algorithm. The signature must be encoded as
+	// specified in RFC 7518, e.g. as R || S for ECDSA.
+	SignPayload(payload []byte, alg SignatureAlgorithm) ([]byte, error)
+}
+
+// A payload signer backed by an OpaqueSigner
+type opaqueSigner struct {
+	signer OpaqueSigner
+}
+
+// newOpaqueSigner creates a recipientSigInfo based on the given signer.
+func newOpaqueSigner(sigAlg SignatureAlgorithm, signer OpaqueSigner) (recipientSigInfo, error) {
+	supported := false
+	for _, alg := range signer.Algs() {
+		if alg == sigAlg {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return recipientSigInfo{}, ErrUnsupportedAlgorithm
+	}
+
+	public := signer.Public()
+	if public == nil || !public.IsPublic() {
+		return recipientSigInfo{}, errors.New("square/go-jose: opaque signer has invalid public key")
+	}
+
+	return recipientSigInfo{
+		sigAlg:       sigAlg,
+		keyID:        public.KeyID,
+		publicKey:    &JsonWebKey{Key: public.Key},
+		certificates: public.Certificates,
+		signer: &opaqueSigner{
+			signer: signer,
+		},
+	}, nil
+}
+
+// Sign the given payload
+func (ctx *opaqueSigner) signPayload(payload []byte, alg SignatureAlgorithm) (Signature, error) {
+	out, err := ctx.signer.SignPayload(payload, alg)
+	if err != nil {
+		return Signature{}, err
+	}
+
+	return Signature{
+		Signature: out,
+		protected: &rawHeader{},
+	}, nil
+}
+
+// cryptoSigner adapts a crypto.Signer holding an RSA, ECDSA or Ed25519 key
+// to the OpaqueSigner interface.
+type cryptoSigner struct {
+	signer crypto.Signer
+}
+
+func (ctx *cryptoSigner) Public() *JsonWebKey {
+	return &JsonWebKey{Key: ctx.signer.Public()}
+}
+
+func (ctx *cryptoSigner) Algs() []SignatureAlgorithm {
+	switch public := ctx.signer.Public().(type) {
+	case *rsa.PublicKey:
+		return []SignatureAlgorithm{RS256, RS384, RS512, PS256, PS384, PS512}
+	case *ecdsa.PublicKey:
+		for _, alg := range []SignatureAlgorithm{ES256, ES384, ES512, ES256K} {
+			if checkECDSACurve(alg, public.Curve) == nil {
+				return []SignatureAlgorithm{alg}
+			}
+		}
+	case ed25519.PublicKey:
+		return []SignatureAlgorithm{EdDSA}
+	}
+
+	return nil
+}
+
+func (ctx *cryptoSigner) SignPayload(payload []byte, alg SignatureAlgorithm) ([]byte, error) {
+	switch public := ctx.signer.Public().(type) {
+	case *rsa.PublicKey:
+		hash, err := rsaSignatureHash(alg)
+		if err != nil {
+			return nil, err
+		}
+
+		var opts crypto.SignerOpts = hash
+		switch alg {
+		case PS256, PS384, PS512:
+			// RFC 7518 requires the salt to be the same size as the hash output.
+			opts = &rsa.PSSOptions{
+				SaltLength: rsa.PSSSaltLengthEqualsHash,
+				Hash:       hash,
+			}
+		}
+
+		return ctx.signer.Sign(randReader, hashPayload(hash, payload), opts)
+	case *ecdsa.PublicKey:
+		if err := checkECDSACurve(alg, public.Curve); err != nil {
+			return nil, err
+		}
+
+		hash, err := ecdsaSignatureHash(alg)
+		if err != nil {
+			return nil, err
+		}
+
+		der, err := ctx.signer.Sign(randReader, hashPayload(hash, payload), hash)
+		if err != nil {
+			return nil, err
+		}
+
+		return rawECDSASignature(der, public.Curve)
+	case ed25519.PublicKey:
+		if alg != EdDSA {
+			return nil, ErrUnsupportedAlgorithm
+		}
+
+		// EdDSA signs the message itself, there is no separate hash function.
+		return ctx.signer.Sign(randReader, payload, crypto.Hash(0))
+	default:
+		return nil, ErrUnsupportedKeyType
+	}
+}
+
+// Compute the digest of the payload with the given hash function.
+func hashPayload(hash crypto.Hash, payload []byte) []byte {
+	hasher := hash.New()
+
+	// According to documentation, Write() on hash never fails
+	_, _ = hasher.Write(payload)
+	return hasher.Sum(nil)
+}
+
+// OpaqueKeyEncrypter is an interface that supports encrypting (wrapping) the
+// content encryption key of a JWE with an opaque key, e.g. one held in a
+// hardware module or a cloud KMS. It may be passed to NewEncrypter or
+// AddRecipient in place of a public key. Only key management algorithms whose
+// output is just the encrypted key (RSA and AES key wrap) are supported.
+type OpaqueKeyEncrypter interface {
+	// KeyID returns the key ID for the "kid" header, or an empty string.
+	KeyID() string
+	// Algs returns a list of supported key management algorithms.
+	Algs() []KeyAlgorithm
+	// EncryptKey encrypts the content encryption key using the given
+	// algorithm and returns the encrypted key.
+	EncryptKey(cek []byte, alg KeyAlgorithm) ([]byte, error)
+}
+
+// OpaqueKeyDecrypter is an interface that supports decrypting (unwrapping)
+// the content encryption key of a JWE with an opaque key, e.g. by calling out
+// to a cloud KMS. It may be passed to Decrypt or DecryptMulti in place of a
+// private key. For RSA1_5, errors and keys of the wrong size are replaced by a
+// random key, so that padding errors can't be told apart from other failures.
+type OpaqueKeyDecrypter interface {
+	// DecryptKey decrypts the encrypted key of a recipient, given the merged
+	// headers for that recipient, and returns the content encryption key.
+	DecryptKey(encryptedKey []byte, header JoseHeader) ([]byte, error)
+}
+
+// A key encrypter backed by an OpaqueKeyEncrypter
+type opaqueKeyEncrypter struct {
+	encrypter OpaqueKeyEncrypter
+}
+
+// A key decrypter backed by an OpaqueKeyDecrypter
+type opaqueKeyDecrypter struct {
+	decrypter OpaqueKeyDecrypter
+}
+
+// newOpaqueKeyEncrypter creates recipientKeyInfo based on the given encrypter.
+func newOpaqueKeyEncrypter(keyAlg KeyAlgorithm, encrypter OpaqueKeyEncrypter) (recipientKeyInfo, error) {
+	switch keyAlg {
+	case RSA1_5, RSA_OAEP, RSA_OAEP_256, RSA_OAEP_384, RSA_OAEP_512, A128KW, A192KW, A256KW:
+	default:
+		return recipientKeyInfo{}, ErrUnsupportedAlgorithm
+	}
+
+	supported := false
+	for _, alg := range encrypter.Algs() {
+		if alg == keyAlg {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return recipientKeyInfo{}, ErrUnsupportedAlgorithm
+	}
+
+	return recipientKeyInfo{
+		keyAlg: keyAlg,
+		keyID:  encrypter.KeyID(),
+		keyEncrypter: &opaqueKeyEncrypter{
+			encrypter: encrypter,
+		},
+	}, nil
+}
+
+// Encrypt the given content encryption key.
+func (ctx *opaqueKeyEncrypter) encryptKey(cek []byte, alg KeyAlgorithm) (recipientInfo, error) {
+	encryptedKey, err := ctx.encrypter.EncryptKey(cek, alg)
+	if err != nil {
+		return recipientInfo{}, err
+	}
+
+	return recipientInfo{
+		encryptedKey: encryptedKey,
+		header:       &rawHeader{},
+	}, nil
+}
+
+// Decrypt the encrypted key of the given recipient.
+func (ctx *opaqueKeyDecrypter) decryptKey(headers rawHeader, recipient *recipientInfo, generator keyGenerator) ([]byte, error) {
+	cek, err := ctx.decrypter.DecryptKey(recipient.encryptedKey, headers.sanitized())
+	if KeyAlgorithm(headers.Alg) == RSA1_5 {
+		return rsaPKCS1v15SessionKey(cek, err, generator)
+	}
+	return cek, err
+}
+
+// Convert an ASN.1 encoded ECDSA signature, as produced by crypto.Signer, to
+// the fixed size concatenation of R and S used by JWS.
+func rawECDSASignature(der []byte, curve elliptic.Curve) ([]byte, error) {
+	var sig struct {
+		R, S *big.Int
+	}
+	rest, err := asn1.Unmarshal(der, &sig)
+	if err != nil || len(rest) > 0 || sig.R == nil || sig.S == nil {
+		return nil, errors.New("square/go-jose: invalid ECDSA signature from signer")
+	}
+
+	keyBytes := curveSize(curve)
+	if sig.R.BitLen() > 8*keyBytes || sig.S.BitLen() > 8*keyBytes {
+		return nil, errors.New("square/go-jose: invalid ECDSA signature from signer")
+	}
+
+	out := make([]byte, 2*keyBytes)
+	sig.R.FillBytes(out[:keyBytes])
+	sig.S.FillBytes(out[keyBytes:])
+	return out, nil
+}
+
+// cryptoDecrypter adapts a crypto.Decrypter holding an RSA key, so that RSA
+// key management algorithms can be used with keys held in e.g. a hardware
+// module.
+type cryptoDecrypter struct {
+	decrypter crypto.Decrypter
+}
+
+// newCryptoDecrypter creates a key decrypter based on the given decrypter.
+func newCryptoDecrypter(decrypter crypto.Decrypter) (keyDecrypter, error) {
+	if _, ok := decrypter.Public().(*rsa.PublicKey); !ok {
+		return nil, ErrUnsupportedKeyType
+	}
+
+	return &cryptoDecrypter{
+		decrypter: decrypter,
+	}, nil
+}
+
+// Decrypt the encrypted key of the given recipient.
+func (ctx *cryptoDecrypter) decryptKey(headers rawHeader, recipient *recipientInfo, generator keyGenerator) ([]byte, error) {
+	var opts crypto.DecrypterOpts
+	switch KeyAlgorithm(headers.Alg) {
+	case RSA1_5:
+		// With a session key length, an invalid payload results in a random
+		// key rather than an error, see rsa.DecryptPKCS1v15SessionKey.
+		opts = &rsa.PKCS1v15DecryptOptions{SessionKeyLen: generator.keySize()}
+	case RSA_OAEP:
+		opts = &rsa.OAEPOptions{Hash: crypto.SHA1}
+	case RSA_OAEP_256:
+		opts = &rsa.OAEPOptions{Hash: crypto.SHA256}
+	case RSA_OAEP_384:
+		opts = &rsa.OAEPOptions{Hash: crypto.SHA384}
+	case RSA_OAEP_512:
+		opts = &rsa.OAEPOptions{Hash: crypto.SHA512}
+	default:
+		return nil, ErrUnsupportedAlgorithm
+	}
+
+	// Use rand.Reader for RSA blinding
+	cek, err := ctx.decrypter.Decrypt(rand.Reader, recipient.encryptedKey, opts)
+	if KeyAlgorithm(headers.Alg) == RSA1_5 {
+		// Not all decrypters honour SessionKeyLen, e.g. hardware modules.
+		return rsaPKCS1v15SessionKey(cek, err, generator)
+	}
+	return cek, err
+}
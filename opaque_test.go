@@ -0,0 +1,374 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jose
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/square/go-jose/cipher"
+)
+
+// A crypto.Signer that hides the type of the underlying private key, like a
+// key held in a hardware module.
+type hiddenSigner struct {
+	signer crypto.Signer
+}
+
+func (s hiddenSigner) Public() crypto.PublicKey {
+	return s.signer.Public()
+}
+
+func (s hiddenSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.signer.Sign(rand, digest, opts)
+}
+
+// An OpaqueSigner with a fixed key ID, which counts its signatures.
+type countingSigner struct {
+	signer  cryptoSigner
+	keyID   string
+	counter int
+}
+
+func (s *countingSigner) Public() *JsonWebKey {
+	return &JsonWebKey{Key: s.signer.signer.Public(), KeyID: s.keyID}
+}
+
+func (s *countingSigner) Algs() []SignatureAlgorithm {
+	return s.signer.Algs()
+}
+
+func (s *countingSigner) SignPayload(payload []byte, alg SignatureAlgorithm) ([]byte, error) {
+	s.counter++
+	return s.signer.SignPayload(payload, alg)
+}
+
+func TestCryptoSigner(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	for _, tc := range []struct {
+		alg SignatureAlgorithm
+		key crypto.Signer
+	}{
+		{RS256, rsaTestKey},
+		{PS384, rsaTestKey},
+		{ES256, ecTestKey256},
+		{ES384, ecTestKey384},
+		{ES512, ecTestKey521},
+		{EdDSA, edKey},
+	} {
+		signer, err := NewSigner(tc.alg, hiddenSigner{tc.key})
+		if err != nil {
+			t.Error(tc.alg, err)
+			continue
+		}
+
+		input := []byte("Lorem ipsum dolor sit amet")
+		obj, err := signer.Sign(input)
+		if err != nil {
+			t.Error(tc.alg, err)
+			continue
+		}
+
+		serialized, _ := obj.CompactSerialize()
+		parsed, err := ParseSigned(serialized)
+		if err != nil {
+			t.Error(tc.alg, err)
+			continue
+		}
+
+		output, err := parsed.Verify(tc.key.Public())
+		if err != nil {
+			t.Error(tc.alg, "error on verify:", err)
+		} else if !bytes.Equal(output, input) {
+			t.Error(tc.alg, "input/output do not match", output, input)
+		}
+	}
+
+	if _, err := NewSigner(ES384, hiddenSigner{ecTestKey256}); err != ErrUnsupportedAlgorithm {
+		t.Error("should reject algorithm not matching curve", err)
+	}
+	if _, err := NewSigner(EdDSA, hiddenSigner{rsaTestKey}); err != ErrUnsupportedAlgorithm {
+		t.Error("should reject algorithm not matching key type", err)
+	}
+}
+
+func TestOpaqueSigner(t *testing.T) {
+	opaque := &countingSigner{
+		signer: cryptoSigner{signer: ecTestKey256},
+		keyID:  "hsm-key",
+	}
+
+	signer, err := NewSigner(ES256, opaque)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := signer.Sign([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opaque.counter != 1 {
+		t.Error("expected opaque signer to be called once, got", opaque.counter)
+	}
+
+	parsed, err := ParseSigned(obj.FullSerialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Signatures[0].Header.KeyID != "hsm-key" {
+		t.Error("expected key ID of opaque signer in header", parsed.Signatures[0].Header.KeyID)
+	}
+	if parsed.Signatures[0].Header.JsonWebKey == nil || !parsed.Signatures[0].Header.JsonWebKey.IsPublic() {
+		t.Error("expected embedded public key of opaque signer")
+	}
+	if _, err := parsed.Verify(&ecTestKey256.PublicKey); err != nil {
+		t.Error("error on verify:", err)
+	}
+
+	if _, err := NewSigner(RS256, opaque); err != ErrUnsupportedAlgorithm {
+		t.Error("should reject algorithm not supported by opaque signer", err)
+	}
+}
+
+// An OpaqueSigner that always fails, e.g. because the hardware module is
+// unavailable.
+type failingSigner struct {
+	countingSigner
+}
+
+func (s *failingSigner) SignPayload(payload []byte, alg SignatureAlgorithm) ([]byte, error) {
+	return nil, errors.New("unavailable")
+}
+
+func TestOpaqueSignerError(t *testing.T) {
+	signer, err := NewSigner(ES256, &failingSigner{countingSigner{signer: cryptoSigner{signer: ecTestKey256}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := signer.Sign([]byte("Lorem ipsum dolor sit amet")); err == nil || err.Error() != "unavailable" {
+		t.Error("expected error from opaque signer", err)
+	}
+}
+
+// A key encrypter/decrypter standing in for a KMS, which wraps keys with an
+// AES key that is never handed out.
+type testKMS struct {
+	keyID string
+	key   []byte
+}
+
+func (k *testKMS) KeyID() string {
+	return k.keyID
+}
+
+func (k *testKMS) Algs() []KeyAlgorithm {
+	return []KeyAlgorithm{A128KW}
+}
+
+func (k *testKMS) EncryptKey(cek []byte, alg KeyAlgorithm) ([]byte, error) {
+	block, err := aes.NewCipher(k.key)
+	if err != nil {
+		return nil, err
+	}
+	return josecipher.KeyWrap(block, cek)
+}
+
+func (k *testKMS) DecryptKey(encryptedKey []byte, header JoseHeader) ([]byte, error) {
+	if header.KeyID != k.keyID || header.Algorithm != string(A128KW) {
+		return nil, errors.New("unknown key")
+	}
+	block, err := aes.NewCipher(k.key)
+	if err != nil {
+		return nil, err
+	}
+	return josecipher.KeyUnwrap(block, encryptedKey)
+}
+
+func TestOpaqueKeyEncrypterDecrypter(t *testing.T) {
+	kms := &testKMS{keyID: "kms-key", key: []byte("0123456789abcdef")}
+
+	enc, err := NewEncrypter(A128KW, A128GCM, kms)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := []byte("Lorem ipsum dolor sit amet")
+	obj, err := enc.Encrypt(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serialized, _ := obj.CompactSerialize()
+	parsed, err := ParseEncrypted(serialized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Header.KeyID != "kms-key" {
+		t.Error("expected key ID of opaque encrypter in header", parsed.Header.KeyID)
+	}
+
+	// Opaque decrypter and the raw key must both work
+	for _, key := range []interface{}{kms, kms.key} {
+		output, err := parsed.Decrypt(key)
+		if err != nil {
+			t.Error("error on decrypt:", err)
+		} else if !bytes.Equal(output, input) {
+			t.Error("input/output do not match", output, input)
+		}
+	}
+
+	if _, err := parsed.Decrypt(&testKMS{keyID: "other", key: kms.key}); err != ErrCryptoFailure {
+		t.Error("should fail with unknown key", err)
+	}
+
+	for _, alg := range []KeyAlgorithm{A192KW, A128GCMKW, DIRECT} {
+		if _, err := NewEncrypter(alg, A128GCM, kms); err == nil {
+			t.Error("should reject unsupported algorithm", alg)
+		}
+	}
+}
+
+// A crypto.Decrypter that hides the type of the underlying private key.
+type hiddenDecrypter struct {
+	decrypter crypto.Decrypter
+}
+
+func (d hiddenDecrypter) Public() crypto.PublicKey {
+	return d.decrypter.Public()
+}
+
+func (d hiddenDecrypter) Decrypt(rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	return d.decrypter.Decrypt(rand, msg, opts)
+}
+
+// A crypto.Decrypter with an ECDSA key, which can't be used with RSA
+// key management algorithms.
+type ecDecrypter struct{}
+
+func (ecDecrypter) Public() crypto.PublicKey {
+	return &ecTestKey256.PublicKey
+}
+
+func (ecDecrypter) Decrypt(rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	return nil, errors.New("not implemented")
+}
+
+func TestCryptoDecrypter(t *testing.T) {
+	input := []byte("Lorem ipsum dolor sit amet")
+	var obj *JsonWebEncryption
+	for _, alg := range []KeyAlgorithm{RSA1_5, RSA_OAEP, RSA_OAEP_256, RSA_OAEP_512} {
+		enc, err := NewEncrypter(alg, A128GCM, &rsaTestKey.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		obj, err = enc.Encrypt(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		output, err := obj.Decrypt(hiddenDecrypter{rsaTestKey})
+		if err != nil {
+			t.Error(alg, "error on decrypt:", err)
+		} else if !bytes.Equal(output, input) {
+			t.Error(alg, "input/output do not match", output, input)
+		}
+	}
+
+	if _, err := obj.Decrypt(hiddenDecrypter{ecDecrypter{}}); err != ErrUnsupportedKeyType {
+		t.Error("should reject non-RSA decrypter", err)
+	}
+}
+
+// A crypto.Decrypter which reports RSA1_5 padding errors, like some hardware
+// modules which ignore SessionKeyLen.
+type paddingOracle struct {
+	key *rsa.PrivateKey
+}
+
+func (d paddingOracle) Public() crypto.PublicKey {
+	return d.key.Public()
+}
+
+func (d paddingOracle) Decrypt(rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	if _, ok := opts.(*rsa.PKCS1v15DecryptOptions); ok {
+		return rsa.DecryptPKCS1v15(rand, d.key, msg)
+	}
+	return d.key.Decrypt(rand, msg, opts)
+}
+
+func TestPKCS1v15PaddingErrorsHidden(t *testing.T) {
+	input := []byte("Lorem ipsum dolor sit amet")
+	enc, err := NewEncrypter(RSA1_5, A128GCM, &rsaTestKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := enc.Encrypt(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generator := randomKeyGenerator{size: 16}
+	headers := obj.mergedHeaders(&obj.recipients[0])
+
+	decrypter, err := newCryptoDecrypter(paddingOracle{rsaTestKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := obj.Decrypt(paddingOracle{rsaTestKey})
+	if err != nil || !bytes.Equal(output, input) {
+		t.Error("unable to decrypt", err)
+	}
+
+	// Corrupt the encrypted key, so that the padding is invalid
+	tampered := obj.recipients[0]
+	tampered.encryptedKey = append([]byte{}, tampered.encryptedKey...)
+	tampered.encryptedKey[10] ^= 0xFF
+
+	opaque := &opaqueKeyDecrypter{decrypter: failingKeyDecrypter{}}
+	for _, decrypter := range []keyDecrypter{decrypter, opaque} {
+		cek, err := decrypter.decryptKey(headers, &tampered, generator)
+		if err != nil {
+			t.Error("padding error should not be reported", err)
+		}
+		if len(cek) != 16 {
+			t.Error("should return random key of the right size", len(cek))
+		}
+	}
+
+	obj.recipients[0] = tampered
+	if _, err := obj.Decrypt(paddingOracle{rsaTestKey}); err != ErrCryptoFailure {
+		t.Error("should fail like a bad authentication tag", err)
+	}
+}
+
+// An opaque key decrypter which always fails.
+type failingKeyDecrypter struct{}
+
+func (failingKeyDecrypter) DecryptKey(encryptedKey []byte, header JoseHeader) ([]byte, error) {
+	return nil, errors.New("decryption error")
+}
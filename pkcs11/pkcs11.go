@@ -0,0 +1,197 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package pkcs11 implements the opaque signer and key decrypter interfaces of
+// go-jose for keys on a PKCS#11 token, such as a smartcard or HSM slot, using
+// github.com/miekg/pkcs11. Opening and logging into a session and finding the
+// private key object is left to the caller, as it depends on the token.
+package pkcs11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"errors"
+	"sync"
+
+	p11 "github.com/miekg/pkcs11"
+	"github.com/square/go-jose"
+)
+
+// Context is the subset of the PKCS#11 API used by this package. It's
+// implemented by *pkcs11.Ctx.
+type Context interface {
+	SignInit(sh p11.SessionHandle, m []*p11.Mechanism, o p11.ObjectHandle) error
+	Sign(sh p11.SessionHandle, message []byte) ([]byte, error)
+	DecryptInit(sh p11.SessionHandle, m []*p11.Mechanism, o p11.ObjectHandle) error
+	Decrypt(sh p11.SessionHandle, cipher []byte) ([]byte, error)
+}
+
+// Key is a private key object on a PKCS#11 token. It implements
+// jose.OpaqueSigner for RSA and ECDSA keys, and jose.OpaqueKeyDecrypter for
+// RSA keys. Operations are serialized, as a PKCS#11 session can only run one
+// operation at a time.
+type Key struct {
+	ctx     Context
+	session p11.SessionHandle
+	object  p11.ObjectHandle
+	public  jose.JsonWebKey
+
+	mu sync.Mutex
+}
+
+// NewKey creates a key for the private key object with the given handle in an
+// open (and logged in) session. The public key must be the RSA or ECDSA public
+// key corresponding to the private key, e.g. from the certificate stored on
+// the token. If keyID is not empty it's used for the "kid" header.
+func NewKey(ctx Context, session p11.SessionHandle, object p11.ObjectHandle, public crypto.PublicKey, keyID string) (*Key, error) {
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+	case *ecdsa.PublicKey:
+		if ecdsaAlgorithm(public.Curve) == "" {
+			return nil, errors.New("square/go-jose/pkcs11: unsupported curve")
+		}
+	default:
+		return nil, jose.ErrUnsupportedKeyType
+	}
+
+	return &Key{
+		ctx:     ctx,
+		session: session,
+		object:  object,
+		public:  jose.JsonWebKey{Key: public, KeyID: keyID},
+	}, nil
+}
+
+// Public returns the public key.
+func (k *Key) Public() *jose.JsonWebKey {
+	public := k.public
+	return &public
+}
+
+// Algs returns the signature algorithms supported by the key.
+func (k *Key) Algs() []jose.SignatureAlgorithm {
+	switch public := k.public.Key.(type) {
+	case *rsa.PublicKey:
+		return []jose.SignatureAlgorithm{jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512}
+	case *ecdsa.PublicKey:
+		return []jose.SignatureAlgorithm{ecdsaAlgorithm(public.Curve)}
+	default:
+		return nil
+	}
+}
+
+// SignPayload signs the payload on the token. RSA signatures use the combined
+// hash and sign mechanisms of the token, whereas for ECDSA the payload is
+// hashed locally, as tokens commonly only implement CKM_ECDSA.
+func (k *Key) SignPayload(payload []byte, alg jose.SignatureAlgorithm) ([]byte, error) {
+	var mechanism *p11.Mechanism
+	message := payload
+
+	switch public := k.public.Key.(type) {
+	case *rsa.PublicKey:
+		switch alg {
+		case jose.RS256:
+			mechanism = p11.NewMechanism(p11.CKM_SHA256_RSA_PKCS, nil)
+		case jose.RS384:
+			mechanism = p11.NewMechanism(p11.CKM_SHA384_RSA_PKCS, nil)
+		case jose.RS512:
+			mechanism = p11.NewMechanism(p11.CKM_SHA512_RSA_PKCS, nil)
+		// RFC 7518 requires the salt to be the same size as the hash output.
+		case jose.PS256:
+			mechanism = p11.NewMechanism(p11.CKM_SHA256_RSA_PKCS_PSS, p11.NewPSSParams(p11.CKM_SHA256, p11.CKG_MGF1_SHA256, 32))
+		case jose.PS384:
+			mechanism = p11.NewMechanism(p11.CKM_SHA384_RSA_PKCS_PSS, p11.NewPSSParams(p11.CKM_SHA384, p11.CKG_MGF1_SHA384, 48))
+		case jose.PS512:
+			mechanism = p11.NewMechanism(p11.CKM_SHA512_RSA_PKCS_PSS, p11.NewPSSParams(p11.CKM_SHA512, p11.CKG_MGF1_SHA512, 64))
+		default:
+			return nil, jose.ErrUnsupportedAlgorithm
+		}
+	case *ecdsa.PublicKey:
+		if alg != ecdsaAlgorithm(public.Curve) {
+			return nil, jose.ErrUnsupportedAlgorithm
+		}
+
+		var hash crypto.Hash
+		switch alg {
+		case jose.ES256:
+			hash = crypto.SHA256
+		case jose.ES384:
+			hash = crypto.SHA384
+		case jose.ES512:
+			hash = crypto.SHA512
+		}
+
+		hasher := hash.New()
+		_, _ = hasher.Write(payload)
+		message = hasher.Sum(nil)
+
+		// CKM_ECDSA produces the concatenation of R and S, as used by JWS.
+		mechanism = p11.NewMechanism(p11.CKM_ECDSA, nil)
+	default:
+		return nil, jose.ErrUnsupportedKeyType
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.ctx.SignInit(k.session, []*p11.Mechanism{mechanism}, k.object); err != nil {
+		return nil, err
+	}
+	return k.ctx.Sign(k.session, message)
+}
+
+// DecryptKey decrypts the encrypted content encryption key on the token. Only
+// RSA-OAEP and RSA-OAEP-256 are supported.
+func (k *Key) DecryptKey(encryptedKey []byte, header jose.JoseHeader) ([]byte, error) {
+	if _, ok := k.public.Key.(*rsa.PublicKey); !ok {
+		return nil, jose.ErrUnsupportedKeyType
+	}
+
+	var params *p11.OAEPParams
+	switch jose.KeyAlgorithm(header.Algorithm) {
+	case jose.RSA_OAEP:
+		params = p11.NewOAEPParams(p11.CKM_SHA_1, p11.CKG_MGF1_SHA1, p11.CKZ_DATA_SPECIFIED, nil)
+	case jose.RSA_OAEP_256:
+		params = p11.NewOAEPParams(p11.CKM_SHA256, p11.CKG_MGF1_SHA256, p11.CKZ_DATA_SPECIFIED, nil)
+	default:
+		return nil, jose.ErrUnsupportedAlgorithm
+	}
+	mechanism := p11.NewMechanism(p11.CKM_RSA_PKCS_OAEP, params)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.ctx.DecryptInit(k.session, []*p11.Mechanism{mechanism}, k.object); err != nil {
+		return nil, err
+	}
+	return k.ctx.Decrypt(k.session, encryptedKey)
+}
+
+// Get the JWS algorithm for ECDSA keys on the given curve.
+func ecdsaAlgorithm(curve elliptic.Curve) jose.SignatureAlgorithm {
+	switch curve {
+	case elliptic.P256():
+		return jose.ES256
+	case elliptic.P384():
+		return jose.ES384
+	case elliptic.P521():
+		return jose.ES512
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,208 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pkcs11
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+
+	p11 "github.com/miekg/pkcs11"
+	"github.com/square/go-jose"
+)
+
+// A fake PKCS#11 token holding a single private key.
+type fakeToken struct {
+	key       crypto.Signer
+	mechanism uint
+	calls     int
+}
+
+func (f *fakeToken) SignInit(sh p11.SessionHandle, m []*p11.Mechanism, o p11.ObjectHandle) error {
+	f.mechanism = m[0].Mechanism
+	return nil
+}
+
+func (f *fakeToken) Sign(sh p11.SessionHandle, message []byte) ([]byte, error) {
+	f.calls++
+
+	var hash crypto.Hash
+	var pss bool
+	switch f.mechanism {
+	case p11.CKM_SHA256_RSA_PKCS:
+		hash = crypto.SHA256
+	case p11.CKM_SHA384_RSA_PKCS:
+		hash = crypto.SHA384
+	case p11.CKM_SHA512_RSA_PKCS:
+		hash = crypto.SHA512
+	case p11.CKM_SHA256_RSA_PKCS_PSS:
+		hash, pss = crypto.SHA256, true
+	case p11.CKM_SHA384_RSA_PKCS_PSS:
+		hash, pss = crypto.SHA384, true
+	case p11.CKM_SHA512_RSA_PKCS_PSS:
+		hash, pss = crypto.SHA512, true
+	case p11.CKM_ECDSA:
+		key := f.key.(*ecdsa.PrivateKey)
+		r, s, err := ecdsa.Sign(rand.Reader, key, message)
+		if err != nil {
+			return nil, err
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		out := make([]byte, 2*size)
+		r.FillBytes(out[:size])
+		s.FillBytes(out[size:])
+		return out, nil
+	default:
+		return nil, errors.New("CKR_MECHANISM_INVALID")
+	}
+
+	hasher := hash.New()
+	hasher.Write(message)
+	digest := hasher.Sum(nil)
+
+	key := f.key.(*rsa.PrivateKey)
+	if pss {
+		return rsa.SignPSS(rand.Reader, key, hash, digest, &rsa.PSSOptions{SaltLength: hash.Size()})
+	}
+	return rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
+}
+
+func (f *fakeToken) DecryptInit(sh p11.SessionHandle, m []*p11.Mechanism, o p11.ObjectHandle) error {
+	f.mechanism = m[0].Mechanism
+	return nil
+}
+
+func (f *fakeToken) Decrypt(sh p11.SessionHandle, cipher []byte) ([]byte, error) {
+	f.calls++
+	if f.mechanism != p11.CKM_RSA_PKCS_OAEP {
+		return nil, errors.New("CKR_MECHANISM_INVALID")
+	}
+
+	// The OAEP parameters are only marshaled when calling into the token, so
+	// try both hash functions.
+	key := f.key.(*rsa.PrivateKey)
+	for _, hash := range []crypto.Hash{crypto.SHA1, crypto.SHA256} {
+		plaintext, err := rsa.DecryptOAEP(hash.New(), rand.Reader, key, cipher, nil)
+		if err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, errors.New("CKR_ENCRYPTED_DATA_INVALID")
+}
+
+func TestSignPayload(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p256Key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p521Key, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+
+	for _, private := range []crypto.Signer{rsaKey, p256Key, p521Key} {
+		token := &fakeToken{key: private}
+		key, err := NewKey(token, 1, 2, private.Public(), "token-key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, alg := range key.Algs() {
+			signer, err := jose.NewSigner(alg, key)
+			if err != nil {
+				t.Fatal(alg, err)
+			}
+
+			input := []byte("Lorem ipsum dolor sit amet")
+			obj, err := signer.Sign(input)
+			if err != nil {
+				t.Fatal(alg, err)
+			}
+
+			serialized, _ := obj.CompactSerialize()
+			parsed, err := jose.ParseSigned(serialized)
+			if err != nil {
+				t.Fatal(alg, err)
+			}
+			if parsed.Signatures[0].Header.KeyID != "token-key" {
+				t.Error(alg, "expected key ID in header")
+			}
+
+			output, err := parsed.Verify(private.Public())
+			if err != nil {
+				t.Error(alg, "error on verify:", err)
+			} else if !bytes.Equal(output, input) {
+				t.Error(alg, "input/output do not match", output, input)
+			}
+		}
+
+		if token.calls != len(key.Algs()) {
+			t.Error("expected one token operation per signature, got", token.calls)
+		}
+	}
+
+	p256, _ := NewKey(&fakeToken{key: p256Key}, 1, 2, p256Key.Public(), "")
+	if _, err := p256.SignPayload([]byte("payload"), jose.ES384); err != jose.ErrUnsupportedAlgorithm {
+		t.Error("should reject algorithm not matching curve", err)
+	}
+}
+
+func TestDecryptKey(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	token := &fakeToken{key: rsaKey}
+	key, err := NewKey(token, 1, 2, rsaKey.Public(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, alg := range []jose.KeyAlgorithm{jose.RSA_OAEP, jose.RSA_OAEP_256} {
+		encrypter, err := jose.NewEncrypter(alg, jose.A128GCM, key.Public())
+		if err != nil {
+			t.Fatal(alg, err)
+		}
+
+		input := []byte("Lorem ipsum dolor sit amet")
+		obj, err := encrypter.Encrypt(input)
+		if err != nil {
+			t.Fatal(alg, err)
+		}
+
+		output, err := obj.Decrypt(key)
+		if err != nil {
+			t.Error(alg, "error on decrypt:", err)
+		} else if !bytes.Equal(output, input) {
+			t.Error(alg, "input/output do not match", output, input)
+		}
+	}
+
+	encrypter, _ := jose.NewEncrypter(jose.RSA1_5, jose.A128GCM, key.Public())
+	obj, _ := encrypter.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if _, err := obj.Decrypt(key); err == nil {
+		t.Error("should reject unsupported algorithm")
+	}
+}
+
+func TestNewKey(t *testing.T) {
+	if _, err := NewKey(&fakeToken{}, 1, 2, []byte("secret"), ""); err != jose.ErrUnsupportedKeyType {
+		t.Error("should reject unsupported key type", err)
+	}
+
+	p224Key, _ := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if _, err := NewKey(&fakeToken{}, 1, 2, p224Key.Public(), ""); err == nil {
+		t.Error("should reject unsupported curve")
+	}
+}
@@ -0,0 +1,110 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jose
+
+import (
+	"errors"
+	"io"
+)
+
+// KeyProvider returns the currently active encryption key, for encrypters
+// created with NewEncrypterWithKeyProvider. The key may be of any type
+// accepted by NewEncrypter; a JWK with a key ID sets the "kid" header.
+type KeyProvider func() (interface{}, error)
+
+// An encrypter which looks up the recipient key for each message. The
+// embedded encrypter only holds the settings shared by all messages.
+type rotatingEncrypter struct {
+	genericEncrypter
+	alg      KeyAlgorithm
+	provider KeyProvider
+}
+
+// NewEncrypterWithKeyProvider creates an encrypter which calls the provider
+// to get the recipient key for each message, rather than using a fixed key.
+// This allows keys to be rotated in long-lived services without rebuilding
+// the encrypter. The key management and content encryption algorithms are
+// fixed, so the provider must always return a key suitable for alg.
+func NewEncrypterWithKeyProvider(alg KeyAlgorithm, enc ContentEncryption, provider KeyProvider) (Encrypter, error) {
+	cipher := getContentCipher(enc)
+	if cipher == nil {
+		return nil, ErrUnsupportedAlgorithm
+	}
+	if provider == nil {
+		return nil, errors.New("square/go-jose: key provider must not be nil")
+	}
+
+	return &rotatingEncrypter{
+		genericEncrypter: genericEncrypter{
+			contentAlg:     enc,
+			compressionAlg: NONE,
+			cipher:         cipher,
+		},
+		alg:      alg,
+		provider: provider,
+	}, nil
+}
+
+// Create an encrypter for the currently active key, with the settings of
+// the rotating encrypter.
+func (ctx *rotatingEncrypter) current() (*genericEncrypter, error) {
+	key, err := ctx.provider()
+	if err != nil {
+		return nil, err
+	}
+
+	encrypter, err := NewEncrypter(ctx.alg, ctx.contentAlg, key)
+	if err != nil {
+		return nil, err
+	}
+
+	current := encrypter.(*genericEncrypter)
+	current.compressionAlg = ctx.compressionAlg
+	current.typ = ctx.typ
+	current.cty = ctx.cty
+	current.extra = ctx.extra
+	current.critical = ctx.critical
+	return current, nil
+}
+
+// Encrypt encrypts the plaintext for the currently active key.
+func (ctx *rotatingEncrypter) Encrypt(plaintext []byte) (*JsonWebEncryption, error) {
+	return ctx.EncryptWithAuthData(plaintext, nil)
+}
+
+// EncryptWithAuthData encrypts the plaintext for the currently active key.
+func (ctx *rotatingEncrypter) EncryptWithAuthData(plaintext []byte, aad []byte) (*JsonWebEncryption, error) {
+	current, err := ctx.current()
+	if err != nil {
+		return nil, err
+	}
+	return current.EncryptWithAuthData(plaintext, aad)
+}
+
+// EncryptStream encrypts a stream of plaintext for the currently active key.
+func (ctx *rotatingEncrypter) EncryptStream(w io.Writer) (io.WriteCloser, error) {
+	current, err := ctx.current()
+	if err != nil {
+		return nil, err
+	}
+	return current.EncryptStream(w)
+}
+
+// SetContentKey is not supported, as the key changes on rotation.
+func (ctx *rotatingEncrypter) SetContentKey(cek []byte) error {
+	return errors.New("square/go-jose: content key can't be set with a key provider")
+}
@@ -0,0 +1,103 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jose
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestEncrypterWithKeyProvider(t *testing.T) {
+	keys := []*JsonWebKey{
+		{Key: []byte("0123456789abcdef"), KeyID: "key-1"},
+		{Key: []byte("fedcba9876543210"), KeyID: "key-2"},
+	}
+
+	active := 0
+	provider := func() (interface{}, error) {
+		return keys[active], nil
+	}
+
+	encrypter, err := NewEncrypterWithKeyProvider(A128KW, A128GCM, provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypter.SetType("JWT")
+	if err := encrypter.SetExtraHeader("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	input := []byte("Lorem ipsum dolor sit amet")
+	for i := range keys {
+		active = i
+
+		obj, err := encrypter.Encrypt(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serialized, _ := obj.CompactSerialize()
+		parsed, err := ParseEncrypted(serialized)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if parsed.Header.KeyID != keys[i].KeyID {
+			t.Error("kid should be that of the active key", parsed.Header.KeyID)
+		}
+		if parsed.Header.Type != "JWT" || parsed.Header.ExtraHeaders["foo"] != "bar" {
+			t.Error("settings should apply to all messages", parsed.Header)
+		}
+
+		output, err := parsed.Decrypt(keys[i])
+		if err != nil || !bytes.Equal(output, input) {
+			t.Error("unable to decrypt with active key", err)
+		}
+		if _, err := parsed.Decrypt(keys[1-i]); err == nil {
+			t.Error("should not decrypt with inactive key")
+		}
+	}
+
+	if err := encrypter.SetContentKey(make([]byte, 16)); err == nil {
+		t.Error("should not allow setting the content key")
+	}
+}
+
+func TestEncrypterWithKeyProviderErrors(t *testing.T) {
+	if _, err := NewEncrypterWithKeyProvider(A128KW, ContentEncryption("XYZ"), nil); err != ErrUnsupportedAlgorithm {
+		t.Error("should reject unsupported content encryption", err)
+	}
+	if _, err := NewEncrypterWithKeyProvider(A128KW, A128GCM, nil); err == nil {
+		t.Error("should reject nil provider")
+	}
+
+	failure := errors.New("no active key")
+	encrypter, _ := NewEncrypterWithKeyProvider(A128KW, A128GCM, func() (interface{}, error) {
+		return nil, failure
+	})
+	if _, err := encrypter.Encrypt([]byte("data")); err != failure {
+		t.Error("should return provider error", err)
+	}
+
+	// Key not suitable for the algorithm
+	encrypter, _ = NewEncrypterWithKeyProvider(A128KW, A128GCM, func() (interface{}, error) {
+		return &rsaTestKey.PublicKey, nil
+	})
+	if _, err := encrypter.Encrypt([]byte("data")); err == nil {
+		t.Error("should reject key not suitable for algorithm")
+	}
+}
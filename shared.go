@@ -17,9 +17,19 @@
 package jose
 
 import (
+	"bytes"
 	"crypto/elliptic"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"strings"
+
+	"github.com/square/go-jose/cipher"
+	"github.com/square/go-jose/json"
 )
 
 // KeyAlgorithm represents a key management algorithm.
@@ -56,16 +66,454 @@ var (
 	// compact form.
 	ErrNotSupported = errors.New("square/go-jose: compact serialization not supported for object")
 
+	// ErrInvalidKeySize indicates that the given key is not the correct size
+	// for the selected algorithm. This can occur, for example, when trying to
+	// use a 32 byte symmetric key with A128KW, which requires a 16 byte key.
+	ErrInvalidKeySize = errors.New("square/go-jose: invalid key size for algorithm")
+
+	// ErrInvalidDigestSize indicates that a pre-computed digest passed to
+	// SignPrehashed does not match the output size of the algorithm's hash.
+	ErrInvalidDigestSize = errors.New("square/go-jose: invalid digest size for algorithm")
+
+	// ErrKeyNotValid indicates that a verification key was used outside of its
+	// validity window, for example after the expiry of its certificate.
+	ErrKeyNotValid = errors.New("square/go-jose: key is not valid at verification time")
+
+	// ErrPBES2CountTooLow indicates that a PBES2 encrypted object uses fewer
+	// iterations than the minimum (see ParseOptions), and could be
+	// brute-forced easily.
+	ErrPBES2CountTooLow = errors.New("square/go-jose: PBES2 iteration count (p2c) too low")
+
+	// ErrPBES2CountTooHigh indicates that a PBES2 encrypted object uses more
+	// iterations than the maximum (see ParseOptions), and would be too
+	// expensive to decrypt.
+	ErrPBES2CountTooHigh = errors.New("square/go-jose: PBES2 iteration count (p2c) too high")
+
+	// ErrDecompressedSizeTooLarge indicates that the plaintext of a compressed
+	// JWE object inflates to more than the maximum size (see ParseOptions).
+	ErrDecompressedSizeTooLarge = errors.New("square/go-jose: decompressed plaintext exceeds maximum size")
+
+	// ErrNoneAlgorithm indicates that a JWS object is unsecured, i.e. uses the
+	// "none" algorithm, which is rejected when parsing (unless explicitly
+	// allowed), verifying or signing.
+	ErrNoneAlgorithm = errors.New("square/go-jose: unsecured JWS (alg \"none\") is not allowed")
+
 	// ErrUnprotectedNonce indicates that while parsing a JWS or JWE object, a
 	// nonce header parameter was included in an unprotected header object.
 	ErrUnprotectedNonce = errors.New("square/go-jose: Nonce parameter included in unprotected header")
 )
 
+// EmbeddedKeyPolicy controls how JWS objects with an embedded public key (the
+// "jwk" header) are treated when parsing, see ParseOptions.EmbeddedKeys.
+type EmbeddedKeyPolicy int
+
+const (
+	// EmbeddedKeyAllowed accepts objects with or without an embedded key. The
+	// embedded key is never used implicitly, see VerifyWithEmbeddedKey.
+	EmbeddedKeyAllowed EmbeddedKeyPolicy = iota
+	// EmbeddedKeyForbidden rejects objects with an embedded key, e.g. for
+	// OpenID Connect, where keys must come from the issuer's key set.
+	EmbeddedKeyForbidden
+	// EmbeddedKeyRequired rejects objects without an embedded key in the
+	// protected header of each signature, e.g. for ACME or DPoP, where
+	// messages are verified with the key they carry.
+	EmbeddedKeyRequired
+)
+
+// ParseOptions configures optional behaviour when parsing JWS and JWE objects.
+// The zero value selects the default (strict) behaviour.
+type ParseOptions struct {
+	// AllowPaddedBase64 makes the parser accept base64url-encoded message parts
+	// and header parameters (including the members of "epk" and "jwk" keys)
+	// with trailing "=" padding, which is otherwise rejected as RFC 7515/7516
+	// mandate unpadded encoding. The padding is stripped on input and never
+	// emitted when serializing. This only exists for interoperability with
+	// non-conforming implementations and should not be enabled otherwise.
+	AllowPaddedBase64 bool
+
+	// StrictHeaders makes the parser reject headers containing parameters not
+	// known to this library, unless they are listed in the "crit" member of
+	// the protected header. By default such parameters are accepted and made
+	// available through JoseHeader.ExtraHeaders.
+	StrictHeaders bool
+
+	// UnderstoodExtensions lists the custom header parameters that the
+	// application is able to process when they are marked as critical. If
+	// set, objects with a "crit" header naming any other parameter are
+	// rejected while parsing, and objects whose critical parameters are all
+	// understood can be verified or decrypted. Otherwise any object with a
+	// "crit" header fails verification and decryption. The "b64" header of
+	// RFC 7797 is implemented by this library and need not be listed.
+	UnderstoodExtensions []string
+
+	// SignatureAlgorithms lists the signature algorithms accepted in the "alg"
+	// header of JWS objects. If set, objects with any other algorithm are
+	// rejected while parsing, before any cryptographic processing. This
+	// prevents algorithm confusion attacks, e.g. an attacker presenting a
+	// public RSA key as an HMAC secret.
+	SignatureAlgorithms []SignatureAlgorithm
+
+	// KeyAlgorithms and ContentEncryption list the key management and content
+	// encryption algorithms accepted in the "alg" and "enc" headers of JWE
+	// objects. If set, objects (or recipients) with any other algorithm are
+	// rejected while parsing.
+	KeyAlgorithms     []KeyAlgorithm
+	ContentEncryption []ContentEncryption
+
+	// UnsafeAllowNoneSignatureType makes the parser accept unsecured JWS
+	// objects with alg "none", which are otherwise rejected. Such objects can
+	// never be verified; their payload is only available through
+	// UnsafeGetPayloadWithoutVerification. This only exists for tests and
+	// debugging tools and must not be enabled otherwise.
+	UnsafeAllowNoneSignatureType bool
+
+	// MaxInputSize, if non-zero, is the maximum length in bytes of a message
+	// to parse. Longer messages are rejected before any decoding, to bound
+	// the memory a hostile message can make the parser allocate.
+	MaxInputSize int
+
+	// MaxPartSize, if non-zero, is the maximum length in bytes of each
+	// base64url-encoded part of a message in compact serialization.
+	MaxPartSize int
+
+	// MaxHeaderSize, if non-zero, is the maximum size in bytes of the JSON of
+	// each protected header, checked before it is unmarshaled.
+	MaxHeaderSize int
+
+	// MaxSignatures and MaxRecipients are the maximum numbers of signatures
+	// and recipients of messages in full serialization format, checked while
+	// decoding the arrays; DefaultMaxSignatures and DefaultMaxRecipients if
+	// zero.
+	MaxSignatures int
+	MaxRecipients int
+
+	// MaxDecompressedSize is the maximum size in bytes of the plaintext of a
+	// compressed JWE object once decompressed, DefaultMaxDecompressedSize if
+	// zero.
+	MaxDecompressedSize int64
+
+	// MinPBES2Count and MaxPBES2Count bound the PBES2 iteration count (p2c)
+	// accepted when decrypting a JWE object, DefaultMinPBES2Count and
+	// DefaultMaxPBES2Count if zero.
+	MinPBES2Count int
+	MaxPBES2Count int
+
+	// MaxPBES2Recipients is the maximum number of recipients of a JWE object
+	// using a PBES2 key management algorithm, DefaultMaxPBES2Recipients if
+	// zero.
+	MaxPBES2Recipients int
+
+	// EmbeddedKeys controls whether the signatures of JWS objects may, or
+	// must, carry an embedded public key in the "jwk" header. By default
+	// embedded keys are allowed.
+	EmbeddedKeys EmbeddedKeyPolicy
+}
+
+func (opts ParseOptions) maxDecompressedSize() int64 {
+	if opts.MaxDecompressedSize <= 0 {
+		return DefaultMaxDecompressedSize
+	}
+	return opts.MaxDecompressedSize
+}
+
+func (opts ParseOptions) maxSignatures() int {
+	if opts.MaxSignatures <= 0 {
+		return DefaultMaxSignatures
+	}
+	return opts.MaxSignatures
+}
+
+func (opts ParseOptions) maxRecipients() int {
+	if opts.MaxRecipients <= 0 {
+		return DefaultMaxRecipients
+	}
+	return opts.MaxRecipients
+}
+
+func (opts ParseOptions) maxPBES2Recipients() int {
+	if opts.MaxPBES2Recipients <= 0 {
+		return DefaultMaxPBES2Recipients
+	}
+	return opts.MaxPBES2Recipients
+}
+
+// Check the size of a message against the limit of the parse options.
+func (opts ParseOptions) checkInputSize(input string) error {
+	if opts.MaxInputSize > 0 && len(input) > opts.MaxInputSize {
+		return fmt.Errorf("square/go-jose: message too large (%d bytes), limit is %d", len(input), opts.MaxInputSize)
+	}
+	return nil
+}
+
+// Check the sizes of the parts of a compact serialization against the limit
+// of the parse options.
+func (opts ParseOptions) checkPartSizes(parts [][]byte) error {
+	if opts.MaxPartSize <= 0 {
+		return nil
+	}
+	for _, part := range parts {
+		if len(part) > opts.MaxPartSize {
+			return fmt.Errorf("square/go-jose: message part too large (%d bytes), limit is %d", len(part), opts.MaxPartSize)
+		}
+	}
+	return nil
+}
+
+// Check the size of a protected header against the limit of the parse
+// options.
+func (opts ParseOptions) checkHeaderSize(protected *byteBuffer) error {
+	if opts.MaxHeaderSize > 0 && protected != nil && len(protected.bytes()) > opts.MaxHeaderSize {
+		return fmt.Errorf("square/go-jose: protected header too large (%d bytes), limit is %d", len(protected.bytes()), opts.MaxHeaderSize)
+	}
+	return nil
+}
+
+// Decode base64url data according to the parse options.
+func (opts ParseOptions) base64URLDecode(data string) ([]byte, error) {
+	if !opts.AllowPaddedBase64 && strings.HasSuffix(data, "=") {
+		return nil, errors.New("square/go-jose: invalid base64url data, must not be padded")
+	}
+	return base64URLDecode(data)
+}
+
+// Decode the base64url-encoded parts of a compact serialization according to
+// the parse options, in place. The decoded parts share a single buffer, to
+// keep allocations down when parsing large numbers of messages.
+func (opts ParseOptions) decodeCompactParts(parts [][]byte) error {
+	size := 0
+	for _, part := range parts {
+		if !opts.AllowPaddedBase64 && bytes.HasSuffix(part, []byte("=")) {
+			return errors.New("square/go-jose: invalid base64url data, must not be padded")
+		}
+		size += base64.RawURLEncoding.DecodedLen(len(part))
+	}
+
+	buffer := make([]byte, size)
+	for i, part := range parts {
+		n, err := base64URLDecodeInto(buffer, part)
+		if err != nil {
+			return err
+		}
+		// Limit capacity, so that appending to a part can't clobber the next.
+		parts[i] = buffer[:n:n]
+		buffer = buffer[n:]
+	}
+
+	return nil
+}
+
+// Check the embedded key of a JWS signature against the policy of the parse
+// options.
+func (opts ParseOptions) checkEmbeddedKey(protected, header *rawHeader) error {
+	switch opts.EmbeddedKeys {
+	case EmbeddedKeyForbidden:
+		if (protected != nil && protected.Jwk != nil) || (header != nil && header.Jwk != nil) {
+			return errors.New("square/go-jose: embedded jwk header is not allowed")
+		}
+	case EmbeddedKeyRequired:
+		if protected == nil || protected.Jwk == nil {
+			return errors.New("square/go-jose: missing embedded jwk in protected header")
+		}
+	}
+	return nil
+}
+
+// Check that none of the given buffers were parsed from padded base64 data,
+// unless the parse options allow it.
+func (opts ParseOptions) checkPadding(buffers ...*byteBuffer) error {
+	if opts.AllowPaddedBase64 {
+		return nil
+	}
+	for _, b := range buffers {
+		if b != nil && b.padded {
+			return errors.New("square/go-jose: invalid base64url data, must not be padded")
+		}
+	}
+	return nil
+}
+
+// Check that the base64url-encoded parameters of the given headers are not
+// padded, unless the parse options allow it.
+func (opts ParseOptions) checkHeaderPadding(headers ...*rawHeader) error {
+	if opts.AllowPaddedBase64 {
+		return nil
+	}
+	for _, h := range headers {
+		if h == nil {
+			continue
+		}
+		err := opts.checkPadding(h.Apu, h.Apv, h.Iv, h.Tag, h.X5t, h.X5t256, h.P2s, h.Ek)
+		if err != nil {
+			return err
+		}
+		if (h.Epk != nil && h.Epk.padded) || (h.Jwk != nil && h.Jwk.padded) {
+			return errors.New("square/go-jose: invalid base64url data, must not be padded")
+		}
+	}
+	return nil
+}
+
+// Check that the given headers contain no unknown parameters, unless the parse
+// options allow it. Parameters named in the crit header are understood.
+func (opts ParseOptions) checkHeaders(protected *rawHeader, headers ...*rawHeader) error {
+	if !opts.StrictHeaders {
+		return nil
+	}
+
+	understood := map[string]bool{}
+	if protected != nil {
+		for _, name := range protected.Crit {
+			understood[name] = true
+		}
+	}
+
+	for _, header := range append([]*rawHeader{protected}, headers...) {
+		if header == nil {
+			continue
+		}
+		for name := range header.Extra {
+			if !understood[name] {
+				return fmt.Errorf("square/go-jose: unexpected header parameter '%s'", name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Check that the algorithm of a JWS signature is allowed by the parse options.
+func (opts ParseOptions) checkSignatureAlgorithm(alg string) error {
+	if alg == string(algNone) && !opts.UnsafeAllowNoneSignatureType {
+		return ErrNoneAlgorithm
+	}
+	if opts.SignatureAlgorithms == nil {
+		return nil
+	}
+	for _, allowed := range opts.SignatureAlgorithms {
+		if alg == string(allowed) {
+			return nil
+		}
+	}
+	return fmt.Errorf("square/go-jose: unexpected signature algorithm '%s'", alg)
+}
+
+// Check that the algorithms of a JWE recipient are allowed by the parse
+// options.
+func (opts ParseOptions) checkEncryptionAlgorithms(alg, enc string) error {
+	if opts.KeyAlgorithms != nil {
+		allowed := false
+		for _, keyAlg := range opts.KeyAlgorithms {
+			allowed = allowed || alg == string(keyAlg)
+		}
+		if !allowed {
+			return fmt.Errorf("square/go-jose: unexpected key management algorithm '%s'", alg)
+		}
+	}
+	if opts.ContentEncryption != nil {
+		allowed := false
+		for _, contentEnc := range opts.ContentEncryption {
+			allowed = allowed || enc == string(contentEnc)
+		}
+		if !allowed {
+			return fmt.Errorf("square/go-jose: unexpected content encryption algorithm '%s'", enc)
+		}
+	}
+	return nil
+}
+
+// Check the crit header of a parsed object against the extensions understood
+// by the application. It returns true if the object has critical parameters,
+// all of which are understood.
+func (opts ParseOptions) checkCritical(protected *rawHeader, headers ...*rawHeader) (bool, error) {
+	if len(opts.UnderstoodExtensions) == 0 && !onlyLibraryExtensions(protected) {
+		return false, nil
+	}
+
+	for _, header := range headers {
+		if header != nil && header.Crit != nil {
+			return false, errors.New("square/go-jose: crit header must be integrity protected")
+		}
+	}
+	if protected == nil || protected.Crit == nil {
+		return false, nil
+	}
+
+	// Copy Extra, so that merging doesn't modify the protected header.
+	merged := *protected
+	merged.Extra = nil
+	merged.merge(&rawHeader{Extra: protected.Extra})
+	for _, header := range headers {
+		merged.merge(header)
+	}
+
+	err := checkCriticalNames(&merged)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range protected.Crit {
+		if name != "b64" && !containsString(opts.UnderstoodExtensions, name) {
+			return false, fmt.Errorf("square/go-jose: unsupported critical header parameter '%s'", name)
+		}
+	}
+
+	return true, nil
+}
+
+// Check that the parameters named in the crit header are present in the given
+// header, and are not ones defined by the JWS/JWE specifications (RFC 7515
+// section 4.1.11).
+func checkCriticalNames(header *rawHeader) error {
+	if header.Crit != nil && len(header.Crit) == 0 {
+		return errors.New("square/go-jose: crit header must not be empty")
+	}
+	for _, name := range header.Crit {
+		if name == "b64" {
+			// Understood by this library, and must always be critical.
+			if header.B64 == nil {
+				return errors.New("square/go-jose: critical header parameter 'b64' is missing")
+			}
+			continue
+		}
+		if knownHeaders[name] || registeredHeaders[name] {
+			return fmt.Errorf("square/go-jose: registered header parameter '%s' must not be critical", name)
+		}
+		if _, ok := header.Extra[name]; !ok {
+			return fmt.Errorf("square/go-jose: critical header parameter '%s' is missing", name)
+		}
+	}
+	return nil
+}
+
+// Check whether the crit header only lists extensions implemented by this
+// library (the b64 header of RFC 7797), which need not be declared in
+// ParseOptions.UnderstoodExtensions.
+func onlyLibraryExtensions(protected *rawHeader) bool {
+	if protected == nil || len(protected.Crit) == 0 {
+		return false
+	}
+	for _, name := range protected.Crit {
+		if name != "b64" {
+			return false
+		}
+	}
+	return true
+}
+
+// Copy a list of critical header names, as given to SetCriticalExtensions.
+func copyCriticalNames(names []string) []string {
+	if len(names) == 0 {
+		return nil
+	}
+	return append([]string{}, names...)
+}
+
 // Key management algorithms
 const (
 	RSA1_5             = KeyAlgorithm("RSA1_5")             // RSA-PKCS1v1.5
 	RSA_OAEP           = KeyAlgorithm("RSA-OAEP")           // RSA-OAEP-SHA1
 	RSA_OAEP_256       = KeyAlgorithm("RSA-OAEP-256")       // RSA-OAEP-SHA256
+	RSA_OAEP_384       = KeyAlgorithm("RSA-OAEP-384")       // RSA-OAEP-SHA384
+	RSA_OAEP_512       = KeyAlgorithm("RSA-OAEP-512")       // RSA-OAEP-SHA512
 	A128KW             = KeyAlgorithm("A128KW")             // AES key wrap (128)
 	A192KW             = KeyAlgorithm("A192KW")             // AES key wrap (192)
 	A256KW             = KeyAlgorithm("A256KW")             // AES key wrap (256)
@@ -82,6 +530,36 @@ const (
 	PBES2_HS512_A256KW = KeyAlgorithm("PBES2-HS512+A256KW") // PBES2 + HMAC-SHA512 + AES key wrap (256)
 )
 
+// Key management algorithms from draft-madden-jose-ecdh-1pu-04. Note that these
+// are not (yet) part of a final RFC.
+const (
+	ECDH_1PU        = KeyAlgorithm("ECDH-1PU")        // ECDH-1PU
+	ECDH_1PU_A128KW = KeyAlgorithm("ECDH-1PU+A128KW") // ECDH-1PU + AES key wrap (128)
+	ECDH_1PU_A192KW = KeyAlgorithm("ECDH-1PU+A192KW") // ECDH-1PU + AES key wrap (192)
+	ECDH_1PU_A256KW = KeyAlgorithm("ECDH-1PU+A256KW") // ECDH-1PU + AES key wrap (256)
+)
+
+// Key management algorithms from draft-ietf-jose-hpke-encrypt, using HPKE (RFC
+// 9180) in base mode to encrypt the content encryption key. Note that these
+// are not (yet) part of a final RFC.
+const (
+	HPKE_0_KE = KeyAlgorithm("HPKE-0-KE") // DHKEM(P-256, HKDF-SHA256), HKDF-SHA256, AES-128-GCM
+	HPKE_1_KE = KeyAlgorithm("HPKE-1-KE") // DHKEM(P-384, HKDF-SHA384), HKDF-SHA384, AES-256-GCM
+	HPKE_2_KE = KeyAlgorithm("HPKE-2-KE") // DHKEM(P-521, HKDF-SHA512), HKDF-SHA512, AES-256-GCM
+	HPKE_3_KE = KeyAlgorithm("HPKE-3-KE") // DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM
+	HPKE_4_KE = KeyAlgorithm("HPKE-4-KE") // DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, ChaCha20-Poly1305
+)
+
+// Key management algorithms from draft-ietf-jose-pqc-kem, using the ML-KEM key
+// encapsulation mechanism (FIPS 203). The ciphertext is sent in the "ek"
+// header. Note that these are not (yet) part of a final RFC.
+const (
+	ML_KEM_768         = KeyAlgorithm("ML-KEM-768")         // ML-KEM-768
+	ML_KEM_1024        = KeyAlgorithm("ML-KEM-1024")        // ML-KEM-1024
+	ML_KEM_768_A192KW  = KeyAlgorithm("ML-KEM-768+A192KW")  // ML-KEM-768 + AES key wrap (192)
+	ML_KEM_1024_A256KW = KeyAlgorithm("ML-KEM-1024+A256KW") // ML-KEM-1024 + AES key wrap (256)
+)
+
 // Signature algorithms
 const (
 	HS256 = SignatureAlgorithm("HS256") // HMAC using SHA-256
@@ -96,6 +574,23 @@ const (
 	PS256 = SignatureAlgorithm("PS256") // RSASSA-PSS using SHA256 and MGF1-SHA256
 	PS384 = SignatureAlgorithm("PS384") // RSASSA-PSS using SHA384 and MGF1-SHA384
 	PS512 = SignatureAlgorithm("PS512") // RSASSA-PSS using SHA512 and MGF1-SHA512
+	EdDSA = SignatureAlgorithm("EdDSA") // EdDSA using Ed25519 (RFC 8037)
+
+	ES256K = SignatureAlgorithm("ES256K") // ECDSA using secp256k1 and SHA-256 (RFC 8812)
+)
+
+// The "none" algorithm of unsecured JWS objects (RFC 7518 section 3.6), which
+// has no signature. It is deliberately not exported: this library never
+// produces or verifies such objects, see ParseOptions.UnsafeAllowNoneSignatureType.
+const algNone = SignatureAlgorithm("none")
+
+// Signature algorithms from draft-ietf-cose-dilithium, using ML-DSA (FIPS 204)
+// with an empty context string. Note that these are not (yet) part of a final
+// RFC.
+const (
+	ML_DSA_44 = SignatureAlgorithm("ML-DSA-44") // ML-DSA-44
+	ML_DSA_65 = SignatureAlgorithm("ML-DSA-65") // ML-DSA-65
+	ML_DSA_87 = SignatureAlgorithm("ML-DSA-87") // ML-DSA-87
 )
 
 // Content encryption algorithms
@@ -108,6 +603,13 @@ const (
 	A256GCM       = ContentEncryption("A256GCM")       // AES-GCM (256)
 )
 
+// Content encryption algorithms from draft-amringer-jose-chacha-02. Note that
+// these are not (yet) part of a final RFC.
+const (
+	C20P  = ContentEncryption("C20P")  // ChaCha20-Poly1305
+	XC20P = ContentEncryption("XC20P") // XChaCha20-Poly1305
+)
+
 // Compression algorithms
 const (
 	NONE    = CompressionAlgorithm("")    // No compression
@@ -116,18 +618,65 @@ const (
 
 // rawHeader represents the JOSE header for JWE/JWS objects (used for parsing).
 type rawHeader struct {
-	Alg   string               `json:"alg,omitempty"`
-	Enc   ContentEncryption    `json:"enc,omitempty"`
-	Zip   CompressionAlgorithm `json:"zip,omitempty"`
-	Crit  []string             `json:"crit,omitempty"`
-	Apu   *byteBuffer          `json:"apu,omitempty"`
-	Apv   *byteBuffer          `json:"apv,omitempty"`
-	Epk   *JsonWebKey          `json:"epk,omitempty"`
-	Iv    *byteBuffer          `json:"iv,omitempty"`
-	Tag   *byteBuffer          `json:"tag,omitempty"`
-	Jwk   *JsonWebKey          `json:"jwk,omitempty"`
-	Kid   string               `json:"kid,omitempty"`
-	Nonce string               `json:"nonce,omitempty"`
+	Alg    string               `json:"alg,omitempty"`
+	Enc    ContentEncryption    `json:"enc,omitempty"`
+	Zip    CompressionAlgorithm `json:"zip,omitempty"`
+	Crit   []string             `json:"crit,omitempty"`
+	Apu    *byteBuffer          `json:"apu,omitempty"`
+	Apv    *byteBuffer          `json:"apv,omitempty"`
+	Epk    *JsonWebKey          `json:"epk,omitempty"`
+	Iv     *byteBuffer          `json:"iv,omitempty"`
+	Tag    *byteBuffer          `json:"tag,omitempty"`
+	Jwk    *JsonWebKey          `json:"jwk,omitempty"`
+	X5c    []string             `json:"x5c,omitempty"`
+	X5t    *byteBuffer          `json:"x5t,omitempty"`
+	X5t256 *byteBuffer          `json:"x5t#S256,omitempty"`
+	Kid    string               `json:"kid,omitempty"`
+	Nonce  string               `json:"nonce,omitempty"`
+	Typ    string               `json:"typ,omitempty"`
+	Cty    string               `json:"cty,omitempty"`
+	Skid   string               `json:"skid,omitempty"`
+	P2s    *byteBuffer          `json:"p2s,omitempty"`
+	P2c    int                  `json:"p2c,omitempty"`
+	Ek     *byteBuffer          `json:"ek,omitempty"`
+	B64    *bool                `json:"b64,omitempty"`
+
+	// Header parameters not modelled by the fields above.
+	Extra map[string]interface{} `json:"-"`
+}
+
+// Names of the header parameters modelled by rawHeader. All other members of
+// a parsed header end up in rawHeader.Extra.
+var knownHeaders = map[string]bool{
+	"alg":      true,
+	"enc":      true,
+	"zip":      true,
+	"crit":     true,
+	"apu":      true,
+	"apv":      true,
+	"epk":      true,
+	"iv":       true,
+	"tag":      true,
+	"jwk":      true,
+	"x5c":      true,
+	"x5t":      true,
+	"x5t#S256": true,
+	"kid":      true,
+	"nonce":    true,
+	"typ":      true,
+	"cty":      true,
+	"skid":     true,
+	"p2s":      true,
+	"p2c":      true,
+	"ek":       true,
+	"b64":      true,
+}
+
+// Names of registered header parameters that are not modelled by rawHeader
+// (yet). These can't be set as extra headers, or be marked as critical.
+var registeredHeaders = map[string]bool{
+	"jku": true,
+	"x5u": true,
 }
 
 // JoseHeader represents the read-only JOSE header for JWE/JWS objects.
@@ -136,16 +685,183 @@ type JoseHeader struct {
 	JsonWebKey *JsonWebKey
 	Algorithm  string
 	Nonce      string
+	Type       string
+
+	// Media type of the payload ("cty" header), e.g. "JWT" for nested tokens.
+	ContentType string
+
+	// Content encryption and compression algorithms of JWE objects ("enc" and
+	// "zip" headers).
+	Encryption  ContentEncryption
+	Compression CompressionAlgorithm
+
+	// Names of the header parameters that must be understood ("crit" header).
+	Critical []string
+
+	// Identifies the sender's static key for ECDH-1PU ("skid" header).
+	SenderKeyID string
+
+	// Certificate chain from the "x5c" header, leaf certificate first. Note
+	// that the certificates are not validated, see VerifyWithCertificates.
+	Certificates []*x509.Certificate
+
+	// SHA-1 and SHA-256 thumbprints of the (DER-encoded) leaf certificate,
+	// from the "x5t" and "x5t#S256" headers.
+	CertificateThumbprintSHA1   []byte
+	CertificateThumbprintSHA256 []byte
+
+	// Any header parameters not otherwise understood by this library, such
+	// as application-specific parameters in a per-recipient header.
+	ExtraHeaders map[string]interface{}
+}
+
+// UnmarshalJSON reads a header from its JSON representation, retaining any
+// members that are not explicitly modelled in Extra.
+func (parsed *rawHeader) UnmarshalJSON(data []byte) error {
+	// Use a type without methods to avoid recursing into this function.
+	type header rawHeader
+
+	var known header
+	err := json.Unmarshal(data, &known)
+	if err != nil {
+		return err
+	}
+
+	var all map[string]interface{}
+	err = json.Unmarshal(data, &all)
+	if err != nil {
+		return err
+	}
+
+	for name, value := range all {
+		if knownHeaders[name] {
+			continue
+		}
+		if known.Extra == nil {
+			known.Extra = map[string]interface{}{}
+		}
+		known.Extra[name] = value
+	}
+
+	*parsed = rawHeader(known)
+	return nil
+}
+
+// MarshalJSON writes a header as JSON, including any members in Extra.
+func (parsed rawHeader) MarshalJSON() ([]byte, error) {
+	type header rawHeader
+
+	known, err := json.Marshal(header(parsed))
+	if err != nil || len(parsed.Extra) == 0 {
+		return known, err
+	}
+
+	extra := make(map[string]interface{}, len(parsed.Extra))
+	for name, value := range parsed.Extra {
+		if !knownHeaders[name] {
+			extra[name] = value
+		}
+	}
+	if len(extra) == 0 {
+		return known, nil
+	}
+
+	members, err := json.Marshal(extra)
+	if err != nil {
+		return nil, err
+	}
+	if len(known) == 2 {
+		return members, nil
+	}
+
+	// Splice the two objects together.
+	out := append(known[:len(known)-1], ',')
+	return append(out, members[1:]...), nil
 }
 
 // sanitized produces a cleaned-up header object from the raw JSON.
 func (parsed rawHeader) sanitized() JoseHeader {
+	var extra map[string]interface{}
+	if len(parsed.Extra) > 0 {
+		extra = make(map[string]interface{}, len(parsed.Extra))
+		for name, value := range parsed.Extra {
+			extra[name] = value
+		}
+	}
+
+	// Invalid chains are rejected when parsing signatures, and verifying
+	// them (VerifyWithCertificates) fails without certificates.
+	certs, _ := parsed.certificates()
+
 	return JoseHeader{
-		KeyID:      parsed.Kid,
-		JsonWebKey: parsed.Jwk,
-		Algorithm:  parsed.Alg,
-		Nonce:      parsed.Nonce,
+		KeyID:        parsed.Kid,
+		JsonWebKey:   parsed.Jwk,
+		Algorithm:    parsed.Alg,
+		Nonce:        parsed.Nonce,
+		Type:         parsed.Typ,
+		ContentType:  parsed.Cty,
+		Encryption:   parsed.Enc,
+		Compression:  parsed.Zip,
+		Critical:     copyCriticalNames(parsed.Crit),
+		SenderKeyID:  parsed.Skid,
+		Certificates: certs,
+		ExtraHeaders: extra,
+
+		CertificateThumbprintSHA1:   parsed.X5t.bytes(),
+		CertificateThumbprintSHA256: parsed.X5t256.bytes(),
+	}
+}
+
+// certificates parses the certificate chain in the x5c header, if any.
+func (parsed rawHeader) certificates() ([]*x509.Certificate, error) {
+	if len(parsed.X5c) == 0 {
+		return nil, nil
+	}
+
+	certs := make([]*x509.Certificate, len(parsed.X5c))
+	for i, encoded := range parsed.X5c {
+		der, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("square/go-jose: invalid x5c header: %v", err)
+		}
+		certs[i], err = x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("square/go-jose: invalid x5c header: %v", err)
+		}
+	}
+
+	return certs, nil
+}
+
+// checkThumbprints verifies that the leaf certificate matches the thumbprints
+// in the x5t and x5t#S256 headers, if present.
+func (parsed rawHeader) checkThumbprints(leaf *x509.Certificate) error {
+	if parsed.X5t != nil {
+		sum := sha1.Sum(leaf.Raw)
+		if subtle.ConstantTimeCompare(sum[:], parsed.X5t.bytes()) != 1 {
+			return errors.New("square/go-jose: certificate does not match x5t header")
+		}
+	}
+	if parsed.X5t256 != nil {
+		sum := sha256.Sum256(leaf.Raw)
+		if subtle.ConstantTimeCompare(sum[:], parsed.X5t256.bytes()) != 1 {
+			return errors.New("square/go-jose: certificate does not match x5t#S256 header")
+		}
+	}
+	return nil
+}
+
+// Encode a certificate chain for the x5c header.
+func encodeCertificates(certs []*x509.Certificate) []string {
+	if len(certs) == 0 {
+		return nil
+	}
+
+	encoded := make([]string, len(certs))
+	for i, cert := range certs {
+		encoded[i] = base64.StdEncoding.EncodeToString(cert.Raw)
 	}
+	return encoded
 }
 
 // Merge headers from src into dst, giving precedence to headers from l.
@@ -190,9 +906,68 @@ func (dst *rawHeader) merge(src *rawHeader) {
 	if dst.Jwk == nil {
 		dst.Jwk = src.Jwk
 	}
+	if dst.X5c == nil {
+		dst.X5c = src.X5c
+	}
+	if dst.X5t == nil {
+		dst.X5t = src.X5t
+	}
+	if dst.X5t256 == nil {
+		dst.X5t256 = src.X5t256
+	}
 	if dst.Nonce == "" {
 		dst.Nonce = src.Nonce
 	}
+	if dst.Typ == "" {
+		dst.Typ = src.Typ
+	}
+	if dst.Cty == "" {
+		dst.Cty = src.Cty
+	}
+	if dst.Skid == "" {
+		dst.Skid = src.Skid
+	}
+	if dst.P2s == nil {
+		dst.P2s = src.P2s
+	}
+	if dst.P2c == 0 {
+		dst.P2c = src.P2c
+	}
+	if dst.Ek == nil {
+		dst.Ek = src.Ek
+	}
+	if dst.B64 == nil {
+		dst.B64 = src.B64
+	}
+	for name, value := range src.Extra {
+		if _, ok := dst.Extra[name]; ok {
+			continue
+		}
+		if dst.Extra == nil {
+			dst.Extra = map[string]interface{}{}
+		}
+		dst.Extra[name] = value
+	}
+}
+
+// CheckType verifies that the "typ" header matches the expected media type.
+// The comparison is case-insensitive, and an "application/" prefix is ignored
+// on either side if the remaining value contains no other '/', as described
+// in RFC 7515 section 4.1.9 and recommended by RFC 8725.
+func (h JoseHeader) CheckType(expected string) error {
+	if normalizeMediaType(h.Type) != normalizeMediaType(expected) {
+		return fmt.Errorf("square/go-jose: unexpected typ header %q, expected %q", h.Type, expected)
+	}
+	return nil
+}
+
+// Normalize a media type for comparison, dropping an "application/" prefix.
+func normalizeMediaType(typ string) string {
+	typ = strings.ToLower(typ)
+	if strings.HasPrefix(typ, "application/") && !strings.Contains(typ[len("application/"):], "/") {
+		typ = typ[len("application/"):]
+	}
+	return typ
 }
 
 // Get JOSE name of curve
@@ -204,6 +979,8 @@ func curveName(crv elliptic.Curve) (string, error) {
 		return "P-384", nil
 	case elliptic.P521():
 		return "P-521", nil
+	case josecipher.Secp256k1():
+		return "secp256k1", nil
 	default:
 		return "", fmt.Errorf("square/go-jose: unsupported/unknown elliptic curve")
 	}
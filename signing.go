@@ -17,10 +17,21 @@
 package jose
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/mldsa"
 	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/square/go-jose/json"
 )
 
 // NonceSource represents a source of random nonces to go into JWS objects
@@ -31,15 +42,37 @@ type NonceSource interface {
 // Signer represents a signer which takes a payload and produces a signed JWS object.
 type Signer interface {
 	Sign(payload []byte) (*JsonWebSignature, error)
+	SignStream(payload io.Reader) (*JsonWebSignature, error)
+	SignPrehashed(digest []byte, alg SignatureAlgorithm) ([]byte, error)
 	SetNonceSource(source NonceSource)
 	SetEmbedJwk(embed bool)
+	SetEmbedCertificates(embed bool)
+	SetType(typ string)
+	SetContentType(cty string)
+	SetProtectedHeaderHook(hook func(header map[string]interface{}) map[string]interface{})
+	SetExtraHeader(name string, value interface{}) error
+	SetCriticalExtensions(names []string)
+	SetUnencodedPayload(unencoded bool)
+	SetDeterministicECDSA(deterministic bool)
+	SetUnprotectedHeaders(names []string) error
 }
 
 // MultiSigner represents a signer which supports multiple recipients.
 type MultiSigner interface {
 	Sign(payload []byte) (*JsonWebSignature, error)
+	SignStream(payload io.Reader) (*JsonWebSignature, error)
+	SignPrehashed(digest []byte, alg SignatureAlgorithm) ([]byte, error)
 	SetNonceSource(source NonceSource)
 	SetEmbedJwk(embed bool)
+	SetEmbedCertificates(embed bool)
+	SetType(typ string)
+	SetContentType(cty string)
+	SetProtectedHeaderHook(hook func(header map[string]interface{}) map[string]interface{})
+	SetExtraHeader(name string, value interface{}) error
+	SetCriticalExtensions(names []string)
+	SetUnencodedPayload(unencoded bool)
+	SetDeterministicECDSA(deterministic bool)
+	SetUnprotectedHeaders(names []string) error
 	AddRecipient(alg SignatureAlgorithm, signingKey interface{}) error
 }
 
@@ -47,24 +80,71 @@ type payloadSigner interface {
 	signPayload(payload []byte, alg SignatureAlgorithm) (Signature, error)
 }
 
+// Implemented by payload signers that support deterministic signatures.
+type deterministicSigner interface {
+	setDeterministic(deterministic bool)
+}
+
+// Implemented by payload signers that can sign a pre-computed digest.
+type digestSigner interface {
+	signDigest(digest []byte, alg SignatureAlgorithm) ([]byte, error)
+}
+
 type payloadVerifier interface {
 	verifyPayload(payload []byte, signature []byte, alg SignatureAlgorithm) error
 }
 
+// Implemented by payload signers that can sign a payload which is hashed
+// incrementally, see SignStream.
+type hashSigner interface {
+	newHash(alg SignatureAlgorithm) (hash.Hash, error)
+	signHash(h hash.Hash, alg SignatureAlgorithm) ([]byte, error)
+}
+
+// Implemented by payload verifiers that can verify a payload which is hashed
+// incrementally, see VerifyStream.
+type hashVerifier interface {
+	newHash(alg SignatureAlgorithm) (hash.Hash, error)
+	verifyHash(h hash.Hash, signature []byte, alg SignatureAlgorithm) error
+}
+
 type genericSigner struct {
-	recipients  []recipientSigInfo
-	nonceSource NonceSource
-	embedJwk    bool
+	recipients        []recipientSigInfo
+	nonceSource       NonceSource
+	embedJwk          bool
+	embedCertificates bool
+	typ               string
+	cty               string
+	headerHook        func(header map[string]interface{}) map[string]interface{}
+	extra             map[string]interface{}
+	critical          []string
+	unencoded         bool
+	deterministic     bool
+	unprotected       []string
+}
+
+// Names of the header parameters set by the library which may be moved to the
+// unprotected header of a signature, see SetUnprotectedHeaders.
+var unprotectableHeaders = map[string]bool{
+	"kid":      true,
+	"jwk":      true,
+	"x5c":      true,
+	"x5t":      true,
+	"x5t#S256": true,
 }
 
 type recipientSigInfo struct {
-	sigAlg    SignatureAlgorithm
-	keyID     string
-	publicKey *JsonWebKey
-	signer    payloadSigner
+	sigAlg       SignatureAlgorithm
+	keyID        string
+	publicKey    *JsonWebKey
+	certificates []*x509.Certificate
+	signer       payloadSigner
 }
 
-// NewSigner creates an appropriate signer based on the key type
+// NewSigner creates an appropriate signer based on the key type. Besides
+// private keys and JWKs, the key may be an OpaqueSigner or any other
+// crypto.Signer (with an RSA, ECDSA or Ed25519 public key), for keys held in
+// e.g. a hardware module.
 func NewSigner(alg SignatureAlgorithm, signingKey interface{}) (Signer, error) {
 	// NewMultiSigner never fails (currently)
 	signer := NewMultiSigner()
@@ -96,12 +176,25 @@ func newVerifier(verificationKey interface{}) (payloadVerifier, error) {
 		return &ecEncrypterVerifier{
 			publicKey: verificationKey,
 		}, nil
+	case ed25519.PublicKey:
+		return &edEncrypterVerifier{
+			publicKey: verificationKey,
+		}, nil
+	case *mldsa.PublicKey:
+		return &mldsaVerifier{
+			publicKey: verificationKey,
+		}, nil
 	case []byte:
 		return &symmetricMac{
 			key: verificationKey,
 		}, nil
 	case *JsonWebKey:
+		if err := verificationKey.checkOperation("verify"); err != nil {
+			return nil, err
+		}
 		return newVerifier(verificationKey.Key)
+	case JsonWebKey:
+		return newVerifier(&verificationKey)
 	default:
 		return nil, ErrUnsupportedKeyType
 	}
@@ -113,25 +206,48 @@ func (ctx *genericSigner) AddRecipient(alg SignatureAlgorithm, signingKey interf
 		return err
 	}
 
+	if signer, ok := recipient.signer.(deterministicSigner); ok {
+		signer.setDeterministic(ctx.deterministic)
+	}
+
 	ctx.recipients = append(ctx.recipients, recipient)
 	return nil
 }
 
 func makeJWSRecipient(alg SignatureAlgorithm, signingKey interface{}) (recipientSigInfo, error) {
+	if alg == algNone {
+		return recipientSigInfo{}, ErrNoneAlgorithm
+	}
+
 	switch signingKey := signingKey.(type) {
 	case *rsa.PrivateKey:
 		return newRSASigner(alg, signingKey)
 	case *ecdsa.PrivateKey:
 		return newECDSASigner(alg, signingKey)
+	case ed25519.PrivateKey:
+		return newEd25519Signer(alg, signingKey)
+	case *mldsa.PrivateKey:
+		return newMLDSASigner(alg, signingKey)
 	case []byte:
 		return newSymmetricSigner(alg, signingKey)
 	case *JsonWebKey:
+		if err := signingKey.checkOperation("sign"); err != nil {
+			return recipientSigInfo{}, err
+		}
 		recipient, err := makeJWSRecipient(alg, signingKey.Key)
 		if err != nil {
 			return recipientSigInfo{}, err
 		}
 		recipient.keyID = signingKey.KeyID
+		recipient.certificates = signingKey.Certificates
 		return recipient, nil
+	case JsonWebKey:
+		return makeJWSRecipient(alg, &signingKey)
+	case OpaqueSigner:
+		return newOpaqueSigner(alg, signingKey)
+	case crypto.Signer:
+		// Any other signer, e.g. a key held in a hardware module.
+		return newOpaqueSigner(alg, &cryptoSigner{signer: signingKey})
 	default:
 		return recipientSigInfo{}, ErrUnsupportedKeyType
 	}
@@ -143,41 +259,282 @@ func (ctx *genericSigner) Sign(payload []byte) (*JsonWebSignature, error) {
 	obj.Signatures = make([]Signature, len(ctx.recipients))
 
 	for i, recipient := range ctx.recipients {
-		protected := &rawHeader{
-			Alg: string(recipient.sigAlg),
+		serializedProtected, protected, unprotected, err := ctx.protectedHeader(recipient)
+		if err != nil {
+			return nil, err
 		}
 
-		if recipient.publicKey != nil && ctx.embedJwk {
-			protected.Jwk = recipient.publicKey
-		}
-		if recipient.keyID != "" {
-			protected.Kid = recipient.keyID
+		input := signingInput(serializedProtected, payload, ctx.unencoded)
+
+		signatureInfo, err := recipient.signer.signPayload(input, recipient.sigAlg)
+		if err != nil {
+			return nil, err
 		}
 
-		if ctx.nonceSource != nil {
-			nonce, err := ctx.nonceSource.Nonce()
-			if err != nil {
-				return nil, fmt.Errorf("square/go-jose: Error generating nonce: %v", err)
+		signatureInfo.protected = protected
+		signatureInfo.header = unprotected
+		if ctx.headerHook != nil {
+			// Keep the exact bytes produced by the hook, as they can't be
+			// reproduced by marshaling the parsed header.
+			signatureInfo.original = &rawSignatureInfo{
+				Protected: newBuffer(serializedProtected),
 			}
-			protected.Nonce = nonce
 		}
+		obj.Signatures[i] = signatureInfo
+	}
 
-		serializedProtected := mustSerializeJSON(protected)
+	return obj, nil
+}
 
-		input := []byte(fmt.Sprintf("%s.%s",
-			base64URLEncode(serializedProtected),
-			base64URLEncode(payload)))
+// Assemble and serialize the protected header for a recipient, along with its
+// unprotected header (if any, see SetUnprotectedHeaders).
+func (ctx *genericSigner) protectedHeader(recipient recipientSigInfo) ([]byte, *rawHeader, *rawHeader, error) {
+	protected := &rawHeader{
+		Alg: string(recipient.sigAlg),
+		Typ: ctx.typ,
+		Cty: ctx.cty,
+	}
 
-		signatureInfo, err := recipient.signer.signPayload(input, recipient.sigAlg)
+	if recipient.publicKey != nil && ctx.embedJwk {
+		protected.Jwk = recipient.publicKey
+	}
+	if recipient.keyID != "" {
+		protected.Kid = recipient.keyID
+	}
+	if ctx.embedCertificates {
+		protected.X5c = encodeCertificates(recipient.certificates)
+	}
+	if len(recipient.certificates) > 0 {
+		sha1Sum := sha1.Sum(recipient.certificates[0].Raw)
+		sha256Sum := sha256.Sum256(recipient.certificates[0].Raw)
+		protected.X5t = newBuffer(sha1Sum[:])
+		protected.X5t256 = newBuffer(sha256Sum[:])
+	}
+
+	protected.merge(&rawHeader{Extra: ctx.extra})
+	protected.Crit = ctx.critical
+
+	if ctx.unencoded {
+		b64 := false
+		protected.B64 = &b64
+		protected.Crit = append([]string{"b64"}, ctx.critical...)
+	}
+
+	if ctx.nonceSource != nil {
+		nonce, err := ctx.nonceSource.Nonce()
 		if err != nil {
-			return nil, err
+			return nil, nil, nil, fmt.Errorf("square/go-jose: Error generating nonce: %v", err)
 		}
+		protected.Nonce = nonce
+	}
 
-		signatureInfo.protected = protected
-		obj.Signatures[i] = signatureInfo
+	unprotected, err := ctx.splitUnprotected(protected)
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
-	return obj, nil
+	serializedProtected := mustSerializeJSON(protected)
+
+	if ctx.headerHook != nil {
+		serializedProtected, protected, err = ctx.applyHeaderHook(serializedProtected, recipient.sigAlg)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	err = checkCriticalNames(protected)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	err = checkB64Header(protected, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	unencoded := protected.B64 != nil && !*protected.B64
+	if unencoded != ctx.unencoded {
+		return nil, nil, nil, errors.New("square/go-jose: protected header hook must not change b64")
+	}
+
+	return serializedProtected, protected, unprotected, nil
+}
+
+// Move the header parameters selected with SetUnprotectedHeaders out of the
+// protected header, returning them as the unprotected header of a signature.
+// Returns nil if none of the parameters are present.
+func (ctx *genericSigner) splitUnprotected(protected *rawHeader) (*rawHeader, error) {
+	if len(ctx.unprotected) == 0 {
+		return nil, nil
+	}
+
+	unprotected := &rawHeader{}
+	moved := false
+	for _, name := range ctx.unprotected {
+		if containsString(ctx.critical, name) {
+			return nil, fmt.Errorf("square/go-jose: critical header parameter '%s' must be integrity protected", name)
+		}
+
+		switch name {
+		case "kid":
+			moved = moved || protected.Kid != ""
+			unprotected.Kid, protected.Kid = protected.Kid, ""
+		case "jwk":
+			moved = moved || protected.Jwk != nil
+			unprotected.Jwk, protected.Jwk = protected.Jwk, nil
+		case "x5c":
+			moved = moved || protected.X5c != nil
+			unprotected.X5c, protected.X5c = protected.X5c, nil
+		case "x5t":
+			moved = moved || protected.X5t != nil
+			unprotected.X5t, protected.X5t = protected.X5t, nil
+		case "x5t#S256":
+			moved = moved || protected.X5t256 != nil
+			unprotected.X5t256, protected.X5t256 = protected.X5t256, nil
+		default:
+			// The extra headers of protected are a copy, see merge.
+			value, ok := protected.Extra[name]
+			if !ok {
+				continue
+			}
+			if unprotected.Extra == nil {
+				unprotected.Extra = map[string]interface{}{}
+			}
+			unprotected.Extra[name] = value
+			delete(protected.Extra, name)
+			moved = true
+		}
+	}
+
+	if !moved {
+		return nil, nil
+	}
+	return unprotected, nil
+}
+
+// Run the protected header hook on a serialized header, returning the new
+// serialized header along with its parsed form.
+func (ctx *genericSigner) applyHeaderHook(serialized []byte, alg SignatureAlgorithm) ([]byte, *rawHeader, error) {
+	var header map[string]interface{}
+	err := json.Unmarshal(serialized, &header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header = ctx.headerHook(header)
+	if value, ok := header["alg"].(string); !ok || value != string(alg) {
+		return nil, nil, errors.New("square/go-jose: protected header hook must not remove or change alg")
+	}
+
+	serialized, err = json.Marshal(header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	protected := &rawHeader{}
+	err = json.Unmarshal(serialized, protected)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return serialized, protected, nil
+}
+
+// SignPrehashed signs a pre-computed digest with the key of the first recipient
+// configured for the given algorithm, and returns the raw signature value. This is meant
+// for large (e.g. detached) payloads where the caller computes the hash itself.
+// Note that the digest must be computed over the JWS signing input, i.e.
+// BASE64URL(protected header) || '.' || BASE64URL(payload), using the hash
+// function of the algorithm; the caller is responsible for constructing the
+// protected header and assembling the resulting JWS. Only RSA and ECDSA
+// algorithms are supported.
+func (ctx *genericSigner) SignPrehashed(digest []byte, alg SignatureAlgorithm) ([]byte, error) {
+	for _, recipient := range ctx.recipients {
+		if recipient.sigAlg != alg {
+			continue
+		}
+
+		signer, ok := recipient.signer.(digestSigner)
+		if !ok {
+			return nil, ErrUnsupportedAlgorithm
+		}
+		return signer.signDigest(digest, alg)
+	}
+
+	return nil, fmt.Errorf("square/go-jose: no recipient configured for algorithm %s", alg)
+}
+
+// SetProtectedHeaderHook installs a function that is called with the protected
+// header of each signature after it has been assembled, and before it's
+// serialized and signed. The returned header is the one that gets integrity
+// protected. This is an escape hatch for protocol quirks that require
+// non-standard header parameters; the hook must not remove or change "alg".
+func (ctx *genericSigner) SetProtectedHeaderHook(hook func(header map[string]interface{}) map[string]interface{}) {
+	ctx.headerHook = hook
+}
+
+// SetExtraHeader sets a custom parameter in the protected header of produced
+// objects. The value must be serializable to JSON. Parameters which are set by
+// the library itself, such as "alg" or "kid", can't be overridden.
+func (ctx *genericSigner) SetExtraHeader(name string, value interface{}) error {
+	if knownHeaders[name] {
+		return fmt.Errorf("square/go-jose: header parameter '%s' is set by the library", name)
+	}
+	if ctx.extra == nil {
+		ctx.extra = map[string]interface{}{}
+	}
+	ctx.extra[name] = value
+	return nil
+}
+
+// SetCriticalExtensions lists custom header parameters that recipients must
+// understand in order to process produced objects, in the "crit" header. Each
+// parameter must be present in the protected header (see SetExtraHeader), and
+// must not be one of the parameters registered by RFC 7515.
+func (ctx *genericSigner) SetCriticalExtensions(names []string) {
+	ctx.critical = copyCriticalNames(names)
+}
+
+// SetUnencodedPayload specifies if the payload should be signed and serialized
+// as is, rather than base64url encoded, by setting the (critical) "b64" header
+// to false as per RFC 7797. This avoids inflating large payloads, which are
+// typically detached (see DetachedCompactSerialize). Note that an unencoded
+// payload must not contain '.' for compact serialization, and must be valid
+// UTF-8 for JSON serialization.
+func (ctx *genericSigner) SetUnencodedPayload(unencoded bool) {
+	ctx.unencoded = unencoded
+}
+
+// SetDeterministicECDSA specifies if ECDSA signatures (ES256, ES384 and ES512)
+// should use deterministic nonces as per RFC 6979, rather than random ones.
+// Signatures are then reproducible, and don't depend on the quality of the
+// random number generator, e.g. on embedded platforms. Other algorithms are
+// not affected.
+func (ctx *genericSigner) SetDeterministicECDSA(deterministic bool) {
+	ctx.deterministic = deterministic
+	for _, recipient := range ctx.recipients {
+		if signer, ok := recipient.signer.(deterministicSigner); ok {
+			signer.setDeterministic(deterministic)
+		}
+	}
+}
+
+// SetUnprotectedHeaders lists header parameters that should be carried in the
+// unprotected header of each signature (the "header" member of the JSON
+// serialization), rather than in the protected header, e.g. when a profile
+// requires "kid" or "x5c" outside of the signed portion. Only "kid", "jwk",
+// "x5c", "x5t" and "x5t#S256", and custom parameters set with SetExtraHeader
+// which are not critical, may be listed. Note that unprotected parameters are
+// not integrity protected, and that objects with an unprotected header can
+// only be serialized with FullSerialize.
+func (ctx *genericSigner) SetUnprotectedHeaders(names []string) error {
+	for _, name := range names {
+		if (knownHeaders[name] || registeredHeaders[name]) && !unprotectableHeaders[name] {
+			return fmt.Errorf("square/go-jose: header parameter '%s' must be integrity protected", name)
+		}
+	}
+	ctx.unprotected = append([]string(nil), names...)
+	return nil
 }
 
 // SetNonceSource provides or updates a nonce pool to the first recipients.
@@ -195,45 +552,252 @@ func (ctx *genericSigner) SetEmbedJwk(embed bool) {
 	ctx.embedJwk = embed
 }
 
+// SetEmbedCertificates specifies if the certificate chain of the signing key
+// should be embedded in the protected header ("x5c"), if any. The chain is
+// taken from JsonWebKey.Certificates, so this requires signing with a JWK.
+// It defaults to 'false'. Note that the thumbprints of the leaf certificate
+// ("x5t" and "x5t#S256") are always included when signing with a certificate.
+func (ctx *genericSigner) SetEmbedCertificates(embed bool) {
+	ctx.embedCertificates = embed
+}
+
+// SetType sets the "typ" header of produced objects to the given media type,
+// e.g. "at+jwt". An empty string (the default) omits the header.
+func (ctx *genericSigner) SetType(typ string) {
+	ctx.typ = typ
+}
+
+// SetContentType sets the "cty" header of produced objects to the media type
+// of the payload, e.g. "JWT" for nested tokens. An empty string (the default)
+// omits the header.
+func (ctx *genericSigner) SetContentType(cty string) {
+	ctx.cty = cty
+}
+
 // Verify validates the signature on the object and returns the payload.
 // This function does not support multi-signature, if you desire multi-sig
-// verification use VerifyMulti instead.
+// verification use VerifyMulti instead. If the key is a JWK with a key ID, the
+// signature must have a matching (or absent) "kid" header, as in VerifyMulti.
+// If the key is a JsonWebKeySet, the candidate keys for the signature are
+// tried in turn.
 //
 // Be careful when verifying signatures based on embedded JWKs inside the
 // payload header. You cannot assume that the key received in a payload is
 // trusted.
 func (obj JsonWebSignature) Verify(verificationKey interface{}) ([]byte, error) {
-	verifier, err := newVerifier(verificationKey)
+	err := obj.DetachedVerify(obj.payload, verificationKey)
 	if err != nil {
 		return nil, err
 	}
 
+	return obj.payload, nil
+}
+
+// DetachedVerify validates the signature on the object over the given
+// payload, for objects whose payload is transported separately (see
+// DetachedCompactSerialize). Otherwise it behaves like Verify, and likewise
+// does not support multi-signature.
+func (obj JsonWebSignature) DetachedVerify(payload []byte, verificationKey interface{}) error {
+	if set, ok := keySet(verificationKey); ok {
+		return obj.detachedVerifyKeySet(payload, set)
+	}
+
+	verifier, err := newVerifier(verificationKey)
+	if err != nil {
+		return err
+	}
+
 	if len(obj.Signatures) > 1 {
-		return nil, errors.New("square/go-jose: too many signatures in payload; expecting only one")
+		return errors.New("square/go-jose: too many signatures in payload; expecting only one")
 	}
 
 	signature := obj.Signatures[0]
 	headers := signature.mergedHeaders()
-	if len(headers.Crit) > 0 {
+	if len(headers.Crit) > 0 && !signature.critUnderstood {
 		// Unsupported crit header
-		return nil, ErrCryptoFailure
+		return ErrCryptoFailure
+	}
+	if !keyIDMatches(verificationKey, headers.Kid) {
+		// Signature was made with a different key
+		return ErrCryptoFailure
 	}
 
-	input := obj.computeAuthData(&signature)
 	alg := SignatureAlgorithm(headers.Alg)
+	if alg == algNone {
+		return ErrNoneAlgorithm
+	}
+
+	input := computeAuthData(payload, &signature)
 	err = verifier.verifyPayload(input, signature.Signature, alg)
-	if err == nil {
-		return obj.payload, nil
+	if err != nil {
+		return ErrCryptoFailure
+	}
+
+	return nil
+}
+
+// Verify the (single) signature with the candidate keys from a key set.
+func (obj JsonWebSignature) detachedVerifyKeySet(payload []byte, set *JsonWebKeySet) error {
+	if len(obj.Signatures) > 1 {
+		return errors.New("square/go-jose: too many signatures in payload; expecting only one")
+	}
+
+	for _, key := range set.candidates(obj.Signatures[0].mergedHeaders(), "sig") {
+		err := obj.DetachedVerify(payload, key)
+		if err == nil || err == ErrNoneAlgorithm {
+			return err
+		}
+	}
+
+	return ErrCryptoFailure
+}
+
+// KeyValidity describes the time window during which a verification key may be
+// used, e.g. the validity period of the certificate it was taken from. Zero
+// values for NotBefore or NotAfter leave that end of the window unbounded.
+type KeyValidity struct {
+	NotBefore time.Time
+	NotAfter  time.Time
+
+	// Leeway allows for some clock skew when checking the window.
+	Leeway time.Duration
+
+	// Now returns the verification time, defaults to time.Now if nil.
+	Now func() time.Time
+}
+
+// KeyValidityFromCertificate returns the validity window of a certificate.
+func KeyValidityFromCertificate(cert *x509.Certificate) KeyValidity {
+	return KeyValidity{
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+	}
+}
+
+// check returns an error if the current time falls outside the window.
+func (v KeyValidity) check() error {
+	now := time.Now()
+	if v.Now != nil {
+		now = v.Now()
+	}
+
+	if !v.NotBefore.IsZero() && now.Add(v.Leeway).Before(v.NotBefore) {
+		return ErrKeyNotValid
+	}
+	if !v.NotAfter.IsZero() && now.Add(-v.Leeway).After(v.NotAfter) {
+		return ErrKeyNotValid
+	}
+
+	return nil
+}
+
+// VerifyWithValidity validates the signature on the object like Verify, but
+// first checks that the verification time falls within the validity window of
+// the key. This prevents accepting objects signed with an expired key (or
+// certificate, see KeyValidityFromCertificate).
+func (obj JsonWebSignature) VerifyWithValidity(verificationKey interface{}, validity KeyValidity) ([]byte, error) {
+	if err := validity.check(); err != nil {
+		return nil, err
 	}
 
-	return nil, ErrCryptoFailure
+	return obj.Verify(verificationKey)
+}
+
+// VerifyWithEmbeddedKey validates the signature on the object like Verify,
+// using the public key embedded in its protected "jwk" header, and returns that
+// key along with the payload. This is for protocols such as ACME or DPoP where
+// messages are signed with a key that isn't known in advance; the caller must
+// then decide whether to trust the returned key, e.g. by looking up its
+// thumbprint. The key is only used if it is integrity protected. Like Verify,
+// this does not support multi-signature. See also ParseOptions.EmbeddedKeys.
+func (obj JsonWebSignature) VerifyWithEmbeddedKey() (*JsonWebKey, []byte, error) {
+	if len(obj.Signatures) != 1 {
+		return nil, nil, errors.New("square/go-jose: expecting exactly one signature")
+	}
+
+	protected := obj.Signatures[0].protected
+	if protected == nil || protected.Jwk == nil {
+		return nil, nil, errors.New("square/go-jose: missing embedded jwk in protected header")
+	}
+
+	key := protected.Jwk
+	if !key.Valid() || !key.IsPublic() {
+		return nil, nil, errors.New("square/go-jose: invalid embedded jwk, must be public key")
+	}
+
+	payload, err := obj.Verify(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, payload, nil
+}
+
+// VerifyWithCertificates validates the signature on the object like Verify,
+// using the public key of the leaf certificate in the "x5c" header. The
+// certificate chain is first validated with the given options, typically
+// with the trusted roots in opts.Roots; the other certificates in the header
+// are used as intermediates. The leaf certificate must also match the
+// thumbprints in the "x5t" and "x5t#S256" headers, if present. Note that
+// crypto/x509 requires certificates for server authentication by default, so
+// opts.KeyUsages should usually be set. Returns the verified chains along
+// with the payload.
+func (obj JsonWebSignature) VerifyWithCertificates(opts x509.VerifyOptions) ([][]*x509.Certificate, []byte, error) {
+	if len(obj.Signatures) == 0 {
+		return nil, nil, ErrCryptoFailure
+	}
+
+	headers := obj.Signatures[0].mergedHeaders()
+	certs, err := headers.certificates()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(certs) == 0 {
+		return nil, nil, errors.New("square/go-jose: missing x5c header")
+	}
+
+	err = headers.checkThumbprints(certs[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	intermediates := x509.NewCertPool()
+	if opts.Intermediates != nil {
+		intermediates = opts.Intermediates.Clone()
+	}
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	opts.Intermediates = intermediates
+
+	chains, err := certs[0].Verify(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	payload, err := obj.Verify(certs[0].PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return chains, payload, nil
 }
 
 // VerifyMulti validates (one of the multiple) signatures on the object and
 // returns the index of the signature that was verified, along with the signature
 // object and the payload. We return the signature and index to guarantee that
-// callers are getting the verified value.
+// callers are getting the verified value. The Header of the returned signature
+// holds the merged protected and unprotected headers of that signature, also
+// for objects which weren't parsed, so that callers can apply policy (e.g. on
+// the "kid" or "x5c" headers) to the matched entry. If the key is a JWK with a
+// key ID, only signatures with a matching (or absent) "kid" header are
+// considered. If the key is a JsonWebKeySet, the candidate keys for each
+// signature are tried in turn.
 func (obj JsonWebSignature) VerifyMulti(verificationKey interface{}) (int, Signature, []byte, error) {
+	if set, ok := keySet(verificationKey); ok {
+		return obj.verifyMultiKeySet(set)
+	}
+
 	verifier, err := newVerifier(verificationKey)
 	if err != nil {
 		return -1, Signature{}, nil, err
@@ -241,18 +805,96 @@ func (obj JsonWebSignature) VerifyMulti(verificationKey interface{}) (int, Signa
 
 	for i, signature := range obj.Signatures {
 		headers := signature.mergedHeaders()
-		if len(headers.Crit) > 0 {
+		if len(headers.Crit) > 0 && !signature.critUnderstood {
 			// Unsupported crit header
 			continue
 		}
+		if !keyIDMatches(verificationKey, headers.Kid) {
+			// Signature was made with a different key
+			continue
+		}
 
-		input := obj.computeAuthData(&signature)
 		alg := SignatureAlgorithm(headers.Alg)
+		if alg == algNone {
+			// Unsecured, never valid
+			continue
+		}
+
+		input := computeAuthData(obj.payload, &signature)
 		err := verifier.verifyPayload(input, signature.Signature, alg)
 		if err == nil {
+			signature.Header = headers.sanitized()
 			return i, signature, obj.payload, nil
 		}
 	}
 
 	return -1, Signature{}, nil, ErrCryptoFailure
 }
+
+// Verify one of the signatures with the candidate keys from a key set.
+func (obj JsonWebSignature) verifyMultiKeySet(set *JsonWebKeySet) (int, Signature, []byte, error) {
+	for i, signature := range obj.Signatures {
+		single := obj
+		single.Signatures = []Signature{signature}
+
+		for _, key := range set.candidates(signature.mergedHeaders(), "sig") {
+			_, matched, payload, err := single.VerifyMulti(key)
+			if err == nil {
+				return i, matched, payload, nil
+			}
+		}
+	}
+
+	return -1, Signature{}, nil, ErrCryptoFailure
+}
+
+// VerifyAll validates all of the signatures on the object and returns the
+// payload. Each signature must be valid under (at least) one of the given
+// keys, for example when an object must be signed by several parties. Use
+// VerifyMulti if a single valid signature is sufficient. JWKs with a key ID
+// are only tried for signatures with a matching (or absent) "kid" header.
+func (obj JsonWebSignature) VerifyAll(verificationKeys ...interface{}) ([]byte, error) {
+	verifiers := make([]payloadVerifier, len(verificationKeys))
+	for i, key := range verificationKeys {
+		verifier, err := newVerifier(key)
+		if err != nil {
+			return nil, err
+		}
+		verifiers[i] = verifier
+	}
+
+	if len(obj.Signatures) == 0 {
+		return nil, ErrCryptoFailure
+	}
+
+	for _, signature := range obj.Signatures {
+		headers := signature.mergedHeaders()
+		if len(headers.Crit) > 0 && !signature.critUnderstood {
+			// Unsupported crit header
+			return nil, ErrCryptoFailure
+		}
+
+		alg := SignatureAlgorithm(headers.Alg)
+		if alg == algNone {
+			return nil, ErrNoneAlgorithm
+		}
+
+		input := computeAuthData(obj.payload, &signature)
+
+		verified := false
+		for i, verifier := range verifiers {
+			if !keyIDMatches(verificationKeys[i], headers.Kid) {
+				continue
+			}
+			if verifier.verifyPayload(input, signature.Signature, alg) == nil {
+				verified = true
+				break
+			}
+		}
+		if !verified {
+			return nil, ErrCryptoFailure
+		}
+	}
+
+	return obj.payload, nil
+}
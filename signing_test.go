@@ -19,11 +19,20 @@ package jose
 import (
 	"bytes"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
+	"crypto/mldsa"
 	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
 	"io"
+	"math/big"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/square/go-jose/json"
 )
@@ -92,7 +101,7 @@ func RoundtripJWS(sigAlg SignatureAlgorithm, serializer func(*JsonWebSignature)
 
 func TestRoundtripsJWS(t *testing.T) {
 	// Test matrix
-	sigAlgs := []SignatureAlgorithm{RS256, RS384, RS512, PS256, PS384, PS512, HS256, HS384, HS512, ES256, ES384, ES512}
+	sigAlgs := []SignatureAlgorithm{RS256, RS384, RS512, PS256, PS384, PS512, HS256, HS384, HS512, ES256, ES384, ES512, EdDSA, ML_DSA_44, ML_DSA_65, ML_DSA_87}
 
 	serializers := []func(*JsonWebSignature) (string, error){
 		func(obj *JsonWebSignature) (string, error) { return obj.CompactSerialize() },
@@ -115,7 +124,7 @@ func TestRoundtripsJWS(t *testing.T) {
 
 func TestRoundtripsJWSCorruptSignature(t *testing.T) {
 	// Test matrix
-	sigAlgs := []SignatureAlgorithm{RS256, RS384, RS512, PS256, PS384, PS512, HS256, HS384, HS512, ES256, ES384, ES512}
+	sigAlgs := []SignatureAlgorithm{RS256, RS384, RS512, PS256, PS384, PS512, HS256, HS384, HS512, ES256, ES384, ES512, EdDSA, ML_DSA_44, ML_DSA_65, ML_DSA_87}
 
 	serializers := []func(*JsonWebSignature) (string, error){
 		func(obj *JsonWebSignature) (string, error) { return obj.CompactSerialize() },
@@ -266,6 +275,410 @@ func TestMultiRecipientJWS(t *testing.T) {
 	}
 }
 
+func TestVerifyMultiMatchedHeader(t *testing.T) {
+	key1 := &JsonWebKey{KeyID: "k1", Key: []byte("0123456789abcdef0123456789abcdef")}
+	key2 := &JsonWebKey{KeyID: "k2", Key: []byte("fedcba9876543210fedcba9876543210")}
+
+	signer := NewMultiSigner()
+	if err := signer.AddRecipient(HS256, key1); err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.AddRecipient(HS256, key2); err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.SetUnprotectedHeaders([]string{"kid"}); err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := signer.Sign([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseSigned(obj.FullSerialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, obj := range []*JsonWebSignature{obj, parsed} {
+		for i, key := range []*JsonWebKey{key1, key2} {
+			index, sig, _, err := obj.VerifyMulti(key.Key)
+			if err != nil {
+				t.Fatal("error on verify: ", err)
+			}
+			if index != i {
+				t.Errorf("signature index should be %d, was %d", i, index)
+			}
+			if sig.Header.KeyID != key.KeyID || sig.Header.Algorithm != string(HS256) {
+				t.Errorf("expected merged header of signature %d, got %+v", i, sig.Header)
+			}
+		}
+	}
+}
+
+func TestVerifyWithKeySet(t *testing.T) {
+	hmacKey := JsonWebKey{Key: []byte("0123456789abcdef0123456789abcdef"), KeyID: "hmac"}
+	ecKey := JsonWebKey{Key: &ecTestKey256.PublicKey, KeyID: "ec"}
+
+	signer := NewMultiSigner()
+	if err := signer.AddRecipient(HS256, hmacKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.AddRecipient(ES256, &JsonWebKey{Key: ecTestKey256, KeyID: "ec"}); err != nil {
+		t.Fatal(err)
+	}
+	signer.SetEmbedJwk(false)
+
+	input := []byte("Lorem ipsum dolor sit amet")
+	obj, err := signer.Sign(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err = ParseSigned(obj.FullSerialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys with a different key ID, algorithm or use are skipped
+	decoy := JsonWebKey{Key: []byte("fedcba9876543210fedcba9876543210"), KeyID: "hmac"}
+	wrongAlg := hmacKey
+	wrongAlg.Algorithm = string(HS512)
+	wrongUse := hmacKey
+	wrongUse.Use = "enc"
+
+	set := JsonWebKeySet{Keys: []JsonWebKey{decoy, wrongAlg, ecKey}}
+	index, sig, output, err := obj.VerifyMulti(set)
+	if err != nil {
+		t.Fatal("error on verify with key set:", err)
+	}
+	if index != 1 || sig.Header.KeyID != "ec" || !bytes.Equal(input, output) {
+		t.Errorf("expected signature 1, got %d with %v", index, sig.Header)
+	}
+
+	for _, keys := range [][]JsonWebKey{nil, {decoy}, {wrongAlg, wrongUse}} {
+		if _, _, _, err := obj.VerifyMulti(&JsonWebKeySet{Keys: keys}); err != ErrCryptoFailure {
+			t.Error("should not verify without a matching key", err)
+		}
+	}
+
+	// Single signature
+	single, err := NewSigner(HS256, hmacKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err = single.Sign(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set.Keys = append(set.Keys, hmacKey)
+	if output, err := obj.Verify(&set); err != nil || !bytes.Equal(input, output) {
+		t.Error("unable to verify with key set", err)
+	}
+	if _, err := obj.Verify(&JsonWebKeySet{Keys: []JsonWebKey{decoy, wrongUse}}); err != ErrCryptoFailure {
+		t.Error("should not verify without a matching key", err)
+	}
+}
+
+func TestDetachedPayload(t *testing.T) {
+	signer, err := NewSigner(ES256, ecTestKey256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := []byte("Lorem ipsum dolor sit amet")
+	obj, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := obj.DetachedCompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parts := strings.Split(msg, "."); len(parts) != 3 || parts[1] != "" {
+		t.Fatal("expected empty payload part", msg)
+	}
+
+	parsed, err := ParseSigned(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := parsed.DetachedVerify(payload, &ecTestKey256.PublicKey); err != nil {
+		t.Error("error on detached verify: ", err)
+	}
+	if err := parsed.DetachedVerify([]byte("Lorem ipsum"), &ecTestKey256.PublicKey); err != ErrCryptoFailure {
+		t.Error("should not verify with modified payload", err)
+	}
+	if _, err := parsed.Verify(&ecTestKey256.PublicKey); err != ErrCryptoFailure {
+		t.Error("should not verify detached signature without payload", err)
+	}
+
+	// Attached and detached forms only differ in the payload part
+	compact, err := obj.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Replace(compact, base64URLEncode(payload), "", 1) != msg {
+		t.Error("detached serialization should only omit the payload", msg, compact)
+	}
+
+	multi := NewMultiSigner()
+	multi.AddRecipient(RS256, rsaTestKey)
+	multi.AddRecipient(ES256, ecTestKey256)
+	obj, err = multi.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := obj.DetachedCompactSerialize(); err != ErrNotSupported {
+		t.Error("should not compact serialize multiple signatures", err)
+	}
+}
+
+func TestUnencodedPayload(t *testing.T) {
+	payload := []byte(`{"large":"payload"}`)
+
+	for _, detached := range []bool{false, true} {
+		signer, err := NewSigner(ES256, ecTestKey256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer.SetUnencodedPayload(true)
+
+		obj, err := signer.Sign(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var msg string
+		if detached {
+			msg, err = obj.DetachedCompactSerialize()
+		} else {
+			msg, err = obj.CompactSerialize()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !detached && !strings.Contains(msg, string(payload)) {
+			t.Error("payload should not be encoded", msg)
+		}
+
+		for _, serialized := range []string{msg, obj.FullSerialize()} {
+			parsed, err := ParseSigned(serialized)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !parsed.Signatures[0].unencodedPayload() {
+				t.Error("expected b64 header to be false")
+			}
+
+			if detached && serialized == msg {
+				err = parsed.DetachedVerify(payload, &ecTestKey256.PublicKey)
+			} else {
+				var output []byte
+				output, err = parsed.Verify(&ecTestKey256.PublicKey)
+				if err == nil && !bytes.Equal(output, payload) {
+					t.Error("input/output do not match", output, payload)
+				}
+			}
+			if err != nil {
+				t.Error("error on verify: ", err)
+			}
+		}
+
+		// The b64 header is covered by the signature
+		tampered := strings.Replace(msg, strings.Split(msg, ".")[0], base64URLEncode([]byte(`{"alg":"ES256"}`)), 1)
+		parsed, err := ParseSigned(tampered)
+		if err == nil {
+			if err := parsed.DetachedVerify(payload, &ecTestKey256.PublicKey); err == nil {
+				t.Error("should not verify with b64 header removed")
+			}
+		}
+	}
+
+	// Application extensions can be combined with b64
+	signer, err := NewSigner(HS256, []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer.SetUnencodedPayload(true)
+	if err := signer.SetExtraHeader("exp", 1234); err != nil {
+		t.Fatal(err)
+	}
+	signer.SetCriticalExtensions([]string{"exp"})
+	obj, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseSigned(obj.FullSerialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parsed.Verify([]byte("0123456789abcdef0123456789abcdef")); err != ErrCryptoFailure {
+		t.Error("should not verify with unknown critical extension", err)
+	}
+	parsed, err = ParseSignedWithOptions(obj.FullSerialize(), ParseOptions{UnderstoodExtensions: []string{"exp"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parsed.Verify([]byte("0123456789abcdef0123456789abcdef")); err != nil {
+		t.Error("error on verify: ", err)
+	}
+}
+
+func TestVerifyAll(t *testing.T) {
+	signer := NewMultiSigner()
+	if err := signer.AddRecipient(RS256, rsaTestKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.AddRecipient(ES256, ecTestKey256); err != nil {
+		t.Fatal(err)
+	}
+
+	input := []byte("Lorem ipsum dolor sit amet")
+	obj, err := signer.Sign(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err = ParseSigned(obj.FullSerialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys can be given in any order, unused keys are ignored
+	for _, keys := range [][]interface{}{
+		{&rsaTestKey.PublicKey, &ecTestKey256.PublicKey},
+		{&ecTestKey384.PublicKey, &ecTestKey256.PublicKey, &JsonWebKey{Key: &rsaTestKey.PublicKey}},
+	} {
+		output, err := obj.VerifyAll(keys...)
+		if err != nil {
+			t.Error("error on verify: ", err)
+		} else if !bytes.Equal(output, input) {
+			t.Error("input/output do not match", output, input)
+		}
+	}
+
+	// Every signature must be verified
+	for _, keys := range [][]interface{}{
+		{},
+		{&rsaTestKey.PublicKey},
+		{&ecTestKey256.PublicKey, &ecTestKey384.PublicKey},
+	} {
+		if _, err := obj.VerifyAll(keys...); err != ErrCryptoFailure {
+			t.Error("should not verify with missing keys", err)
+		}
+	}
+
+	if _, err := obj.VerifyAll(&rsaTestKey.PublicKey, "invalid"); err != ErrUnsupportedKeyType {
+		t.Error("should reject invalid key", err)
+	}
+}
+
+func TestKeyIDSelection(t *testing.T) {
+	key1 := JsonWebKey{Key: []byte("0123456789abcdef0123456789abcdef"), KeyID: "key1"}
+	key2 := JsonWebKey{Key: []byte("0123456789abcdef0123456789abcdef"), KeyID: "key2"}
+
+	// Key given by value, its key ID is emitted in the protected header
+	signer, err := NewSigner(HS256, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := signer.Sign([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err = ParseSigned(obj.FullSerialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := obj.Signatures[0].Header.KeyID; kid != "key1" {
+		t.Error("unexpected kid in header", kid)
+	}
+
+	if _, _, _, err := obj.VerifyMulti(key1); err != nil {
+		t.Error("should verify with matching key ID", err)
+	}
+	if _, _, _, err := obj.VerifyMulti(&key2); err != ErrCryptoFailure {
+		t.Error("should not verify with different key ID", err)
+	}
+	if _, _, _, err := obj.VerifyMulti(key2.Key); err != nil {
+		t.Error("should verify with raw key", err)
+	}
+	if _, err := obj.VerifyAll(&key2, &key1); err != nil {
+		t.Error("should select key by key ID", err)
+	}
+	if _, err := obj.VerifyAll(&key2); err != ErrCryptoFailure {
+		t.Error("should not verify with different key ID", err)
+	}
+
+	// Single signature verification selects keys the same way
+	if _, err := obj.Verify(&key1); err != nil {
+		t.Error("should verify with matching key ID", err)
+	}
+	if _, err := obj.Verify(key2); err != ErrCryptoFailure {
+		t.Error("should not verify with different key ID", err)
+	}
+	if err := obj.DetachedVerify(obj.payload, &key2); err != ErrCryptoFailure {
+		t.Error("should not verify with different key ID", err)
+	}
+	if _, err := obj.Verify(key2.Key); err != nil {
+		t.Error("should verify with raw key", err)
+	}
+}
+
+func TestDualSignatureMLDSA(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pqKey, err := mldsa.GenerateKey(mldsa.MLDSA44())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer := NewMultiSigner()
+	if err := signer.AddRecipient(ES256, ecKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.AddRecipient(ML_DSA_44, pqKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.AddRecipient(ML_DSA_65, pqKey); err == nil {
+		t.Error("should not accept ML-DSA-65 signer with ML-DSA-44 key")
+	}
+
+	input := []byte("Lorem ipsum dolor sit amet")
+	obj, err := signer.Sign(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(obj.Signatures[1].Signature) != mldsa.MLDSA44SignatureSize {
+		t.Error("unexpected ML-DSA-44 signature size", len(obj.Signatures[1].Signature))
+	}
+
+	parsed, err := ParseSigned(obj.FullSerialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, key := range []interface{}{&ecKey.PublicKey, pqKey.PublicKey()} {
+		index, _, output, err := parsed.VerifyMulti(key)
+		if err != nil {
+			t.Fatal("error on verify: ", err)
+		}
+		if index != i {
+			t.Errorf("signature index should be %d, was %d", i, index)
+		}
+		if !bytes.Equal(output, input) {
+			t.Error("verified payload does not match input")
+		}
+	}
+
+	// The embedded JWK carries the ML-DSA public key and algorithm
+	jwk := parsed.Signatures[1].Header.JsonWebKey
+	if jwk == nil || jwk.Algorithm != string(ML_DSA_44) || !pqKey.PublicKey().Equal(jwk.Key) {
+		t.Error("expected embedded ML-DSA-44 JWK")
+	}
+}
+
 func GenerateSigningTestKey(sigAlg SignatureAlgorithm) (sig, ver interface{}) {
 	switch sigAlg {
 	case RS256, RS384, RS512, PS256, PS384, PS512:
@@ -286,6 +699,13 @@ func GenerateSigningTestKey(sigAlg SignatureAlgorithm) (sig, ver interface{}) {
 		key, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
 		sig = key
 		ver = &key.PublicKey
+	case EdDSA:
+		ver, sig, _ = ed25519.GenerateKey(rand.Reader)
+	case ML_DSA_44, ML_DSA_65, ML_DSA_87:
+		params, _ := mldsaParameters(sigAlg)
+		key, _ := mldsa.GenerateKey(params)
+		sig = key
+		ver = key.PublicKey()
 	default:
 		panic("Must update test case")
 	}
@@ -449,3 +869,632 @@ func TestSignerWithJWKAndKeyID(t *testing.T) {
 		t.Errorf("expected message to have key id from JWK, but found '%s' instead", parsed2.Signatures[0].Header.KeyID)
 	}
 }
+
+func TestSignPrehashed(t *testing.T) {
+	payload := []byte("Lorem ipsum dolor sit amet")
+	input := fmt.Sprintf("%s.%s", base64URLEncode([]byte(`{"alg":"RS256"}`)), base64URLEncode(payload))
+	digest := sha256.Sum256([]byte(input))
+
+	signer, err := NewSigner(RS256, rsaTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signature, err := signer.SignPrehashed(digest[:], RS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := ParseSigned(input + "." + base64URLEncode(signature))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := obj.Verify(&rsaTestKey.PublicKey)
+	if err != nil {
+		t.Fatal("prehashed signature should verify against full message:", err)
+	}
+	if !bytes.Equal(output, payload) {
+		t.Error("payload mismatch")
+	}
+
+	// Digest must match the hash size of the algorithm
+	if _, err := signer.SignPrehashed(digest[:20], RS256); err != ErrInvalidDigestSize {
+		t.Error("should reject digest of wrong size, got:", err)
+	}
+
+	// Algorithm must match a recipient
+	if _, err := signer.SignPrehashed(digest[:], PS256); err == nil {
+		t.Error("should reject algorithm without matching recipient")
+	}
+
+	ecSigner, err := NewSigner(ES256, ecTestKey256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err = ecSigner.SignPrehashed(digest[:], ES256)
+	if err != nil || len(signature) != 64 {
+		t.Error("failed to sign prehashed digest with ECDSA:", err)
+	}
+
+	hmacSigner, err := NewSigner(HS256, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hmacSigner.SignPrehashed(digest[:], HS256); err == nil {
+		t.Error("should not support prehashed signing with HMAC")
+	}
+}
+
+func TestDeterministicECDSA(t *testing.T) {
+	// Test vector from RFC 6979, section A.2.5 (P-256, SHA-256, "sample")
+	d, _ := new(big.Int).SetString("C9AFA9D845BA75166B5C215767B1D6934E50C3DB36E89B127B8A622B120F6721", 16)
+	key := &ecdsa.PrivateKey{D: d}
+	key.Curve = elliptic.P256()
+	key.X, key.Y = key.Curve.ScalarBaseMult(d.Bytes())
+
+	signer, err := NewSigner(ES256, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer.SetDeterministicECDSA(true)
+
+	digest := sha256.Sum256([]byte("sample"))
+	signature, err := signer.SignPrehashed(digest[:], ES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fromHexBytes("EFD48B2AACB6A8FD1140DD9CD45E81D69D2C877B56AAF991C34D0EA84EAF3716F7CB1C942D657C41D436C7A1B6E29F65F3E900DBB9AFF4064DC4AB2F843ACDA8")
+	if !bytes.Equal(signature, expected) {
+		t.Errorf("signature does not match test vector: %x", signature)
+	}
+
+	for _, key := range []*ecdsa.PrivateKey{ecTestKey256, ecTestKey384, ecTestKey521} {
+		alg := map[int]SignatureAlgorithm{256: ES256, 384: ES384, 521: ES512}[key.Curve.Params().BitSize]
+
+		// Applies to recipients added before and after the option is set
+		signer := NewMultiSigner()
+		_ = signer.AddRecipient(alg, key)
+		signer.SetDeterministicECDSA(true)
+		_ = signer.AddRecipient(alg, key)
+
+		payload := []byte("Lorem ipsum dolor sit amet")
+		obj1, err := signer.Sign(payload)
+		if err != nil {
+			t.Fatal(alg, err)
+		}
+		obj2, err := signer.Sign(payload)
+		if err != nil {
+			t.Fatal(alg, err)
+		}
+
+		if !bytes.Equal(obj1.Signatures[0].Signature, obj1.Signatures[1].Signature) ||
+			!bytes.Equal(obj1.Signatures[0].Signature, obj2.Signatures[0].Signature) {
+			t.Error(alg, "deterministic signatures should be identical")
+		}
+		if _, _, _, err := obj1.VerifyMulti(&key.PublicKey); err != nil {
+			t.Error(alg, "deterministic signature should verify", err)
+		}
+
+		signer.SetDeterministicECDSA(false)
+		obj3, _ := signer.Sign(payload)
+		if bytes.Equal(obj1.Signatures[0].Signature, obj3.Signatures[0].Signature) {
+			t.Error(alg, "randomized signatures should differ")
+		}
+	}
+}
+
+func TestVerifyWithValidity(t *testing.T) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "expired"},
+		NotBefore:    time.Now().Add(-48 * time.Hour),
+		NotAfter:     time.Now().Add(-24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &ecTestKey256.PublicKey, ecTestKey256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := NewSigner(ES256, ecTestKey256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := signer.Sign([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validity := KeyValidityFromCertificate(cert)
+	if _, err := obj.VerifyWithValidity(cert.PublicKey, validity); err != ErrKeyNotValid {
+		t.Error("should reject signature from expired certificate, got:", err)
+	}
+
+	// Leeway covers the expiry
+	validity.Leeway = 25 * time.Hour
+	if _, err := obj.VerifyWithValidity(cert.PublicKey, validity); err != nil {
+		t.Error("should accept signature within leeway:", err)
+	}
+
+	// Verification time inside the window
+	validity.Leeway = 0
+	validity.Now = func() time.Time { return time.Now().Add(-36 * time.Hour) }
+	if _, err := obj.VerifyWithValidity(cert.PublicKey, validity); err != nil {
+		t.Error("should accept signature inside validity window:", err)
+	}
+
+	// Verification time before the window
+	validity.Now = func() time.Time { return time.Now().Add(-72 * time.Hour) }
+	if _, err := obj.VerifyWithValidity(cert.PublicKey, validity); err != ErrKeyNotValid {
+		t.Error("should reject signature before validity window, got:", err)
+	}
+}
+
+// Create a certificate for the given public key, signed by the parent
+// certificate and key (or self-signed if parent is nil).
+func createTestCertificate(t *testing.T, name string, isCA bool, pub interface{}, parent *x509.Certificate, parentKey interface{}) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+	}
+	if parent == nil {
+		parent = template
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// Create a root, intermediate and leaf certificate, the latter for ecTestKey256.
+func createTestCertificateChain(t *testing.T) (root, intermediate, leaf *x509.Certificate) {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root = createTestCertificate(t, "root", true, &rootKey.PublicKey, nil, rootKey)
+	intermediate = createTestCertificate(t, "intermediate", true, &intermediateKey.PublicKey, root, rootKey)
+	leaf = createTestCertificate(t, "leaf", false, &ecTestKey256.PublicKey, intermediate, intermediateKey)
+	return
+}
+
+func TestEmbedCertificates(t *testing.T) {
+	root, intermediate, leaf := createTestCertificateChain(t)
+	payload := []byte("Lorem ipsum dolor sit amet")
+
+	signer, err := NewSigner(ES256, &JsonWebKey{
+		Key:          ecTestKey256,
+		Certificates: []*x509.Certificate{leaf, intermediate},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Certificates are not embedded by default
+	obj, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Signatures[0].protected.X5c != nil {
+		t.Error("x5c should not be set in protected header by default")
+	}
+
+	signer.SetEmbedCertificates(true)
+	obj, err = signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialized, err := obj.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err = ParseSigned(serialized)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certs := obj.Signatures[0].Header.Certificates
+	if len(certs) != 2 || !certs[0].Equal(leaf) || !certs[1].Equal(intermediate) {
+		t.Fatal("certificate chain not embedded in header")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	opts := x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+
+	chains, output, err := obj.VerifyWithCertificates(opts)
+	if err != nil {
+		t.Fatal("unable to verify with certificate chain:", err)
+	}
+	if !bytes.Equal(output, payload) {
+		t.Error("payload mismatch")
+	}
+	if len(chains) != 1 || len(chains[0]) != 3 || !chains[0][2].Equal(root) {
+		t.Error("unexpected verified chains", chains)
+	}
+
+	// Chain must lead to a trusted root
+	if _, _, err := obj.VerifyWithCertificates(x509.VerifyOptions{Roots: x509.NewCertPool()}); err == nil {
+		t.Error("should not verify with untrusted certificate chain")
+	}
+
+	// Signature must be valid under the leaf certificate
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewSigner(ES256, &JsonWebKey{
+		Key:          otherKey,
+		Certificates: []*x509.Certificate{leaf, intermediate},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.SetEmbedCertificates(true)
+	obj, err = other.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := obj.VerifyWithCertificates(opts); err == nil {
+		t.Error("should not verify signature by other key")
+	}
+
+	// Objects without certificates
+	other, err = NewSigner(ES256, ecTestKey256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err = other.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := obj.VerifyWithCertificates(opts); err == nil {
+		t.Error("should not verify object without x5c header")
+	}
+
+	// Invalid certificates are rejected when parsing
+	header := base64URLEncode([]byte(`{"alg":"ES256","x5c":["AAAA"]}`))
+	if _, err := ParseSigned(header + "." + base64URLEncode(payload) + ".AAAA"); err == nil {
+		t.Error("should not parse object with invalid x5c header")
+	}
+}
+
+func TestCertificateThumbprints(t *testing.T) {
+	root, intermediate, leaf := createTestCertificateChain(t)
+	payload := []byte("Lorem ipsum dolor sit amet")
+
+	signer, err := NewSigner(ES256, &JsonWebKey{
+		Key:          ecTestKey256,
+		Certificates: []*x509.Certificate{leaf, intermediate},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Thumbprints are included even if the chain isn't embedded
+	obj, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err = ParseSigned(obj.FullSerialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := obj.Signatures[0].Header
+	sha1Sum := sha1.Sum(leaf.Raw)
+	sha256Sum := sha256.Sum256(leaf.Raw)
+	if !bytes.Equal(header.CertificateThumbprintSHA1, sha1Sum[:]) {
+		t.Error("x5t header does not match leaf certificate")
+	}
+	if !bytes.Equal(header.CertificateThumbprintSHA256, sha256Sum[:]) {
+		t.Error("x5t#S256 header does not match leaf certificate")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	opts := x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+
+	signer.SetEmbedCertificates(true)
+	obj, err = signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := obj.VerifyWithCertificates(opts); err != nil {
+		t.Error("unable to verify with matching thumbprints:", err)
+	}
+
+	// Leaf certificate must match the thumbprints
+	for _, hook := range []func(header map[string]interface{}) map[string]interface{}{
+		func(header map[string]interface{}) map[string]interface{} {
+			header["x5t"] = base64URLEncode(make([]byte, 20))
+			return header
+		},
+		func(header map[string]interface{}) map[string]interface{} {
+			header["x5t#S256"] = base64URLEncode(make([]byte, 32))
+			return header
+		},
+	} {
+		signer.SetProtectedHeaderHook(hook)
+		obj, err = signer.Sign(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := obj.VerifyWithCertificates(opts); err == nil {
+			t.Error("should not verify with mismatched thumbprint")
+		}
+	}
+}
+
+func TestSignerType(t *testing.T) {
+	signer, err := NewSigner(HS256, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer.SetType("at+jwt")
+	signer.SetContentType("JWT")
+
+	obj, err := signer.Sign([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := obj.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseSigned(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sig, _, err := parsed.VerifyMulti([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sig.Header.Type != "at+jwt" {
+		t.Errorf("unexpected typ header: %q", sig.Header.Type)
+	}
+	if sig.Header.ContentType != "JWT" {
+		t.Errorf("unexpected cty header: %q", sig.Header.ContentType)
+	}
+	for _, expected := range []string{"at+jwt", "AT+JWT", "application/at+jwt", "Application/AT+JWT"} {
+		if err := sig.Header.CheckType(expected); err != nil {
+			t.Errorf("typ should match %q: %v", expected, err)
+		}
+	}
+	for _, expected := range []string{"", "jwt", "application/jwt", "text/at+jwt"} {
+		if err := sig.Header.CheckType(expected); err == nil {
+			t.Errorf("typ should not match %q", expected)
+		}
+	}
+
+	// A media type with a subtype containing '/' keeps its prefix
+	header := JoseHeader{Type: "application/foo/bar"}
+	if header.CheckType("foo/bar") == nil {
+		t.Error("application/ prefix should only be dropped if no other '/' remains")
+	}
+}
+
+func TestProtectedHeaderHook(t *testing.T) {
+	signer, err := NewSigner(HS256, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer.SetProtectedHeaderHook(func(header map[string]interface{}) map[string]interface{} {
+		header["custom"] = "value"
+		return header
+	})
+
+	obj, err := signer.Sign([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range []string{obj.FullSerialize(), mustCompactSerialize(t, obj)} {
+		parsed, err := ParseSigned(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, sig, _, err := parsed.VerifyMulti([]byte("secret"))
+		if err != nil {
+			t.Fatal("signature over hooked header should verify:", err)
+		}
+		if sig.Header.ExtraHeaders["custom"] != "value" {
+			t.Error("custom member should be in the signed header")
+		}
+	}
+
+	// Removing alg is not allowed
+	signer.SetProtectedHeaderHook(func(header map[string]interface{}) map[string]interface{} {
+		delete(header, "alg")
+		return header
+	})
+	if _, err := signer.Sign([]byte("Lorem ipsum dolor sit amet")); err == nil {
+		t.Error("hook should not be able to remove alg")
+	}
+}
+
+func TestCriticalExtensionsJWS(t *testing.T) {
+	signer, err := NewSigner(HS256, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.SetExtraHeader("alg", "none"); err == nil {
+		t.Error("should not be able to override alg")
+	}
+	if err := signer.SetExtraHeader("exp", 1363284000); err != nil {
+		t.Fatal(err)
+	}
+	signer.SetCriticalExtensions([]string{"exp"})
+
+	obj, err := signer.Sign([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range []string{obj.FullSerialize(), mustCompactSerialize(t, obj)} {
+		parsed, err := ParseSignedWithOptions(msg, ParseOptions{UnderstoodExtensions: []string{"exp"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parsed.Verify([]byte("secret")); err != nil {
+			t.Error("understood critical header should verify:", err)
+		}
+		if parsed.Signatures[0].Header.ExtraHeaders["exp"] != float64(1363284000) {
+			t.Error("critical header should be in the signed header")
+		}
+
+		// Not understood by the consumer
+		_, err = ParseSignedWithOptions(msg, ParseOptions{UnderstoodExtensions: []string{"other"}})
+		if err == nil {
+			t.Error("should reject critical header not understood")
+		}
+		parsed, err = ParseSigned(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parsed.Verify([]byte("secret")); err == nil {
+			t.Error("should not verify without understanding critical header")
+		}
+	}
+
+	// Critical parameters must be present and not registered ones
+	signer.SetCriticalExtensions([]string{"missing"})
+	if _, err := signer.Sign([]byte("Lorem ipsum dolor sit amet")); err == nil {
+		t.Error("should reject critical header that isn't present")
+	}
+	signer.SetCriticalExtensions([]string{"kid"})
+	if _, err := signer.Sign([]byte("Lorem ipsum dolor sit amet")); err == nil {
+		t.Error("should reject registered header marked as critical")
+	}
+}
+
+func TestUnprotectedHeadersJWS(t *testing.T) {
+	key := &JsonWebKey{KeyID: "k1", Key: []byte("0123456789abcdef0123456789abcdef")}
+	signer, err := NewSigner(HS256, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.SetUnprotectedHeaders([]string{"alg"}); err == nil {
+		t.Error("should not be able to move alg to the unprotected header")
+	}
+	if err := signer.SetExtraHeader("route", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.SetUnprotectedHeaders([]string{"kid", "route"}); err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := signer.Sign([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := obj.CompactSerialize(); err == nil {
+		t.Error("should not be able to compact serialize an unprotected header")
+	}
+
+	for _, msg := range []string{obj.FullSerialize(), obj.FullSerializeGeneral()} {
+		parsed, err := ParseSigned(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig := parsed.Signatures[0]
+		if sig.protected.Kid != "" || sig.protected.Extra["route"] != nil {
+			t.Error("unprotected parameters should not be in the protected header", msg)
+		}
+		if sig.header == nil || sig.header.Kid != "k1" {
+			t.Error("kid should be in the unprotected header", msg)
+		}
+		if sig.Header.KeyID != "k1" || sig.Header.ExtraHeaders["route"] != "a" {
+			t.Error("unprotected parameters missing from merged header", sig.Header)
+		}
+		if _, err := parsed.Verify(key); err != nil {
+			t.Error("unable to verify", err)
+		}
+	}
+
+	// Critical parameters must stay integrity protected
+	signer.SetCriticalExtensions([]string{"route"})
+	if _, err := signer.Sign([]byte("Lorem ipsum dolor sit amet")); err == nil {
+		t.Error("should not move critical header to the unprotected header")
+	}
+}
+
+func TestVectorsEdDSA(t *testing.T) {
+	// Example from RFC 8037 appendix A.4
+	seed, _ := base64URLDecode("nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A")
+	key := ed25519.NewKeyFromSeed(seed)
+
+	signer, err := NewSigner(EdDSA, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer.SetEmbedJwk(false)
+
+	obj, err := signer.Sign([]byte("Example of Ed25519 signing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "eyJhbGciOiJFZERTQSJ9.RXhhbXBsZSBvZiBFZDI1NTE5IHNpZ25pbmc." +
+		"hgyY0il_MGCjP0JzlnLWG1PPOt7-09PGcvMg3AIbQR6dWbhijcNR4ki4iylGjg5BhVsPt9g7sVvpAr_MuM0KAg"
+	if msg := mustCompactSerialize(t, obj); msg != expected {
+		t.Errorf("unexpected signature, got %s, expected %s", msg, expected)
+	}
+
+	parsed, err := ParseSigned(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parsed.Verify(key.Public()); err != nil {
+		t.Error("failed to verify RFC 8037 example:", err)
+	}
+
+	// Ed25519 keys can only be used with EdDSA
+	if _, err := NewSigner(ES256, key); err != ErrUnsupportedAlgorithm {
+		t.Error("should reject Ed25519 key with other algorithms, got", err)
+	}
+	parsed.Signatures[0].protected.Alg = string(ES256)
+	if _, err := parsed.Verify(key.Public()); err == nil {
+		t.Error("should not verify Ed25519 signature with other algorithms")
+	}
+}
+
+func mustCompactSerialize(t *testing.T, obj *JsonWebSignature) string {
+	msg, err := obj.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
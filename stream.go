@@ -0,0 +1,455 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jose
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/square/go-jose/cipher"
+)
+
+// Maximum size of the (base64url-encoded) header, encrypted key and IV parts
+// of a streamed JWE object, to bound memory use.
+const maxStreamPartSize = 1 << 20
+
+// Size of the chunks in which streamed ciphertext is decrypted.
+const streamChunkSize = 32 * 1024
+
+// ErrStreamClosed is returned when writing to a stream which has been closed.
+var ErrStreamClosed = errors.New("square/go-jose: write to closed stream")
+
+// Writer for a streamed JWE object, which encrypts the plaintext written to it
+// and writes the ciphertext to the underlying writer.
+type streamEncrypter struct {
+	out    io.Writer
+	enc    io.WriteCloser
+	cipher *josecipher.CBCHMACEncrypter
+	closed bool
+}
+
+// Reader for a streamed JWE object, which returns the plaintext.
+type streamDecrypter struct {
+	ciphertext io.Reader
+	tag        io.Reader
+	cipher     *josecipher.CBCHMACDecrypter
+	chunk      []byte
+	plaintext  []byte
+	err        error
+}
+
+// Reader for a single part of a compact serialization, which returns io.EOF
+// at the next "." delimiter.
+type partReader struct {
+	r       *bufio.Reader
+	pending []byte
+	done    bool
+}
+
+// Check whether a content encryption algorithm can be streamed.
+func isStreamable(enc ContentEncryption) bool {
+	switch enc {
+	case A128CBC_HS256, A192CBC_HS384, A256CBC_HS512:
+		return true
+	default:
+		return false
+	}
+}
+
+// EncryptStream encrypts a stream of plaintext, for payloads too large to be
+// held in memory. It writes the object in compact serialization format to the
+// given writer and returns a writer for the plaintext. The object is complete
+// once the returned writer has been closed. Streaming requires a single
+// recipient, an AES-CBC-HMAC content encryption algorithm (AES-GCM requires
+// the whole plaintext) and no compression.
+func (ctx *genericEncrypter) EncryptStream(w io.Writer) (io.WriteCloser, error) {
+	if !isStreamable(ctx.contentAlg) {
+		return nil, fmt.Errorf("square/go-jose: streaming not supported with enc value '%s'", string(ctx.contentAlg))
+	}
+	if ctx.compressionAlg != NONE {
+		return nil, errors.New("square/go-jose: streaming not supported with compression")
+	}
+	if len(ctx.recipients) > 1 {
+		return nil, ErrNotSupported
+	}
+
+	obj, cek, deferred, err := ctx.newObject(nil)
+	if err != nil {
+		return nil, err
+	}
+	if deferred[0] != nil {
+		// The encrypted key would depend on the tag, which comes last.
+		return nil, ErrNotSupported
+	}
+
+	iv := make([]byte, 16)
+	_, err = io.ReadFull(randReader, iv)
+	if err != nil {
+		return nil, err
+	}
+
+	authData := obj.computeAuthData()
+	cipher, err := josecipher.NewCBCHMACEncrypter(cek, iv, authData, aes.NewCipher)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = fmt.Fprintf(w, "%s.%s.%s.", authData, base64URLEncode(obj.recipients[0].encryptedKey), base64URLEncode(iv))
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamEncrypter{
+		out:    w,
+		enc:    base64.NewEncoder(base64.RawURLEncoding, w),
+		cipher: cipher,
+	}, nil
+}
+
+// Write encrypts the given plaintext.
+func (s *streamEncrypter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, ErrStreamClosed
+	}
+
+	_, err := s.enc.Write(s.cipher.Update(p))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close completes the object by writing the remaining ciphertext and the tag.
+func (s *streamEncrypter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	ciphertext, tag := s.cipher.Finish()
+	_, err := s.enc.Write(ciphertext)
+	if err != nil {
+		return err
+	}
+
+	err = s.enc.Close()
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(s.out, "."+base64URLEncode(tag))
+	return err
+}
+
+// UnsafeDecryptStream decrypts an object in compact serialization format read
+// from the given reader, for payloads too large to be held in memory. It
+// returns the headers of the object along with a reader for the plaintext.
+// Only objects with an AES-CBC-HMAC content encryption algorithm and without
+// compression can be streamed. The header is parsed and checked according to
+// the given options, as with ParseEncryptedWithOptions.
+//
+// This function is unsafe: the plaintext is released before the authentication
+// tag at the end of the stream has been checked, so it is unauthenticated until
+// the reader has returned io.EOF. If the tag is invalid the reader returns an
+// error instead, and any plaintext read so far must be discarded. Callers that
+// cannot defer acting on the plaintext should use Decrypt instead.
+func UnsafeDecryptStream(input io.Reader, decryptionKey interface{}, opts ParseOptions) (JoseHeader, io.Reader, error) {
+	r := bufio.NewReader(input)
+
+	var parts [3][]byte
+	for i := range parts {
+		part, err := io.ReadAll(io.LimitReader(&partReader{r: r}, maxStreamPartSize+1))
+		if err != nil {
+			return JoseHeader{}, nil, err
+		}
+		if len(part) > maxStreamPartSize {
+			return JoseHeader{}, nil, errors.New("square/go-jose: compact JWE header too large")
+		}
+		parts[i] = part
+	}
+
+	// Parse the header, encrypted key and IV with empty ciphertext and tag.
+	obj, err := parseEncryptedCompact(string(bytes.Join(parts[:], []byte(".")))+"..", opts)
+	if err != nil {
+		return JoseHeader{}, nil, err
+	}
+
+	headers := obj.mergedHeaders(&obj.recipients[0])
+	if len(headers.Crit) > 0 && !obj.critUnderstood {
+		return JoseHeader{}, nil, fmt.Errorf("square/go-jose: unsupported crit header")
+	}
+	if !isStreamable(headers.Enc) {
+		return JoseHeader{}, nil, fmt.Errorf("square/go-jose: streaming not supported with enc value '%s'", string(headers.Enc))
+	}
+	if obj.protected.Zip != "" {
+		return JoseHeader{}, nil, errors.New("square/go-jose: streaming not supported with compression")
+	}
+	// Keys are selected as for Decrypt, but as the content can only be
+	// authenticated at the end of the stream, the first key which unwraps a
+	// content encryption key of the right size is used.
+	decrypters, err := obj.keyDecrypters(decryptionKey, headers)
+	if err != nil {
+		return JoseHeader{}, nil, err
+	}
+
+	generator := randomKeyGenerator{
+		size: getContentCipher(headers.Enc).keySize(),
+	}
+
+	var cek []byte
+	var lastErr error
+	for _, decrypter := range decrypters {
+		key, err := decrypter.decryptKey(headers, &obj.recipients[0], generator)
+		if err == nil && len(key) == generator.size {
+			cek = key
+			break
+		}
+		lastErr = decryptError(lastErr, err)
+	}
+	if cek == nil {
+		if lastErr == nil {
+			lastErr = ErrCryptoFailure
+		}
+		return JoseHeader{}, nil, lastErr
+	}
+
+	cipher, err := josecipher.NewCBCHMACDecrypter(cek, obj.iv, obj.computeAuthData(), aes.NewCipher)
+	if err != nil {
+		return JoseHeader{}, nil, err
+	}
+
+	return headers.sanitized(), &streamDecrypter{
+		ciphertext: base64.NewDecoder(base64.RawURLEncoding, &partReader{r: r}),
+		tag:        r,
+		cipher:     cipher,
+		chunk:      make([]byte, streamChunkSize),
+	}, nil
+}
+
+// Read decrypts the next chunk of ciphertext, and checks the tag once all of
+// it has been read.
+func (s *streamDecrypter) Read(p []byte) (int, error) {
+	for len(s.plaintext) == 0 && s.err == nil {
+		n, err := s.ciphertext.Read(s.chunk)
+		s.plaintext = s.cipher.Update(s.chunk[:n])
+
+		switch err {
+		case nil:
+		case io.EOF:
+			s.finish()
+		default:
+			s.plaintext = nil
+			s.err = err
+		}
+	}
+
+	n := copy(p, s.plaintext)
+	s.plaintext = s.plaintext[n:]
+	if len(s.plaintext) > 0 {
+		return n, nil
+	}
+	return n, s.err
+}
+
+// Read the tag and complete decryption.
+func (s *streamDecrypter) finish() {
+	encoded, err := io.ReadAll(io.LimitReader(s.tag, 128))
+	if err != nil {
+		s.plaintext = nil
+		s.err = err
+		return
+	}
+
+	tag, err := base64URLDecode(string(bytes.TrimRight(encoded, "\r\n")))
+	if err != nil {
+		s.plaintext = nil
+		s.err = err
+		return
+	}
+
+	plaintext, err := s.cipher.Finish(tag)
+	if err != nil {
+		s.plaintext = nil
+		s.err = ErrCryptoFailure
+		return
+	}
+
+	s.plaintext = append(s.plaintext, plaintext...)
+	s.err = io.EOF
+}
+
+// Read returns the data up to the next "." delimiter.
+func (p *partReader) Read(b []byte) (int, error) {
+	for len(p.pending) == 0 {
+		if p.done {
+			return 0, io.EOF
+		}
+
+		slice, err := p.r.ReadSlice('.')
+		switch err {
+		case nil:
+			p.pending = append(p.pending[:0], slice[:len(slice)-1]...)
+			p.done = true
+		case bufio.ErrBufferFull:
+			p.pending = append(p.pending[:0], slice...)
+		case io.EOF:
+			return 0, io.ErrUnexpectedEOF
+		default:
+			return 0, err
+		}
+	}
+
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+// SignStream signs a payload read from the given reader, which is hashed
+// incrementally rather than held in memory, for large payloads such as
+// firmware images. The returned object does not contain the payload, which
+// must be transported separately (see DetachedCompactSerialize) and verified
+// with VerifyStream or DetachedVerify. Only algorithms which hash the payload
+// (HMAC, RSA and ECDSA) can be streamed; for other signers this returns
+// ErrUnsupportedAlgorithm.
+func (ctx *genericSigner) SignStream(payload io.Reader) (*JsonWebSignature, error) {
+	obj := &JsonWebSignature{}
+	obj.Signatures = make([]Signature, len(ctx.recipients))
+
+	signers := make([]hashSigner, len(ctx.recipients))
+	hashes := make([]hash.Hash, len(ctx.recipients))
+	writers := make([]io.Writer, len(ctx.recipients))
+	for i, recipient := range ctx.recipients {
+		signer, ok := recipient.signer.(hashSigner)
+		if !ok {
+			return nil, ErrUnsupportedAlgorithm
+		}
+
+		serializedProtected, protected, unprotected, err := ctx.protectedHeader(recipient)
+		if err != nil {
+			return nil, err
+		}
+
+		h, err := signer.newHash(recipient.sigAlg)
+		if err != nil {
+			return nil, err
+		}
+
+		// According to documentation, Write() on hash never fails
+		_, _ = h.Write([]byte(base64URLEncode(serializedProtected) + "."))
+
+		obj.Signatures[i].protected = protected
+		obj.Signatures[i].header = unprotected
+		if ctx.headerHook != nil {
+			// Keep the exact bytes produced by the hook, as they can't be
+			// reproduced by marshaling the parsed header.
+			obj.Signatures[i].original = &rawSignatureInfo{
+				Protected: newBuffer(serializedProtected),
+			}
+		}
+		signers[i] = signer
+		hashes[i] = h
+		writers[i] = h
+	}
+
+	err := hashStream(io.MultiWriter(writers...), payload, ctx.unencoded)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, recipient := range ctx.recipients {
+		obj.Signatures[i].Signature, err = signers[i].signHash(hashes[i], recipient.sigAlg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return obj, nil
+}
+
+// VerifyStream validates the signature on the object over a payload read from
+// the given reader, which is hashed incrementally rather than held in memory.
+// Otherwise it behaves like DetachedVerify, and likewise does not support
+// multi-signature. Only algorithms which hash the payload (HMAC, RSA and
+// ECDSA) can be streamed.
+func (obj JsonWebSignature) VerifyStream(payload io.Reader, verificationKey interface{}) error {
+	verifier, err := newVerifier(verificationKey)
+	if err != nil {
+		return err
+	}
+
+	if len(obj.Signatures) > 1 {
+		return errors.New("square/go-jose: too many signatures in payload; expecting only one")
+	}
+
+	hv, ok := verifier.(hashVerifier)
+	if !ok {
+		return ErrUnsupportedAlgorithm
+	}
+
+	signature := obj.Signatures[0]
+	headers := signature.mergedHeaders()
+	if len(headers.Crit) > 0 && !signature.critUnderstood {
+		// Unsupported crit header
+		return ErrCryptoFailure
+	}
+
+	alg := SignatureAlgorithm(headers.Alg)
+	if alg == algNone {
+		return ErrNoneAlgorithm
+	}
+
+	h, err := hv.newHash(alg)
+	if err != nil {
+		return err
+	}
+
+	// According to documentation, Write() on hash never fails
+	_, _ = h.Write([]byte(base64URLEncode(signature.serializedProtected()) + "."))
+
+	err = hashStream(h, payload, signature.unencodedPayload())
+	if err != nil {
+		return err
+	}
+
+	err = hv.verifyHash(h, signature.Signature, alg)
+	if err != nil {
+		return ErrCryptoFailure
+	}
+
+	return nil
+}
+
+// Write a payload to the given hash(es), base64url encoding it unless it is
+// unencoded (RFC 7797).
+func hashStream(w io.Writer, payload io.Reader, unencoded bool) error {
+	if unencoded {
+		_, err := io.Copy(w, payload)
+		return err
+	}
+
+	enc := base64.NewEncoder(base64.RawURLEncoding, w)
+	if _, err := io.Copy(enc, payload); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,307 @@
+/*-
+ * Copyright 2014 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jose
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestEncryptDecryptStream(t *testing.T) {
+	aesKey := []byte("0123456789abcdef")
+
+	for _, tc := range []struct {
+		alg        KeyAlgorithm
+		enc        ContentEncryption
+		encryptKey interface{}
+		decryptKey interface{}
+	}{
+		{A128KW, A128CBC_HS256, aesKey, aesKey},
+		{RSA_OAEP, A256CBC_HS512, &rsaTestKey.PublicKey, rsaTestKey},
+		{ECDH_ES, A192CBC_HS384, &ecTestKey256.PublicKey, ecTestKey256},
+		{DIRECT, A128CBC_HS256, []byte("0123456789abcdef0123456789abcdef"), []byte("0123456789abcdef0123456789abcdef")},
+	} {
+		for _, size := range []int{0, 1, 16, 100, 100000} {
+			input := make([]byte, size)
+			_, _ = io.ReadFull(rand.Reader, input)
+
+			encrypter, err := NewEncrypter(tc.alg, tc.enc, tc.encryptKey)
+			if err != nil {
+				t.Fatal(tc.alg, err)
+			}
+
+			var out bytes.Buffer
+			w, err := encrypter.EncryptStream(&out)
+			if err != nil {
+				t.Fatal(tc.alg, err)
+			}
+			for i := 0; i < size; i += 1000 {
+				end := i + 1000
+				if end > size {
+					end = size
+				}
+				if _, err := w.Write(input[i:end]); err != nil {
+					t.Fatal(tc.alg, err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(tc.alg, err)
+			}
+
+			// Streamed output is a regular compact JWE
+			parsed, err := ParseEncrypted(out.String())
+			if err != nil {
+				t.Fatal(tc.alg, size, err)
+			}
+			output, err := parsed.Decrypt(tc.decryptKey)
+			if err != nil {
+				t.Error(tc.alg, size, "error on decrypt:", err)
+			} else if !bytes.Equal(output, input) {
+				t.Error(tc.alg, size, "input/output do not match")
+			}
+
+			headers, r, err := UnsafeDecryptStream(strings.NewReader(out.String()), tc.decryptKey, ParseOptions{})
+			if err != nil {
+				t.Fatal(tc.alg, size, err)
+			}
+			if headers.Algorithm != string(tc.alg) {
+				t.Error(tc.alg, size, "unexpected headers", headers)
+			}
+			output, err = io.ReadAll(r)
+			if err != nil {
+				t.Error(tc.alg, size, "error on streaming decrypt:", err)
+			} else if !bytes.Equal(output, input) {
+				t.Error(tc.alg, size, "input/output do not match")
+			}
+		}
+	}
+}
+
+func TestDecryptStreamFromEncrypt(t *testing.T) {
+	encrypter, err := NewEncrypter(RSA_OAEP_256, A128CBC_HS256, &rsaTestKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := []byte("Lorem ipsum dolor sit amet")
+	obj, err := encrypter.Encrypt(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialized, _ := obj.CompactSerialize()
+
+	_, r, err := UnsafeDecryptStream(strings.NewReader(serialized+"\n"), rsaTestKey, ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := io.ReadAll(r)
+	if err != nil {
+		t.Error("error on streaming decrypt:", err)
+	} else if !bytes.Equal(output, input) {
+		t.Error("input/output do not match", output, input)
+	}
+
+	// Tampered tag
+	tampered := serialized[:len(serialized)-2] + "AA"
+	if tampered == serialized {
+		tampered = serialized[:len(serialized)-2] + "BA"
+	}
+	_, r, err = UnsafeDecryptStream(strings.NewReader(tampered), rsaTestKey, ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err != ErrCryptoFailure {
+		t.Error("should reject invalid tag", err)
+	}
+
+	// Truncated streams
+	for _, n := range []int{10, strings.LastIndex(serialized, ".") - 5, strings.LastIndex(serialized, ".")} {
+		_, r, err = UnsafeDecryptStream(strings.NewReader(serialized[:n]), rsaTestKey, ParseOptions{})
+		if err == nil {
+			_, err = io.ReadAll(r)
+		}
+		if err == nil {
+			t.Error("should reject truncated stream", n)
+		}
+	}
+}
+
+func TestDecryptStreamParseOptions(t *testing.T) {
+	encrypter, err := NewEncrypter(RSA_OAEP_256, A128CBC_HS256, &rsaTestKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := encrypter.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialized, _ := obj.CompactSerialize()
+
+	opts := ParseOptions{KeyAlgorithms: []KeyAlgorithm{A128KW}}
+	if _, _, err := UnsafeDecryptStream(strings.NewReader(serialized), rsaTestKey, opts); err == nil {
+		t.Error("should reject key algorithm not in allow-list")
+	}
+
+	opts = ParseOptions{MaxHeaderSize: 10}
+	if _, _, err := UnsafeDecryptStream(strings.NewReader(serialized), rsaTestKey, opts); err == nil {
+		t.Error("should reject header larger than MaxHeaderSize")
+	}
+
+	opts = ParseOptions{KeyAlgorithms: []KeyAlgorithm{RSA_OAEP_256}}
+	if _, _, err := UnsafeDecryptStream(strings.NewReader(serialized), rsaTestKey, opts); err != nil {
+		t.Error("should accept key algorithm in allow-list", err)
+	}
+}
+
+func TestDecryptStreamKeySelection(t *testing.T) {
+	aesKey := []byte("0123456789abcdef")
+	encrypter, err := NewEncrypter(A128KW, A128CBC_HS256, &JsonWebKey{Key: aesKey, KeyID: "aes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := encrypter.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialized, _ := obj.CompactSerialize()
+
+	// Keys are selected as for Decrypt
+	set := JsonWebKeySet{Keys: []JsonWebKey{{Key: rsaTestKey, KeyID: "rsa"}, {Key: aesKey, KeyID: "aes"}}}
+	for _, key := range []interface{}{aesKey, &JsonWebKey{Key: aesKey, KeyID: "aes"}, set} {
+		_, r, err := UnsafeDecryptStream(strings.NewReader(serialized), key, ParseOptions{})
+		if err != nil {
+			t.Fatalf("unable to decrypt stream with %T: %v", key, err)
+		}
+		if _, err := io.ReadAll(r); err != nil {
+			t.Errorf("unable to decrypt stream with %T: %v", key, err)
+		}
+	}
+
+	other := &JsonWebKey{Key: aesKey, KeyID: "other"}
+	if _, _, err := UnsafeDecryptStream(strings.NewReader(serialized), other, ParseOptions{}); err != ErrCryptoFailure {
+		t.Error("should not decrypt stream with different key ID", err)
+	}
+}
+
+func TestEncryptStreamUnsupported(t *testing.T) {
+	encrypter, _ := NewEncrypter(A128KW, A128GCM, []byte("0123456789abcdef"))
+	if _, err := encrypter.EncryptStream(io.Discard); err == nil {
+		t.Error("should reject AES-GCM")
+	}
+
+	encrypter, _ = NewEncrypter(A128KW, A128CBC_HS256, []byte("0123456789abcdef"))
+	encrypter.SetCompression(DEFLATE)
+	if _, err := encrypter.EncryptStream(io.Discard); err == nil {
+		t.Error("should reject compression")
+	}
+
+	// Objects with AES-GCM can't be decrypted as a stream either
+	encrypter, _ = NewEncrypter(A128KW, A128GCM, []byte("0123456789abcdef"))
+	obj, _ := encrypter.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	serialized, _ := obj.CompactSerialize()
+	if _, _, err := UnsafeDecryptStream(strings.NewReader(serialized), []byte("0123456789abcdef"), ParseOptions{}); err == nil {
+		t.Error("should reject AES-GCM")
+	}
+
+	encrypter, _ = NewEncrypter(A128KW, A128CBC_HS256, []byte("0123456789abcdef"))
+	w, _ := encrypter.EncryptStream(io.Discard)
+	_ = w.Close()
+	if _, err := w.Write([]byte("data")); err != ErrStreamClosed {
+		t.Error("should reject write after close", err)
+	}
+}
+
+func TestSignVerifyStream(t *testing.T) {
+	hmacKey := []byte("0123456789abcdef0123456789abcdef")
+
+	payload := make([]byte, 100000)
+	_, _ = rand.Read(payload)
+
+	for _, tc := range []struct {
+		alg       SignatureAlgorithm
+		signKey   interface{}
+		verifyKey interface{}
+	}{
+		{HS256, hmacKey, hmacKey},
+		{RS256, rsaTestKey, &rsaTestKey.PublicKey},
+		{PS384, rsaTestKey, &rsaTestKey.PublicKey},
+		{ES256, ecTestKey256, &ecTestKey256.PublicKey},
+		{ES512, ecTestKey521, &ecTestKey521.PublicKey},
+	} {
+		for _, unencoded := range []bool{false, true} {
+			signer, err := NewSigner(tc.alg, tc.signKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signer.SetUnencodedPayload(unencoded)
+
+			obj, err := signer.SignStream(bytes.NewReader(payload))
+			if err != nil {
+				t.Error(tc.alg, unencoded, err)
+				continue
+			}
+
+			// Interoperable with detached signatures
+			serialized, err := obj.DetachedCompactSerialize()
+			if err != nil {
+				t.Error(tc.alg, unencoded, err)
+				continue
+			}
+			parsed, err := ParseSigned(serialized)
+			if err != nil {
+				t.Error(tc.alg, unencoded, err)
+				continue
+			}
+			if err := parsed.DetachedVerify(payload, tc.verifyKey); err != nil {
+				t.Error(tc.alg, unencoded, "failed to verify detached", err)
+			}
+			if err := parsed.VerifyStream(bytes.NewReader(payload), tc.verifyKey); err != nil {
+				t.Error(tc.alg, unencoded, "failed to verify stream", err)
+			}
+
+			tampered := append([]byte{}, payload...)
+			tampered[len(tampered)-1] ^= 1
+			if err := parsed.VerifyStream(bytes.NewReader(tampered), tc.verifyKey); err == nil {
+				t.Error(tc.alg, unencoded, "should reject tampered payload")
+			}
+
+			obj, _ = signer.Sign(payload)
+			serialized, _ = obj.DetachedCompactSerialize()
+			parsed, _ = ParseSigned(serialized)
+			if err := parsed.VerifyStream(bytes.NewReader(payload), tc.verifyKey); err != nil {
+				t.Error(tc.alg, unencoded, "failed to verify stream of signed object", err)
+			}
+		}
+	}
+}
+
+func TestSignStreamUnsupported(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := NewSigner(EdDSA, edKey)
+	if _, err := signer.SignStream(strings.NewReader("data")); err != ErrUnsupportedAlgorithm {
+		t.Error("should reject EdDSA", err)
+	}
+
+	obj, _ := signer.Sign([]byte("data"))
+	if err := obj.VerifyStream(strings.NewReader("data"), edKey.Public()); err != ErrUnsupportedAlgorithm {
+		t.Error("should reject EdDSA", err)
+	}
+}
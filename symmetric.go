@@ -20,23 +20,53 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
+	"crypto/pbkdf2"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/sha512"
 	"crypto/subtle"
 	"errors"
+	"fmt"
 	"hash"
 	"io"
+	"strings"
 
 	"github.com/square/go-jose/cipher"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 // Random reader (stubbed out in tests)
 var randReader = rand.Reader
 
+// DefaultPBES2Count is the PBES2 iteration count (p2c) used when encrypting
+// with a password, unless set with SetPBES2Count. Higher counts make
+// brute-forcing the password more expensive, at the cost of slower encryption
+// and decryption.
+const DefaultPBES2Count = 100000
+
+// DefaultMinPBES2Count and DefaultMaxPBES2Count bound the PBES2 iteration
+// count (p2c) accepted when decrypting, unless other bounds are set in
+// ParseOptions. Objects with a lower count are rejected as too weak, and
+// objects with a higher count as they could be used to tie up the receiver
+// (the count is chosen by the sender).
+const (
+	DefaultMinPBES2Count = 1000
+	DefaultMaxPBES2Count = 5000000
+)
+
+// DefaultMaxPBES2Recipients is the maximum number of PBES2 recipients accepted
+// when parsing a JWE object, unless another limit is set in ParseOptions. Each
+// of them may cost a key derivation with up to MaxPBES2Count iterations on
+// decrypt, so a message with many of them could tie up the receiver.
+const DefaultMaxPBES2Recipients = 1
+
 // Dummy key cipher for shared symmetric key mode
 type symmetricKeyCipher struct {
 	key []byte // Pre-shared content-encryption key
+
+	// PBES2 iteration count used when encrypting, and bounds on the count
+	// accepted when decrypting; the defaults if zero.
+	p2c, minP2c, maxP2c int
 }
 
 // Signer/verifier for MAC modes
@@ -86,13 +116,27 @@ func newAESGCM(keySize int) contentCipher {
 func newAESCBC(keySize int) contentCipher {
 	return &aeadContentCipher{
 		keyBytes:     keySize * 2,
-		authtagBytes: 16,
+		authtagBytes: keySize,
 		getAead: func(key []byte) (cipher.AEAD, error) {
 			return josecipher.NewCBCHMAC(key, aes.NewCipher)
 		},
 	}
 }
 
+// Create a new content cipher based on (X)ChaCha20-Poly1305
+func newChaCha20Poly1305(extended bool) contentCipher {
+	return &aeadContentCipher{
+		keyBytes:     chacha20poly1305.KeySize,
+		authtagBytes: chacha20poly1305.Overhead,
+		getAead: func(key []byte) (cipher.AEAD, error) {
+			if extended {
+				return chacha20poly1305.NewX(key)
+			}
+			return chacha20poly1305.New(key)
+		},
+	}
+}
+
 // Get an AEAD cipher object for the given content encryption algorithm
 func getContentCipher(alg ContentEncryption) contentCipher {
 	switch alg {
@@ -108,19 +152,81 @@ func getContentCipher(alg ContentEncryption) contentCipher {
 		return newAESCBC(24)
 	case A256CBC_HS512:
 		return newAESCBC(32)
+	case C20P:
+		return newChaCha20Poly1305(false)
+	case XC20P:
+		return newChaCha20Poly1305(true)
 	default:
 		return nil
 	}
 }
 
+// ParseSymmetricKey decodes a symmetric key given as a base64url string, as
+// they are often stored in configuration files. The returned key can be used
+// with any of the symmetric algorithms, its size is checked against the
+// algorithm when it is used.
+func ParseSymmetricKey(encoded string) ([]byte, error) {
+	key, err := base64URLDecode(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("square/go-jose: invalid symmetric key: %v", err)
+	}
+	if len(key) == 0 {
+		return nil, errors.New("square/go-jose: invalid symmetric key: empty")
+	}
+	return key, nil
+}
+
+// Get the key size (in bytes) required by an AES-based key wrapping algorithm,
+// or zero if the algorithm does not require a particular key size.
+func keyWrapKeySize(alg KeyAlgorithm) int {
+	switch alg {
+	case A128KW, A128GCMKW:
+		return 16
+	case A192KW, A192GCMKW:
+		return 24
+	case A256KW, A256GCMKW:
+		return 32
+	default:
+		return 0
+	}
+}
+
+// Derive the key encryption key for a PBES2 algorithm from a password, as
+// described in RFC 7518 section 4.8.
+func derivePBES2Key(alg KeyAlgorithm, password, p2s []byte, p2c int) ([]byte, error) {
+	var h func() hash.Hash
+	var size int
+	switch alg {
+	case PBES2_HS256_A128KW:
+		h, size = sha256.New, 16
+	case PBES2_HS384_A192KW:
+		h, size = sha512.New384, 24
+	case PBES2_HS512_A256KW:
+		h, size = sha512.New, 32
+	}
+
+	// The salt is the algorithm name and the p2s header, separated by a zero.
+	salt := make([]byte, 0, len(alg)+1+len(p2s))
+	salt = append(salt, alg...)
+	salt = append(salt, 0)
+	salt = append(salt, p2s...)
+
+	return pbkdf2.Key(h, string(password), salt, p2c, size)
+}
+
 // newSymmetricRecipient creates a JWE encrypter based on AES-GCM key wrap.
 func newSymmetricRecipient(keyAlg KeyAlgorithm, key []byte) (recipientKeyInfo, error) {
 	switch keyAlg {
 	case DIRECT, A128GCMKW, A192GCMKW, A256GCMKW, A128KW, A192KW, A256KW:
+	case PBES2_HS256_A128KW, PBES2_HS384_A192KW, PBES2_HS512_A256KW:
 	default:
 		return recipientKeyInfo{}, ErrUnsupportedAlgorithm
 	}
 
+	if size := keyWrapKeySize(keyAlg); size != 0 && len(key) != size {
+		return recipientKeyInfo{}, ErrInvalidKeySize
+	}
+
 	return recipientKeyInfo{
 		keyAlg: keyAlg,
 		keyEncrypter: &symmetricKeyCipher{
@@ -181,6 +287,10 @@ func (ctx aeadContentCipher) keySize() int {
 
 // Encrypt some data
 func (ctx aeadContentCipher) encrypt(key, aad, pt []byte) (*aeadParts, error) {
+	if len(key) != ctx.keyBytes {
+		return nil, ErrInvalidKeySize
+	}
+
 	// Get a new AEAD instance
 	aead, err := ctx.getAead(key)
 	if err != nil {
@@ -206,11 +316,26 @@ func (ctx aeadContentCipher) encrypt(key, aad, pt []byte) (*aeadParts, error) {
 
 // Decrypt some data
 func (ctx aeadContentCipher) decrypt(key, aad []byte, parts *aeadParts) ([]byte, error) {
+	// A key of the wrong size could be the result of a corrupted or malicious
+	// wrapped key, so check it before doing anything else.
+	if len(key) != ctx.keyBytes {
+		return nil, ErrInvalidKeySize
+	}
+
 	aead, err := ctx.getAead(key)
 	if err != nil {
 		return nil, err
 	}
 
+	// The IV comes from the message (or header, for GCM key wrapping), and
+	// AEAD implementations may panic if given one of the wrong size.
+	if len(parts.iv) != aead.NonceSize() {
+		return nil, errors.New("square/go-jose: invalid iv length")
+	}
+	if len(parts.tag) != ctx.authtagBytes {
+		return nil, errors.New("square/go-jose: invalid tag length")
+	}
+
 	return aead.Open(nil, parts.iv, append(parts.ciphertext, parts.tag...), aad)
 }
 
@@ -251,6 +376,39 @@ func (ctx *symmetricKeyCipher) encryptKey(cek []byte, alg KeyAlgorithm) (recipie
 			encryptedKey: jek,
 			header:       &rawHeader{},
 		}, nil
+	case PBES2_HS256_A128KW, PBES2_HS384_A192KW, PBES2_HS512_A256KW:
+		p2s := make([]byte, 16)
+		_, err := io.ReadFull(randReader, p2s)
+		if err != nil {
+			return recipientInfo{}, err
+		}
+
+		p2c := ctx.p2c
+		if p2c == 0 {
+			p2c = DefaultPBES2Count
+		}
+		kek, err := derivePBES2Key(alg, ctx.key, p2s, p2c)
+		if err != nil {
+			return recipientInfo{}, err
+		}
+
+		block, err := aes.NewCipher(kek)
+		if err != nil {
+			return recipientInfo{}, err
+		}
+
+		jek, err := josecipher.KeyWrap(block, cek)
+		if err != nil {
+			return recipientInfo{}, err
+		}
+
+		return recipientInfo{
+			encryptedKey: jek,
+			header: &rawHeader{
+				P2s: newBuffer(p2s),
+				P2c: p2c,
+			},
+		}, nil
 	}
 
 	return recipientInfo{}, ErrUnsupportedAlgorithm
@@ -258,8 +416,19 @@ func (ctx *symmetricKeyCipher) encryptKey(cek []byte, alg KeyAlgorithm) (recipie
 
 // Decrypt the content encryption key.
 func (ctx *symmetricKeyCipher) decryptKey(headers rawHeader, recipient *recipientInfo, generator keyGenerator) ([]byte, error) {
+	if size := keyWrapKeySize(KeyAlgorithm(headers.Alg)); size != 0 && len(ctx.key) != size {
+		return nil, ErrInvalidKeySize
+	}
+
 	switch KeyAlgorithm(headers.Alg) {
 	case DIRECT:
+		if len(ctx.key) != generator.keySize() {
+			return nil, ErrInvalidKeySize
+		}
+		// The encrypted key must be empty (RFC 7516 section 5.2).
+		if len(recipient.encryptedKey) > 0 {
+			return nil, errors.New("square/go-jose: unexpected encrypted key for direct encryption")
+		}
 		cek := make([]byte, len(ctx.key))
 		copy(cek, ctx.key)
 		return cek, nil
@@ -289,6 +458,36 @@ func (ctx *symmetricKeyCipher) decryptKey(headers rawHeader, recipient *recipien
 			return nil, err
 		}
 		return cek, nil
+	case PBES2_HS256_A128KW, PBES2_HS384_A192KW, PBES2_HS512_A256KW:
+		// Check the iteration count before doing any work.
+		minP2c, maxP2c := ctx.minP2c, ctx.maxP2c
+		if minP2c == 0 {
+			minP2c = DefaultMinPBES2Count
+		}
+		if maxP2c == 0 {
+			maxP2c = DefaultMaxPBES2Count
+		}
+		if headers.P2c < minP2c {
+			return nil, ErrPBES2CountTooLow
+		}
+		if headers.P2c > maxP2c {
+			return nil, ErrPBES2CountTooHigh
+		}
+		if len(headers.P2s.bytes()) < 8 {
+			return nil, errors.New("square/go-jose: invalid p2s header, salt too short")
+		}
+
+		kek, err := derivePBES2Key(KeyAlgorithm(headers.Alg), ctx.key, headers.P2s.bytes(), headers.P2c)
+		if err != nil {
+			return nil, err
+		}
+
+		block, err := aes.NewCipher(kek)
+		if err != nil {
+			return nil, err
+		}
+
+		return josecipher.KeyUnwrap(block, recipient.encryptedKey)
 	}
 
 	return nil, ErrUnsupportedAlgorithm
@@ -309,25 +508,30 @@ func (ctx symmetricMac) signPayload(payload []byte, alg SignatureAlgorithm) (Sig
 
 // Verify the given payload
 func (ctx symmetricMac) verifyPayload(payload []byte, mac []byte, alg SignatureAlgorithm) error {
-	expected, err := ctx.hmac(payload, alg)
+	hmac, err := ctx.newHash(alg)
 	if err != nil {
 		return errors.New("square/go-jose: failed to compute hmac")
 	}
 
-	if len(mac) != len(expected) {
-		return errors.New("square/go-jose: invalid hmac")
-	}
+	// According to documentation, Write() on hash never fails
+	_, _ = hmac.Write(payload)
+	return ctx.verifyHash(hmac, mac, alg)
+}
 
-	match := subtle.ConstantTimeCompare(mac, expected)
-	if match != 1 {
-		return errors.New("square/go-jose: invalid hmac")
+// Compute the HMAC based on the given alg value
+func (ctx symmetricMac) hmac(payload []byte, alg SignatureAlgorithm) ([]byte, error) {
+	hmac, err := ctx.newHash(alg)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	// According to documentation, Write() on hash never fails
+	_, _ = hmac.Write(payload)
+	return hmac.Sum(nil), nil
 }
 
-// Compute the HMAC based on the given alg value
-func (ctx symmetricMac) hmac(payload []byte, alg SignatureAlgorithm) ([]byte, error) {
+// Create an HMAC for a payload which is hashed incrementally.
+func (ctx symmetricMac) newHash(alg SignatureAlgorithm) (hash.Hash, error) {
 	var hash func() hash.Hash
 
 	switch alg {
@@ -341,9 +545,25 @@ func (ctx symmetricMac) hmac(payload []byte, alg SignatureAlgorithm) ([]byte, er
 		return nil, ErrUnsupportedAlgorithm
 	}
 
-	hmac := hmac.New(hash, ctx.key)
+	return hmac.New(hash, ctx.key), nil
+}
 
-	// According to documentation, Write() on hash never fails
-	_, _ = hmac.Write(payload)
-	return hmac.Sum(nil), nil
+// Sign a payload which has been hashed incrementally.
+func (ctx symmetricMac) signHash(h hash.Hash, alg SignatureAlgorithm) ([]byte, error) {
+	return h.Sum(nil), nil
+}
+
+// Verify a payload which has been hashed incrementally.
+func (ctx symmetricMac) verifyHash(h hash.Hash, mac []byte, alg SignatureAlgorithm) error {
+	expected := h.Sum(nil)
+	if len(mac) != len(expected) {
+		return errors.New("square/go-jose: invalid hmac")
+	}
+
+	match := subtle.ConstantTimeCompare(mac, expected)
+	if match != 1 {
+		return errors.New("square/go-jose: invalid hmac")
+	}
+
+	return nil
 }
@@ -21,6 +21,7 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"io"
+	"strings"
 	"testing"
 )
 
@@ -37,6 +38,101 @@ func TestInvalidSymmetricAlgorithms(t *testing.T) {
 	}
 }
 
+func TestInvalidKeyWrapKeySize(t *testing.T) {
+	sizes := map[KeyAlgorithm]int{
+		A128KW: 16, A192KW: 24, A256KW: 32,
+		A128GCMKW: 16, A192GCMKW: 24, A256GCMKW: 32,
+	}
+
+	for alg, size := range sizes {
+		for _, keySize := range []int{16, 24, 32} {
+			_, err := newSymmetricRecipient(alg, make([]byte, keySize))
+			if keySize == size && err != nil {
+				t.Error("should accept key of correct size", alg, keySize, err)
+			}
+			if keySize != size && err != ErrInvalidKeySize {
+				t.Error("should reject key of incorrect size", alg, keySize)
+			}
+		}
+	}
+
+	dec := &symmetricKeyCipher{key: make([]byte, 16)}
+	_, err := dec.decryptKey(rawHeader{Alg: string(A192KW)}, &recipientInfo{}, nil)
+	if err != ErrInvalidKeySize {
+		t.Error("should reject key of incorrect size on decrypt")
+	}
+}
+
+func TestVectorsA192KW(t *testing.T) {
+	// Source: RFC 3394, section 4.2 (wrap 128 bits of key data with a 192-bit KEK)
+	kek := fromHexBytes("000102030405060708090A0B0C0D0E0F1011121314151617")
+	cek := fromHexBytes("00112233445566778899AABBCCDDEEFF")
+	expected := fromHexBytes("96778B25AE6CA435F92B5B97C050AED2468AB8A17AD84E5D")
+
+	recipient, err := newSymmetricRecipient(A192KW, kek)
+	if err != nil {
+		t.Fatal("unable to create A192KW recipient:", err)
+	}
+
+	info, err := recipient.keyEncrypter.encryptKey(cek, A192KW)
+	if err != nil {
+		t.Fatal("unable to wrap key:", err)
+	}
+	if !bytes.Equal(info.encryptedKey, expected) {
+		t.Errorf("wrapped key did not match, got %x but wanted %x", info.encryptedKey, expected)
+	}
+
+	dec := &symmetricKeyCipher{key: kek}
+	unwrapped, err := dec.decryptKey(rawHeader{Alg: string(A192KW)}, &info, nil)
+	if err != nil {
+		t.Fatal("unable to unwrap key:", err)
+	}
+	if !bytes.Equal(unwrapped, cek) {
+		t.Errorf("unwrapped key did not match, got %x but wanted %x", unwrapped, cek)
+	}
+}
+
+func TestRoundtripA192KW(t *testing.T) {
+	key := fromHexBytes("000102030405060708090A0B0C0D0E0F1011121314151617")
+
+	for _, enc := range []ContentEncryption{A128GCM, A192GCM, A256GCM, A128CBC_HS256, A192CBC_HS384, A256CBC_HS512} {
+		encrypter, err := NewEncrypter(A192KW, enc, key)
+		if err != nil {
+			t.Fatal("unable to create A192KW encrypter:", err)
+		}
+
+		input := []byte("Lorem ipsum dolor sit amet")
+		obj, err := encrypter.Encrypt(input)
+		if err != nil {
+			t.Fatal("unable to encrypt:", err)
+		}
+
+		msg, err := obj.CompactSerialize()
+		if err != nil {
+			t.Fatal("unable to serialize:", err)
+		}
+
+		parsed, err := ParseEncrypted(msg)
+		if err != nil {
+			t.Fatal("unable to parse:", err)
+		}
+
+		output, err := parsed.Decrypt(key)
+		if err != nil {
+			t.Error("unable to decrypt:", err, enc)
+			continue
+		}
+		if !bytes.Equal(input, output) {
+			t.Error("decrypted output does not match input", enc)
+		}
+	}
+
+	_, err := NewEncrypter(A192KW, A128GCM, key[:16])
+	if err != ErrInvalidKeySize {
+		t.Error("should not accept 16 byte key for A192KW")
+	}
+}
+
 func TestAeadErrors(t *testing.T) {
 	aead := &aeadContentCipher{
 		keyBytes:     16,
@@ -46,17 +142,110 @@ func TestAeadErrors(t *testing.T) {
 		},
 	}
 
-	parts, err := aead.encrypt([]byte{}, []byte{}, []byte{})
+	key := make([]byte, 16)
+
+	parts, err := aead.encrypt(key, []byte{}, []byte{})
 	if err != ErrCryptoFailure {
 		t.Error("should handle aead failure")
 	}
 
-	_, err = aead.decrypt([]byte{}, []byte{}, parts)
+	_, err = aead.decrypt(key, []byte{}, parts)
 	if err != ErrCryptoFailure {
 		t.Error("should handle aead failure")
 	}
 }
 
+func TestAESGCMKeyWrapHeaders(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	enc, err := NewEncrypter(A128GCMKW, A128GCM, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := enc.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseEncrypted(obj.FullSerialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.protected.Iv.bytes()) != 12 || len(parsed.protected.Tag.bytes()) != 16 {
+		t.Fatal("expected iv and tag headers for key wrapping")
+	}
+	if _, err := parsed.Decrypt(key); err != nil {
+		t.Fatal(err)
+	}
+
+	// A malformed iv or tag header must be an error, not a panic
+	parsed.protected.Iv = newBuffer([]byte{1, 2, 3})
+	if _, err := parsed.Decrypt(key); err == nil {
+		t.Error("should reject invalid iv header")
+	}
+	parsed.protected.Iv = nil
+	if _, err := parsed.Decrypt(key); err == nil {
+		t.Error("should reject missing iv header")
+	}
+
+	parsed, _ = ParseEncrypted(obj.FullSerialize())
+	parsed.protected.Tag = newBuffer([]byte{1, 2, 3})
+	if _, err := parsed.Decrypt(key); err == nil {
+		t.Error("should reject invalid tag header")
+	}
+}
+
+func TestContentCipherSizes(t *testing.T) {
+	cases := []struct {
+		enc            ContentEncryption
+		ivSize, tagLen int
+	}{
+		{A128GCM, 12, 16},
+		{A192GCM, 12, 16},
+		{A256GCM, 12, 16},
+		{A128CBC_HS256, 16, 16},
+		{A192CBC_HS384, 16, 24},
+		{A256CBC_HS512, 16, 32},
+		{C20P, 12, 16},
+		{XC20P, 24, 16},
+	}
+
+	for _, c := range cases {
+		cipher := getContentCipher(c.enc)
+		key := make([]byte, cipher.keySize())
+
+		parts, err := cipher.encrypt(key, []byte{}, []byte("Lorem ipsum dolor sit amet"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parts.iv) != c.ivSize || len(parts.tag) != c.tagLen {
+			t.Errorf("%s: unexpected iv/tag size %d/%d", c.enc, len(parts.iv), len(parts.tag))
+		}
+		if _, err := cipher.decrypt(key, []byte{}, parts); err != nil {
+			t.Error(c.enc, err)
+		}
+
+		// Moving bytes between ciphertext and tag must be rejected
+		shifted := &aeadParts{
+			iv:         parts.iv,
+			ciphertext: append(append([]byte{}, parts.ciphertext...), parts.tag[0]),
+			tag:        parts.tag[1:],
+		}
+		if _, err := cipher.decrypt(key, []byte{}, shifted); err == nil {
+			t.Errorf("%s: should reject truncated tag", c.enc)
+		}
+
+		short := &aeadParts{
+			iv:         parts.iv[1:],
+			ciphertext: parts.ciphertext,
+			tag:        parts.tag,
+		}
+		if _, err := cipher.decrypt(key, []byte{}, short); err == nil {
+			t.Errorf("%s: should reject short iv", c.enc)
+		}
+	}
+}
+
 func TestInvalidKey(t *testing.T) {
 	gcm := newAESGCM(16).(*aeadContentCipher)
 	_, err := gcm.getAead([]byte{})
@@ -129,3 +318,160 @@ func TestVectorsAESGCM(t *testing.T) {
 		t.Error("Auth tag did not match")
 	}
 }
+
+func TestVectorsHS256(t *testing.T) {
+	// Source: https://tools.ietf.org/html/rfc7515#appendix-A.1
+	key, _ := base64URLDecode("AyM1SysPpbyDfgZld3umj1qzKObwVMkoqQ-EstJQLr_T-1qS0gZH75aKtMN3Yj0iPS4hcgUuTwjAzZr1Z9CAow")
+	signingInput := "eyJ0eXAiOiJKV1QiLA0KICJhbGciOiJIUzI1NiJ9" +
+		".eyJpc3MiOiJqb2UiLA0KICJleHAiOjEzMDA4MTkzODAsDQogImh0dHA6Ly9leGFtcGxlLmNvbS9pc19yb290Ijp0cnVlfQ"
+	expectedMac := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	expectedPayload := "{\"iss\":\"joe\",\r\n \"exp\":1300819380,\r\n \"http://example.com/is_root\":true}"
+
+	mac := symmetricMac{key: key}
+	sig, err := mac.signPayload([]byte(signingInput), HS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base64URLEncode(sig.Signature) != expectedMac {
+		t.Error("computed hmac does not match test vector")
+	}
+
+	obj, err := ParseSigned(signingInput + "." + expectedMac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := obj.Verify(key)
+	if err != nil {
+		t.Fatal("unable to verify test vector:", err)
+	}
+	if string(payload) != expectedPayload {
+		t.Error("payload does not match test vector")
+	}
+
+	// Modified or truncated tags must be rejected
+	tag := obj.Signatures[0].Signature
+	tag[len(tag)-1] ^= 1
+	if _, err := obj.Verify(key); err == nil {
+		t.Error("should reject modified hmac")
+	}
+	tag[len(tag)-1] ^= 1
+	obj.Signatures[0].Signature = tag[:16]
+	if _, err := obj.Verify(key); err == nil {
+		t.Error("should reject truncated hmac")
+	}
+}
+
+func TestDirectEncryptedKey(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	enc, err := NewEncrypter(DIRECT, A128GCM, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := enc.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := obj.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(msg, ".")
+	if parts[1] != "" {
+		t.Fatal("direct encryption should not produce an encrypted key")
+	}
+
+	// An encrypted key must not be present in direct mode
+	parts[1] = base64URLEncode(key)
+	parsed, err := ParseEncrypted(strings.Join(parts, "."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parsed.Decrypt(key); err == nil {
+		t.Error("should reject direct encryption with an encrypted key")
+	}
+}
+
+func TestParseSymmetricKeyDirect(t *testing.T) {
+	// 32 bytes, for A128CBC-HS256
+	key, err := ParseSymmetricKey("AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 32 || key[31] != 31 {
+		t.Fatal("unexpected key value")
+	}
+
+	enc, err := NewEncrypter(DIRECT, A128CBC_HS256, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := enc.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := obj.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseEncrypted(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := parsed.Decrypt(key)
+	if err != nil || string(plaintext) != "Lorem ipsum dolor sit amet" {
+		t.Error("failed to decrypt with parsed key:", err)
+	}
+
+	// Key size must match the content encryption algorithm
+	if _, err := NewEncrypter(DIRECT, A256CBC_HS512, key); err != ErrInvalidKeySize {
+		t.Error("should reject dir key of wrong size, got:", err)
+	}
+	if _, err := parsed.Decrypt(key[:16]); err == nil {
+		t.Error("should reject dir key of wrong size on decrypt")
+	}
+
+	for _, invalid := range []string{"", "not base64!", "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8+/"} {
+		if _, err := ParseSymmetricKey(invalid); err == nil {
+			t.Errorf("should reject invalid key %q", invalid)
+		}
+	}
+}
+
+func TestInvalidContentKeySize(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	enc, err := NewEncrypter(A128KW, A256GCM, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := enc.Encrypt([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := obj.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Swap the protected header for one asking for A128GCM, so that the
+	// (valid) wrapped 32 byte key unwraps to the wrong size for enc.
+	parts := strings.Split(msg, ".")
+	parts[0] = base64URLEncode([]byte(`{"alg":"A128KW","enc":"A128GCM"}`))
+
+	parsed, err := ParseEncrypted(strings.Join(parts, "."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parsed.Decrypt(key); err != ErrInvalidKeySize {
+		t.Error("should reject unwrapped key of wrong size, got:", err)
+	}
+
+	// Content cipher checks key size before running
+	if _, err := newAESGCM(16).decrypt(make([]byte, 32), nil, &aeadParts{}); err != ErrInvalidKeySize {
+		t.Error("content cipher should reject key of wrong size, got:", err)
+	}
+	if _, err := newAESCBC(16).encrypt(make([]byte, 16), nil, nil); err != ErrInvalidKeySize {
+		t.Error("content cipher should reject key of wrong size, got:", err)
+	}
+}
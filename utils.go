@@ -17,6 +17,7 @@
 package jose
 
 import (
+	"crypto"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
@@ -72,3 +73,42 @@ func LoadPrivateKey(data []byte) (interface{}, error) {
 
 	return nil, fmt.Errorf("square/go-jose: parse error, got '%s', '%s' and '%s'", err0, err1, err2)
 }
+
+// MarshalPublicKey encodes a public key as a PEM-encoded SubjectPublicKeyInfo.
+// The key may also be a JWK, or a private key whose public key is encoded.
+func MarshalPublicKey(key interface{}) ([]byte, error) {
+	key = unwrapJsonWebKey(key)
+	if priv, ok := key.(interface{ Public() crypto.PublicKey }); ok {
+		key = priv.Public()
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("square/go-jose: unable to marshal public key: %s", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// MarshalPrivateKey encodes a private key as a PEM-encoded PKCS#8 private key.
+// The key may also be a JWK.
+func MarshalPrivateKey(key interface{}) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(unwrapJsonWebKey(key))
+	if err != nil {
+		return nil, fmt.Errorf("square/go-jose: unable to marshal private key: %s", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// Returns the key of a JWK, or the given key if it isn't a JWK.
+func unwrapJsonWebKey(key interface{}) interface{} {
+	switch jwk := key.(type) {
+	case JsonWebKey:
+		return jwk.Key
+	case *JsonWebKey:
+		return jwk.Key
+	default:
+		return key
+	}
+}
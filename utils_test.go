@@ -23,6 +23,7 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"math/big"
+	"reflect"
 	"regexp"
 	"testing"
 )
@@ -223,3 +224,63 @@ func TestLoadPrivateKey(t *testing.T) {
 		t.Error("should not parse invalid key")
 	}
 }
+
+func TestMarshalPublicKey(t *testing.T) {
+	pub, _ := LoadPublicKey([]byte(pkixPublicKey))
+	ecPriv, _ := LoadPrivateKey([]byte(ecPrivateKey))
+
+	for _, key := range []interface{}{
+		pub,
+		&JsonWebKey{Key: pub},
+		ecPriv,
+		JsonWebKey{Key: ecPriv},
+	} {
+		encoded, err := MarshalPublicKey(key)
+		if err != nil {
+			t.Error("unable to marshal public key", err)
+			continue
+		}
+
+		parsed, err := LoadPublicKey(encoded)
+		if err != nil {
+			t.Error("unable to load marshaled public key", err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed, pub) && !reflect.DeepEqual(parsed, &ecPriv.(*ecdsa.PrivateKey).PublicKey) {
+			t.Error("public key changed in PEM round trip")
+		}
+	}
+
+	_, err := MarshalPublicKey([]byte("secret"))
+	if err == nil {
+		t.Error("should not marshal symmetric key")
+	}
+}
+
+func TestMarshalPrivateKey(t *testing.T) {
+	rsaPriv, _ := LoadPrivateKey([]byte(pkcs1PrivateKey))
+	ecPriv, _ := LoadPrivateKey([]byte(ecPrivateKey))
+
+	for _, key := range []interface{}{rsaPriv, ecPriv, &JsonWebKey{Key: ecPriv}} {
+		encoded, err := MarshalPrivateKey(key)
+		if err != nil {
+			t.Error("unable to marshal private key", err)
+			continue
+		}
+
+		parsed, err := LoadPrivateKey(encoded)
+		if err != nil {
+			t.Error("unable to load marshaled private key", err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed, unwrapJsonWebKey(key)) {
+			t.Error("private key changed in PEM round trip")
+		}
+	}
+
+	pub, _ := LoadPublicKey([]byte(pkixPublicKey))
+	_, err := MarshalPrivateKey(pub)
+	if err == nil {
+		t.Error("should not marshal public key as private key")
+	}
+}